@@ -1,6 +1,10 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"os"
+
 	"github.com/denizydmr07/zapwrapper/pkg/zapwrapper"
 	"go.uber.org/zap"
 
@@ -17,6 +21,16 @@ func main() {
 	defer logger.Sync() // Flush any buffered log entries
 	logger.Info("Client started")
 
+	// export the spans of the calls if RPC_TRACING is otlp, the ones left are flushed on exit
+	if os.Getenv("RPC_TRACING") == "otlp" {
+		shutdownTracing, err := startTracing(context.Background())
+		if err != nil {
+			logger.Error("Error in starting the tracing", zap.Error(err))
+			return
+		}
+		defer shutdownTracing(context.Background())
+	}
+
 	result, err := stub.Add(1, 2)
 	if err != nil {
 		logger.Error("Error in Add", zap.Error(err))
@@ -28,4 +42,13 @@ func main() {
 		logger.Error("Error in Sub", zap.Error(err))
 	}
 	logger.Info("Sub result", zap.Float64("result", result))
+
+	result, err = stub.Divide(1, 0)
+	if errors.Is(err, stub.ErrDivByZero) {
+		logger.Error("Division by zero in Divide", zap.Error(err))
+	} else if err != nil {
+		logger.Error("Error in Divide", zap.Error(err))
+	} else {
+		logger.Info("Divide result", zap.Float64("result", result))
+	}
 }
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/denizydmr07/rpc-project/client/stub"
+)
+
+// fakeLB is a load balancer answering the requests of the client stub with a handler
+type fakeLB struct {
+	address  string
+	conns    int64 // connections accepted
+	requests chan map[string]interface{}
+}
+
+// startFakeLB serves the tls listener of a load balancer with the certificate of the load balancer,
+// each request of a connection is answered with the response of answer until the client closes it
+func startFakeLB(t *testing.T, answer func(request map[string]interface{}) map[string]interface{}) *fakeLB {
+	t.Helper()
+	certificate, err := tls.LoadX509KeyPair("../loadbalancer/lb.crt", "../loadbalancer/lb.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{certificate}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	lb := &fakeLB{address: ln.Addr().String(), requests: make(chan map[string]interface{}, 64)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt64(&lb.conns, 1)
+			go func() {
+				defer conn.Close()
+				decoder, encoder := json.NewDecoder(conn), json.NewEncoder(conn)
+				for {
+					var request map[string]interface{}
+					if err := decoder.Decode(&request); err != nil {
+						return
+					}
+					select {
+					case lb.requests <- request:
+					default:
+					}
+					encoder.Encode(answer(request))
+				}
+			}()
+		}
+	}()
+	return lb
+}
+
+// sum answers the calls of Add, Sub and Divide
+func sum(request map[string]interface{}) map[string]interface{} {
+	params, _ := request["params"].(map[string]interface{})
+	a, _ := params["a"].(float64)
+	b, _ := params["b"].(float64)
+	return map[string]interface{}{"result": a + b}
+}
+
+// closedAddress returns an address refusing connections
+func closedAddress(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := ln.Addr().String()
+	ln.Close()
+	return address
+}
+
+// the client tries the load balancers in order, the first one refusing connections
+func TestFailoverToSecondLoadBalancer(t *testing.T) {
+	lb := startFakeLB(t, sum)
+	t.Setenv("LB_CLIENT_ADDRESS", closedAddress(t)+", "+lb.address)
+
+	if result, err := stub.Add(1, 2); err != nil || result != 3 {
+		t.Fatalf("Add(1, 2) = %v, %v", result, err)
+	}
+	if len(lb.requests) != 1 {
+		t.Fatalf("the second load balancer got %d requests", len(lb.requests))
+	}
+
+	// every load balancer is down
+	t.Setenv("LB_CLIENT_ADDRESS", closedAddress(t)+","+closedAddress(t))
+	if _, err := stub.Add(1, 2); err == nil || err.Error() != "Load balancer is down" {
+		t.Fatalf("got %v", err)
+	}
+}
@@ -1,228 +1,1300 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
 	"os"
-	"regexp"
+	"path/filepath"
 	"strings"
 	"text/template"
 
+	"github.com/denizydmr07/rpc-project/idl"
 	"github.com/denizydmr07/zapwrapper/pkg/zapwrapper"
 	"go.uber.org/zap"
 )
 
-// Service represents a service
-// it contains the name of the service and the methods
-type Service struct {
-	Name    string
-	Methods []Method
+// clientStubTemplate is the template for the client stub
+// it contains the callRPC function and the method stubs
+var clientStubTemplate = `
+package stub
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// defaultLBClientAddress is the load balancer address used when LB_CLIENT_ADDRESS is not set
+const defaultLBClientAddress = "139.179.211.34:8080"
+
+// lbClientAddresses returns the load balancer addresses to try, in order.
+// LB_CLIENT_ADDRESS may contain a comma-separated list of addresses.
+func lbClientAddresses() []string {
+	value := os.Getenv("LB_CLIENT_ADDRESS")
+	if value == "" {
+		value = defaultLBClientAddress
+	}
+
+	var addresses []string
+	for _, address := range strings.Split(value, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
 }
 
-// print the service
-func (s Service) String() string {
-	str := "Service: " + s.Name + ", "
-	for _, method := range s.Methods {
-		str += method.String()
+// dialLB connects to the first reachable load balancer
+// it returns the error of the last address if none of them is reachable
+func dialLB(tlsConfig *tls.Config) (net.Conn, error) {
+	var err error
+	for _, address := range lbClientAddresses() {
+		var conn net.Conn
+		conn, err = tls.Dial("tcp", address, tlsConfig)
+		if err == nil {
+			return conn, nil
+		}
+	}
+	if err == nil {
+		err = errors.New("no load balancer address is set")
 	}
-	return str
+	return nil, err
 }
 
-// Method represents a method
-// it contains the name, params and returns
-type Method struct {
-	Name    string
-	Params  map[string]interface{}
-	Returns map[string]interface{}
+// dial connects to the server on RPC_DIRECT_ADDRESS if it is set, bypassing the load balancer,
+// to the first reachable load balancer otherwise. the server is dialed with tls if RPC_DIRECT_TLS is set.
+// it fails without dialing if the tls policy of the environment is invalid
+func dial(tlsConfig *tls.Config) (net.Conn, error) {
+	if clientTLSError != nil {
+		return nil, clientTLSError
+	}
+	address := os.Getenv("RPC_DIRECT_ADDRESS")
+	if address == "" {
+		return dialLB(tlsConfig)
+	}
+	if os.Getenv("RPC_DIRECT_TLS") != "" {
+		return tls.Dial("tcp", address, tlsConfig)
+	}
+	return net.Dial("tcp", address)
+}
+
+// unreachableError is the error message returned when the dialed address refuses the connection
+func unreachableError() string {
+	if os.Getenv("RPC_DIRECT_ADDRESS") != "" {
+		return "Server is down"
+	}
+	return "Load balancer is down"
+}
+
+// RetryPolicy retries the calls failing with a transient error, e.g. when no server is available
+type RetryPolicy struct {
+	MaxAttempts int           // attempts of a call including the first one
+	Backoff     time.Duration // delay before the first retry, doubled on each retry
+	MaxBackoff  time.Duration // maximum delay between two attempts, not capped if zero
+	Retryable   []string      // codes or messages of the errors to retry, DefaultRetryable if nil
+}
+
+// DefaultRetryable are the errors retried by default, they are returned before the method
+// is called so retrying them does not call a method twice
+var DefaultRetryable = []string{
+	"Load balancer is down",
+	"Server is down",
+	"No server available",
+	"Error in connecting to server",
+	"server busy",
+	"method busy",
+	"Rate limit of the method exceeded",
 }
 
-// print the method
-func (m Method) String() string {
-	str := "Method: " + m.Name + ", "
-	str += "Params: "
-	for key, value := range m.Params {
-		str += key + " " + value.(string) + ", "
+// retryable returns true if the error of the response should be retried by the policy
+func (p *RetryPolicy) retryable(response map[string]interface{}) bool {
+	errors := p.Retryable
+	if errors == nil {
+		errors = DefaultRetryable
 	}
-	str += "Returns: "
-	for key, value := range m.Returns {
-		str += key + " " + value.(string) + ", "
+
+	message, _ := response["error"].(string)
+	code, _ := response["code"].(string)
+	for _, e := range errors {
+		if e == message || (code != "" && e == code) {
+			return true
+		}
 	}
-	return str
+	return false
 }
 
-// clientStubTemplate is the template for the client stub
-// it contains the callRPC function and the method stubs
-var clientStubTemplate = `
-package stub
+// errDeadlineExceeded is the error of a call which did not complete within the Timeout of the client
+const errDeadlineExceeded = "Deadline exceeded"
 
-import (
-	"crypto/tls"
-	"encoding/json"
-	"errors"
-	"net"
-)
+// tracer starts the spans of the calls, they are not recorded unless the application sets a TracerProvider
+var tracer = otel.Tracer("github.com/denizydmr07/rpc-project/client/stub")
+
+// callRPC calls the method in a span covering its attempts, the trace context of the span is sent
+// in the metadata of the requests so the load balancer and the server trace the call as its children
+func (c Client) callRPC(method string, params map[string]interface{}, chunked *chunkedParam) map[string]interface{} {
+	ctx, span := tracer.Start(context.Background(), method, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attribute.String("rpc.method", method)))
+	defer span.End()
+	c.Metadata = traceMetadata(ctx, c.Metadata)
+
+	response := c.callAttempts(method, params, chunked)
+	if e, failed := response["error"]; failed {
+		span.SetStatus(codes.Error, fmt.Sprint(e))
+	}
+	return response
+}
+
+// traceMetadata returns the metadata with the trace context of ctx added, e.g. "traceparent",
+// or as is if ctx has none. the metadata of the client is not modified
+func traceMetadata(ctx context.Context, metadata Metadata) Metadata {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return metadata
+	}
+	traced := make(Metadata, len(metadata)+2)
+	for key, value := range metadata {
+		traced[key] = value
+	}
+	propagation.TraceContext{}.Inject(ctx, propagation.MapCarrier(traced))
+	return traced
+}
+
+// callAttempts calls the method, retrying it with the retry policy of the client if it fails with a retryable error
+// the call is made once if the policy is nil. the attempts share the deadline of the call if the client has a Timeout
+func (c Client) callAttempts(method string, params map[string]interface{}, chunked *chunkedParam) map[string]interface{} {
+	var deadline time.Time
+	if c.Timeout > 0 {
+		deadline = time.Now().Add(c.Timeout)
+	}
+
+	response := c.callOnce(method, params, chunked, deadline)
+	policy := c.Retry
+	if policy == nil {
+		return response
+	}
 
-func callRPC(method string, params map[string]interface{}) map[string]interface{} {
+	delay := policy.Backoff
+	for attempt := 1; attempt < policy.MaxAttempts; attempt++ {
+		if _, failed := response["error"]; !failed || !policy.retryable(response) {
+			break
+		}
+		// a retry which would start after the deadline is not made
+		if !deadline.IsZero() && time.Now().Add(delay).After(deadline) {
+			break
+		}
+
+		time.Sleep(delay)
+		delay *= 2
+		if policy.MaxBackoff > 0 && delay > policy.MaxBackoff {
+			delay = policy.MaxBackoff
+		}
+
+		response = c.callOnce(method, params, chunked, deadline)
+	}
+	return response
+}
+
+// callOnce sends a request to the load balancer, or the direct address, and returns its response
+// the chunked param is uploaded after the request if it is not nil. the request carries the deadline
+// unless it is zero, so the load balancer and the server give up once it passes, and so does the client
+func (c Client) callOnce(method string, params map[string]interface{}, chunked *chunkedParam, deadline time.Time) map[string]interface{} {
 	var response map[string]interface{}
-	LBClientAddress := "139.179.211.34:8080"
 
-	tlsConfig := &tls.Config{
+	request := map[string]interface{}{
+		"method": method,
+		"params": params,
+	}
+	if len(c.Metadata) > 0 {
+		request["metadata"] = c.Metadata
+	}
+	if chunked != nil {
+		request["chunked"] = chunked.name
+	}
+	if !deadline.IsZero() {
+		request["deadline_unix_nano"] = deadline.UnixNano()
+	}
+	if c.Checksum {
+		request["checksum"] = checksum(params)
+	}
+
+	// the load balancer keeps a pooled connection alive for the next call,
+	// chunked uploads and direct calls take a connection of their own
+	pool := c.Pool
+	if chunked != nil || os.Getenv("RPC_DIRECT_ADDRESS") != "" {
+		pool = nil
+	}
+	if pool != nil {
+		request["keepalive"] = true
+	}
+
+	for {
+		conn, reused, err := pool.get(c.Compress && os.Getenv("RPC_DIRECT_ADDRESS") == "")
+		if err != nil {
+			var errorStr string
+			// if error contains dial tcp error, return load balancer is down
+			if _, ok := err.(*net.OpError); ok {
+				errorStr = unreachableError()
+			} else {
+				errorStr = err.Error()
+			}
+			response = map[string]interface{}{
+				"error": errorStr,
+			}
+			return response
+		}
+
+		conn.SetDeadline(deadline)
+		encoder := json.NewEncoder(conn)
+		err = encoder.Encode(request)
+
+		// the chunks are written while waiting for the response,
+		// so a server rejecting the upload stops it instead of leaving it blocked
+		if chunked != nil {
+			go sendChunks(encoder, chunked.data)
+		}
+
+		if err == nil {
+			err = conn.decoder.Decode(&response)
+		}
+		if err == nil && c.Checksum {
+			response = verifyChecksum(response)
+		}
+		if err == nil && pool != nil {
+			conn.SetDeadline(time.Time{})
+			pool.put(conn)
+			return response
+		}
+		conn.Close()
+
+		if err != nil && !deadline.IsZero() && !time.Now().Before(deadline) {
+			return map[string]interface{}{
+				"error": errDeadlineExceeded,
+			}
+		}
+
+		// the load balancer closes a kept-alive connection which stayed idle for too long,
+		// it answers every request it reads, so the request is sent again on a new connection
+		if err != nil && reused {
+			response = nil
+			continue
+		}
+		return response
+	}
+}
+
+// clientTLSConfig is shared by the connections so their TLS sessions are resumed,
+// sparing a full handshake when connecting again to the same load balancer.
+// clientTLSError is the error of its policy, returned by the dials if it is invalid
+var clientTLSConfig, clientTLSError = newClientTLSConfig()
+
+// newClientTLSConfig returns the tls config of the client with the policy of the environment:
+// RPC_TLS_MIN_VERSION is the minimum TLS version, 1.2 or 1.3, 1.2 if it is not set, and
+// RPC_TLS_CIPHERS is a comma-separated list of the cipher suites allowed below TLS 1.3, Go defaults if it is not set
+func newClientTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{
 		InsecureSkipVerify: true,
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+		MinVersion:         tls.VersionTLS12,
+	}
+
+	switch version := os.Getenv("RPC_TLS_MIN_VERSION"); version {
+	case "", "1.2":
+	case "1.3":
+		config.MinVersion = tls.VersionTLS13
+	default:
+		return config, fmt.Errorf("RPC_TLS_MIN_VERSION: unsupported version %q, must be 1.2 or 1.3", version)
+	}
+
+	value := os.Getenv("RPC_TLS_CIPHERS")
+	if value == "" {
+		return config, nil
+	}
+	if config.MinVersion == tls.VersionTLS13 {
+		return config, errors.New("RPC_TLS_CIPHERS: the cipher suites of TLS 1.3 are not configurable")
+	}
+	suites := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		suites[suite.Name] = suite.ID
 	}
+	for _, name := range strings.Split(value, ",") {
+		id, ok := suites[strings.TrimSpace(name)]
+		if !ok {
+			return config, fmt.Errorf("RPC_TLS_CIPHERS: unknown or insecure cipher suite %q", strings.TrimSpace(name))
+		}
+		config.CipherSuites = append(config.CipherSuites, id)
+	}
+	return config, nil
+}
+
+// Pool keeps connections to the load balancer alive to reuse them across the calls of the clients sharing it,
+// sparing a dial and a TLS handshake per call. It is safe for concurrent use
+type Pool struct {
+	size        int           // idle connections kept at most
+	idleTimeout time.Duration // idle connections older than it are closed instead of reused
+	mutex       sync.Mutex
+	idle        []*pooledConn // idle connections, the most recently used last
+	closed      bool
+}
+
+// pooledConn is a connection of a pool with the decoder of its responses
+type pooledConn struct {
+	net.Conn
+	decoder   *json.Decoder
+	idleSince time.Time
+}
+
+// NewPool returns a pool keeping at most size idle connections.
+// a connection idle for idleTimeout is closed instead of reused, it should be shorter than
+// the idle timeout of the load balancer (LB_CLIENT_IDLE_TIMEOUT, 30s by default)
+func NewPool(size int, idleTimeout time.Duration) *Pool {
+	return &Pool{size: size, idleTimeout: idleTimeout}
+}
 
-	conn, err := tls.Dial("tcp", LBClientAddress, tlsConfig)
+// get returns the most recently used idle connection of the pool, a new connection if none is idle
+// or the pool is nil, which offers compression if compress is set. reused is true if the connection was idle in the pool
+func (p *Pool) get(compress bool) (conn *pooledConn, reused bool, err error) {
+	if p != nil {
+		p.mutex.Lock()
+		for len(p.idle) > 0 {
+			conn = p.idle[len(p.idle)-1]
+			p.idle = p.idle[:len(p.idle)-1]
+			if time.Since(conn.idleSince) < p.idleTimeout {
+				p.mutex.Unlock()
+				return conn, true, nil
+			}
+			conn.Close()
+		}
+		p.mutex.Unlock()
+	}
+
+	c, err := dial(clientTLSConfig)
 	if err != nil {
-		var errorStr string
-		// if error contains dial tcp error, return load balancer is down
-		if _, ok := err.(*net.OpError); ok {
-			errorStr = "Load balancer is down"
-		} else {
-			errorStr = err.Error()
+		return nil, false, err
+	}
+	if compress {
+		if c, err = negotiateCompression(c); err != nil {
+			return nil, false, err
 		}
-		response = map[string]interface{}{
-			"error": errorStr,
+	}
+	// numbers are decoded as json.Number and converted to the types of the returns
+	decoder := json.NewDecoder(c)
+	decoder.UseNumber()
+	return &pooledConn{Conn: c, decoder: decoder}, false, nil
+}
+
+// negotiateCompression offers gzip to the load balancer as the compression of the connection,
+// it returns the connection compressed if the load balancer picked it, as it is otherwise.
+// the connection is closed if the negotiation fails
+func negotiateCompression(conn net.Conn) (net.Conn, error) {
+	decoder := json.NewDecoder(conn)
+	var answer map[string]interface{}
+	err := json.NewEncoder(conn).Encode(map[string]interface{}{"compression": []string{"gzip"}})
+	if err == nil {
+		err = decoder.Decode(&answer)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if answer["compression"] != "gzip" {
+		return conn, nil
+	}
+
+	// the newline after the answer is not part of the compressed bytes
+	buffered, err := io.ReadAll(decoder.Buffered())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return newCompressedConn(conn, bytes.NewReader(bytes.TrimLeft(buffered, " \t\r\n"))), nil
+}
+
+// compressedConn is a connection compressed with gzip in both directions,
+// every write is flushed so a message is not held back in the compressor
+type compressedConn struct {
+	net.Conn
+	source io.Reader    // compressed bytes, the ones already read from the connection first
+	reader *gzip.Reader // reads the header of the peer, so it is created on the first read
+	writer *gzip.Writer
+}
+
+// newCompressedConn returns the connection compressed with gzip, buffered holds the compressed bytes
+// already read from it
+func newCompressedConn(conn net.Conn, buffered io.Reader) *compressedConn {
+	return &compressedConn{
+		Conn:   conn,
+		source: io.MultiReader(buffered, conn),
+		writer: gzip.NewWriter(conn),
+	}
+}
+
+func (c *compressedConn) Read(p []byte) (int, error) {
+	if c.reader == nil {
+		reader, err := gzip.NewReader(c.source)
+		if err != nil {
+			return 0, err
 		}
+		c.reader = reader
+	}
+	return c.reader.Read(p)
+}
+
+func (c *compressedConn) Write(p []byte) (int, error) {
+	if _, err := c.writer.Write(p); err != nil {
+		return 0, err
+	}
+	return len(p), c.writer.Flush()
+}
+
+// Close ends the compressed bytes before closing the connection, so the load balancer reads them to the end
+func (c *compressedConn) Close() error {
+	c.writer.Close()
+	return c.Conn.Close()
+}
+
+// put returns a connection to the pool once its call is done, it is closed if the pool is full or closed
+func (p *Pool) put(conn *pooledConn) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed || len(p.idle) >= p.size {
+		conn.Close()
+		return
+	}
+	conn.idleSince = time.Now()
+	p.idle = append(p.idle, conn)
+}
+
+// Close closes the idle connections of the pool,
+// the connections in use are closed once their calls return
+func (p *Pool) Close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, conn := range p.idle {
+		conn.Close()
+	}
+	p.idle = nil
+	p.closed = true
+}
+
+// ChunkSize is the size in bytes of the chunks a chunked param is uploaded in
+var ChunkSize = 256 << 10
+
+// chunkedParam is a param uploaded in chunks after the request instead of in its params
+type chunkedParam struct {
+	name string
+	data []byte
+}
+
+// sendChunks writes the data as chunks numbered from zero, the last one is marked final.
+// it stops at the first error, e.g. once the server rejected the upload and the connection is closed
+func sendChunks(encoder *json.Encoder, data []byte) {
+	for seq := 0; ; seq++ {
+		size := ChunkSize
+		if size > len(data) {
+			size = len(data)
+		}
+		final := size == len(data)
+
+		chunk := map[string]interface{}{
+			"seq":   seq,
+			"data":  data[:size],
+			"final": final,
+		}
+		if err := encoder.Encode(chunk); err != nil || final {
+			return
+		}
+		data = data[size:]
+	}
+}
+
+// checksum returns the CRC32 of the canonical JSON encoding of the params or the returns, with the keys sorted.
+// the numbers are decoded as json.Number, so they encode to the same text on both sides
+func checksum(values map[string]interface{}) string {
+	data, _ := json.Marshal(values)
+	return fmt.Sprintf("%08x", crc32.ChecksumIEEE(data))
+}
+
+// verifyChecksum verifies the checksum of the returns the server sent, and removes it from the response.
+// it returns a ChecksumMismatch error if it does not match or is missing, the errors are not verified
+func verifyChecksum(response map[string]interface{}) map[string]interface{} {
+	if _, failed := response["error"]; failed {
 		return response
 	}
-	defer conn.Close()
+	sum, _ := response["checksum"].(string)
+	delete(response, "checksum")
+	if sum != checksum(response) {
+		return map[string]interface{}{
+			"error": ErrChecksumMismatch.Message,
+			"code":  ErrChecksumMismatch.Code,
+		}
+	}
+	return response
+}
+
+// responseError returns the error of a failed call,
+// an *RPCError matching the Err sentinels if the server sent the code of a declared error
+func responseError(response map[string]interface{}) error {
+	message, _ := response["error"].(string)
+	if code, ok := response["code"].(string); ok {
+		return &RPCError{Code: code, Message: message}
+	}
+	return errors.New(message)
+}
 
-	request := map[string]interface{}{
+// openStream connects to the load balancer, or the direct address, and opens a streaming call of the method
+func openStream(method string, metadata Metadata) (net.Conn, error) {
+	return openConn(map[string]interface{}{
 		"method": method,
-		"params": params,
+		"stream": true,
+	}, metadata)
+}
+
+// openSubscription connects to the load balancer, or the direct address, and subscribes to the method with the params
+func openSubscription(method string, params map[string]interface{}, metadata Metadata) (net.Conn, error) {
+	return openConn(map[string]interface{}{
+		"method":    method,
+		"subscribe": true,
+		"params":    params,
+	}, metadata)
+}
+
+// openConn connects to the load balancer, or the direct address, and sends the request opening a stream or a subscription
+func openConn(request map[string]interface{}, metadata Metadata) (net.Conn, error) {
+	conn, err := dial(clientTLSConfig)
+	if err != nil {
+		if _, ok := err.(*net.OpError); ok {
+			return nil, errors.New(unreachableError())
+		}
+		return nil, err
 	}
 
-	encoder := json.NewEncoder(conn)
-	encoder.Encode(request)
+	if len(metadata) > 0 {
+		request["metadata"] = metadata
+	}
+	if err := json.NewEncoder(conn).Encode(request); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
 
+// unsubscribe ends the side of the client of a subscription, the server ends the subscription then
+func unsubscribe(conn net.Conn) error {
+	if err := json.NewEncoder(conn).Encode(map[string]interface{}{"end": true}); err != nil {
+		return err
+	}
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// receiveFrames decodes the frames of a streaming call and passes them to handle until the end frame
+// it returns the error frame of the server, the error of the connection or the error of handle
+func receiveFrames(conn net.Conn, handle func(frame map[string]interface{}) error) error {
 	decoder := json.NewDecoder(conn)
-	decoder.Decode(&response)
+	decoder.UseNumber()
+	for {
+		var frame map[string]interface{}
+		if err := decoder.Decode(&frame); err != nil {
+			if err == io.EOF {
+				return errors.New("stream closed before its end")
+			}
+			return err
+		}
+		if _, ok := frame["error"]; ok {
+			return responseError(frame)
+		}
+		if _, ok := frame["end"]; ok {
+			return nil
+		}
+		if err := handle(frame); err != nil {
+			return err
+		}
+	}
+}
 
-	return response
+// toBytes converts a value decoded as a base64 string to a []byte
+func toBytes(v interface{}) ([]byte, bool) {
+	s, ok := v.(string)
+	if !ok {
+		return nil, false
+	}
+	b, err := base64.StdEncoding.DecodeString(s)
+	return b, err == nil
+}
+
+// toFloat64 converts a number decoded as json.Number to a float64
+func toFloat64(v interface{}) (float64, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	f, err := n.Float64()
+	return f, err == nil
+}
+
+// toFloat32 converts a number decoded as json.Number to a float32, it fails if the number overflows it
+func toFloat32(v interface{}) (float32, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(string(n), 32)
+	return float32(f), err == nil
+}
+
+// toInt32 converts a number decoded as json.Number to an int32, it fails if the number is not an integer in its range
+func toInt32(v interface{}) (int32, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	i, err := strconv.ParseInt(string(n), 10, 32)
+	return int32(i), err == nil
+}
+
+// toInt64 converts a number decoded as json.Number to an int64, it fails if the number is not an integer in its range
+func toInt64(v interface{}) (int64, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	i, err := strconv.ParseInt(string(n), 10, 64)
+	return i, err == nil
 }
 
+// toUint32 converts a number decoded as json.Number to a uint32, it fails if the number is not an integer in its range
+func toUint32(v interface{}) (uint32, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	i, err := strconv.ParseUint(string(n), 10, 32)
+	return uint32(i), err == nil
+}
+
+// toUint64 converts a number decoded as json.Number to a uint64, it fails if the number is not an integer in its range
+func toUint64(v interface{}) (uint64, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	i, err := strconv.ParseUint(string(n), 10, 64)
+	return i, err == nil
+}
+{{range .MapValues}}{{$type := .Type}}
+// toMap{{title .Type}} converts a value decoded as an object to a map[string]{{.Type}}, it fails if a value is not a {{.Type}}
+func toMap{{title .Type}}(v interface{}) (map[string]{{.Type}}, bool) {
+	object, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	m := make(map[string]{{.Type}}, len(object))
+	for key, value := range object {
+		{{- with .Converter}}
+		converted, ok := {{.}}(value)
+		{{- else}}
+		converted, ok := value.({{$type}})
+		{{- end}}
+		if !ok {
+			return nil, false
+		}
+		m[key] = converted
+	}
+	return m, true
+}
+{{end}}
+// Call is a call prepared for RunParallel which stores its own results, e.g.
+//	func() error { var err error; sum, err = Add(1, 2); return err }
+type Call func() error
+
+// RunParallel runs the calls concurrently with at most limit calls in flight, all at once if limit <= 0.
+// It returns the error of each call in order and the first error that occurred.
+// Once a call fails or ctx is done, the calls not started yet are skipped with the error
+// of the cancelled context, the calls in flight are completed.
+func RunParallel(ctx context.Context, limit int, calls ...Call) ([]error, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if limit <= 0 || limit > len(calls) {
+		limit = len(calls)
+	}
+
+	errs := make([]error, len(calls))
+	var first error
+	var once sync.Once
+	var wg sync.WaitGroup
+
+	// slots of the calls in flight
+	slots := make(chan struct{}, limit)
+	for i, call := range calls {
+		// wait for a free slot unless the calls are cancelled
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if err := ctx.Err(); err != nil {
+			errs[i] = err
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, call Call) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			if errs[i] = call(); errs[i] != nil {
+				once.Do(func() {
+					first = errs[i]
+					cancel()
+				})
+			}
+		}(i, call)
+	}
+	wg.Wait()
+
+	// no call failed, but the calls may have been cancelled by ctx
+	if first == nil {
+		for _, err := range errs {
+			if err != nil {
+				first = err
+				break
+			}
+		}
+	}
+	return errs, first
+}
+
+{{range $enum := .Enums}}
+// {{.Name}} is an enum of the {{$.Name}} service, sent as its integer value
+type {{.Name}} int
+
+const (
+{{- range $i, $v := .Values}}
+	{{$v}}{{if eq $i 0}} {{$enum.Name}} = iota{{end}}
+{{- end}}
+)
+
+// Valid returns true if the value is one of the declared values of {{.Name}}
+func (v {{.Name}}) Valid() bool {
+	return v >= 0 && v < {{len .Values}}
+}
+{{end}}
+{{- if .Metadata}}
+// metadata of the {{.Name}} service declared in the idl
+const (
+{{- range .Metadata}}
+	{{- range .Doc}}
+	//{{.}}
+	{{- end}}
+	{{.Name}} = {{printf "%q" .Value}}
+{{- end}}
+)
+{{end}}
+// RPCError is an error declared in the idl, it is sent with its code
+// so the caller can match it against the Err sentinels with errors.Is
+type RPCError struct {
+	Code    string // name of the error in the idl
+	Message string
+}
+
+func (e *RPCError) Error() string {
+	return e.Message
+}
+
+// Is reports whether the target is an RPCError with the same code
+func (e *RPCError) Is(target error) bool {
+	t, ok := target.(*RPCError)
+	return ok && t.Code == e.Code
+}
+
+// ErrChecksumMismatch is the error of a call whose params or returns do not match their checksum,
+// i.e. the payload was corrupted on the way. it is only checked for a Client with Checksum set
+var ErrChecksumMismatch = &RPCError{Code: "ChecksumMismatch", Message: "checksum mismatch"}
+{{if .Errors}}
+// errors declared in the idl
+var (
+{{- range .Errors}}
+	Err{{.}} = &RPCError{Code: "{{.}}", Message: "{{.}}"}
+{{- end}}
+)
+{{end}}
+{{template "doc" .}}{{if .Doc}}//
+{{end}}// {{title .Name}}Service is the method set of the {{.Name}} service
+// it is implemented by Client and, if generated, Mock{{title .Name}}
+type {{title .Name}}Service interface {
+{{range .Methods}}{{template "doc" .}}	{{template "signature" .}}
+{{end}}}
+
+// Metadata holds the request-scoped values sent alongside the params of a call,
+// e.g. tracing headers or auth context, the load balancer relays it to the server as is
+type Metadata map[string]string
+
+// Client calls the methods of the {{.Name}} service through the load balancer
+type Client struct {
+	Metadata Metadata      // sent with every call of the client, nil to send none
+	Retry    *RetryPolicy  // retries the calls failing with a transient error, nil to call once
+	Pool     *Pool         // reuses the connections to the load balancer across calls, nil to connect per call
+	Timeout  time.Duration // budget of every call including its retries, sent as a deadline to the load balancer and the server, no deadline if zero
+	Checksum bool          // sends a checksum of the params and verifies the one of the response, to detect a payload corrupted on the way
+	Compress bool          // offers to compress the new connections to the load balancer with gzip, they are compressed if it allows it
+}
+
+var _ {{title .Name}}Service = Client{}
 {{range .Methods}}
-func {{.Name}}({{range $key, $value := .Params}}{{$key}} {{$value}}, {{end}})( {{range $key, $value := .Returns}}{{$value}}, error {{end}}) {
+{{template "doc" .}}func {{template "signature" .}} {
+	return Client{}.{{.Name}}({{template "args" .}})
+}
+{{end}}
+{{range $method := .Methods}}
+{{- if .Stream}}{{$in := index .Params 0}}{{$out := index .Returns 0}}
+// {{.Name}}Stream is an open streaming call of {{.Name}}.
+// values sent on Send are streamed to the server and closing Send ends the input, it must be closed.
+// values streamed back are received on Receive, which is closed when the stream ends
+type {{.Name}}Stream struct {
+	Send    chan<- {{$in.Type}}
+	Receive <-chan {{$out.Type}}
+	err     error
+}
+
+// Err returns the error which ended the stream, nil if the server ended it
+// it must be called once Receive is closed
+func (s *{{.Name}}Stream) Err() error {
+	return s.err
+}
+
+{{template "doc" .}}func (client_ Client) {{template "signature" .}} {
+	conn, err := openStream("{{.Name}}", client_.Metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	send := make(chan {{$in.Type}})
+	receive := make(chan {{$out.Type}})
+	stream := &{{.Name}}Stream{Send: send, Receive: receive}
+
+	// write the values sent as frames, then the end frame
+	go func() {
+		encoder := json.NewEncoder(conn)
+		for v := range send {
+			if err := encoder.Encode(map[string]interface{}{"{{$in.Name}}": v}); err != nil {
+				// the stream is closed, drain the values so the sender does not block
+				for range send {
+				}
+				return
+			}
+		}
+		encoder.Encode(map[string]interface{}{"end": true})
+	}()
+
+	// read the frames of the server until it ends the stream
+	go func() {
+		defer conn.Close()
+		defer close(receive)
+		stream.err = receiveFrames(conn, func(frame map[string]interface{}) error {
+			{{- if $out.Enum}}
+			f, ok := toInt64(frame["{{$out.Name}}"])
+			v := {{$out.Type}}(f)
+			{{- else if $out.Converter}}
+			v, ok := {{$out.Converter}}(frame["{{$out.Name}}"])
+			{{- else}}
+			v, ok := frame["{{$out.Name}}"].({{$out.Type}})
+			{{- end}}
+			if !ok {
+				return errors.New("invalid frame in the stream")
+			}
+			receive <- v
+			return nil
+		})
+	}()
+
+	return stream, nil
+}
+{{- else if .Subscribe}}{{$out := index .Returns 0}}
+// {{.Name}}Subscription is a subscription to {{.Name}}, the server pushes its events until it ends
+// the subscription or Close is called. the events are received on Events, which is closed when the subscription ends
+type {{.Name}}Subscription struct {
+	Events    <-chan {{$out.Type}}
+	conn      net.Conn
+	err       error
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Err returns the error which ended the subscription, nil if the server ended it or Close was called
+// it must be called once Events is closed
+func (s *{{.Name}}Subscription) Err() error {
+	return s.err
+}
+
+// Close unsubscribes, the events pushed since are dropped and Events is closed once the server ends the subscription
+func (s *{{.Name}}Subscription) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		err = unsubscribe(s.conn)
+	})
+	return err
+}
+
+{{template "doc" .}}func (client_ Client) {{template "signature" .}} {
+	params := map[string]interface{}{
+		{{range .Params}}"{{.Name}}": {{.Name}},
+		{{end}}
+	}
+	conn, err := openSubscription("{{.Name}}", params, client_.Metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make(chan {{$out.Type}})
+	subscription := &{{.Name}}Subscription{Events: events, conn: conn, closed: make(chan struct{})}
+
+	// read the events until the server ends the subscription
+	go func() {
+		defer conn.Close()
+		defer close(events)
+		err := receiveFrames(conn, func(frame map[string]interface{}) error {
+			{{- if $out.Enum}}
+			f, ok := toInt64(frame["{{$out.Name}}"])
+			v := {{$out.Type}}(f)
+			{{- else if $out.Converter}}
+			v, ok := {{$out.Converter}}(frame["{{$out.Name}}"])
+			{{- else}}
+			v, ok := frame["{{$out.Name}}"].({{$out.Type}})
+			{{- end}}
+			if !ok {
+				return errors.New("invalid frame in the subscription")
+			}
+			select {
+			case events <- v:
+			case <-subscription.closed:
+			}
+			return nil
+		})
+		select {
+		case <-subscription.closed:
+		default:
+			subscription.err = err
+		}
+	}()
+
+	return subscription, nil
+}
+{{- else}}
+{{template "doc" .}}func (client_ Client) {{template "signature" .}} {
 	var err error
 	params := map[string]interface{} {
-		{{range $key, $value := .Params}}"{{$key}}": {{$key}},{{end}}
+		{{range .Params}}{{if not .Chunked}}"{{.Name}}": {{.Name}},{{end}}{{end}}
 	}
-	response := callRPC("{{.Name}}", params)
+	{{- with .ChunkedParam}}
+	chunked := &chunkedParam{name: "{{.Name}}", data: {{.Name}}}
+	{{- else}}
+	var chunked *chunkedParam
+	{{- end}}
+	response := client_.callRPC("{{.Name}}", params, chunked)
 	// checking if response contains error
 	if _, ok := response["error"]; ok {
-		err = errors.New(response["error"].(string))
-		return -1, err
+		err = responseError(response)
+		return {{range .Returns}}{{.Zero}}, {{end}}err
+	}
+{{- if positional}}
+	// returns are encoded in the order of declaration
+	results, ok := response["results"].([]interface{})
+	if !ok || len(results) != {{len .Returns}} {
+		return {{range .Returns}}{{.Zero}}, {{end}}errors.New("invalid results in the response")
+	}
+	{{- range $i, $r := .Returns}}{{with .Converter}}
+	if v, ok := {{.}}(results[{{$i}}]); ok {
+		results[{{$i}}] = {{if $r.Enum}}{{$r.Type}}(v){{else}}v{{end}}
+	} else{{if $r.Optional}} if results[{{$i}}] != nil{{end}} {
+		return {{range $method.Returns}}{{.Zero}}, {{end}}errors.New("invalid {{$r.Name}} in the response")
 	}
-	return {{range $key, $value := .Returns}}response["{{$key}}"].({{$value}}), err {{end}}
+	{{- end}}{{end}}
+	{{- range $i, $r := .Returns}}{{if .Optional}}
+	// the optional {{.Name}} is null if it is absent
+	var r{{$i}} *{{.Type}}
+	if v, ok := results[{{$i}}].({{.Type}}); ok {
+		r{{$i}} = &v
+	}
+	{{- end}}{{end}}
+	return {{range $i, $r := .Returns}}{{if .Optional}}r{{$i}}{{else}}results[{{$i}}].({{$r.Type}}){{end}}, {{end}}err
+{{- else}}
+	{{- range $r := .Returns}}{{with .Converter}}
+	if v, ok := {{.}}(response["{{$r.Name}}"]); ok {
+		response["{{$r.Name}}"] = {{if $r.Enum}}{{$r.Type}}(v){{else}}v{{end}}
+	} else{{if $r.Optional}} if response["{{$r.Name}}"] != nil{{end}} {
+		return {{range $method.Returns}}{{.Zero}}, {{end}}errors.New("invalid {{$r.Name}} in the response")
+	}
+	{{- end}}{{end}}
+	{{- range $i, $r := .Returns}}{{if .Optional}}
+	// the optional {{.Name}} is omitted if it is absent
+	var r{{$i}} *{{.Type}}
+	if v, ok := response["{{.Name}}"].({{.Type}}); ok {
+		r{{$i}} = &v
+	}
+	{{- end}}{{end}}
+	return {{range $i, $r := .Returns}}{{if .Optional}}r{{$i}}{{else}}response["{{.Name}}"].({{.Type}}){{end}}, {{end}}err
+{{- end}}
+}
+{{- if paramsStructs}}
+
+// {{.Name}}Params are the params of {{.Name}}, the fields are marshalled by the names of the idl
+type {{.Name}}Params struct {
+	{{- range .Params}}
+	{{title .Name}} {{.Type}} ` + "`" + `json:"{{.Name}}"` + "`" + `
+	{{- end}}
+}
+
+// {{.Name}}WithParams calls {{.Name}} with the params of the struct.
+// the call fails if ctx is done before it starts, and the deadline of ctx bounds the Timeout of the client
+func (client_ Client) {{.Name}}WithParams(ctx context.Context, params {{.Name}}Params) ({{template "returns" .}}) {
+	if err := ctx.Err(); err != nil {
+		return {{range .Returns}}{{.Zero}}, {{end}}err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return {{range .Returns}}{{.Zero}}, {{end}}context.DeadlineExceeded
+		}
+		if client_.Timeout <= 0 || remaining < client_.Timeout {
+			client_.Timeout = remaining
+		}
+	}
+	return client_.{{.Name}}({{range $i, $p := .Params}}{{if $i}}, {{end}}params.{{title $p.Name}}{{end}})
+}
+
+// {{.Name}}WithParams calls {{.Name}} with the params of the struct using a client without options
+func {{.Name}}WithParams(ctx context.Context, params {{.Name}}Params) ({{template "returns" .}}) {
+	return Client{}.{{.Name}}WithParams(ctx, params)
+}
+{{- end}}
+{{- end}}
+{{range $alias := .Aliases}}
+// Deprecated: {{$alias}} is an alias of {{$method.Name}}, use {{$method.Name}} instead.
+func {{$alias}}({{template "params" $method}}) ({{template "returns" $method}}) {
+	return {{$method.Name}}({{template "args" $method}})
+}
+{{end}}
+{{- end}}
+`
+
+// mockTemplate is the template for the mock client
+// each method of the mock calls the function field stubbed for it
+var mockTemplate = `
+package stub
+
+// Mock{{title .Name}} is a mock of {{title .Name}}Service for testing
+// each method calls the corresponding function field, which must be stubbed before the call
+type Mock{{title .Name}} struct {
+{{range .Methods}}	{{.Name}}Func func({{template "params" .}}) ({{template "returns" .}})
+{{end}}}
+
+var _ {{title .Name}}Service = (*Mock{{title .Name}})(nil)
+{{range .Methods}}
+func (mock_ *Mock{{title $.Name}}) {{template "signature" .}} {
+	if mock_.{{.Name}}Func == nil {
+		panic("Mock{{title $.Name}}.{{.Name}} is not stubbed")
+	}
+	return mock_.{{.Name}}Func({{template "args" .}})
 }
 {{end}}
 `
 
+// signatureTemplate contains the templates shared by the client stub and the mock
+// so their method signatures stay the same
+var signatureTemplate = `
+{{define "params"}}{{if not .Stream}}{{range $i, $p := .Params}}{{if $i}}, {{end}}{{$p.Name}} {{$p.Type}}{{end}}{{end}}{{end}}
+{{define "returns"}}{{if .Stream}}*{{.Name}}Stream, {{else if .Subscribe}}*{{.Name}}Subscription, {{else}}{{range .Returns}}{{.ReturnType}}, {{end}}{{end}}error{{end}}
+{{define "doc"}}{{range .Doc}}//{{.}}
+{{end}}{{end}}
+{{define "signature"}}{{.Name}}({{template "params" .}}) ({{template "returns" .}}){{end}}
+{{define "args"}}{{if not .Stream}}{{range $i, $p := .Params}}{{if $i}}, {{end}}{{$p.Name}}{{end}}{{end}}{{end}}
+`
+
 // addServiceToClient adds the service to the client stub
-// it creates a new file under client/stub directory
-// and writes the service stub to the file
-func addServiceToClient(service Service) {
-	// create a new template from the clientStubTemplate variable
-	tmpl, err := template.New("clientStub").Parse(clientStubTemplate)
+// it writes the service stub to a new file under the output directory
+func addServiceToClient(service idl.Service, positional bool, paramsStructs bool, out output) error {
+	return writeTemplate(clientStubTemplate, "client_stub_"+service.Name+".go", service, positional, paramsStructs, out)
+}
+
+// addMockToClient adds the mock of the service to the client stub
+// it writes the mock to a new file under the output directory
+func addMockToClient(service idl.Service, out output) error {
+	return writeTemplate(mockTemplate, "client_stub_"+service.Name+"_mock.go", service, false, false, out)
+}
+
+// writeTemplate executes the template with the service and writes it to the file with the given name
+// positional selects extracting the returns by position from a "results" array,
+// paramsStructs selects emitting a typed params struct and a WithParams variant per method
+func writeTemplate(text string, name string, service idl.Service, positional bool, paramsStructs bool, out output) error {
+	funcs := template.FuncMap{
+		"title":         strings.Title,
+		"positional":    func() bool { return positional },
+		"paramsStructs": func() bool { return paramsStructs },
+	}
+
+	// create a new template with the shared signature templates
+	tmpl, err := template.New("clientStub").Funcs(funcs).Parse(signatureTemplate)
 	if err != nil {
 		panic(err)
 	}
-
-	//create stubs directory under client if it doesn't exist
-	os.Mkdir("../client/stub", 0755)
-
-	// create a new file under client/stub directory
-	file, err := os.Create("../client/stub/client_stub_" + service.Name + ".go")
+	tmpl, err = tmpl.Parse(text)
 	if err != nil {
 		panic(err)
 	}
-	defer file.Close()
-
-	// write the service stub to the file
-	writer := bufio.NewWriter(file)
 
 	// execute the template
-	err = tmpl.Execute(writer, service)
-	if err != nil {
+	var source bytes.Buffer
+	if err := tmpl.Execute(&source, service); err != nil {
 		panic(err)
 	}
+	return out.write(name, source.Bytes())
+}
 
-	// flush the buffer
-	writer.Flush()
+// output is where the generator writes the stubs
+type output struct {
+	dir    string // directory to write the stubs in
+	dryRun bool   // print the stubs to stdout instead of writing them
 }
 
-func main() {
-	// c reating a new logger
-	logger := zapwrapper.NewLogger(
-		zapwrapper.DefaultFilepath,   // Log file path
-		zapwrapper.DefaultMaxBackups, // Max number of log files to retain
-		zapwrapper.DefaultLogLevel,   // Log level
-	)
+// write formats the source of a stub with gofmt and writes it to the file under the output directory,
+// or prints it to stdout after a comment naming the file in a dry run.
+// a source which does not parse is a bug of the template, the error lists it with line numbers
+func (o output) write(name string, source []byte) error {
+	path := filepath.Join(o.dir, name)
+	formatted, err := format.Source(source)
+	if err != nil {
+		return fmt.Errorf("generated %s is not valid Go: %v\n%s", path, err, numberLines(source))
+	}
+	source = formatted
 
-	defer logger.Sync() // flushes buffer, if any
+	if o.dryRun {
+		fmt.Printf("// %s\n", path)
+		_, err := os.Stdout.Write(source)
+		return err
+	}
 
-	service := &Service{}
+	// create the output directory if it doesn't exist
+	if err := os.MkdirAll(o.dir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, source, 0644)
+}
 
-	// get the idf file path from the command line
-	idfFilePath := "../idl/calculator.idl"
-	logger.Debug("idf file path", zap.String("idfFilePath", idfFilePath))
+// numberLines prefixes the lines of the source with their numbers, which the errors of format.Source refer to
+func numberLines(source []byte) string {
+	var b strings.Builder
+	for i, line := range strings.Split(string(source), "\n") {
+		fmt.Fprintf(&b, "%4d  %s\n", i+1, line)
+	}
+	return b.String()
+}
 
+// validate parses the idl file at the path and prints its first error with its line number,
+// or that it is valid, without generating the stub. it returns the exit code, 1 if the file is invalid
+func validate(idfFilePath string) int {
 	file, err := os.Open(idfFilePath)
 	if err != nil {
-		panic(err)
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
 	}
+	defer file.Close()
 
-	// read the idf file line by line
-	scanner := bufio.NewScanner(file)
-	logger.Debug("starting to scan the file")
-
-	// parse the idf file
-	for scanner.Scan() {
-
-		line := scanner.Text()
-
-		// if the line contains KEYWORD service, get the service name
-		if strings.Contains(line, "service") {
-			logger.Debug("Service found", zap.String("line", line))
-
-			service.Name = strings.Fields(line)[1]
-		} else if strings.Contains(line, "->") { // if the line contains method, get the method details
-			logger.Debug("Method found", zap.String("line", line))
-
-			method := Method{}
-
-			// example: add(int a, int b) -> (int result);
-			pattern := `(\w+)\(([^)]*)\)\s*->\s*\(([^)]*)\);` // regex pattern to match the method
-
-			// compile the regex pattern
-			re := regexp.MustCompile(pattern)
+	if _, err := idl.Parse(file, zap.NewNop()); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", idfFilePath, err)
+		return 1
+	}
+	fmt.Printf("%s: valid\n", idfFilePath)
+	return 0
+}
 
-			matches := re.FindStringSubmatch(line)
-			method.Name = matches[1]
+func main() {
+	// "validate [file]" only checks the idl, e.g. before committing it
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		idfFilePath := "../idl/calculator.idl"
+		if len(os.Args) > 2 {
+			idfFilePath = os.Args[2]
+		}
+		os.Exit(validate(idfFilePath))
+	}
 
-			// if method name starts with lowercase, make it uppercase
-			if method.Name[0] >= 'a' && method.Name[0] <= 'z' {
-				method.Name = strings.Title(method.Name)
-			}
+	mock := flag.Bool("mock", false, "Generate a mock client implementing the same methods")
+	positional := flag.Bool("positional", false, "Encode returns as an ordered \"results\" array instead of by name, must match the server generator")
+	paramsStructs := flag.Bool("params-structs", false, "Emit a typed params struct and a WithParams variant taking it for each method")
+	outDir := flag.String("out", "../client/stub", "Directory to write the client stub in")
+	dryRun := flag.Bool("dry-run", false, "Print the generated stubs to stdout instead of writing them")
+	flag.Parse()
 
-			method.Params = make(map[string]interface{})
+	// a dry run writes no log file and keeps stdout for the stubs
+	logger := zap.NewNop()
+	if !*dryRun {
+		logger = zapwrapper.NewLogger(
+			zapwrapper.DefaultFilepath,   // Log file path
+			zapwrapper.DefaultMaxBackups, // Max number of log files to retain
+			zapwrapper.DefaultLogLevel,   // Log level
+		)
+	}
+	defer logger.Sync() // flushes buffer, if any
 
-			// paramsare in the form of "int a, int b, ..."
-			params := strings.Split(matches[2], ",")
-			for _, param := range params {
-				paramParts := strings.Fields(param)
-				method.Params[paramParts[1]] = paramParts[0]
-			}
+	// get the idf file path from the command line
+	idfFilePath := "../idl/calculator.idl"
+	logger.Debug("idf file path", zap.String("idfFilePath", idfFilePath))
 
-			// returns are in the form of "int result, ..."
-			method.Returns = make(map[string]interface{})
-			returns := strings.Fields(matches[3])
-			method.Returns[returns[1]] = returns[0]
+	file, err := os.Open(idfFilePath)
+	if err != nil {
+		panic(err)
+	}
 
-			service.Methods = append(service.Methods, method)
-		}
+	service, err := idl.Parse(file, logger)
+	file.Close()
+	if err != nil {
+		logger.Error("Error in parsing the idl file", zap.String("idfFilePath", idfFilePath), zap.Error(err))
+		fmt.Fprintf(os.Stderr, "%s: %v\n", idfFilePath, err)
+		logger.Sync()
+		os.Exit(1)
 	}
 
-	addServiceToClient(*service) // add the service to the client stub
+	// add the service to the client stub
+	out := output{dir: *outDir, dryRun: *dryRun}
+	if err := addServiceToClient(*service, *positional, *paramsStructs, out); err != nil {
+		logger.Error("Error in writing the client stub", zap.Error(err))
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		logger.Sync()
+		os.Exit(1)
+	}
 	logger.Debug("Service added to client stub", zap.String("service", service.Name))
 
-	file.Close()
+	if *mock {
+		// add the mock of the service to the client stub
+		if err := addMockToClient(*service, out); err != nil {
+			logger.Error("Error in writing the mock", zap.Error(err))
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			logger.Sync()
+			os.Exit(1)
+		}
+		logger.Debug("Mock added to client stub", zap.String("service", service.Name))
+	}
 }
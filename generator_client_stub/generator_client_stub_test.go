@@ -0,0 +1,1444 @@
+package main
+
+import (
+	"bytes"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/denizydmr07/rpc-project/idl"
+	"go.uber.org/zap"
+)
+
+// stubModule generates the client stub and the mock of the idl source in a module using the dependencies
+// of the client, the files, e.g. tests, are added to the stub package. it returns the directory of the module
+// the flags select extracting the returns by position then params structs
+func stubModule(t *testing.T, source string, files map[string]string, flags ...bool) string {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("builds a module")
+	}
+	service, err := idl.Parse(strings.NewReader(source), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	goMod, err := os.ReadFile("../client/go.mod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	goMod = []byte(strings.Replace(string(goMod), "module github.com/denizydmr07/rpc-project/client", "module stubtest", 1))
+	goSum, err := os.ReadFile("../client/go.sum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "go.mod"), goMod, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "go.sum"), goSum, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out := output{dir: filepath.Join(dir, "stub")}
+	if err := os.Mkdir(out.dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	positional, paramsStructs := len(flags) > 0 && flags[0], len(flags) > 1 && flags[1]
+	if err := addServiceToClient(*service, positional, paramsStructs, out); err != nil {
+		t.Fatal(err)
+	}
+	if err := addMockToClient(*service, out); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(out.dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// runGo runs the go command in the module directory, failing the test with its output if it fails
+func runGo(t *testing.T, dir string, args ...string) {
+	t.Helper()
+	cmd := exec.Command("go", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOFLAGS=-mod=mod", "GOTOOLCHAIN=local")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go %s: %v\n%s", strings.Join(args, " "), err, output)
+	}
+}
+
+// the mock and the client implement the same service interface, the mock calls its stubbed functions
+func TestMockClient(t *testing.T) {
+	source := `service calculator {
+    add(float64 a, float64 b) -> (float64 result);
+    sub(float64 a, float64 b) -> (float64 result);
+}
+`
+	test := `package stub
+
+import "testing"
+
+func TestMock(t *testing.T) {
+	var service CalculatorService = &MockCalculator{
+		AddFunc: func(a float64, b float64) (float64, error) { return a + b, nil },
+	}
+	if result, err := service.Add(1, 2); result != 3 || err != nil {
+		t.Fatalf("got %v, %v", result, err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("calling a method which is not stubbed did not panic")
+		}
+	}()
+	service.Sub(1, 2)
+}
+`
+	runGo(t, stubModule(t, source, map[string]string{"stub_test.go": test}, false), "test", "-count=1", "./...")
+}
+
+// serveTest is the prefix of the tests calling the stub, serve plays the load balancer
+const serveTest = `package stub
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// listen listens over tls with a self-signed certificate as the load balancer the stub connects to
+func listen(t *testing.T) net.Listener {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{certificate}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	t.Setenv("LB_CLIENT_ADDRESS", ln.Addr().String())
+	return ln
+}
+
+// serve answers one call over tls with the response and returns the request it received
+func serve(t *testing.T, response string) <-chan map[string]interface{} {
+	ln := listen(t)
+	requests := make(chan map[string]interface{}, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var request map[string]interface{}
+		json.NewDecoder(conn).Decode(&request)
+		requests <- request
+		conn.Write([]byte(response + "\n"))
+	}()
+	return requests
+}
+`
+
+// the returns of a method with two of them are extracted by name, or by position with -positional
+func TestTwoReturnsRoundTrip(t *testing.T) {
+	source := `service arithmetic {
+    divmod(float64 a, float64 b) -> (float64 quotient, float64 remainder);
+}
+`
+	test := serveTest + `
+func TestDivmod(t *testing.T) {
+	requests := serve(t, RESPONSE)
+	quotient, remainder, err := Divmod(7, 2)
+	if err != nil || quotient != 3 || remainder != 1 {
+		t.Fatalf("Divmod(7, 2) = %v, %v, %v", quotient, remainder, err)
+	}
+	request := <-requests
+	params := request["params"].(map[string]interface{})
+	if request["method"] != "Divmod" || params["a"] != 7.0 || params["b"] != 2.0 {
+		t.Fatalf("got request %v", request)
+	}
+}
+`
+	t.Run("named", func(t *testing.T) {
+		dir := stubModule(t, source, map[string]string{"stub_test.go": strings.Replace(test, "RESPONSE", "`{\"quotient\":3,\"remainder\":1}`", 1)}, false)
+		runGo(t, dir, "test", "-count=1", "./...")
+	})
+	t.Run("positional", func(t *testing.T) {
+		dir := stubModule(t, source, map[string]string{"stub_test.go": strings.Replace(test, "RESPONSE", "`{\"results\":[3,1]}`", 1)}, true)
+		runGo(t, dir, "test", "-count=1", "./...")
+	})
+}
+
+// the deprecated alias of a method calls the method by its new name
+func TestAliasCallsMethod(t *testing.T) {
+	source := `service arithmetic {
+    add(float64 a, float64 b) -> (float64 result);
+    deprecated add_numbers = add;
+}
+`
+	test := serveTest + `
+func TestAddNumbers(t *testing.T) {
+	requests := serve(t, ` + "`" + `{"result":3}` + "`" + `)
+	result, err := Add_numbers(1, 2)
+	if err != nil || result != 3 {
+		t.Fatalf("Add_numbers(1, 2) = %v, %v", result, err)
+	}
+	if request := <-requests; request["method"] != "Add" {
+		t.Fatalf("got request %v", request)
+	}
+}
+`
+	dir := stubModule(t, source, map[string]string{"stub_test.go": test}, false)
+	runGo(t, dir, "test", "-count=1", "./...")
+}
+
+// enum params are sent as their integer values and enum returns are converted back to the type
+func TestEnumRoundTrip(t *testing.T) {
+	source := `service palette {
+    enum Color { RED; GREEN; BLUE; }
+    mix(Color a, Color b) -> (Color result);
+}
+`
+	test := serveTest + `
+func TestMix(t *testing.T) {
+	requests := serve(t, ` + "`" + `{"result":2}` + "`" + `)
+	result, err := Mix(RED, GREEN)
+	if err != nil || result != BLUE || !result.Valid() || Color(3).Valid() {
+		t.Fatalf("Mix(RED, GREEN) = %v, %v", result, err)
+	}
+	params := (<-requests)["params"].(map[string]interface{})
+	if params["a"] != 0.0 || params["b"] != 1.0 {
+		t.Fatalf("got params %v", params)
+	}
+}
+`
+	dir := stubModule(t, source, map[string]string{"stub_test.go": test}, false)
+	runGo(t, dir, "test", "-count=1", "./...")
+}
+
+// RunParallel keeps at most limit calls in flight and skips the calls not started once one fails
+func TestRunParallel(t *testing.T) {
+	source := `service calculator {
+    add(float64 a, float64 b) -> (float64 result);
+}
+`
+	test := `package stub
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunParallel(t *testing.T) {
+	var inFlight, maxInFlight int64
+	call := func() error {
+		n := atomic.AddInt64(&inFlight, 1)
+		for {
+			max := atomic.LoadInt64(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt64(&maxInFlight, max, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt64(&inFlight, -1)
+		return nil
+	}
+	errs, err := RunParallel(context.Background(), 2, call, call, call, call, call)
+	if err != nil || len(errs) != 5 || maxInFlight != 2 {
+		t.Fatalf("got %v, %v with %d calls in flight", errs, err, maxInFlight)
+	}
+
+	failed := errors.New("failed")
+	var started int64
+	slow := func() error {
+		atomic.AddInt64(&started, 1)
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	}
+	fail := func() error {
+		atomic.AddInt64(&started, 1)
+		return failed
+	}
+	errs, err = RunParallel(context.Background(), 2, slow, fail, slow, slow)
+	if err != failed || errs[0] != nil || errs[1] != failed || errs[2] != context.Canceled || errs[3] != context.Canceled || started != 2 {
+		t.Fatalf("got %v, %v with %d calls started", errs, err, started)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := RunParallel(ctx, 1, call); err != context.Canceled {
+		t.Fatalf("cancelled context: got %v", err)
+	}
+}
+`
+	dir := stubModule(t, source, map[string]string{"parallel_test.go": test}, false)
+	runGo(t, dir, "test", "-count=1", "./...")
+}
+
+// the values sent on a stream are framed to the load balancer and the frames streamed back are received
+func TestStreamRoundTrip(t *testing.T) {
+	source := `service sensors {
+    stream feed(stream float64 x) -> (stream float64 y);
+}
+`
+	test := serveTest + `
+func TestFeed(t *testing.T) {
+	ln := listen(t)
+	requests := make(chan map[string]interface{}, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		decoder := json.NewDecoder(conn)
+		encoder := json.NewEncoder(conn)
+		var request map[string]interface{}
+		decoder.Decode(&request)
+		requests <- request
+		for {
+			var frame map[string]interface{}
+			if decoder.Decode(&frame) != nil || frame["end"] == true {
+				break
+			}
+			encoder.Encode(map[string]interface{}{"y": frame["x"].(float64) * 2})
+		}
+		encoder.Encode(map[string]interface{}{"end": true})
+	}()
+
+	stream, err := Feed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, x := range []float64{1, 2, 3} {
+		stream.Send <- x
+	}
+	close(stream.Send)
+	var received []float64
+	for y := range stream.Receive {
+		received = append(received, y)
+	}
+	if stream.Err() != nil || len(received) != 3 || received[0] != 2 || received[2] != 6 {
+		t.Fatalf("received %v, %v", received, stream.Err())
+	}
+	if request := <-requests; request["method"] != "Feed" || request["stream"] != true {
+		t.Fatalf("got request %v", request)
+	}
+}
+`
+	dir := stubModule(t, source, map[string]string{"stub_test.go": test}, false)
+	runGo(t, dir, "test", "-count=1", "./...")
+}
+
+// the events pushed by the server are received in order until it ends the subscription or Close is called,
+// and an error frame ends it with the error
+func TestSubscriptionRoundTrip(t *testing.T) {
+	source := `service ticker {
+    subscribe ticks(int32 count) -> (stream int32 n);
+}
+`
+	test := serveTest + `
+// serveTicks serves one subscription, pushing the count of events then the last frame,
+// or events until the client unsubscribes if the last frame is empty, and returns the request and the frames received
+func serveTicks(t *testing.T, last string) (<-chan map[string]interface{}, <-chan map[string]interface{}) {
+	ln := listen(t)
+	requests := make(chan map[string]interface{}, 1)
+	frames := make(chan map[string]interface{}, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		decoder := json.NewDecoder(conn)
+		encoder := json.NewEncoder(conn)
+		var request map[string]interface{}
+		decoder.Decode(&request)
+		requests <- request
+		params, _ := request["params"].(map[string]interface{})
+		count, _ := params["count"].(float64)
+		if last == "" {
+			unsubscribed := make(chan struct{})
+			go func() {
+				var frame map[string]interface{}
+				decoder.Decode(&frame)
+				frames <- frame
+				close(unsubscribed)
+			}()
+			for n := 1; ; n++ {
+				select {
+				case <-unsubscribed:
+					encoder.Encode(map[string]interface{}{"end": true})
+					return
+				default:
+				}
+				if encoder.Encode(map[string]interface{}{"n": n}) != nil {
+					return
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}
+		for n := 1; n <= int(count); n++ {
+			encoder.Encode(map[string]interface{}{"n": n})
+		}
+		conn.Write([]byte(last + "\n"))
+	}()
+	return requests, frames
+}
+
+func TestTicks(t *testing.T) {
+	requests, _ := serveTicks(t, ` + "`" + `{"end":true}` + "`" + `)
+	subscription, err := Ticks(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []int32
+	for n := range subscription.Events {
+		events = append(events, n)
+	}
+	if subscription.Err() != nil || len(events) != 3 || events[0] != 1 || events[2] != 3 {
+		t.Fatalf("received %v, %v", events, subscription.Err())
+	}
+	if request := <-requests; request["method"] != "Ticks" || request["subscribe"] != true || request["params"].(map[string]interface{})["count"] != 3.0 {
+		t.Fatalf("got request %v", request)
+	}
+}
+
+func TestTicksError(t *testing.T) {
+	serveTicks(t, ` + "`" + `{"error":"ticker stopped"}` + "`" + `)
+	subscription, err := Ticks(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []int32
+	for n := range subscription.Events {
+		events = append(events, n)
+	}
+	if len(events) != 1 || subscription.Err() == nil || subscription.Err().Error() != "ticker stopped" {
+		t.Fatalf("received %v, %v", events, subscription.Err())
+	}
+}
+
+func TestTicksClose(t *testing.T) {
+	_, frames := serveTicks(t, "")
+	subscription, err := Ticks(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := <-subscription.Events; n != 1 {
+		t.Fatalf("got the event %d", n)
+	}
+	if err := subscription.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for range subscription.Events {
+	}
+	if subscription.Err() != nil {
+		t.Fatalf("got %v after Close", subscription.Err())
+	}
+	if frame := <-frames; frame["end"] != true {
+		t.Fatalf("the server got %v", frame)
+	}
+}
+`
+	dir := stubModule(t, source, map[string]string{"stub_test.go": test}, false)
+	runGo(t, dir, "test", "-count=1", "./...")
+}
+
+// the metadata of the service is declared inside its block and generated as constants named after the keys
+func TestServiceMetadata(t *testing.T) {
+	source := `service calculator {
+    version "2.1";
+    build_date "2024-05-01";
+    add(float64 a, float64 b) -> (float64 result);
+}
+`
+	test := `package stub
+
+import "testing"
+
+func TestMetadata(t *testing.T) {
+	if ServiceVersion != "2.1" || ServiceBuildDate != "2024-05-01" {
+		t.Fatalf("got %q and %q", ServiceVersion, ServiceBuildDate)
+	}
+}
+`
+	dir := stubModule(t, source, map[string]string{"stub_test.go": test}, false)
+	runGo(t, dir, "test", "-count=1", "./...")
+}
+
+// an error response with the code of a declared error matches its sentinel, other errors do not
+func TestThrownErrorMatchesSentinel(t *testing.T) {
+	source := `service calculator {
+    divide(float64 a, float64 b) -> (float64 result) throws DivByZero;
+}
+`
+	test := serveTest + `
+func TestDivide(t *testing.T) {
+	serve(t, ` + "`" + `{"error":"division by zero","code":"DivByZero"}` + "`" + `)
+	_, err := Divide(1, 0)
+	var rpcErr *RPCError
+	if !errors.Is(err, ErrDivByZero) || !errors.As(err, &rpcErr) || err.Error() != "division by zero" {
+		t.Fatalf("Divide(1, 0) = %v", err)
+	}
+
+	serve(t, ` + "`" + `{"error":"Invalid RPC Method"}` + "`" + `)
+	if _, err := Divide(1, 0); err == nil || errors.Is(err, ErrDivByZero) {
+		t.Fatalf("Divide(1, 0) = %v", err)
+	}
+}
+`
+	dir := stubModule(t, source, map[string]string{"stub_test.go": strings.Replace(test, "\"encoding/json\"", "\"encoding/json\"\n\t\"errors\"", 1)}, false)
+	runGo(t, dir, "test", "-count=1", "./...")
+}
+
+// the metadata of a client is sent with its calls, the package functions send none
+func TestClientMetadata(t *testing.T) {
+	source := `service calculator {
+    add(float64 a, float64 b) -> (float64 result);
+}
+`
+	test := serveTest + `
+func TestAdd(t *testing.T) {
+	requests := serve(t, ` + "`" + `{"result":3}` + "`" + `)
+	if _, err := (Client{Metadata: Metadata{"trace-id": "abc"}}).Add(1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if metadata, _ := (<-requests)["metadata"].(map[string]interface{}); metadata["trace-id"] != "abc" || len(metadata) != 1 {
+		t.Fatalf("got metadata %v", metadata)
+	}
+
+	requests = serve(t, ` + "`" + `{"result":3}` + "`" + `)
+	if _, err := Add(1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if request := <-requests; request["metadata"] != nil {
+		t.Fatalf("got request %v", request)
+	}
+}
+`
+	dir := stubModule(t, source, map[string]string{"stub_test.go": test}, false)
+	runGo(t, dir, "test", "-count=1", "./...")
+}
+
+// the retry policy of the client retries the transient errors with a capped backoff and returns the others at once
+func TestRetryPolicy(t *testing.T) {
+	source := `service arithmetic {
+    add(float64 a, float64 b) -> (float64 result);
+}
+`
+	test := `package stub
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// failing answers each call on a direct address with the next failure, then with the result 3,
+// and returns the func listing the times the calls arrived
+func failing(t *testing.T, failures ...string) func() []time.Time {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	t.Setenv("RPC_DIRECT_ADDRESS", ln.Addr().String())
+	var mutex sync.Mutex
+	var calls []time.Time
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			var request map[string]interface{}
+			json.NewDecoder(conn).Decode(&request)
+			mutex.Lock()
+			calls = append(calls, time.Now())
+			response := ` + "`" + `{"result":3}` + "`" + `
+			if len(calls) <= len(failures) {
+				response = failures[len(calls)-1]
+			}
+			mutex.Unlock()
+			conn.Write([]byte(response + "\n"))
+			conn.Close()
+		}
+	}()
+	return func() []time.Time {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]time.Time(nil), calls...)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	const unavailable = ` + "`" + `{"error":"No server available"}` + "`" + `
+	client := Client{Retry: &RetryPolicy{MaxAttempts: 4, Backoff: 40 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}}
+
+	// the call succeeds on the third attempt, after 40ms then 50ms instead of 80ms
+	calls := failing(t, unavailable, unavailable)
+	if result, err := client.Add(1, 2); err != nil || result != 3 {
+		t.Fatalf("Add(1, 2) = %v, %v", result, err)
+	}
+	times := calls()
+	if len(times) != 3 {
+		t.Fatalf("%d attempts, want 3", len(times))
+	}
+	if first, second := times[1].Sub(times[0]), times[2].Sub(times[1]); first < 40*time.Millisecond || second < 50*time.Millisecond || second > 75*time.Millisecond {
+		t.Fatalf("retried after %v then %v, want 40ms then 50ms", first, second)
+	}
+
+	// the attempts are bounded
+	calls = failing(t, unavailable, unavailable, unavailable, unavailable, unavailable)
+	if _, err := client.Add(1, 2); err == nil || err.Error() != "No server available" {
+		t.Fatalf("got %v", err)
+	}
+	if n := len(calls()); n != 4 {
+		t.Fatalf("%d attempts, want 4", n)
+	}
+
+	// the errors of the method are not retried
+	calls = failing(t, ` + "`" + `{"error":"validation error: parameter a must be a float64"}` + "`" + `)
+	if _, err := client.Add(1, 2); err == nil {
+		t.Fatal("the validation error is not returned")
+	}
+	if n := len(calls()); n != 1 {
+		t.Fatalf("%d attempts of a validation error", n)
+	}
+
+	// the retryable errors are matched by their code too, and calls are made once without a policy
+	calls = failing(t, ` + "`" + `{"error":"backend restarting","code":"Unavailable"}` + "`" + `)
+	client.Retry.Retryable = []string{"Unavailable"}
+	if _, err := client.Add(1, 2); err != nil || len(calls()) != 2 {
+		t.Fatalf("got %v after %d attempts", err, len(calls()))
+	}
+	calls = failing(t, unavailable)
+	if _, err := (Client{}).Add(1, 2); err == nil || len(calls()) != 1 {
+		t.Fatalf("got %v after %d attempts without a policy", err, len(calls()))
+	}
+}
+`
+	dir := stubModule(t, source, map[string]string{"stub_test.go": test}, false)
+	runGo(t, dir, "test", "-count=1", "./...")
+}
+
+// a chunked param is uploaded after the request in numbered chunks of ChunkSize, the last one final
+func TestChunkedUpload(t *testing.T) {
+	source := `service storage {
+    upload(string name, chunked bytes data) -> (float64 size);
+}
+`
+	test := `package stub
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+)
+
+// receive answers one upload on a direct address with the size of the data reassembled from the chunks,
+// or with an error if the chunks are not numbered in order or the final chunk is not the last one
+func receive(t *testing.T) (<-chan map[string]interface{}, <-chan []byte) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	t.Setenv("RPC_DIRECT_ADDRESS", ln.Addr().String())
+	requests, uploads := make(chan map[string]interface{}, 1), make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		decoder, encoder := json.NewDecoder(conn), json.NewEncoder(conn)
+		var request map[string]interface{}
+		decoder.Decode(&request)
+		requests <- request
+
+		var data []byte
+		for seq := 0; ; seq++ {
+			var chunk struct {
+				Seq   int
+				Data  []byte
+				Final bool
+			}
+			if err := decoder.Decode(&chunk); err != nil || chunk.Seq != seq || len(chunk.Data) > ChunkSize {
+				encoder.Encode(map[string]interface{}{"error": fmt.Sprintf("chunk %d: seq %d, %d bytes, %v", seq, chunk.Seq, len(chunk.Data), err)})
+				return
+			}
+			data = append(data, chunk.Data...)
+			if chunk.Final {
+				break
+			}
+		}
+		uploads <- data
+		encoder.Encode(map[string]interface{}{"size": len(data)})
+	}()
+	return requests, uploads
+}
+
+func TestUpload(t *testing.T) {
+	payload := make([]byte, 3<<20+17)
+	for i := range payload {
+		payload[i] = byte(i % 251)
+	}
+	requests, uploads := receive(t)
+	size, err := Upload("blob", payload)
+	if err != nil || size != float64(len(payload)) {
+		t.Fatalf("Upload = %v, %v", size, err)
+	}
+	request := <-requests
+	if request["method"] != "Upload" || request["chunked"] != "data" || request["params"].(map[string]interface{})["name"] != "blob" {
+		t.Fatalf("got request %v", request)
+	}
+	if _, inline := request["params"].(map[string]interface{})["data"]; inline {
+		t.Fatal("the chunked param is sent in the params")
+	}
+	if data := <-uploads; !bytes.Equal(data, payload) {
+		t.Fatalf("the server reassembled %d bytes, want the %d bytes of the payload", len(data), len(payload))
+	}
+}
+
+func TestUploadEmpty(t *testing.T) {
+	_, uploads := receive(t)
+	if size, err := Upload("blob", nil); err != nil || size != 0 {
+		t.Fatalf("Upload = %v, %v", size, err)
+	}
+	if data := <-uploads; len(data) != 0 {
+		t.Fatalf("got %d bytes", len(data))
+	}
+}
+
+func TestUploadRejected(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	t.Setenv("RPC_DIRECT_ADDRESS", ln.Addr().String())
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var request map[string]interface{}
+		json.NewDecoder(conn).Decode(&request)
+		json.NewEncoder(conn).Encode(map[string]interface{}{"error": "chunked upload error: upload exceeds 6 bytes"})
+	}()
+	if _, err := Upload("blob", []byte("abcdefgh")); err == nil || err.Error() != "chunked upload error: upload exceeds 6 bytes" {
+		t.Fatalf("Upload = %v", err)
+	}
+}
+`
+	dir := stubModule(t, source, map[string]string{"stub_test.go": test}, false)
+	runGo(t, dir, "test", "-count=1", "./...")
+}
+
+// the clients sharing a pool reuse its connections to the load balancer, sending the calls with keepalive,
+// and the clients without one connect per call, resuming the tls session of the previous connection
+func TestConnectionPool(t *testing.T) {
+	source := `service calculator {
+    add(float64 a, float64 b) -> (float64 result);
+}
+`
+	test := `package stub
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeLB plays the load balancer over tls, it answers the requests of a connection until one is sent
+// without keepalive or it served perConn of them
+type fakeLB struct {
+	mutex    sync.Mutex
+	resumed  []bool                   // whether each connection resumed a tls session
+	requests []map[string]interface{} // requests received on all the connections
+	closed   chan struct{}            // receives once a client closes a connection
+}
+
+func startFakeLB(t *testing.T, perConn int) *fakeLB {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	t.Setenv("LB_CLIENT_ADDRESS", ln.Addr().String())
+	t.Setenv("RPC_DIRECT_ADDRESS", "")
+
+	lb := &fakeLB{closed: make(chan struct{}, 16)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go lb.serve(conn.(*tls.Conn), perConn)
+		}
+	}()
+	return lb
+}
+
+func (lb *fakeLB) serve(conn *tls.Conn, perConn int) {
+	defer conn.Close()
+	if err := conn.Handshake(); err != nil {
+		return
+	}
+	lb.mutex.Lock()
+	lb.resumed = append(lb.resumed, conn.ConnectionState().DidResume)
+	lb.mutex.Unlock()
+
+	decoder, encoder := json.NewDecoder(conn), json.NewEncoder(conn)
+	for served := 0; served < perConn; served++ {
+		var request map[string]interface{}
+		if err := decoder.Decode(&request); err != nil {
+			lb.closed <- struct{}{}
+			return
+		}
+		lb.mutex.Lock()
+		lb.requests = append(lb.requests, request)
+		lb.mutex.Unlock()
+		encoder.Encode(map[string]interface{}{"result": 3})
+		if keepAlive, _ := request["keepalive"].(bool); !keepAlive {
+			return
+		}
+	}
+}
+
+// counts returns the connections and the requests received
+func (lb *fakeLB) counts() (int, int) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	return len(lb.resumed), len(lb.requests)
+}
+
+func add(t *testing.T, c Client) {
+	t.Helper()
+	if result, err := c.Add(1, 2); err != nil || result != 3 {
+		t.Fatalf("Add(1, 2) = %v, %v", result, err)
+	}
+}
+
+func TestPoolReusesConnection(t *testing.T) {
+	lb := startFakeLB(t, 100)
+	pool := NewPool(2, time.Second)
+	for i := 0; i < 5; i++ {
+		add(t, Client{Pool: pool})
+	}
+	if conns, requests := lb.counts(); conns != 1 || requests != 5 {
+		t.Fatalf("got %d requests on %d connections, want 5 on 1", requests, conns)
+	}
+	lb.mutex.Lock()
+	for _, request := range lb.requests {
+		if request["keepalive"] != true {
+			t.Fatalf("got request %v", request)
+		}
+	}
+	lb.mutex.Unlock()
+
+	// closing the pool closes its idle connection
+	pool.Close()
+	select {
+	case <-lb.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the idle connection is open after the pool is closed")
+	}
+}
+
+func TestWithoutPoolSessionResumed(t *testing.T) {
+	lb := startFakeLB(t, 100)
+	for i := 0; i < 3; i++ {
+		add(t, Client{})
+	}
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	if len(lb.resumed) != 3 || !lb.resumed[1] || !lb.resumed[2] {
+		t.Fatalf("got %d connections, resumed %v, want 3 resuming the first session", len(lb.resumed), lb.resumed)
+	}
+	for _, request := range lb.requests {
+		if _, ok := request["keepalive"]; ok {
+			t.Fatalf("got request %v", request)
+		}
+	}
+}
+
+// a call on a pooled connection the load balancer closed meanwhile is sent again on a new connection
+func TestPoolConnectionClosedByLoadBalancer(t *testing.T) {
+	lb := startFakeLB(t, 1)
+	pool := NewPool(2, time.Second)
+	defer pool.Close()
+	for i := 0; i < 3; i++ {
+		add(t, Client{Pool: pool})
+	}
+	if conns, requests := lb.counts(); conns != 3 || requests != 3 {
+		t.Fatalf("got %d requests on %d connections, want 3 on 3", requests, conns)
+	}
+}
+
+// a connection idle in the pool for longer than its idle timeout is closed instead of reused
+func TestPoolIdleTimeout(t *testing.T) {
+	lb := startFakeLB(t, 100)
+	pool := NewPool(2, 20*time.Millisecond)
+	defer pool.Close()
+	add(t, Client{Pool: pool})
+	time.Sleep(50 * time.Millisecond)
+	add(t, Client{Pool: pool})
+	if conns, _ := lb.counts(); conns != 2 {
+		t.Fatalf("got %d connections, want 2", conns)
+	}
+	select {
+	case <-lb.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the expired connection is not closed")
+	}
+}
+`
+	dir := stubModule(t, source, map[string]string{"stub_test.go": test}, false)
+	runGo(t, dir, "test", "-count=1", "./...")
+}
+
+// docs returns the doc comments of the functions, methods, types and interface methods declared in the Go file by name,
+// e.g. "Divide", "Client.Divide", "CalculatorService" and "CalculatorService.Divide"
+func docs(t *testing.T, path string) map[string]string {
+	t.Helper()
+	file, err := parser.ParseFile(token.NewFileSet(), path, nil, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs := map[string]string{}
+	for _, decl := range file.Decls {
+		switch decl := decl.(type) {
+		case *ast.FuncDecl:
+			name := decl.Name.Name
+			if decl.Recv != nil {
+				name = types.ExprString(decl.Recv.List[0].Type) + "." + name
+			}
+			docs[name] = decl.Doc.Text()
+		case *ast.GenDecl:
+			for _, spec := range decl.Specs {
+				spec, ok := spec.(*ast.TypeSpec)
+				if !ok {
+					continue
+				}
+				docs[spec.Name.Name] = decl.Doc.Text()
+				if iface, ok := spec.Type.(*ast.InterfaceType); ok {
+					for _, method := range iface.Methods.List {
+						docs[spec.Name.Name+"."+method.Names[0].Name] = method.Doc.Text()
+					}
+				}
+			}
+		}
+	}
+	return docs
+}
+
+// the comments of the service and the methods in the idl are the doc comments of the generated interface,
+// functions and methods, a method without a comment keeps none
+func TestDocComments(t *testing.T) {
+	source := `// calculator does arithmetic
+// on float64 numbers
+service calculator {
+    add(float64 a, float64 b) -> (float64 result);
+    // Divide returns a divided by b,
+    // it fails with ErrDivByZero if b is zero
+    divide(float64 a, float64 b) -> (float64 result) throws DivByZero;
+}
+`
+	dir := stubModule(t, source, nil, false)
+	runGo(t, dir, "vet", "./...")
+	docs := docs(t, filepath.Join(dir, "stub", "client_stub_calculator.go"))
+
+	const divide = "Divide returns a divided by b,\nit fails with ErrDivByZero if b is zero\n"
+	for _, name := range []string{"Divide", "Client.Divide", "CalculatorService.Divide"} {
+		if docs[name] != divide {
+			t.Errorf("doc of %s: %q, want %q", name, docs[name], divide)
+		}
+	}
+	for _, name := range []string{"Add", "Client.Add", "CalculatorService.Add"} {
+		if docs[name] != "" {
+			t.Errorf("doc of %s: %q, want none", name, docs[name])
+		}
+	}
+	if service := docs["CalculatorService"]; !strings.HasPrefix(service, "calculator does arithmetic\non float64 numbers\n\n") || !strings.Contains(service, "CalculatorService is the method set") {
+		t.Errorf("doc of CalculatorService: %q", service)
+	}
+}
+
+// the generated stubs are gofmt-clean
+func TestStubFormatted(t *testing.T) {
+	source := `service calculator {
+    add(float64 a, float64 b) -> (float64 result);
+    divide(float64 a, float64 b) -> (float64 result) throws DivByZero;
+    stream feed(stream float64 x) -> (stream float64 y);
+    upload(string name, chunked bytes data) -> (float64 size);
+    subscribe ticks(int32 count) -> (stream int32 n);
+}
+`
+	dir := stubModule(t, source, nil, false)
+	for _, name := range []string{"client_stub_calculator.go", "client_stub_calculator_mock.go"} {
+		stub, err := os.ReadFile(filepath.Join(dir, "stub", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if formatted, err := format.Source(stub); err != nil || !bytes.Equal(formatted, stub) {
+			t.Errorf("%s is not formatted: %v", name, err)
+		}
+	}
+}
+
+// the params, the arguments and the returns of a signature are joined without a trailing comma, before gofmt
+func TestSignatureJoined(t *testing.T) {
+	tmpl := template.Must(template.New("signature").Parse(signatureTemplate))
+	cases := []struct {
+		method          idl.Method
+		signature, args string
+	}{
+		{idl.Method{Name: "Divmod", Params: []idl.Field{{Name: "a", Type: "float64"}, {Name: "b", Type: "float64"}}, Returns: []idl.Field{{Name: "q", Type: "float64"}, {Name: "r", Type: "float64"}}},
+			"Divmod(a float64, b float64) (float64, float64, error)", "a, b"},
+		{idl.Method{Name: "Negate", Params: []idl.Field{{Name: "x", Type: "float64"}}, Returns: []idl.Field{{Name: "result", Type: "float64"}}},
+			"Negate(x float64) (float64, error)", "x"},
+		{idl.Method{Name: "Feed", Params: []idl.Field{{Name: "x", Type: "float64"}}, Returns: []idl.Field{{Name: "y", Type: "float64"}}, Stream: true},
+			"Feed() (*FeedStream, error)", ""},
+		{idl.Method{Name: "Ticks", Params: []idl.Field{{Name: "count", Type: "int32"}}, Returns: []idl.Field{{Name: "n", Type: "int32"}}, Subscribe: true},
+			"Ticks(count int32) (*TicksSubscription, error)", "count"},
+	}
+	for _, c := range cases {
+		var signature, args strings.Builder
+		if err := tmpl.ExecuteTemplate(&signature, "signature", c.method); err != nil {
+			t.Fatal(err)
+		}
+		if err := tmpl.ExecuteTemplate(&args, "args", c.method); err != nil {
+			t.Fatal(err)
+		}
+		if signature.String() != c.signature || args.String() != c.args {
+			t.Errorf("got %q with args %q, want %q with args %q", signature.String(), args.String(), c.signature, c.args)
+		}
+	}
+}
+
+// a bytes param is sent as a base64 string and a bytes return is decoded from one
+func TestBytesRoundTrip(t *testing.T) {
+	source := `service codec {
+    reverse(bytes data) -> (bytes result);
+}
+`
+	test := serveTest + `
+func TestReverse(t *testing.T) {
+	requests := serve(t, ` + "`" + `{"result":"b2xsZWg="}` + "`" + `)
+	result, err := Reverse([]byte("hello"))
+	if err != nil || string(result) != "olleh" {
+		t.Fatalf("Reverse(hello) = %q, %v", result, err)
+	}
+	if params := (<-requests)["params"].(map[string]interface{}); params["data"] != "aGVsbG8=" {
+		t.Fatalf("got params %v", params)
+	}
+
+	serve(t, ` + "`" + `{"result":"not base64"}` + "`" + `)
+	if _, err := Reverse([]byte("hello")); err == nil {
+		t.Fatal("a result which is not base64 is decoded")
+	}
+}
+`
+	dir := stubModule(t, source, map[string]string{"stub_test.go": test}, false)
+	runGo(t, dir, "test", "-count=1", "./...")
+}
+
+// the tls policy of the client is read from the environment, an invalid policy fails the calls without dialing
+func TestClientTLSPolicy(t *testing.T) {
+	source := `service arithmetic {
+    add(float64 a, float64 b) -> (float64 result);
+}
+`
+	test := `package stub
+
+import (
+	"crypto/tls"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestNewClientTLSConfig(t *testing.T) {
+	t.Setenv("RPC_TLS_MIN_VERSION", "")
+	t.Setenv("RPC_TLS_CIPHERS", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256")
+	config, err := newClientTLSConfig()
+	if err != nil || config.MinVersion != tls.VersionTLS12 || !reflect.DeepEqual(config.CipherSuites, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}) {
+		t.Fatalf("got %x, %x, %v", config.MinVersion, config.CipherSuites, err)
+	}
+
+	cases := map[[2]string]string{
+		{"1.0", ""}:                       ` + "`" + `RPC_TLS_MIN_VERSION: unsupported version "1.0", must be 1.2 or 1.3` + "`" + `,
+		{"1.2", "TLS_RSA_WITH_RC4_128_SHA"}: ` + "`" + `RPC_TLS_CIPHERS: unknown or insecure cipher suite "TLS_RSA_WITH_RC4_128_SHA"` + "`" + `,
+		{"1.3", "TLS_AES_128_GCM_SHA256"}:   "RPC_TLS_CIPHERS: the cipher suites of TLS 1.3 are not configurable",
+	}
+	for policy, want := range cases {
+		t.Setenv("RPC_TLS_MIN_VERSION", policy[0])
+		t.Setenv("RPC_TLS_CIPHERS", policy[1])
+		if _, err := newClientTLSConfig(); err == nil || err.Error() != want {
+			t.Errorf("%v: got %v, want %s", policy, err, want)
+		}
+	}
+}
+
+func TestInvalidPolicyFailsCalls(t *testing.T) {
+	clientTLSError = errors.New("RPC_TLS_MIN_VERSION: unsupported version \"1.0\", must be 1.2 or 1.3")
+	defer func() { clientTLSError = nil }()
+	if _, err := Add(1, 2); err == nil || err.Error() != clientTLSError.Error() {
+		t.Fatalf("Add(1, 2) = %v with an invalid tls policy", err)
+	}
+}
+`
+	dir := stubModule(t, source, map[string]string{"stub_test.go": test}, false)
+	runGo(t, dir, "test", "-count=1", "./...")
+}
+
+// an optional return is returned as a pointer, nil if the response omits it or sends it as null
+func TestOptionalReturn(t *testing.T) {
+	source := `service directory {
+    lookup(string name) -> (string? email, float64 count);
+}
+`
+	test := serveTest + `
+func TestLookup(t *testing.T) {
+	serve(t, ` + "`" + `{"email":"ada@example.com","count":1}` + "`" + `)
+	email, count, err := Lookup("ada")
+	if err != nil || email == nil || *email != "ada@example.com" || count != 1 {
+		t.Fatalf("Lookup(ada) = %v, %v, %v", email, count, err)
+	}
+	for _, response := range []string{` + "`" + `{"count":0}` + "`" + `, ` + "`" + `{"email":null,"count":0}` + "`" + `} {
+		serve(t, response)
+		if email, _, err := Lookup("bob"); err != nil || email != nil {
+			t.Fatalf("%s: Lookup(bob) = %v, %v", response, email, err)
+		}
+	}
+}
+`
+	dir := stubModule(t, source, map[string]string{"stub_test.go": test}, false)
+	runGo(t, dir, "test", "-count=1", "./...")
+
+	// the returns are sent by position, the optional email as null if it is absent
+	test = strings.NewReplacer(`{"email":"ada@example.com","count":1}`, `{"results":["ada@example.com",1]}`,
+		`{"count":0}`, `{"results":[null,0]}`, `{"email":null,"count":0}`, `{"results":[null,0]}`).Replace(test)
+	dir = stubModule(t, source, map[string]string{"stub_test.go": test}, true)
+	runGo(t, dir, "test", "-count=1", "./...")
+}
+
+// the Timeout of the client is sent as the deadline of the call, which fails once it passes
+// and is not retried past it
+func TestClientTimeout(t *testing.T) {
+	source := `service arithmetic {
+    add(float64 a, float64 b) -> (float64 result);
+}
+`
+	test := `package stub
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDeadline(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	t.Setenv("RPC_DIRECT_ADDRESS", ln.Addr().String())
+	requests := make(chan map[string]interface{}, 8)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			// the server never answers
+			defer conn.Close()
+			var request map[string]interface{}
+			json.NewDecoder(conn).Decode(&request)
+			requests <- request
+		}
+	}()
+
+	client := Client{Timeout: 200 * time.Millisecond, Retry: &RetryPolicy{MaxAttempts: 3, Backoff: 10 * time.Millisecond, MaxBackoff: 10 * time.Millisecond}}
+	start := time.Now()
+	_, err = client.Add(1, 2)
+	if err == nil || err.Error() != "Deadline exceeded" {
+		t.Fatalf("got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("the call failed after %v, want 200ms", elapsed)
+	}
+
+	request := <-requests
+	deadline, ok := request["deadline_unix_nano"].(float64)
+	if !ok || time.Unix(0, int64(deadline)).Sub(start) > 200*time.Millisecond+50*time.Millisecond {
+		t.Fatalf("got the deadline %v", request["deadline_unix_nano"])
+	}
+	if len(requests) != 0 {
+		t.Fatalf("the call is retried past its deadline")
+	}
+
+	// without a Timeout no deadline is sent
+	answered := make(chan struct{})
+	go func() {
+		request := <-requests
+		if _, ok := request["deadline_unix_nano"]; ok {
+			t.Errorf("got the deadline %v without a timeout", request["deadline_unix_nano"])
+		}
+		close(answered)
+	}()
+	go (Client{}).Add(1, 2)
+	select {
+	case <-answered:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the call without a timeout is not sent")
+	}
+}
+`
+	dir := stubModule(t, source, map[string]string{"stub_test.go": test}, false)
+	runGo(t, dir, "test", "-count=1", "./...")
+}
+
+// a client with Checksum sends the checksum of the params and verifies the one of the returns
+func TestClientChecksum(t *testing.T) {
+	source := `service arithmetic {
+    add(float64 a, float64 b) -> (float64 result);
+}
+`
+	test := serveTest + `
+func TestChecksum(t *testing.T) {
+	client := Client{Checksum: true}
+	returns := checksum(map[string]interface{}{"result": 3})
+	requests := serve(t, "{\"result\":3,\"checksum\":\""+returns+"\"}")
+	if result, err := client.Add(1, 2); err != nil || result != 3 {
+		t.Fatalf("Add(1, 2) = %v, %v", result, err)
+	}
+	request := <-requests
+	params := request["params"].(map[string]interface{})
+	if request["checksum"] != checksum(params) {
+		t.Fatalf("got the checksum %v of the params %v", request["checksum"], params)
+	}
+
+	// the returns corrupted on the way do not match, and a missing checksum neither
+	for _, response := range []string{"{\"result\":4,\"checksum\":\"" + returns + "\"}", "{\"result\":3}"} {
+		serve(t, response)
+		if _, err := client.Add(1, 2); err == nil || !err.(*RPCError).Is(ErrChecksumMismatch) {
+			t.Fatalf("%s: got %v", response, err)
+		}
+	}
+
+	// the errors are not verified
+	serve(t, "{\"error\":\"No server available\"}")
+	if _, err := client.Add(1, 2); err == nil || err.Error() != "No server available" {
+		t.Fatalf("got %v", err)
+	}
+}
+`
+	dir := stubModule(t, source, map[string]string{"stub_test.go": test}, false)
+	runGo(t, dir, "test", "-count=1", "./...")
+}
+
+// with params structs each method has a WithParams variant taking its typed params and a context,
+// which bounds the Timeout of the client by its deadline
+func TestParamsStructs(t *testing.T) {
+	source := `service arithmetic {
+    add(float64 a, float64 b) -> (float64 result);
+}
+`
+	test := serveTest + `
+func TestAddWithParams(t *testing.T) {
+	requests := serve(t, "{\"result\":3}")
+	if result, err := AddWithParams(context.Background(), AddParams{A: 1, B: 2}); err != nil || result != 3 {
+		t.Fatalf("AddWithParams = %v, %v", result, err)
+	}
+	request := <-requests
+	if params := request["params"].(map[string]interface{}); params["a"] != 1.0 || params["b"] != 2.0 {
+		t.Fatalf("got the params %v", params)
+	}
+	if _, ok := request["deadline_unix_nano"]; ok {
+		t.Fatalf("got a deadline without a timeout: %v", request)
+	}
+
+	// the deadline of the context is sent as the deadline of the call
+	requests = serve(t, "{\"result\":3}")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if _, err := (Client{Timeout: time.Hour}).AddWithParams(ctx, AddParams{A: 1, B: 2}); err != nil {
+		t.Fatal(err)
+	}
+	deadline, _ := ctx.Deadline()
+	// the deadline loses its last digits as a float64
+	got := time.Unix(0, int64((<-requests)["deadline_unix_nano"].(float64)))
+	if diff := got.Sub(deadline); diff > time.Millisecond || diff < -time.Second {
+		t.Fatalf("got the deadline %v, want the one of the context %v", got, deadline)
+	}
+
+	// a done context fails the call before it starts
+	cancel()
+	if _, err := AddWithParams(ctx, AddParams{A: 1, B: 2}); err != context.Canceled {
+		t.Fatalf("got %v", err)
+	}
+}
+`
+	test = strings.Replace(test, "import (\n", "import (\n\t\"context\"\n", 1)
+	dir := stubModule(t, source, map[string]string{"stub_test.go": test}, false, true)
+	runGo(t, dir, "test", "-count=1", "./...")
+}
+
+// a map return is converted from the object of the response
+func TestMapReturn(t *testing.T) {
+	source := `service exchange {
+    rates(string base) -> (map<string, float64> rates, map<string,int32> counts, string base);
+}
+`
+	test := serveTest + `
+func TestRates(t *testing.T) {
+	serve(t, ` + "`" + `{"rates":{"eur":0.5,"gbp":0.25},"counts":{"eur":2},"base":"usd"}` + "`" + `)
+	rates, counts, base, err := Rates("usd")
+	if err != nil || len(rates) != 2 || rates["eur"] != 0.5 || rates["gbp"] != 0.25 || len(counts) != 1 || counts["eur"] != 2 || base != "usd" {
+		t.Fatalf("Rates(usd) = %v, %v, %v, %v", rates, counts, base, err)
+	}
+	serve(t, ` + "`" + `{"rates":{"eur":"high"},"counts":{},"base":"usd"}` + "`" + `)
+	if rates, _, _, err := Rates("usd"); err == nil || rates != nil {
+		t.Fatalf("got %v, %v for a value which is not a float64", rates, err)
+	}
+}
+`
+	dir := stubModule(t, source, map[string]string{"stub_test.go": test}, false)
+	runGo(t, dir, "test", "-count=1", "./...")
+}
+
+// a call sends the trace context of its span in the metadata of the request, without changing the metadata of the client
+func TestCallSpan(t *testing.T) {
+	source := `service calculator {
+    add(float64 a, float64 b) -> (float64 result);
+}
+`
+	test := serveTest + `
+func TestCallSpan(t *testing.T) {
+	// without a TracerProvider the spans are not recorded and no trace context is sent
+	requests := serve(t, ` + "`" + `{"result":3}` + "`" + `)
+	if _, err := Add(1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if request := <-requests; request["metadata"] != nil {
+		t.Fatalf("sent the metadata %v", request["metadata"])
+	}
+
+	recorder := tracetest.NewSpanRecorder()
+	tracer = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+	client := Client{Metadata: Metadata{"user": "ada"}}
+	requests = serve(t, ` + "`" + `{"result":3}` + "`" + `)
+	if _, err := client.Add(1, 2); err != nil {
+		t.Fatal(err)
+	}
+	request := <-requests
+	spans := recorder.Ended()
+	if len(spans) != 1 || spans[0].Name() != "Add" {
+		t.Fatalf("got the spans %v", spans)
+	}
+	metadata, _ := request["metadata"].(map[string]interface{})
+	want := "00-" + spans[0].SpanContext().TraceID().String() + "-" + spans[0].SpanContext().SpanID().String() + "-01"
+	if metadata["traceparent"] != want || metadata["user"] != "ada" {
+		t.Fatalf("sent the metadata %v, want the traceparent %s", metadata, want)
+	}
+	if len(client.Metadata) != 1 {
+		t.Fatalf("the metadata of the client is modified: %v", client.Metadata)
+	}
+}
+`
+	test = strings.Replace(test, "import (\n", "import (\n\tsdktrace \"go.opentelemetry.io/otel/sdk/trace\"\n\t\"go.opentelemetry.io/otel/sdk/trace/tracetest\"\n", 1)
+	dir := stubModule(t, source, map[string]string{"stub_test.go": test})
+	runGo(t, dir, "test", "-count=1", "./...")
+}
+
+// a parameter named like the receiver of the generated methods or of the mock used to shadow it
+func TestParameterNamedLikeReceiver(t *testing.T) {
+	source := `service calculator {
+    add(int32 c, int32 m) -> (int32 result);
+}
+`
+	for _, flags := range [][]bool{{false, false}, {true, false}, {false, true}} {
+		runGo(t, stubModule(t, source, nil, flags...), "vet", "./...")
+	}
+}
+
+// validate exits with 1 for an idl which does not parse, e.g. with an unknown type
+func TestValidate(t *testing.T) {
+	dir := t.TempDir()
+	invalid := filepath.Join(dir, "paint.idl")
+	valid := filepath.Join(dir, "calculator.idl")
+	os.WriteFile(invalid, []byte("service paint {\n    paint(Colour color) -> (bool ok);\n}\n"), 0644)
+	os.WriteFile(valid, []byte("service calculator {\n    add(int32 a, int32 b) -> (int32 result);\n}\n"), 0644)
+	if code := validate(invalid); code != 1 {
+		t.Errorf("validate exited with %d for an unknown type", code)
+	}
+	if code := validate(valid); code != 0 {
+		t.Errorf("validate exited with %d for a valid idl", code)
+	}
+}
+
+func TestMethodWithoutParams(t *testing.T) {
+	source := `service health {
+    ping() -> (bool ok);
+}
+`
+	for _, flags := range [][]bool{{false, false}, {true, false}, {false, true}} {
+		runGo(t, stubModule(t, source, nil, flags...), "vet", "./...")
+	}
+}
@@ -3,6 +3,7 @@ module github.com/denizydmr07/rpc-project/generator_client_stub
 go 1.18
 
 require (
+	github.com/denizydmr07/rpc-project/idl v0.0.0
 	github.com/denizydmr07/zapwrapper v0.1.0
 	go.uber.org/zap v1.27.0
 )
@@ -11,3 +12,5 @@ require (
 	go.uber.org/multierr v1.10.0 // indirect
 	gopkg.in/natefinch/lumberjack.v2 v2.2.1 // indirect
 )
+
+replace github.com/denizydmr07/rpc-project/idl => ../idl
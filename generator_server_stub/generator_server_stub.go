@@ -1,64 +1,52 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
+	"flag"
 	"fmt"
+	"go/format"
 	"os"
-	"regexp"
+	"path/filepath"
 	"strings"
 	"text/template"
 
+	"github.com/denizydmr07/rpc-project/idl"
 	"github.com/denizydmr07/zapwrapper/pkg/zapwrapper"
 	"go.uber.org/zap"
 )
 
-// Service represents a service
-// it contains the name of the service and the methods
-type Service struct {
-	Name    string
-	Methods []Method
-}
-
-// print the service
-func (s Service) String() string {
-	str := "Service: " + s.Name + ", "
-	for _, method := range s.Methods {
-		str += method.String()
-	}
-	return str
-}
-
-// Method represents a method
-// it contains the name, params and returns
-type Method struct {
-	Name    string
-	Params  map[string]interface{}
-	Returns map[string]interface{}
-}
-
-// print the method
-func (m Method) String() string {
-	str := "Method: " + m.Name + ", "
-	str += "Params: "
-	for key, value := range m.Params {
-		str += key + " " + value.(string) + ", "
-	}
-	str += "Returns: "
-	for key, value := range m.Returns {
-		str += key + " " + value.(string) + ", "
-	}
-	return str
-}
-
 var serverStubTemplate = `
 package stub
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 	"net"
 
 	"github.com/denizydmr07/zapwrapper/pkg/zapwrapper"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
@@ -67,204 +55,1472 @@ var logger *zap.Logger = zapwrapper.NewLogger(
 	zapwrapper.DefaultMaxBackups, // Max number of log files to retain
 	zapwrapper.DefaultLogLevel,   // Log level
 )
+{{range $enum := .Enums}}
+// {{.Name}} is an enum of the {{$.Name}} service, sent as its integer value
+type {{.Name}} int
+
+const (
+{{- range $i, $v := .Values}}
+	{{$v}}{{if eq $i 0}} {{$enum.Name}} = iota{{end}}
+{{- end}}
+)
+
+// Valid returns true if the value is one of the declared values of {{.Name}}
+func (v {{.Name}}) Valid() bool {
+	return v >= 0 && v < {{len .Values}}
+}
+{{end}}
+{{- if .Metadata}}
+// metadata of the {{.Name}} service declared in the idl
+const (
+{{- range .Metadata}}
+	{{- range .Doc}}
+	//{{.}}
+	{{- end}}
+	{{.Name}} = {{printf "%q" .Value}}
+{{- end}}
+)
+{{end}}
+// serviceMetadata is the metadata of the service by key, advertised to the load balancer
+// with the first heartbeat and with the methods served, nil if the idl declares none
+var serviceMetadata {{if .Metadata}}= map[string]string{
+{{- range .Metadata}}
+	"{{.Key}}": {{.Name}},
+{{- end}}
+}{{else}}map[string]string{{end}}
+
+// RPCError is an error declared in the idl, it is sent with its code
+// so the caller can match it against the Err sentinels with errors.Is
+type RPCError struct {
+	Code    string // name of the error in the idl
+	Message string
+}
+
+func (e *RPCError) Error() string {
+	return e.Message
+}
+
+// Is reports whether the target is an RPCError with the same code
+func (e *RPCError) Is(target error) bool {
+	t, ok := target.(*RPCError)
+	return ok && t.Code == e.Code
+}
+
+// ErrChecksumMismatch is sent when the params of a request do not match the checksum of the client,
+// i.e. the payload was corrupted on the way
+var ErrChecksumMismatch = &RPCError{Code: "ChecksumMismatch", Message: "checksum mismatch"}
 
-// sendHeartbeats sends heartbeats to the load balancer
-func SendHeartbeats(lbDown chan struct{}, port string) {
-	LBHeartbeatAddress := "139.179.211.34:7070"
-	conn, err := net.Dial("tcp", LBHeartbeatAddress)
+// checksum returns the CRC32 of the canonical JSON encoding of the params or the returns, with the keys sorted.
+// the numbers are decoded as json.Number, so they encode to the same text on both sides
+func checksum(values map[string]interface{}) string {
+	data, _ := json.Marshal(values)
+	return fmt.Sprintf("%08x", crc32.ChecksumIEEE(data))
+}
+{{if .Errors}}
+// errors declared in the idl
+var (
+{{- range .Errors}}
+	Err{{.}} = &RPCError{Code: "{{.}}", Message: "{{.}}"}
+{{- end}}
+)
+{{end}}
+
+// SendHeartbeats sends heartbeats to the load balancer on lbAddress once Ready is called
+// the first heartbeat advertises the port the server is serving on and the Addresses if set.
+// it returns, closing the connection, once ctx is cancelled or the connection fails
+func SendHeartbeats(ctx context.Context, lbDown chan struct{}, lbAddress string, port string) {
+	// wait for the server to accept connections, so no request is routed to it before
+	select {
+	case <-ready:
+	case <-unregister:
+		close(unregistered)
+		return
+	case <-ctx.Done():
+		return
+	}
+
+	conn, err := dialLB(ctx, lbAddress)
 	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
 		logger.Error("Error in dialing load balancer", zap.Error(err))
-		// send a signal to the server that the load balancer is down
-		lbDown <- struct{}{}
+		signalLBDown(ctx, lbDown)
 		return
 	}
 	defer conn.Close()
 
 	request := map[string]interface{}{
 		"heartbeat": true,
+		"ready":     true,
 	}
 
-	encoder := json.NewEncoder(conn)
+	// shared secret to sign the heartbeats, heartbeats are not signed if empty
+	secret := []byte(os.Getenv("LB_HB_SECRET"))
+	var lastTimestamp int64
 
-	// send the first heartbeat, which also contains the serving port
+	encode := heartbeatEncoder(conn)
+
+	// send the first heartbeat, which also contains the serving port, a nonce, addresses, capabilities and metadata
 	request["port"] = port
-	err = encoder.Encode(request)
+	request["nonce"] = heartbeatNonce()
+	if len(Addresses) > 0 {
+		request["addresses"] = Addresses
+	}
+	if capabilities, ok := pendingCapabilities(); ok {
+		request["capabilities"] = capabilities
+	}
+	if serviceMetadata != nil {
+		request["metadata"] = serviceMetadata
+	}
+	request["load"] = Load()
+	if Draining() {
+		request["draining"] = true
+	}
+	lastTimestamp = signHeartbeat(request, secret, lastTimestamp)
+	err = encode(request)
 	if err != nil {
 		logger.Error("Error in sending heartbeat", zap.Error(err))
-		// send a signal to the server that the load balancer is down
-		lbDown <- struct{}{}
+		signalLBDown(ctx, lbDown)
 		return
 	}
-	// remove the port from the request
+	// remove the port, the nonce, the addresses, the capabilities and the metadata from the request
 	delete(request, "port")
+	delete(request, "nonce")
+	delete(request, "addresses")
+	delete(request, "capabilities")
+	delete(request, "metadata")
 
 	// set the sleep duration
 	sleepDuration := 500 * time.Millisecond
 
-	// wait for sleepDuration
-	time.Sleep(sleepDuration)
-
 	// send heartbeats every 2 seconds, keep the connection alive
 	for {
-		err := encoder.Encode(request)
+		// wait for sleepDuration, unless the server is unregistering
+		select {
+		case <-unregister:
+			message := map[string]interface{}{
+				"unregister": true,
+			}
+			signHeartbeat(message, secret, lastTimestamp)
+			if err := encode(message); err != nil {
+				logger.Error("Error in sending unregister message", zap.Error(err))
+				return
+			}
+			logger.Info("Unregistered from load balancer")
+			close(unregistered)
+			return
+		case <-ctx.Done():
+			logger.Debug("Heartbeats stopped")
+			return
+		case <-time.After(sleepDuration):
+		}
+
+		// capabilities changed since they were sent are sent again
+		if capabilities, ok := pendingCapabilities(); ok {
+			request["capabilities"] = capabilities
+		}
+		request["load"] = Load()
+		if Draining() {
+			request["draining"] = true
+		}
+		lastTimestamp = signHeartbeat(request, secret, lastTimestamp)
+		err := encode(request)
+		delete(request, "capabilities")
 		if err != nil {
 			logger.Error("Error in sending heartbeat", zap.Error(err))
-			// send a signal to the server that the load balancer is down
-			lbDown <- struct{}{}
+			signalLBDown(ctx, lbDown)
 			return
 		}
 		logger.Debug("Heartbeat sent to load balancer")
-		time.Sleep(sleepDuration)
 	}
 }
 
+// signalLBDown sends a signal to the server that the load balancer is down,
+// unless ctx is cancelled first, so the heartbeats do not block on a stopped server
+func signalLBDown(ctx context.Context, lbDown chan struct{}) {
+	select {
+	case lbDown <- struct{}{}:
+	case <-ctx.Done():
+	}
+}
+
+// HeartbeatFormat is the format of the heartbeats, "binary" or "json" for the load balancers
+// which do not read binary heartbeats yet, "json" will be removed in the next release
+var HeartbeatFormat = "binary"
+
+// heartbeatMagic starts a binary heartbeat, a JSON one starts with '{'
+const heartbeatMagic = 0xB7
+
+// types of the binary heartbeat messages
+const (
+	heartbeatMessage  = 1
+	unregisterMessage = 2
+)
+
+// heartbeatEncoder returns the func writing a heartbeat or unregister message to conn in HeartbeatFormat
+func heartbeatEncoder(conn net.Conn) func(message map[string]interface{}) error {
+	if HeartbeatFormat == "json" {
+		encoder := json.NewEncoder(conn)
+		return func(message map[string]interface{}) error {
+			return encoder.Encode(message)
+		}
+	}
+	// the buffer is reused by the heartbeats of the connection
+	var buf []byte
+	return func(message map[string]interface{}) error {
+		var err error
+		if buf, err = appendHeartbeat(buf[:0], message); err != nil {
+			return err
+		}
+		_, err = conn.Write(buf)
+		return err
+	}
+}
+
+// appendHeartbeat appends the message as a binary heartbeat to buf: the magic byte, the type
+// and the length of the body, then the ready and draining flags, the load, the timestamp, the signature, the port
+// and the nonce, addresses, capabilities and metadata as a JSON object if the message carries them
+func appendHeartbeat(buf []byte, message map[string]interface{}) ([]byte, error) {
+	kind := byte(heartbeatMessage)
+	if _, ok := message["unregister"]; ok {
+		kind = unregisterMessage
+	}
+	start := len(buf)
+	buf = append(buf, heartbeatMagic, kind, 0, 0)
+
+	var flags byte
+	if ready, _ := message["ready"].(bool); ready {
+		flags |= 1
+	}
+	if draining, _ := message["draining"].(bool); draining {
+		flags |= 2
+	}
+	load, _ := message["load"].(float64)
+	timestamp, _ := message["ts"].(int64)
+	var fixed [17]byte
+	fixed[0] = flags
+	binary.BigEndian.PutUint64(fixed[1:9], math.Float64bits(load))
+	binary.BigEndian.PutUint64(fixed[9:17], uint64(timestamp))
+	buf = append(buf, fixed[:]...)
+
+	mac, _ := message["mac"].(string)
+	port, _ := message["port"].(string)
+	for _, s := range []string{mac, port} {
+		if len(s) > math.MaxUint8 {
+			return nil, fmt.Errorf("heartbeat field too long: %q", s)
+		}
+		buf = append(buf, byte(len(s)))
+		buf = append(buf, s...)
+	}
+
+	// the nonce, the addresses, the capabilities and the metadata are only sent with the first heartbeat and when they change
+	extra := make(map[string]interface{}, 4)
+	for _, key := range []string{"nonce", "addresses", "capabilities", "metadata"} {
+		if value, ok := message[key]; ok {
+			extra[key] = value
+		}
+	}
+	if len(extra) > 0 {
+		encoded, err := json.Marshal(extra)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, encoded...)
+	}
+
+	length := len(buf) - start - 4
+	if length > math.MaxUint16 {
+		return nil, fmt.Errorf("heartbeat too long: %d bytes", length)
+	}
+	binary.BigEndian.PutUint16(buf[start+2:start+4], uint16(length))
+	return buf, nil
+}
+
+// LBWait is how long the server retries to reach the load balancer at startup,
+// so the servers and the load balancer can be started in any order
+var LBWait = 30 * time.Second
+
+// maxDialBackoff is the maximum delay between two attempts to reach the load balancer
+const maxDialBackoff = 5 * time.Second
+
+// dialLB connects to the load balancer, retrying with a capped exponential backoff for LBWait
+// it returns the last error once LBWait passes, the server is unregistered or ctx is cancelled
+func dialLB(ctx context.Context, lbAddress string) (net.Conn, error) {
+	deadline := time.Now().Add(LBWait)
+	delay := 100 * time.Millisecond
+	var dialer net.Dialer
+	for {
+		conn, err := dialer.DialContext(ctx, "tcp", lbAddress)
+		if err == nil {
+			return conn, nil
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return nil, err
+		}
+
+		logger.Warn("Load balancer is unreachable, retrying", zap.Error(err), zap.Duration("delay", delay))
+		select {
+		case <-time.After(delay):
+		case <-unregister:
+			return nil, err
+		case <-ctx.Done():
+			return nil, err
+		}
+
+		delay *= 2
+		if delay > maxDialBackoff {
+			delay = maxDialBackoff
+		}
+	}
+}
+
+// ready is closed by Ready to make SendHeartbeats send the first heartbeat
+var ready = make(chan struct{})
+
+var readyOnce sync.Once
+
+// Ready marks the server as accepting connections, the load balancer does not route
+// requests to the server until the heartbeats report it as ready
+func Ready() {
+	readyOnce.Do(func() { close(ready) })
+}
+
+// unregister is closed by Unregister to make SendHeartbeats unregister the server
+var unregister = make(chan struct{})
+
+// unregistered is closed by SendHeartbeats once the unregister message is sent
+var unregistered = make(chan struct{})
+
+var unregisterOnce sync.Once
+
+// Unregister makes SendHeartbeats tell the load balancer to stop routing requests to the server
+// and stop sending heartbeats. It returns true once the message is sent, false if the timeout passes first.
+func Unregister(timeout time.Duration) bool {
+	unregisterOnce.Do(func() { close(unregister) })
+
+	select {
+	case <-unregistered:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// signedHeartbeatFields are the fields of a heartbeat covered by its signature in the order they are signed,
+// the load balancer signs the same ones
+var signedHeartbeatFields = []string{"heartbeat", "unregister", "ready", "draining", "load", "port", "nonce", "addresses", "capabilities", "metadata"}
+
+// signHeartbeat adds a timestamp and its HMAC signature to the heartbeat request.
+// the timestamp is kept strictly increasing so the load balancer can reject replays.
+// the signature covers the timestamp and each of the signedHeartbeatFields the request carries
+// as its name and its JSON value, whose object keys are sorted, so no field can be changed on the way.
+// it returns the timestamp used, the request is left unchanged if the secret is empty.
+func signHeartbeat(request map[string]interface{}, secret []byte, lastTimestamp int64) int64 {
+	if len(secret) == 0 {
+		return lastTimestamp
+	}
+
+	timestamp := time.Now().UnixMilli()
+	if timestamp <= lastTimestamp {
+		timestamp = lastTimestamp + 1
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%d", timestamp)
+	for _, field := range signedHeartbeatFields {
+		if value, ok := request[field]; ok {
+			encoded, _ := json.Marshal(value)
+			fmt.Fprintf(mac, "\n%s=%s", field, encoded)
+		}
+	}
+
+	request["ts"] = timestamp
+	request["mac"] = hex.EncodeToString(mac.Sum(nil))
+	return timestamp
+}
+
+// heartbeatNonce returns a random nonce for the first heartbeat of a connection,
+// the load balancer accepts a first heartbeat only once so it can not be replayed on another connection
+func heartbeatNonce() string {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	return hex.EncodeToString(nonce)
+}
+
+// Addresses are the serving addresses advertised to the load balancer in order of preference,
+// the load balancer uses the host the heartbeats come from with the port if empty
+var Addresses []string
+
+// capabilities are the capability key/values advertised to the load balancer, set by SetCapabilities
+var capabilities map[string]string
+
+// capabilitiesChanged is true if the capabilities changed since they were last sent
+var capabilitiesChanged bool
+
+var capabilitiesMutex sync.Mutex
+
+// SetCapabilities sets the capability key/values advertised to the load balancer, e.g. {"gpu": "true"},
+// which its routing can filter the servers on. they are sent with the first heartbeat,
+// and with the next heartbeat whenever they are set again
+func SetCapabilities(c map[string]string) {
+	capabilitiesMutex.Lock()
+	defer capabilitiesMutex.Unlock()
+	capabilities = make(map[string]string, len(c))
+	for key, value := range c {
+		capabilities[key] = value
+	}
+	capabilitiesChanged = true
+}
+
+// pendingCapabilities returns the capabilities to send with the next heartbeat,
+// ok is false if they were not set or did not change since they were sent
+func pendingCapabilities() (c map[string]string, ok bool) {
+	capabilitiesMutex.Lock()
+	defer capabilitiesMutex.Unlock()
+	if !capabilitiesChanged {
+		return nil, false
+	}
+	capabilitiesChanged = false
+	return capabilities, true
+}
+
+// MaxInFlight is the number of requests handled at the same time which is reported as full load
+var MaxInFlight int64 = 64
+
+// inFlight is the number of requests being handled
+var inFlight int64
+
+// draining is 1 once SetDraining is called
+var draining int32
+
+// SetDraining asks the load balancer to stop routing new requests to the server with the next heartbeats,
+// e.g. before it is stopped for an upgrade. the requests relayed to it are still handled, and the load balancer
+// reports when none is left. the server does not unregister, it keeps sending heartbeats until it is stopped
+func SetDraining() {
+	atomic.StoreInt32(&draining, 1)
+}
+
+// Draining returns true once SetDraining is called
+func Draining() bool {
+	return atomic.LoadInt32(&draining) == 1
+}
+
+// Load returns the load of the server reported to the load balancer in heartbeats,
+// the ratio of the requests being handled to MaxInFlight capped at 1
+func Load() float64 {
+	load := float64(atomic.LoadInt64(&inFlight)) / float64(MaxInFlight)
+	if load > 1 {
+		load = 1
+	}
+	return load
+}
+
+// Metadata holds the request-scoped values sent by the client alongside the params,
+// e.g. tracing headers or auth context. The methods get it with MetadataFromContext
+type Metadata map[string]string
+
+type metadataKey struct{}
+
+// MetadataFromContext returns the metadata of the request the context is passed to the method for,
+// nil if the request has no metadata
+func MetadataFromContext(ctx context.Context) Metadata {
+	metadata, _ := ctx.Value(metadataKey{}).(Metadata)
+	return metadata
+}
+
+// requestContext returns the context of a request, carrying the string values of its "metadata" object
+func requestContext(request map[string]interface{}) context.Context {
+	ctx := context.Background()
+
+	values, ok := request["metadata"].(map[string]interface{})
+	if !ok {
+		return ctx
+	}
+	metadata := make(Metadata, len(values))
+	for key, value := range values {
+		if s, ok := value.(string); ok {
+			metadata[key] = s
+		}
+	}
+	return context.WithValue(ctx, metadataKey{}, metadata)
+}
+
+// tracer starts the spans of the dispatches, they are not recorded unless the server sets a TracerProvider
+var tracer = otel.Tracer("github.com/denizydmr07/rpc-project/server/stub")
+
+// startDispatchSpan starts the span of the dispatch of a call of the method, a child of the span
+// of the caller if the metadata of the request carries its trace context, e.g. "traceparent"
+func startDispatchSpan(ctx context.Context, method string) (context.Context, trace.Span) {
+	ctx = propagation.TraceContext{}.Extract(ctx, propagation.MapCarrier(MetadataFromContext(ctx)))
+	return tracer.Start(ctx, method, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attribute.String("rpc.method", method)))
+}
+
+// endDispatchSpan sets the error of the response, if any, as the status of the span and ends it
+func endDispatchSpan(span trace.Span, response map[string]interface{}) {
+	if e, failed := response["error"]; failed {
+		span.SetStatus(codes.Error, fmt.Sprint(e))
+	}
+	span.End()
+}
+
+// requestDeadline returns the deadline the client set in the "deadline_unix_nano" of the request,
+// false if it has none
+func requestDeadline(request map[string]interface{}) (time.Time, bool) {
+	nanos, ok := toInt64(request["deadline_unix_nano"])
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(0, nanos), true
+}
+
 func HandleConnection(conn net.Conn) {
+	atomic.AddInt64(&inFlight, 1)
+	defer atomic.AddInt64(&inFlight, -1)
+	defer conn.Close()
 	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
 
+	// numbers are decoded as json.Number and converted to the types of the params
 	decoder := json.NewDecoder(conn)
+	decoder.UseNumber()
 	var request map[string]interface{}
-	decoder.Decode(&request)
 
-	method := request["method"].(string)
-	params := request["params"].(map[string]interface{})
+	// the connection may be closed without a request, e.g. by a health probe
+	if err := decoder.Decode(&request); err != nil {
+		logger.Debug("Error in decoding request", zap.Error(err))
+		return
+	}
 
-	var response map[string]interface{}
+	// a JSON-RPC 2.0 request, told apart by its "jsonrpc" field, is served like a native one
+	// and its response is converted back to JSON-RPC 2.0
+	_, jsonrpc := request["jsonrpc"]
+	if jsonrpc {
+		if response := fromJSONRPC(request); response != nil {
+			json.NewEncoder(conn).Encode(response)
+			return
+		}
+	}
 
-	switch method {
-	{{range .Methods}}
-	case "{{.Name}}":
-		result, err := {{.Name}}({{range $key, $value := .Params}}params["{{$key}}"].({{$value}}), {{end}})
+	method, ok := request["method"].(string)
+	if !ok {
+		json.NewEncoder(conn).Encode(map[string]interface{}{
+			"error": "Invalid request: method must be a string",
+		})
+		return
+	}
 
-		if err == nil {
-			response = map[string]interface{}{
-				"result": result,
+	// the load balancer asks for the methods served to route each method only to the servers serving it
+	if method == methodsMethod {
+		response := map[string]interface{}{"methods": ServedMethods()}
+		if serviceMetadata != nil {
+			response["metadata"] = serviceMetadata
+		}
+		json.NewEncoder(conn).Encode(response)
+		return
+	}
+
+	// context of the request passed to the method, carrying the metadata of the request
+	ctx := requestContext(request)
+
+	// the method gets the remaining budget of the client, a request past its deadline is not served
+	if deadline, ok := requestDeadline(request); ok {
+		if !time.Now().Before(deadline) {
+			response := map[string]interface{}{
+				"error": "Deadline exceeded",
 			}
-		} else {
-			response = map[string]interface{}{
-				"error": err.Error(),
+			if jsonrpc {
+				response = toJSONRPC(response, request["id"])
 			}
+			json.NewEncoder(conn).Encode(response)
+			return
 		}
-	{{end}}
-	default:
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	// subscriptions push their events until either side ends the subscription
+	if subscribe, _ := request["subscribe"].(bool); subscribe {
+		params, _ := request["params"].(map[string]interface{})
+		handleSubscription(ctx, conn, decoder, method, params)
+		return
+	}
+
+	// streaming calls are served until either side ends the stream
+	if stream, _ := request["stream"].(bool); stream {
+		handleStream(ctx, conn, decoder, method)
+		return
+	}
+
+	params, ok := request["params"].(map[string]interface{})
+	if !ok {
+		json.NewEncoder(conn).Encode(map[string]interface{}{
+			"error": "Invalid request: params must be an object",
+		})
+		return
+	}
+
+	// the params are verified against the checksum of the client if it sent one,
+	// before the chunked param which is not part of them is added
+	sum, checked := request["checksum"].(string)
+	if checked && sum != checksum(params) {
+		logger.Warn("Checksum mismatch of the params", zap.String("method", method))
+		response := errorResponse(ErrChecksumMismatch)
+		if jsonrpc {
+			response = toJSONRPC(response, request["id"])
+		}
+		json.NewEncoder(conn).Encode(response)
+		return
+	}
+
+	// the chunked param follows the request in chunks, reassemble it before the dispatch
+	if name, ok := request["chunked"].(string); ok {
+		data, err := readChunks(conn, decoder)
+		if err != nil {
+			logger.Debug("Error in reading chunks", zap.Error(err))
+			json.NewEncoder(conn).Encode(map[string]interface{}{
+				"error": "chunked upload error: " + err.Error(),
+			})
+			return
+		}
+		params[name] = data
+	}
+
+	// the dispatch is traced as a child of the span of the caller
+	ctx, span := startDispatchSpan(ctx, method)
+
+	// the method is looked up in the registry, it may be registered or unregistered at runtime
+	var response map[string]interface{}
+	if call, ok := lookupMethod(method); ok {
+		results, err := call(ctx, params)
+		switch {
+		case err != nil:
+			response = errorResponse(err)
+		case results == nil:
+			response = map[string]interface{}{}
+		default:
+			response = results
+		}
+	} else {
 		response = map[string]interface{}{
 			"error": "Invalid RPC Call Method",
 		}
 	}
+	endDispatchSpan(span, response)
+
+	// the returns are sent with their checksum if the client sent one
+	if _, failed := response["error"]; checked && !failed {
+		response["checksum"] = checksum(response)
+	}
 
+	if jsonrpc {
+		response = toJSONRPC(response, request["id"])
+	}
 	encoder := json.NewEncoder(conn)
 	encoder.Encode(response)
 }
 
-// implmentation of Add method
-func Add(a float64, b float64) (float64, error) {
-	return a + b, nil
+// MethodFunc serves a call of a method. it gets the context and the params of the request as decoded,
+// with the numbers as json.Number, and returns the returns by name or an error sent like the errors of the idl methods
+type MethodFunc func(ctx context.Context, params map[string]interface{}) (map[string]interface{}, error)
+
+// methods is the registry of the methods served by HandleConnection, the methods of the idl
+// and their aliases are registered at start. streams and subscriptions are not in it, they are always served
+var (
+	methods = map[string]MethodFunc{
+		{{- range .Methods}}{{if not (or .Stream .Subscribe)}}{{$method := .}}
+		{{- range $name := prepend .Aliases .Name}}
+		"{{$name}}": call{{$method.Name}},
+		{{- end}}
+		{{- end}}{{end}}
+	}
+	methodsMutex sync.RWMutex
+)
+
+// RegisterMethod registers the method under the name, replacing the one registered under it if any,
+// e.g. to add a method at runtime or to switch a method of the idl back on. it is safe to call while serving
+func RegisterMethod(name string, method MethodFunc) {
+	methodsMutex.Lock()
+	defer methodsMutex.Unlock()
+	methods[name] = method
 }
 
-// implmentation of Sub method
-func Sub(a float64, b float64) (float64, error) {
-	return a - b, nil
+// UnregisterMethod unregisters the method registered under the name and returns it, nil if there is none.
+// the calls of the name fail as an unknown method until it is registered again, an alias is registered apart
+// from the name of its method. it is safe to call while serving, the calls in progress are not affected
+func UnregisterMethod(name string) MethodFunc {
+	methodsMutex.Lock()
+	defer methodsMutex.Unlock()
+	method := methods[name]
+	delete(methods, name)
+	return method
 }
-`
 
-func addServiceToServer(service Service) {
-	fmt.Printf("Service: %s\n", service)
-	tmpl, err := template.New("serverStub").Parse(serverStubTemplate)
-	if err != nil {
-		panic(err)
+// methodsMethod is the reserved method answered with ServedMethods and the metadata of the service,
+// for the deep health check of the load balancer
+const methodsMethod = "__methods"
+
+// streams are the names of the streaming methods and the subscriptions of the idl and their aliases,
+// which are always served
+var streams = []string{
+	{{- range .Methods}}{{if or .Stream .Subscribe}}
+	{{- range $name := prepend .Aliases .Name}}
+	"{{$name}}",
+	{{- end}}
+	{{- end}}{{end}}
+}
+
+// ServedMethods returns the names of the methods served in order, the registered ones, the streams and the subscriptions
+func ServedMethods() []string {
+	methodsMutex.RLock()
+	names := make([]string, 0, len(methods)+len(streams))
+	for name := range methods {
+		names = append(names, name)
 	}
+	methodsMutex.RUnlock()
 
-	os.Mkdir("../server/stub", 0755)
+	names = append(names, streams...)
+	sort.Strings(names)
+	return names
+}
 
-	file, err := os.Create("../server/stub/server_stub_" + service.Name + ".go")
+// lookupMethod returns the method registered under the name
+func lookupMethod(name string) (MethodFunc, bool) {
+	methodsMutex.RLock()
+	defer methodsMutex.RUnlock()
+	method, ok := methods[name]
+	return method, ok
+}
+{{range .Methods}}{{if not .Stream}}
+{{- if paramsStructs}}
+// {{.Name}}Params are the params of a call of {{.Name}}, decoded by the names of the idl
+type {{.Name}}Params struct {
+	{{- range .Params}}
+	{{title .Name}} {{.Type}} ` + "`" + `json:"{{.Name}}"` + "`" + `
+	{{- end}}
+}
+{{end}}
+{{- if .Subscribe}}{{$out := index .Returns 0}}
+// subscribe{{.Name}} converts and validates the params of a subscription to {{.Name}}, and returns the func running it
+{{- range .Doc}}
+//{{.}}
+{{- end}}
+func subscribe{{.Name}}(params map[string]interface{}) (func(ctx context.Context, out chan<- {{$out.Type}}) error, error) {
+	{{- template "validate" .}}
+	return func(ctx context.Context, out chan<- {{$out.Type}}) error {
+		return {{.Name}}(ctx{{range .Params}}, {{if paramsStructs}}{{param .Name}}{{else}}params["{{.Name}}"].({{.Type}}){{end}}{{end}}, out)
+	}, nil
+}
+{{- else}}
+// call{{.Name}} converts and validates the params of a call of {{.Name}}, then calls it
+{{- range .Doc}}
+//{{.}}
+{{- end}}
+func call{{.Name}}(ctx context.Context, params map[string]interface{}) (map[string]interface{}, error) {
+	{{- template "validate" .}}
+	{{- if .MaxConcurrency}}
+	release, ok := acquireSlot("{{.Name}}")
+	if !ok {
+		return nil, errors.New("method busy")
+	}
+	{{- end}}
+	{{range $i, $r := .Returns}}r{{$i}}, {{end}}err := {{.Name}}(ctx{{range .Params}}, {{if paramsStructs}}{{param .Name}}{{else}}params["{{.Name}}"].({{.Type}}){{end}}{{end}})
+	{{- if .MaxConcurrency}}
+	release()
+	{{- end}}
+	{{- range $i, $r := .Returns}}
+	{{- if and $r.Enum $r.Optional}}
+	if err == nil && r{{$i}} != nil && !r{{$i}}.Valid() {
+		err = fmt.Errorf("invalid {{$r.Type}} %d returned as {{$r.Name}}", *r{{$i}})
+	}
+	{{- else if $r.Enum}}
+	if err == nil && !r{{$i}}.Valid() {
+		err = fmt.Errorf("invalid {{$r.Type}} %d returned as {{$r.Name}}", r{{$i}})
+	}
+	{{- else if $r.MapValue}}
+	// a nil map is sent as an empty object rather than null
+	if r{{$i}} == nil {
+		r{{$i}} = {{$r.Type}}{}
+	}
+	{{- end}}
+	{{- end}}
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	defer file.Close()
 
-	writer := bufio.NewWriter(file)
+	response := map[string]interface{}{
+	{{- if positional}}
+		"results": []interface{}{ {{- range $i, $r := .Returns}}{{if $i}}, {{end}}r{{$i}}{{end -}} },
+	{{- else}}
+		{{range $i, $r := .Returns}}{{if not $r.Optional}}"{{$r.Name}}": r{{$i}},
+		{{end}}{{end}}
+	{{- end}}
+	}
+	{{- if not positional}}{{range $i, $r := .Returns}}{{if $r.Optional}}
+	// the optional {{$r.Name}} is omitted if it is absent
+	if r{{$i}} != nil {
+		response["{{$r.Name}}"] = *r{{$i}}
+	}
+	{{- end}}{{end}}{{end}}
+	return response, nil
+}
+{{- end}}
+{{end}}{{end}}
+// handleStream serves a streaming call: the input frames are passed to the method
+// while the values it outputs are written as frames, concurrently.
+// the stream is ended with an end frame, or an error frame if the method or the input failed
+func handleStream(ctx context.Context, conn net.Conn, decoder *json.Decoder, method string) {
+	// a stream may stay idle longer than a call
+	conn.SetReadDeadline(time.Time{})
+	encoder := json.NewEncoder(conn)
 
-	err = tmpl.Execute(writer, service)
-	if err != nil {
-		panic(err)
+	switch method {
+	{{- range .Methods}}{{if .Stream}}{{$in := index .Params 0}}{{$out := index .Returns 0}}
+	{{- range .Doc}}
+	//{{.}}
+	{{- end}}
+	case "{{.Name}}"{{range .Aliases}}, "{{.}}"{{end}}:
+		{{- if .MaxConcurrency}}
+		release, ok := acquireSlot("{{.Name}}")
+		if !ok {
+			encoder.Encode(map[string]interface{}{
+				"error": "method busy",
+			})
+			break
+		}
+		defer release()
+		{{- end}}
+		in := make(chan {{$in.Type}})
+		out := make(chan {{$out.Type}})
+		done := make(chan struct{})      // closed once the output is written
+		inputErr := make(chan error, 1) // error which stopped reading the input
+
+		// read the input frames until the client ends its side
+		go func() {
+			defer close(in)
+			inputErr <- readFrames(decoder, func(frame map[string]interface{}) error {
+				{{- if $in.Enum}}
+				f, ok := toInt64(frame["{{$in.Name}}"])
+				v := {{$in.Type}}(f)
+				if !ok || !v.Valid() {
+				{{- else if $in.Converter}}
+				v, ok := {{$in.Converter}}(frame["{{$in.Name}}"])
+				if !ok {
+				{{- else}}
+				v, ok := frame["{{$in.Name}}"].({{$in.Type}})
+				if !ok {
+				{{- end}}
+					return fmt.Errorf("validation error: frame must contain {{$in.Name}} of type {{$in.Type}}")
+				}
+				select {
+				case in <- v:
+					return nil
+				case <-done:
+					return errStreamDone
+				}
+			})
+		}()
+
+		var err error
+		go func() {
+			err = {{.Name}}(ctx, in, out)
+			close(out)
+		}()
+
+		// write the output frames, keep draining the output if the client is gone
+		var writeErr error
+		for v := range out {
+			if writeErr == nil {
+				writeErr = encoder.Encode(map[string]interface{}{"{{$out.Name}}": v})
+			}
+		}
+		if err == nil {
+			select {
+			case err = <-inputErr:
+			default:
+			}
+		}
+		close(done)
+
+		if writeErr != nil {
+			logger.Debug("Error in writing stream", zap.Error(writeErr))
+		} else if err != nil {
+			encoder.Encode(errorResponse(err))
+		} else {
+			encoder.Encode(map[string]interface{}{"end": true})
+		}
+	{{end}}{{end}}
+	default:
+		encoder.Encode(map[string]interface{}{
+			"error": "Invalid RPC Stream Method",
+		})
 	}
+}
+
+// handleSubscription serves a subscription: the events the method pushes are written as frames
+// until it returns, or until the client ends its side, e.g. by disconnecting, which cancels its context.
+// the subscription is ended with an end frame, or an error frame if the params are invalid or the method failed
+func handleSubscription(ctx context.Context, conn net.Conn, decoder *json.Decoder, method string, params map[string]interface{}) {
+	// a subscription may stay idle longer than a call
+	conn.SetReadDeadline(time.Time{})
+	encoder := json.NewEncoder(conn)
+
+	// the client unsubscribes by ending its side, the frames it sends before are ignored
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		readFrames(decoder, func(map[string]interface{}) error { return nil })
+		cancel()
+	}()
+
+	switch method {
+	{{- range .Methods}}{{if .Subscribe}}{{$out := index .Returns 0}}
+	{{- range .Doc}}
+	//{{.}}
+	{{- end}}
+	case "{{.Name}}"{{range .Aliases}}, "{{.}}"{{end}}:
+		run, err := subscribe{{.Name}}(params)
+		if err != nil {
+			encoder.Encode(errorResponse(err))
+			break
+		}
+		{{- if .MaxConcurrency}}
+		release, ok := acquireSlot("{{.Name}}")
+		if !ok {
+			encoder.Encode(map[string]interface{}{
+				"error": "method busy",
+			})
+			break
+		}
+		defer release()
+		{{- end}}
+		out := make(chan {{$out.Type}})
+		go func() {
+			err = run(ctx, out)
+			close(out)
+		}()
 
-	writer.Flush()
+		// write the events, stop the method and keep draining the events if the client is gone
+		var writeErr error
+		for v := range out {
+			if writeErr == nil {
+				if writeErr = encoder.Encode(map[string]interface{}{"{{$out.Name}}": v}); writeErr != nil {
+					cancel()
+				}
+			}
+		}
+
+		// the method returns the error of its context once the client unsubscribed, which ends it normally
+		if writeErr != nil {
+			logger.Debug("Error in writing subscription", zap.Error(writeErr))
+		} else if err != nil && ctx.Err() == nil {
+			encoder.Encode(errorResponse(err))
+		} else {
+			encoder.Encode(map[string]interface{}{"end": true})
+		}
+	{{end}}{{end}}
+	default:
+		encoder.Encode(map[string]interface{}{
+			"error": "Invalid RPC Subscription Method",
+		})
+	}
 }
 
-func main() {
-	// c reating a new logger
-	logger := zapwrapper.NewLogger(
-		zapwrapper.DefaultFilepath,   // Log file path
-		zapwrapper.DefaultMaxBackups, // Max number of log files to retain
-		zapwrapper.DefaultLogLevel,   // Log level
-	)
+// JSON-RPC 2.0 error codes
+const (
+	jsonrpcInvalidRequest = -32600
+	jsonrpcMethodNotFound = -32601
+	jsonrpcInvalidParams  = -32602
+	jsonrpcServerError    = -32000 // errors returned by the methods
+)
 
-	defer logger.Sync() // flushes buffer, if any
+// methodParams are the names of the params of the methods callable over JSON-RPC 2.0 in the order of declaration,
+// the params of a request given by position are named after them. streams and chunked uploads are only served natively
+var methodParams = map[string][]string{
+	{{- range .Methods}}{{if not (or .Stream .Subscribe .HasChunkedParam)}}{{$method := .}}
+	{{- range $name := prepend .Aliases .Name}}
+	"{{$name}}": { {{- range $i, $p := $method.Params}}{{if $i}}, {{end}}"{{$p.Name}}"{{end -}} },
+	{{- end}}
+	{{- end}}{{end}}
+}
 
-	service := &Service{}
+// fromJSONRPC converts a JSON-RPC 2.0 request to the native format in place, the params given by position
+// are named after the params of the method. it returns the error response if the request is not valid.
+// notifications and batches are not supported
+func fromJSONRPC(request map[string]interface{}) map[string]interface{} {
+	id, hasID := request["id"]
+	if version, _ := request["jsonrpc"].(string); version != "2.0" {
+		return jsonrpcError(id, jsonrpcInvalidRequest, "jsonrpc must be \"2.0\"", nil)
+	}
+	switch id.(type) {
+	case string, json.Number, nil:
+	default:
+		return jsonrpcError(nil, jsonrpcInvalidRequest, "id must be a string, a number or null", nil)
+	}
+	if !hasID {
+		return jsonrpcError(nil, jsonrpcInvalidRequest, "notifications are not supported, the request must have an id", nil)
+	}
 
-	// get the idf file path from the command line
-	idfFilePath := "../idl/calculator.idl"
-	logger.Debug("idf file path", zap.String("idfFilePath", idfFilePath))
+	// an unregistered method is not found, even if it is in the idl
+	method, _ := request["method"].(string)
+	if _, ok := lookupMethod(method); !ok {
+		return jsonrpcError(id, jsonrpcMethodNotFound, "Method not found", nil)
+	}
+	names, declared := methodParams[method]
+	_, chunked := request["chunked"]
+	subscribe, _ := request["subscribe"].(bool)
+	if stream, _ := request["stream"].(bool); stream || subscribe || chunked {
+		return jsonrpcError(id, jsonrpcInvalidRequest, "streams, subscriptions and chunked uploads are not supported over JSON-RPC", nil)
+	}
 
-	file, err := os.Open(idfFilePath)
-	if err != nil {
-		panic(err)
+	params := make(map[string]interface{}, len(names))
+	switch p := request["params"].(type) {
+	case nil:
+	case map[string]interface{}:
+		params = p
+	case []interface{}:
+		// the params of a method registered at runtime are not declared
+		if !declared {
+			return jsonrpcError(id, jsonrpcInvalidParams, "the params of "+method+" must be given by name", nil)
+		}
+		if len(p) != len(names) {
+			return jsonrpcError(id, jsonrpcInvalidParams, fmt.Sprintf("%s takes %d params, got %d", method, len(names), len(p)), nil)
+		}
+		for i, name := range names {
+			params[name] = p[i]
+		}
+	default:
+		return jsonrpcError(id, jsonrpcInvalidRequest, "params must be an array or an object", nil)
+	}
+	for _, name := range names {
+		if _, ok := params[name]; !ok {
+			return jsonrpcError(id, jsonrpcInvalidParams, "missing param "+name, nil)
+		}
 	}
+	request["params"] = params
+	return nil
+}
 
-	// read the idf file line by line
-	scanner := bufio.NewScanner(file)
-	logger.Debug("starting to scan the file")
+// toJSONRPC converts a native response to JSON-RPC 2.0, the returns are the result.
+// a validation error is an invalid params error, the other errors are server errors
+// with the code of an RPCError kept in the data of the error object
+func toJSONRPC(response map[string]interface{}, id interface{}) map[string]interface{} {
+	message, failed := response["error"].(string)
+	if !failed {
+		return map[string]interface{}{
+			"jsonrpc": "2.0",
+			"id":      id,
+			{{- if positional}}
+			"result":  response["results"],
+			{{- else}}
+			"result":  response,
+			{{- end}}
+		}
+	}
 
-	// parse the idf file
-	for scanner.Scan() {
+	code := jsonrpcServerError
+	if strings.HasPrefix(message, "validation error") {
+		code = jsonrpcInvalidParams
+	}
+	var data interface{}
+	if rpcCode, ok := response["code"]; ok {
+		data = map[string]interface{}{"code": rpcCode}
+	}
+	return jsonrpcError(id, code, message, data)
+}
 
-		line := scanner.Text()
+// jsonrpcError returns a JSON-RPC 2.0 error response, the data is omitted if nil
+func jsonrpcError(id interface{}, code int, message string, data interface{}) map[string]interface{} {
+	object := map[string]interface{}{
+		"code":    code,
+		"message": message,
+	}
+	if data != nil {
+		object["data"] = data
+	}
+	return map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      id,
+		"error":   object,
+	}
+}
 
-		// if the line contains KEYWORD service, get the service name
-		if strings.Contains(line, "service") {
-			logger.Debug("Service found", zap.String("line", line))
+// errorResponse returns the response of a failed call,
+// the code of an RPCError is sent in the "code" field so the client can match it
+func errorResponse(err error) map[string]interface{} {
+	response := map[string]interface{}{
+		"error": err.Error(),
+	}
+	var rpcErr *RPCError
+	if errors.As(err, &rpcErr) {
+		response["code"] = rpcErr.Code
+	}
+	return response
+}
 
-			service.Name = strings.Fields(line)[1]
-		} else if strings.Contains(line, "->") { // if the line contains method, get the method details
-			logger.Debug("Method found", zap.String("line", line))
+// toBytes converts a value decoded as a base64 string to a []byte
+func toBytes(v interface{}) ([]byte, bool) {
+	s, ok := v.(string)
+	if !ok {
+		return nil, false
+	}
+	b, err := base64.StdEncoding.DecodeString(s)
+	return b, err == nil
+}
 
-			method := Method{}
+// toFloat64 converts a number decoded as json.Number to a float64
+func toFloat64(v interface{}) (float64, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	f, err := n.Float64()
+	return f, err == nil
+}
 
-			// example: add(int a, int b) -> (int result);
-			pattern := `(\w+)\(([^)]*)\)\s*->\s*\(([^)]*)\);` // regex pattern to match the method
+// toFloat32 converts a number decoded as json.Number to a float32, it fails if the number overflows it
+func toFloat32(v interface{}) (float32, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(string(n), 32)
+	return float32(f), err == nil
+}
 
-			// compile the regex pattern
-			re := regexp.MustCompile(pattern)
+// toInt32 converts a number decoded as json.Number to an int32, it fails if the number is not an integer in its range
+func toInt32(v interface{}) (int32, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	i, err := strconv.ParseInt(string(n), 10, 32)
+	return int32(i), err == nil
+}
 
-			matches := re.FindStringSubmatch(line)
-			method.Name = matches[1]
+// toInt64 converts a number decoded as json.Number to an int64, it fails if the number is not an integer in its range
+func toInt64(v interface{}) (int64, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	i, err := strconv.ParseInt(string(n), 10, 64)
+	return i, err == nil
+}
+
+// toUint32 converts a number decoded as json.Number to a uint32, it fails if the number is not an integer in its range
+func toUint32(v interface{}) (uint32, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	i, err := strconv.ParseUint(string(n), 10, 32)
+	return uint32(i), err == nil
+}
+
+// toUint64 converts a number decoded as json.Number to a uint64, it fails if the number is not an integer in its range
+func toUint64(v interface{}) (uint64, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	i, err := strconv.ParseUint(string(n), 10, 64)
+	return i, err == nil
+}
+
+// QueueBusyMethods makes a call over the concurrency limit of its method wait for a running call to end,
+// instead of failing with a "method busy" error
+var QueueBusyMethods = false
+
+// methodSlots limit the calls running at the same time of the methods declared with maxconcurrency
+var methodSlots = map[string]chan struct{}{
+{{- range .Methods}}{{if .MaxConcurrency}}
+	"{{.Name}}": make(chan struct{}, {{.MaxConcurrency}}),
+{{- end}}{{end}}
+}
+
+// acquireSlot takes a slot of the method until release is called, it returns false
+// if the method is at its concurrency limit and the calls over it are not queued
+func acquireSlot(method string) (release func(), ok bool) {
+	slots := methodSlots[method]
+	if QueueBusyMethods {
+		slots <- struct{}{}
+	} else {
+		select {
+		case slots <- struct{}{}:
+		default:
+			return nil, false
+		}
+	}
+	return func() { <-slots }, true
+}
+
+// MaxUploadSize is the maximum size in bytes of a chunked param
+var MaxUploadSize = 64 << 20
+
+// chunk is a part of a chunked param, the chunks are numbered from zero and the last one is final.
+// it is decoded from {"seq": 0, "data": "<base64>", "final": false}, json matches the fields ignoring case
+type chunk struct {
+	Seq   *int
+	Data  []byte
+	Final bool
+}
+
+// readChunks reads the chunks of a chunked param until the final chunk and returns the reassembled data.
+// a missing, duplicated or out of order chunk fails the upload, each chunk extends the read deadline
+func readChunks(conn net.Conn, decoder *json.Decoder) ([]byte, error) {
+	var data []byte
+	for seq := 0; ; seq++ {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		var c chunk
+		if err := decoder.Decode(&c); err != nil {
+			if err == io.EOF {
+				return nil, fmt.Errorf("upload ended before the final chunk, %d chunks received", seq)
+			}
+			return nil, err
+		}
+		switch {
+		case c.Seq == nil:
+			return nil, fmt.Errorf("chunk %d has no seq", seq)
+		case *c.Seq < seq:
+			return nil, fmt.Errorf("chunk %d is duplicated or out of order, expected chunk %d", *c.Seq, seq)
+		case *c.Seq > seq:
+			return nil, fmt.Errorf("chunk %d is missing, received chunk %d", seq, *c.Seq)
+		}
+		if len(data)+len(c.Data) > MaxUploadSize {
+			return nil, fmt.Errorf("upload exceeds %d bytes", MaxUploadSize)
+		}
+
+		data = append(data, c.Data...)
+		if c.Final {
+			return data, nil
+		}
+	}
+}
+
+// errStreamDone stops reading the input of a stream whose method returned
+var errStreamDone = fmt.Errorf("stream is done")
 
-			// if method name starts with lowercase, make it uppercase
-			if method.Name[0] >= 'a' && method.Name[0] <= 'z' {
-				method.Name = strings.Title(method.Name)
+// readFrames decodes the input frames of a streaming call and passes them to handle
+// until the end frame or the client closes its side.
+// it returns the error of the connection or the error of handle, which stops reading
+func readFrames(decoder *json.Decoder, handle func(frame map[string]interface{}) error) error {
+	for {
+		var frame map[string]interface{}
+		if err := decoder.Decode(&frame); err != nil {
+			if err == io.EOF {
+				return nil
 			}
+			return err
+		}
+		if _, ok := frame["end"]; ok {
+			return nil
+		}
+		if err := handle(frame); err != nil {
+			return err
+		}
+	}
+}
 
-			method.Params = make(map[string]interface{})
+// implmentation of Add method
+func Add(ctx context.Context, a float64, b float64) (float64, error) {
+	return a + b, nil
+}
+
+// implmentation of Sub method
+func Sub(ctx context.Context, a float64, b float64) (float64, error) {
+	return a - b, nil
+}
+
+// implmentation of Divide method
+func Divide(ctx context.Context, a float64, b float64) (float64, error) {
+	if b == 0 {
+		return 0, ErrDivByZero
+	}
+	return a / b, nil
+}
+
+{{- /* validate converts and validates the params of a call or a subscription into the vars passed to the method */}}
+{{define "validate"}}
+	{{- if paramsStructs}}
+	var p {{.Name}}Params
+	{{- end}}
+	{{- range .Params}}
+	{{- if .Enum}}
+	if v, ok := toInt64(params["{{.Name}}"]); ok && {{.Type}}(v).Valid() {
+		{{param .Name}} = {{.Type}}(v)
+	} else {
+		return nil, errors.New("validation error: parameter {{.Name}} must be a {{.Type}}")
+	}
+	{{- else if .Converter}}
+	if v, ok := {{.Converter}}(params["{{.Name}}"]); ok {
+		{{param .Name}} = v
+	} else {
+		return nil, errors.New("validation error: parameter {{.Name}} must be a {{.Type}}")
+	}
+	{{- else if paramsStructs}}
+	if v, ok := params["{{.Name}}"].({{.Type}}); ok {
+		{{param .Name}} = v
+	} else {
+		return nil, errors.New("validation error: parameter {{.Name}} must be a {{.Type}}")
+	}
+	{{- end}}
+	{{- if or .Min .Max}}
+	if {{if paramsStructs}}v := {{param .Name}}; {{else}}v, ok := params["{{.Name}}"].({{.Type}}); ok && {{end}}({{if .Min}}v < {{.Min}}{{end}}{{if and .Min .Max}} || {{end}}{{if .Max}}v > {{.Max}}{{end}}) {
+		return nil, errors.New("validation error: parameter {{.Name}} must be in [{{.Min}}..{{.Max}}]")
+	}
+	{{- end}}
+	{{- if .MaxLen}}
+	if {{if paramsStructs}}v := {{param .Name}}; {{else}}v, ok := params["{{.Name}}"].(string); ok && {{end}}len([]rune(v)) > {{.MaxLen}} {
+		return nil, errors.New("validation error: parameter {{.Name}} must be at most {{.MaxLen}} characters")
+	}
+	{{- end}}
+	{{- end}}
+{{- end}}
+`
 
-			// paramsare in the form of "int a, int b, ..."
-			params := strings.Split(matches[2], ",")
-			for _, param := range params {
-				paramParts := strings.Fields(param)
-				method.Params[paramParts[1]] = paramParts[0]
+// addServiceToServer adds the service to the server stub
+// positional selects encoding the returns by position in a "results" array,
+// paramsStructs selects decoding the params of each method into a typed struct
+func addServiceToServer(service idl.Service, positional bool, paramsStructs bool, out output) error {
+	if !out.dryRun {
+		fmt.Printf("Service: %s\n", service)
+	}
+	funcs := template.FuncMap{
+		"positional":    func() bool { return positional },
+		"paramsStructs": func() bool { return paramsStructs },
+		"title":         strings.Title,
+		// param is the expression of a converted param, a field of the params struct or an entry of the params map
+		"param": func(name string) string {
+			if paramsStructs {
+				return "p." + strings.Title(name)
 			}
+			return fmt.Sprintf("params[%q]", name)
+		},
+		"prepend": func(list []string, s string) []string { return append([]string{s}, list...) },
+	}
+	tmpl, err := template.New("serverStub").Funcs(funcs).Parse(serverStubTemplate)
+	if err != nil {
+		panic(err)
+	}
+
+	var source bytes.Buffer
+	if err := tmpl.Execute(&source, service); err != nil {
+		panic(err)
+	}
+	return out.write("server_stub_"+service.Name+".go", source.Bytes())
+}
+
+// output is where the generator writes the stubs
+type output struct {
+	dir    string // directory to write the stubs in
+	dryRun bool   // print the stubs to stdout instead of writing them
+}
+
+// write formats the source of a stub with gofmt and writes it to the file under the output directory,
+// or prints it to stdout after a comment naming the file in a dry run.
+// a source which does not parse is a bug of the template, the error lists it with line numbers
+func (o output) write(name string, source []byte) error {
+	path := filepath.Join(o.dir, name)
+	formatted, err := format.Source(source)
+	if err != nil {
+		return fmt.Errorf("generated %s is not valid Go: %v\n%s", path, err, numberLines(source))
+	}
+	source = formatted
+
+	if o.dryRun {
+		fmt.Printf("// %s\n", path)
+		_, err := os.Stdout.Write(source)
+		return err
+	}
+
+	// create the output directory if it doesn't exist
+	if err := os.MkdirAll(o.dir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, source, 0644)
+}
+
+// numberLines prefixes the lines of the source with their numbers, which the errors of format.Source refer to
+func numberLines(source []byte) string {
+	var b strings.Builder
+	for i, line := range strings.Split(string(source), "\n") {
+		fmt.Fprintf(&b, "%4d  %s\n", i+1, line)
+	}
+	return b.String()
+}
+
+// validate parses the idl file at the path and prints its first error with its line number,
+// or that it is valid, without generating the stub. it returns the exit code, 1 if the file is invalid
+func validate(idfFilePath string) int {
+	file, err := os.Open(idfFilePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	defer file.Close()
 
-			// returns are in the form of "int result, ..."
-			method.Returns = make(map[string]interface{})
-			returns := strings.Fields(matches[3])
-			method.Returns[returns[1]] = returns[0]
+	if _, err := idl.Parse(file, zap.NewNop()); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", idfFilePath, err)
+		return 1
+	}
+	fmt.Printf("%s: valid\n", idfFilePath)
+	return 0
+}
 
-			service.Methods = append(service.Methods, method)
+func main() {
+	// "validate [file]" only checks the idl, e.g. before committing it
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		idfFilePath := "../idl/calculator.idl"
+		if len(os.Args) > 2 {
+			idfFilePath = os.Args[2]
 		}
+		os.Exit(validate(idfFilePath))
 	}
 
-	addServiceToServer(*service) // add the service to the server stub
-	logger.Debug("Service added to server stub", zap.String("service", service.Name))
+	positional := flag.Bool("positional", false, "Encode returns as an ordered \"results\" array instead of by name, must match the client generator")
+	paramsStructs := flag.Bool("params-structs", false, "Decode the params of each method into a typed params struct instead of asserting on the map")
+	outDir := flag.String("out", "../server/stub", "Directory to write the server stub in")
+	dryRun := flag.Bool("dry-run", false, "Print the generated stubs to stdout instead of writing them")
+	flag.Parse()
+
+	// a dry run writes no log file and keeps stdout for the stubs
+	logger := zap.NewNop()
+	if !*dryRun {
+		logger = zapwrapper.NewLogger(
+			zapwrapper.DefaultFilepath,   // Log file path
+			zapwrapper.DefaultMaxBackups, // Max number of log files to retain
+			zapwrapper.DefaultLogLevel,   // Log level
+		)
+	}
+	defer logger.Sync() // flushes buffer, if any
 
+	// get the idf file path from the command line
+	idfFilePath := "../idl/calculator.idl"
+	logger.Debug("idf file path", zap.String("idfFilePath", idfFilePath))
+
+	file, err := os.Open(idfFilePath)
+	if err != nil {
+		panic(err)
+	}
+
+	service, err := idl.Parse(file, logger)
 	file.Close()
+	if err != nil {
+		logger.Error("Error in parsing the idl file", zap.String("idfFilePath", idfFilePath), zap.Error(err))
+		fmt.Fprintf(os.Stderr, "%s: %v\n", idfFilePath, err)
+		logger.Sync()
+		os.Exit(1)
+	}
+
+	// add the service to the server stub
+	out := output{dir: *outDir, dryRun: *dryRun}
+	if err := addServiceToServer(*service, *positional, *paramsStructs, out); err != nil {
+		logger.Error("Error in writing the server stub", zap.Error(err))
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		logger.Sync()
+		os.Exit(1)
+	}
+	logger.Debug("Service added to server stub", zap.String("service", service.Name))
 }
@@ -0,0 +1,1653 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/denizydmr07/rpc-project/idl"
+	"go.uber.org/zap"
+)
+
+// calculatorMethods are the methods of the calculator, the stub implements them so every idl generating it declares them
+const calculatorMethods = `
+    add(float64 a, float64 b) -> (float64 result);
+    sub(float64 a, float64 b) -> (float64 result);
+    divide(float64 a, float64 b) -> (float64 result) throws DivByZero;
+`
+
+// testStub generates the server stub of the idl source in a module using the dependencies of the server,
+// adds the files to the stub package, e.g. the implementations of the methods and a test, and runs the tests.
+// the flags select positional returns then params structs
+func testStub(t *testing.T, source string, files map[string]string, flags ...bool) {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("builds a module")
+	}
+	service, err := idl.Parse(strings.NewReader(source), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	goMod, err := os.ReadFile("../server/go.mod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	goMod = []byte(strings.Replace(string(goMod), "module github.com/denizydmr07/rpc-project/server", "module stubtest", 1))
+	goSum, err := os.ReadFile("../server/go.sum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "go.mod"), goMod, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "go.sum"), goSum, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out := output{dir: filepath.Join(dir, "stub")}
+	positional, paramsStructs := len(flags) > 0 && flags[0], len(flags) > 1 && flags[1]
+	if err := addServiceToServer(*service, positional, paramsStructs, out); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(out.dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cmd := exec.Command("go", "test", "-count=1", "./...")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOFLAGS=-mod=mod", "GOTOOLCHAIN=local")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("tests of the generated stub failed: %v\n%s", err, output)
+	}
+}
+
+// callTest is the prefix of the tests calling the stub, call sends a request to HandleConnection and returns the response
+const callTest = `package stub
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+)
+
+func call(t *testing.T, request string) map[string]interface{} {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	go HandleConnection(server)
+	if _, err := client.Write([]byte(request + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	var response map[string]interface{}
+	if err := json.NewDecoder(client).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+`
+
+// the returns of a method with two of them are encoded by name, or by position with -positional
+func TestTwoReturnsRoundTrip(t *testing.T) {
+	source := "service arithmetic {" + calculatorMethods + "    divmod(float64 a, float64 b) -> (float64 quotient, float64 remainder);\n}\n"
+	implementation := `package stub
+
+import (
+	"context"
+	"math"
+)
+
+func Divmod(ctx context.Context, a float64, b float64) (float64, float64, error) {
+	return math.Floor(a / b), math.Mod(a, b), nil
+}
+`
+	named := callTest + `
+func TestDivmod(t *testing.T) {
+	response := call(t, ` + "`" + `{"method":"Divmod","params":{"a":7,"b":2}}` + "`" + `)
+	if response["quotient"] != 3.0 || response["remainder"] != 1.0 {
+		t.Fatalf("got %v", response)
+	}
+}
+`
+	positional := callTest + `
+func TestDivmod(t *testing.T) {
+	response := call(t, ` + "`" + `{"method":"Divmod","params":{"a":7,"b":2}}` + "`" + `)
+	results, _ := response["results"].([]interface{})
+	if len(results) != 2 || results[0] != 3.0 || results[1] != 1.0 {
+		t.Fatalf("got %v", response)
+	}
+}
+`
+	t.Run("named", func(t *testing.T) {
+		testStub(t, source, map[string]string{"divmod.go": implementation, "stub_test.go": named}, false)
+	})
+	t.Run("positional", func(t *testing.T) {
+		testStub(t, source, map[string]string{"divmod.go": implementation, "stub_test.go": positional}, true)
+	})
+}
+
+// the parameters breaking their constraints are rejected before the method is called
+func TestConstraintsValidatedBeforeDispatch(t *testing.T) {
+	source := "service people {" + calculatorMethods + "    setAge(float64 age [0..150], string name [maxlen=4]) -> (bool ok);\n}\n"
+	implementation := `package stub
+
+import "context"
+
+var calls int
+
+func SetAge(ctx context.Context, age float64, name string) (bool, error) {
+	calls++
+	return true, nil
+}
+`
+	test := callTest + `
+func TestSetAge(t *testing.T) {
+	cases := []struct {
+		request string
+		err     interface{}
+	}{
+		{` + "`" + `{"method":"SetAge","params":{"age":200,"name":"ann"}}` + "`" + `, "validation error: parameter age must be in [0..150]"},
+		{` + "`" + `{"method":"SetAge","params":{"age":-1,"name":"ann"}}` + "`" + `, "validation error: parameter age must be in [0..150]"},
+		{` + "`" + `{"method":"SetAge","params":{"age":30,"name":"annabel"}}` + "`" + `, "validation error: parameter name must be at most 4 characters"},
+	}
+	for _, c := range cases {
+		if response := call(t, c.request); response["error"] != c.err {
+			t.Errorf("%s: got %v", c.request, response)
+		}
+	}
+	if calls != 0 {
+		t.Fatalf("SetAge called %d times with invalid parameters", calls)
+	}
+	if response := call(t, ` + "`" + `{"method":"SetAge","params":{"age":150,"name":"anna"}}` + "`" + `); response["ok"] != true || calls != 1 {
+		t.Fatalf("got %v", response)
+	}
+}
+`
+	files := map[string]string{"setage.go": implementation, "stub_test.go": test}
+	t.Run("params map", func(t *testing.T) {
+		testStub(t, source, files)
+	})
+	t.Run("params structs", func(t *testing.T) {
+		testStub(t, source, files, false, true)
+	})
+}
+
+// a call of the deprecated alias of a method reaches the implementation of the method
+func TestAliasDispatch(t *testing.T) {
+	source := "service calculator {" + calculatorMethods + "    deprecated add_numbers = add;\n    deprecated plus = add;\n}\n"
+	test := callTest + `
+func TestAddNumbers(t *testing.T) {
+	for _, method := range []string{"Add", "Add_numbers", "Plus"} {
+		response := call(t, ` + "`" + `{"method":"` + "`" + ` + method + ` + "`" + `","params":{"a":1,"b":2}}` + "`" + `)
+		if response["result"] != 3.0 {
+			t.Fatalf("%s: got %v", method, response)
+		}
+	}
+	if response := call(t, ` + "`" + `{"method":"Add_number","params":{"a":1,"b":2}}` + "`" + `); response["error"] == nil {
+		t.Fatalf("unknown method answered %v", response)
+	}
+}
+`
+	t.Run("params map", func(t *testing.T) {
+		testStub(t, source, map[string]string{"stub_test.go": test})
+	})
+	t.Run("params structs", func(t *testing.T) {
+		testStub(t, source, map[string]string{"stub_test.go": test}, false, true)
+	})
+}
+
+// enum params outside of the declared values are rejected, and an invalid enum return is an error
+func TestEnumDispatch(t *testing.T) {
+	source := "service palette {" + calculatorMethods + "    enum Color { RED; GREEN; BLUE; }\n    next(Color color) -> (Color result);\n}\n"
+	implementation := `package stub
+
+import "context"
+
+func Next(ctx context.Context, color Color) (Color, error) {
+	return color + 1, nil
+}
+`
+	test := callTest + `
+func TestNext(t *testing.T) {
+	if response := call(t, ` + "`" + `{"method":"Next","params":{"color":1}}` + "`" + `); response["result"] != float64(BLUE) {
+		t.Fatalf("got %v", response)
+	}
+	for _, color := range []string{"3", "-1", "0.5", "\"RED\""} {
+		if response := call(t, ` + "`" + `{"method":"Next","params":{"color":` + "`" + ` + color + ` + "`" + `}}` + "`" + `); response["error"] != "validation error: parameter color must be a Color" {
+			t.Errorf("%s: got %v", color, response)
+		}
+	}
+	if response := call(t, ` + "`" + `{"method":"Next","params":{"color":2}}` + "`" + `); response["error"] == nil {
+		t.Fatalf("invalid return answered %v", response)
+	}
+}
+`
+	files := map[string]string{"next.go": implementation, "stub_test.go": test}
+	t.Run("params map", func(t *testing.T) {
+		testStub(t, source, files)
+	})
+	t.Run("params structs", func(t *testing.T) {
+		testStub(t, source, files, false, true)
+	})
+}
+
+// the first heartbeat is sent once the server calls Ready, and reports it ready with its port
+func TestHeartbeatsWaitForReady(t *testing.T) {
+	test := `package stub
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReady(t *testing.T) {
+	HeartbeatFormat = "json"
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	heartbeats := make(chan map[string]interface{}, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var heartbeat map[string]interface{}
+		json.NewDecoder(conn).Decode(&heartbeat)
+		heartbeats <- heartbeat
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go SendHeartbeats(ctx, make(chan struct{}, 1), ln.Addr().String(), "8081")
+
+	select {
+	case heartbeat := <-heartbeats:
+		t.Fatalf("heartbeat %v sent before the server is ready", heartbeat)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	Ready()
+	select {
+	case heartbeat := <-heartbeats:
+		if heartbeat["ready"] != true || heartbeat["port"] != "8081" {
+			t.Fatalf("got %v", heartbeat)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no heartbeat once the server is ready")
+	}
+}
+`
+	testStub(t, "service calculator {"+calculatorMethods+"}\n", map[string]string{"stub_test.go": test}, false)
+}
+
+// the input frames of a stream are passed to the method and its output is framed back, an invalid frame ends the stream
+func TestStreamDispatch(t *testing.T) {
+	source := "service calculator {" + calculatorMethods + "    stream feed(stream float64 x) -> (stream float64 y);\n}\n"
+	implementation := `package stub
+
+import "context"
+
+func Feed(ctx context.Context, in <-chan float64, out chan<- float64) error {
+	for x := range in {
+		out <- x * 2
+	}
+	return nil
+}
+`
+	test := `package stub
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+// stream opens a stream of Feed, sends the frames and returns the frames received until the server ends it
+func stream(t *testing.T, frames ...string) []map[string]interface{} {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	go HandleConnection(server)
+	go func() {
+		client.Write([]byte(` + "`" + `{"method":"Feed","stream":true}` + "`" + ` + "\n"))
+		for _, frame := range frames {
+			if _, err := client.Write([]byte(frame + "\n")); err != nil {
+				return
+			}
+		}
+	}()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	decoder := json.NewDecoder(client)
+	var received []map[string]interface{}
+	for {
+		var frame map[string]interface{}
+		if err := decoder.Decode(&frame); err != nil {
+			t.Fatal(err)
+		}
+		received = append(received, frame)
+		if frame["end"] != nil || frame["error"] != nil {
+			return received
+		}
+	}
+}
+
+func TestFeed(t *testing.T) {
+	received := stream(t, ` + "`" + `{"x":1}` + "`" + `, ` + "`" + `{"x":2.5}` + "`" + `, ` + "`" + `{"end":true}` + "`" + `)
+	if len(received) != 3 || received[0]["y"] != 2.0 || received[1]["y"] != 5.0 || received[2]["end"] != true {
+		t.Fatalf("got %v", received)
+	}
+
+	received = stream(t, ` + "`" + `{"x":1}` + "`" + `, ` + "`" + `{"x":"two"}` + "`" + `)
+	if last := received[len(received)-1]; last["error"] != "validation error: frame must contain x of type float64" {
+		t.Fatalf("got %v", received)
+	}
+}
+`
+	testStub(t, source, map[string]string{"feed.go": implementation, "stub_test.go": test}, false)
+}
+
+// the events a subscription pushes are framed to the client until the method returns or the client unsubscribes,
+// which cancels the context of the method
+func TestSubscriptionDispatch(t *testing.T) {
+	source := "service calculator {" + calculatorMethods + "    subscribe ticks(int32 count) -> (stream int32 n);\n}\n"
+	implementation := `package stub
+
+import (
+	"context"
+	"errors"
+)
+
+// unsubscribed receives the error of the context of a subscription to Ticks with no count once it is cancelled
+var unsubscribed = make(chan error, 1)
+
+func Ticks(ctx context.Context, count int32, out chan<- int32) error {
+	if count < 0 {
+		return errors.New("count must not be negative")
+	}
+	if count == 0 {
+		<-ctx.Done()
+		unsubscribed <- ctx.Err()
+		return ctx.Err()
+	}
+	for n := int32(1); n <= count; n++ {
+		out <- n
+	}
+	return nil
+}
+`
+	test := `package stub
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+// subscribe subscribes to Ticks with the params, sends the frames and returns the frames received until the server ends it
+func subscribe(t *testing.T, params string, frames ...string) []map[string]interface{} {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	go HandleConnection(server)
+	go func() {
+		client.Write([]byte(` + "`" + `{"method":"Ticks","subscribe":true,"params":` + "`" + ` + params + "}\n"))
+		for _, frame := range frames {
+			if _, err := client.Write([]byte(frame + "\n")); err != nil {
+				return
+			}
+		}
+	}()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	decoder := json.NewDecoder(client)
+	var received []map[string]interface{}
+	for {
+		var frame map[string]interface{}
+		if err := decoder.Decode(&frame); err != nil {
+			t.Fatal(err)
+		}
+		received = append(received, frame)
+		if frame["end"] != nil || frame["error"] != nil {
+			return received
+		}
+	}
+}
+
+func TestTicks(t *testing.T) {
+	received := subscribe(t, ` + "`" + `{"count":3}` + "`" + `)
+	if len(received) != 4 || received[0]["n"] != 1.0 || received[2]["n"] != 3.0 || received[3]["end"] != true {
+		t.Fatalf("got %v", received)
+	}
+
+	if received = subscribe(t, ` + "`" + `{"count":-1}` + "`" + `); len(received) != 1 || received[0]["error"] != "count must not be negative" {
+		t.Fatalf("got %v from a failing method", received)
+	}
+	if received = subscribe(t, ` + "`" + `{"count":"three"}` + "`" + `); len(received) != 1 || received[0]["error"] != "validation error: parameter count must be a int32" {
+		t.Fatalf("got %v with an invalid param", received)
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	received := subscribe(t, ` + "`" + `{"count":0}` + "`" + `, ` + "`" + `{"end":true}` + "`" + `)
+	if len(received) != 1 || received[0]["end"] != true {
+		t.Fatalf("got %v", received)
+	}
+	select {
+	case err := <-unsubscribed:
+		if err != context.Canceled {
+			t.Fatalf("the context of the method ended with %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the context of the method is not cancelled")
+	}
+}
+
+func TestSubscriptionOverJSONRPC(t *testing.T) {
+	// a subscription is not in the registry, so it is not found like a stream
+	response := call(t, ` + "`" + `{"jsonrpc":"2.0","id":1,"method":"Ticks","subscribe":true,"params":{"count":3}}` + "`" + `)
+	if object, _ := response["error"].(map[string]interface{}); object["code"] != -32601.0 {
+		t.Fatalf("got %v", response)
+	}
+	response = call(t, ` + "`" + `{"jsonrpc":"2.0","id":1,"method":"Add","subscribe":true,"params":[1,2]}` + "`" + `)
+	if object, _ := response["error"].(map[string]interface{}); object["code"] != -32600.0 || object["message"] != "streams, subscriptions and chunked uploads are not supported over JSON-RPC" {
+		t.Fatalf("got %v", response)
+	}
+	if methods := ServedMethods(); len(methods) != 4 || methods[3] != "Ticks" {
+		t.Fatalf("got the methods %v", methods)
+	}
+}
+`
+	testStub(t, source, map[string]string{"ticks.go": implementation, "call_test.go": callTest, "stub_test.go": test}, false)
+}
+
+// the metadata is generated as constants and advertised with the first heartbeat and the methods served
+func TestServiceMetadata(t *testing.T) {
+	source := "service calculator {\n    version \"2.1\";\n    owner \"math-team\";\n" + calculatorMethods + "}\n"
+	test := `package stub
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestMetadata(t *testing.T) {
+	if ServiceVersion != "2.1" || ServiceOwner != "math-team" {
+		t.Fatalf("got the constants %q and %q", ServiceVersion, ServiceOwner)
+	}
+	response := call(t, ` + "`" + `{"method":"__methods","params":{}}` + "`" + `)
+	if fmt.Sprint(response["metadata"]) != "map[owner:math-team version:2.1]" {
+		t.Fatalf("got %v", response)
+	}
+
+	buf, err := appendHeartbeat(nil, map[string]interface{}{"heartbeat": true, "port": "8081", "metadata": serviceMetadata})
+	if err != nil || !bytes.HasSuffix(buf, []byte(` + "`" + `{"metadata":{"owner":"math-team","version":"2.1"}}` + "`" + `)) {
+		t.Fatalf("got %q, %v", buf, err)
+	}
+}
+
+func TestFirstHeartbeatMetadata(t *testing.T) {
+	HeartbeatFormat = "json"
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	heartbeats := make(chan map[string]interface{}, 2)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		decoder := json.NewDecoder(conn)
+		for i := 0; i < 2; i++ {
+			var heartbeat map[string]interface{}
+			if decoder.Decode(&heartbeat) != nil {
+				return
+			}
+			heartbeats <- heartbeat
+		}
+	}()
+
+	Ready()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go SendHeartbeats(ctx, make(chan struct{}, 1), ln.Addr().String(), "8081")
+	if first := <-heartbeats; fmt.Sprint(first["metadata"]) != "map[owner:math-team version:2.1]" {
+		t.Fatalf("got the first heartbeat %v", first)
+	}
+	if next := <-heartbeats; next["metadata"] != nil {
+		t.Fatalf("got the metadata again in %v", next)
+	}
+}
+`
+	testStub(t, source, map[string]string{"call_test.go": callTest, "stub_test.go": test}, false)
+}
+
+// a declared error returned by the method is sent with its code, other errors without one
+func TestThrownErrorSentWithCode(t *testing.T) {
+	source := "service calculator {" + calculatorMethods + "    root(float64 x) -> (float64 result) throws Negative;\n}\n"
+	implementation := `package stub
+
+import (
+	"context"
+	"errors"
+)
+
+func Root(ctx context.Context, x float64) (float64, error) {
+	if x < 0 {
+		return 0, ErrNegative
+	}
+	return 0, errors.New("not implemented")
+}
+`
+	test := callTest + `
+func TestRoot(t *testing.T) {
+	if response := call(t, ` + "`" + `{"method":"Divide","params":{"a":1,"b":0}}` + "`" + `); response["error"] != "DivByZero" || response["code"] != "DivByZero" {
+		t.Fatalf("got %v", response)
+	}
+	if response := call(t, ` + "`" + `{"method":"Root","params":{"x":-1}}` + "`" + `); response["code"] != "Negative" {
+		t.Fatalf("got %v", response)
+	}
+	if response := call(t, ` + "`" + `{"method":"Root","params":{"x":4}}` + "`" + `); response["error"] != "not implemented" || response["code"] != nil {
+		t.Fatalf("got %v", response)
+	}
+}
+`
+	testStub(t, source, map[string]string{"root.go": implementation, "stub_test.go": test}, false)
+}
+
+// the string values of the metadata of a request reach the method through its context
+func TestMetadataPassedToMethod(t *testing.T) {
+	source := "service calculator {" + calculatorMethods + "    whoami(string greeting) -> (string user);\n}\n"
+	implementation := `package stub
+
+import "context"
+
+func Whoami(ctx context.Context, greeting string) (string, error) {
+	return greeting + " " + MetadataFromContext(ctx)["user"], nil
+}
+`
+	test := callTest + `
+func TestWhoami(t *testing.T) {
+	if response := call(t, ` + "`" + `{"method":"Whoami","params":{"greeting":"hi"},"metadata":{"user":"ann","retries":2}}` + "`" + `); response["user"] != "hi ann" {
+		t.Fatalf("got %v", response)
+	}
+	if response := call(t, ` + "`" + `{"method":"Whoami","params":{"greeting":"hi"}}` + "`" + `); response["user"] != "hi " {
+		t.Fatalf("got %v", response)
+	}
+}
+`
+	testStub(t, source, map[string]string{"whoami.go": implementation, "stub_test.go": test}, false)
+}
+
+// the load balancer is reported down once it stays unreachable for LBWait
+func TestLoadBalancerUnreachableForLBWait(t *testing.T) {
+	test := `package stub
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLBDown(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := ln.Addr().String()
+	ln.Close()
+
+	LBWait = 500 * time.Millisecond
+	Ready()
+	lbDown := make(chan struct{}, 1)
+	start := time.Now()
+	go SendHeartbeats(context.Background(), lbDown, address, "8081")
+	select {
+	case <-lbDown:
+		if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+			t.Fatalf("reported down after %v, before retrying", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("not reported down after LBWait")
+	}
+}
+`
+	testStub(t, "service calculator {"+calculatorMethods+"}\n", map[string]string{"stub_test.go": test}, false)
+}
+
+// a load balancer coming up after the server gets the first heartbeat, the server is not reported down meanwhile
+func TestLoadBalancerStartsAfterServer(t *testing.T) {
+	test := `package stub
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLBStartsLater(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := ln.Addr().String()
+	ln.Close()
+
+	Ready()
+	lbDown := make(chan struct{}, 1)
+	go SendHeartbeats(context.Background(), lbDown, address, "8081")
+
+	// the load balancer comes up after a second and gets the first heartbeat
+	time.Sleep(time.Second)
+	lb, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lb.Close()
+	registered := make(chan struct{})
+	go func() {
+		hb, err := lb.Accept()
+		if err != nil {
+			return
+		}
+		defer hb.Close()
+		hb.Read(make([]byte, 1))
+		close(registered)
+	}()
+	select {
+	case <-registered:
+	case <-lbDown:
+		t.Fatal("the load balancer is reported down while it is starting")
+	case <-time.After(10 * time.Second):
+		t.Fatal("no heartbeat once the load balancer is up")
+	}
+}
+`
+	testStub(t, "service calculator {"+calculatorMethods+"}\n", map[string]string{"stub_test.go": test}, false)
+}
+
+// the heartbeats stop once the context of the server is cancelled, closing the connection to the
+// load balancer, and the retries to reach the load balancer stop without reporting it down
+func TestHeartbeatsStopOnCancel(t *testing.T) {
+	test := `package stub
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCancel(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conns := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		conns <- conn
+	}()
+
+	Ready()
+	ctx, cancel := context.WithCancel(context.Background())
+	lbDown := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		SendHeartbeats(ctx, lbDown, ln.Addr().String(), "8081")
+		close(stopped)
+	}()
+	var conn net.Conn
+	select {
+	case conn = <-conns:
+		defer conn.Close()
+	case <-time.After(2 * time.Second):
+		t.Fatal("no heartbeat connection")
+	}
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the heartbeats do not stop once the context is cancelled")
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buffer := make([]byte, 4096)
+	for {
+		if _, err := conn.Read(buffer); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				t.Fatal("the heartbeat connection is not closed")
+			}
+			break
+		}
+	}
+
+	// an unreachable load balancer is retried until the context is cancelled
+	address := ln.Addr().String()
+	ln.Close()
+	LBWait = time.Minute
+	ctx, cancel = context.WithCancel(context.Background())
+	stopped = make(chan struct{})
+	go func() {
+		SendHeartbeats(ctx, lbDown, address, "8081")
+		close(stopped)
+	}()
+	time.Sleep(300 * time.Millisecond)
+	cancel()
+	select {
+	case <-stopped:
+	case <-lbDown:
+		t.Fatal("the load balancer is reported down once the context is cancelled")
+	case <-time.After(2 * time.Second):
+		t.Fatal("the retries do not stop once the context is cancelled")
+	}
+}
+`
+	testStub(t, "service calculator {"+calculatorMethods+"}\n", map[string]string{"stub_test.go": test}, false)
+}
+
+// a chunked param is reassembled before the dispatch, a multi-megabyte payload round trips
+// and a missing, out of order or unfinished sequence of chunks fails the upload
+func TestChunkedUpload(t *testing.T) {
+	source := "service storage {" + calculatorMethods + "    upload(string name, chunked bytes data) -> (float64 size);\n}\n"
+	implementation := `package stub
+
+import (
+	"context"
+	"errors"
+)
+
+var uploaded []byte
+
+func Upload(ctx context.Context, name string, data []byte) (float64, error) {
+	if name != "blob" {
+		return 0, errors.New("unexpected name " + name)
+	}
+	uploaded = data
+	return float64(len(data)), nil
+}
+`
+	test := `package stub
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"testing"
+)
+
+// upload sends the request and the data in chunks numbered by seqs over tcp, so the client can close its side
+// without a final chunk, and returns the response
+func upload(t *testing.T, data []byte, seqs []int, final bool) map[string]interface{} {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			HandleConnection(conn)
+		}
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	go func() {
+		encoder := json.NewEncoder(conn)
+		encoder.Encode(map[string]interface{}{"method": "Upload", "params": map[string]interface{}{"name": "blob"}, "chunked": "data"})
+		size := (len(data) + len(seqs) - 1) / len(seqs)
+		for i, seq := range seqs {
+			end := (i + 1) * size
+			if end > len(data) {
+				end = len(data)
+			}
+			if err := encoder.Encode(map[string]interface{}{"seq": seq, "data": data[i*size : end], "final": final && i == len(seqs)-1}); err != nil {
+				return
+			}
+		}
+		if !final {
+			conn.(*net.TCPConn).CloseWrite()
+		}
+	}()
+
+	var response map[string]interface{}
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func TestUpload(t *testing.T) {
+	payload := make([]byte, 3<<20+17)
+	for i := range payload {
+		payload[i] = byte(i % 251)
+	}
+	seqs := make([]int, 13)
+	for i := range seqs {
+		seqs[i] = i
+	}
+	if response := upload(t, payload, seqs, true); response["size"] != float64(len(payload)) || !bytes.Equal(uploaded, payload) {
+		t.Fatalf("got %v with %d bytes uploaded", response["error"], len(uploaded))
+	}
+
+	cases := []struct {
+		seqs  []int
+		final bool
+		want  string
+	}{
+		{[]int{0, 1, 3, 4}, true, "chunk 2 is missing, received chunk 3"},
+		{[]int{1, 0}, true, "chunk 0 is missing, received chunk 1"},
+		{[]int{0, 1, 1, 2}, true, "chunk 1 is duplicated or out of order, expected chunk 2"},
+		{[]int{0, 2, 1}, true, "chunk 1 is missing, received chunk 2"},
+		{[]int{0, 1}, false, "upload ended before the final chunk, 2 chunks received"},
+	}
+	for _, c := range cases {
+		response := upload(t, []byte("abcdefgh"), c.seqs, c.final)
+		if response["error"] != "chunked upload error: "+c.want {
+			t.Errorf("seqs %v: got %v, want %q", c.seqs, response, c.want)
+		}
+	}
+
+	MaxUploadSize = 6
+	defer func() { MaxUploadSize = 64 << 20 }()
+	if response := upload(t, []byte("abcdefgh"), []int{0, 1}, true); response["error"] != "chunked upload error: upload exceeds 6 bytes" {
+		t.Errorf("upload over MaxUploadSize: got %v", response)
+	}
+}
+`
+	testStub(t, source, map[string]string{"upload.go": implementation, "stub_test.go": test}, false)
+}
+
+// the comment of a method in the idl documents the generated func converting the params of its calls
+func TestDocComments(t *testing.T) {
+	source := `service calculator {
+    add(float64 a, float64 b) -> (float64 result);
+    sub(float64 a, float64 b) -> (float64 result);
+    // Divide returns a divided by b,
+    // it fails with ErrDivByZero if b is zero
+    divide(float64 a, float64 b) -> (float64 result) throws DivByZero;
+}
+`
+	service, err := idl.Parse(strings.NewReader(source), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := output{dir: t.TempDir()}
+	if err := addServiceToServer(*service, false, false, out); err != nil {
+		t.Fatal(err)
+	}
+	file, err := parser.ParseFile(token.NewFileSet(), filepath.Join(out.dir, "server_stub_calculator.go"), nil, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	docs := map[string]string{}
+	for _, decl := range file.Decls {
+		if decl, ok := decl.(*ast.FuncDecl); ok {
+			docs[decl.Name.Name] = decl.Doc.Text()
+		}
+	}
+	const divide = "callDivide converts and validates the params of a call of Divide, then calls it\nDivide returns a divided by b,\nit fails with ErrDivByZero if b is zero\n"
+	if docs["callDivide"] != divide {
+		t.Errorf("doc of callDivide: %q, want %q", docs["callDivide"], divide)
+	}
+	if add := "callAdd converts and validates the params of a call of Add, then calls it\n"; docs["callAdd"] != add {
+		t.Errorf("doc of callAdd: %q, want %q", docs["callAdd"], add)
+	}
+}
+
+// the numeric params are converted to their types without losing the precision of the 64-bit integers,
+// a number which does not fit the type of its param is rejected
+func TestNumericTypes(t *testing.T) {
+	source := "service numbers {" + calculatorMethods + "    convert(float32 f32, float64 f64, int32 i32, int64 i64 [..9007199254740992], uint32 u32, uint64 u64) -> (float32 rf32, float64 rf64, int32 ri32, int64 ri64, uint32 ru32, uint64 ru64);\n}\n"
+	implementation := `package stub
+
+import "context"
+
+func Convert(ctx context.Context, f32 float32, f64 float64, i32 int32, i64 int64, u32 uint32, u64 uint64) (float32, float64, int32, int64, uint32, uint64, error) {
+	return f32 * 2, f64, i32, i64 - 1, u32, u64, nil
+}
+`
+	test := callTest + `
+// callRaw sends a request to HandleConnection and returns the response as it is encoded
+func callRaw(t *testing.T, request string) string {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	go HandleConnection(server)
+	if _, err := client.Write([]byte(request + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	var response json.RawMessage
+	if err := json.NewDecoder(client).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	return string(response)
+}
+
+func TestConvert(t *testing.T) {
+	const params = ` + "`" + `"f32":1.5,"f64":0.1,"i32":-2147483648,"i64":-9223372036854775807,"u32":4294967295,"u64":18446744073709551615` + "`" + `
+	response := callRaw(t, ` + "`" + `{"method":"Convert","params":{` + "`" + `+params+` + "`" + `}}` + "`" + `)
+	for _, want := range []string{` + "`" + `"rf32":3` + "`" + `, ` + "`" + `"rf64":0.1` + "`" + `, ` + "`" + `"ri32":-2147483648` + "`" + `, ` + "`" + `"ri64":-9223372036854775808` + "`" + `, ` + "`" + `"ru32":4294967295` + "`" + `, ` + "`" + `"ru64":18446744073709551615` + "`" + `} {
+		if !strings.Contains(response, want) {
+			t.Errorf("response %s has no %s", response, want)
+		}
+	}
+
+	invalid := map[string]string{
+		"i32": "1.5",
+		"u32": "-1",
+		"u64": "18446744073709551616",
+		"f32": "1e39",
+		"f64": ` + "`" + `"1"` + "`" + `,
+	}
+	for name, value := range invalid {
+		request := strings.Replace(` + "`" + `{"method":"Convert","params":{` + "`" + `+params+` + "`" + `}}` + "`" + `, ` + "`" + `"` + "`" + `+name+` + "`" + `":` + "`" + `, ` + "`" + `"` + "`" + `+name+` + "`" + `":` + "`" + `+value+` + "`" + `,"x":` + "`" + `, 1)
+		if response := call(t, request); response["error"] != "validation error: parameter "+name+" must be a "+map[string]string{"i32": "int32", "u32": "uint32", "u64": "uint64", "f32": "float32", "f64": "float64"}[name] {
+			t.Errorf("%s=%s: got %v", name, value, response)
+		}
+	}
+	if response := call(t, ` + "`" + `{"method":"Convert","params":{"f32":1,"f64":1,"i32":2147483648,"i64":1,"u32":1,"u64":1}}` + "`" + `); response["error"] != "validation error: parameter i32 must be a int32" {
+		t.Errorf("i32 overflowing: got %v", response)
+	}
+
+	// 9007199254740993 rounds to the bound as a float64
+	if response := call(t, ` + "`" + `{"method":"Convert","params":{"f32":1,"f64":1,"i32":1,"i64":9007199254740993,"u32":1,"u64":1}}` + "`" + `); response["error"] != "validation error: parameter i64 must be in [..9007199254740992]" {
+		t.Errorf("i64 over the bound: got %v", response)
+	}
+}
+`
+	test = strings.Replace(test, `	"net"
+	"testing"`, `	"net"
+	"strings"
+	"testing"`, 1)
+	for _, paramsStructs := range []bool{false, true} {
+		testStub(t, source, map[string]string{"convert.go": implementation, "stub_test.go": test}, false, paramsStructs)
+	}
+}
+
+// the stub is formatted with gofmt, a stub which does not parse fails listing its numbered lines,
+// and a dry run writes no file
+func TestOutput(t *testing.T) {
+	dir := t.TempDir()
+	source := []byte("package stub\nfunc  Add( a float64 )float64{return a}\n")
+	if err := (output{dir: dir}).write("stub.go", source); err != nil {
+		t.Fatal(err)
+	}
+	if formatted, err := os.ReadFile(filepath.Join(dir, "stub.go")); err != nil || string(formatted) != "package stub\n\nfunc Add(a float64) float64 { return a }\n" {
+		t.Fatalf("got %q, %v", formatted, err)
+	}
+	err := (output{dir: dir}).write("invalid.go", []byte("package stub\nfunc {"))
+	if err == nil || !strings.Contains(err.Error(), "is not valid Go") || !strings.Contains(err.Error(), "   2  func {") {
+		t.Fatalf("got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "invalid.go")); !os.IsNotExist(err) {
+		t.Fatalf("the invalid stub is written: %v", err)
+	}
+
+	if err := (output{dir: filepath.Join(dir, "dry"), dryRun: true}).write("stub.go", source); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "dry")); !os.IsNotExist(err) {
+		t.Fatalf("the dry run created the output directory: %v", err)
+	}
+}
+
+// the generated params and results are joined without a trailing comma, before gofmt
+func TestArgumentsJoined(t *testing.T) {
+	service, err := idl.Parse(strings.NewReader("service calculator {\n    divmod(float64 a, float64 b) -> (float64 q, float64 r);\n    negate(float64 x) -> (float64 result);\n}\n"), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, positional := range []bool{false, true} {
+		funcs := template.FuncMap{
+			"positional":    func() bool { return positional },
+			"paramsStructs": func() bool { return false },
+			"title":         strings.Title,
+			"param":         func(name string) string { return fmt.Sprintf("params[%q]", name) },
+			"prepend":       func(list []string, s string) []string { return append([]string{s}, list...) },
+		}
+		var source bytes.Buffer
+		if err := template.Must(template.New("serverStub").Funcs(funcs).Parse(serverStubTemplate)).Execute(&source, *service); err != nil {
+			t.Fatal(err)
+		}
+		want := []string{
+			`r0, r1, err := Divmod(ctx, params["a"].(float64), params["b"].(float64))`,
+			`r0, err := Negate(ctx, params["x"].(float64))`,
+		}
+		if positional {
+			want = append(want, `"results": []interface{}{r0, r1},`, `"results": []interface{}{r0},`)
+		}
+		for _, line := range want {
+			if !strings.Contains(source.String(), line) {
+				t.Errorf("positional %v: the stub has no %s", positional, line)
+			}
+		}
+	}
+}
+
+// a bytes param is decoded from a base64 string and a bytes return is sent as one
+func TestBytesDispatch(t *testing.T) {
+	source := "service codec {" + calculatorMethods + "    reverse(bytes data) -> (bytes result);\n}\n"
+	implementation := `package stub
+
+import "context"
+
+func Reverse(ctx context.Context, data []byte) ([]byte, error) {
+	result := make([]byte, len(data))
+	for i, b := range data {
+		result[len(data)-1-i] = b
+	}
+	return result, nil
+}
+`
+	test := callTest + `
+func TestReverse(t *testing.T) {
+	if response := call(t, ` + "`" + `{"method":"Reverse","params":{"data":"aGVsbG8="}}` + "`" + `); response["result"] != "b2xsZWg=" {
+		t.Fatalf("got %v", response)
+	}
+	for _, data := range []string{` + "`" + `"not base64"` + "`" + `, "1"} {
+		if response := call(t, ` + "`" + `{"method":"Reverse","params":{"data":` + "`" + ` + data + ` + "`" + `}}` + "`" + `); response["error"] != "validation error: parameter data must be a []byte" {
+			t.Errorf("%s: got %v", data, response)
+		}
+	}
+}
+`
+	testStub(t, source, map[string]string{"reverse.go": implementation, "stub_test.go": test}, false)
+}
+
+// a call over the concurrency limit of its method fails with "method busy", or waits for a slot if they are queued
+func TestMaxConcurrency(t *testing.T) {
+	source := "service calculator {" + calculatorMethods + "    maxconcurrency(1) heavy(float64 x) -> (float64 result);\n}\n"
+	implementation := `package stub
+
+import "context"
+
+var started, finish = make(chan struct{}), make(chan struct{})
+
+func Heavy(ctx context.Context, x float64) (float64, error) {
+	started <- struct{}{}
+	<-finish
+	return x * 2, nil
+}
+`
+	test := callTest + `
+func TestHeavy(t *testing.T) {
+	first := make(chan map[string]interface{})
+	go func() { first <- call(t, ` + "`" + `{"method":"Heavy","params":{"x":1}}` + "`" + `) }()
+	<-started
+	if response := call(t, ` + "`" + `{"method":"Heavy","params":{"x":2}}` + "`" + `); response["error"] != "method busy" {
+		t.Fatalf("the call over the limit got %v", response)
+	}
+	finish <- struct{}{}
+	if response := <-first; response["result"] != 2.0 {
+		t.Fatalf("got %v", response)
+	}
+
+	QueueBusyMethods = true
+	go func() { first <- call(t, ` + "`" + `{"method":"Heavy","params":{"x":1}}` + "`" + `) }()
+	<-started
+	queued := make(chan map[string]interface{})
+	go func() { queued <- call(t, ` + "`" + `{"method":"Heavy","params":{"x":2}}` + "`" + `) }()
+	select {
+	case <-started:
+		t.Fatal("the queued call runs over the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+	finish <- struct{}{}
+	<-started
+	finish <- struct{}{}
+	if response := <-first; response["result"] != 2.0 {
+		t.Fatalf("got %v", response)
+	}
+	if response := <-queued; response["result"] != 4.0 {
+		t.Fatalf("the queued call got %v", response)
+	}
+}
+`
+	test = strings.Replace(test, `	"testing"`, `	"testing"
+	"time"`, 1)
+	testStub(t, source, map[string]string{"heavy.go": implementation, "stub_test.go": test}, false)
+}
+
+// an optional return is omitted from the response if the method returns it as nil
+func TestOptionalReturn(t *testing.T) {
+	source := "service directory {" + calculatorMethods + "    lookup(string name) -> (string? email, float64 count);\n}\n"
+	implementation := `package stub
+
+import "context"
+
+func Lookup(ctx context.Context, name string) (*string, float64, error) {
+	if name != "ada" {
+		return nil, 0, nil
+	}
+	email := "ada@example.com"
+	return &email, 1, nil
+}
+`
+	test := callTest + `
+func TestLookup(t *testing.T) {
+	if response := call(t, ` + "`" + `{"method":"Lookup","params":{"name":"ada"}}` + "`" + `); response["email"] != "ada@example.com" || response["count"] != 1.0 {
+		t.Fatalf("got %v", response)
+	}
+	response := call(t, ` + "`" + `{"method":"Lookup","params":{"name":"bob"}}` + "`" + `)
+	if _, ok := response["email"]; ok || response["count"] != 0.0 {
+		t.Fatalf("got %v", response)
+	}
+}
+`
+	testStub(t, source, map[string]string{"lookup.go": implementation, "stub_test.go": test}, false)
+}
+
+// a request without a method name or with params which are not an object is answered with an error
+func TestMalformedRequest(t *testing.T) {
+	source := "service calculator {" + calculatorMethods + "}\n"
+	test := callTest + `
+func TestMalformedRequest(t *testing.T) {
+	cases := map[string]string{
+		` + "`" + `{"params":{"a":1,"b":2}}` + "`" + `:            "Invalid request: method must be a string",
+		` + "`" + `{"method":7,"params":{"a":1,"b":2}}` + "`" + `: "Invalid request: method must be a string",
+		` + "`" + `{"method":"Add"}` + "`" + `:                    "Invalid request: params must be an object",
+		` + "`" + `{"method":"Add","params":[1,2]}` + "`" + `:     "Invalid request: params must be an object",
+	}
+	for request, want := range cases {
+		if response := call(t, request); response["error"] != want {
+			t.Errorf("%s: got %v", request, response)
+		}
+	}
+}
+`
+	testStub(t, source, map[string]string{"stub_test.go": test})
+}
+
+// a JSON-RPC 2.0 request is served like a native one with its params by name or by position,
+// and its response and errors are JSON-RPC 2.0 objects with its id
+func TestJSONRPC(t *testing.T) {
+	source := "service calculator {" + calculatorMethods + "    root(float64 x) -> (float64 result) throws Negative;\n}\n"
+	implementation := `package stub
+
+import "context"
+
+func Root(ctx context.Context, x float64) (float64, error) {
+	return 0, ErrNegative
+}
+`
+	test := callTest + `
+func TestJSONRPC(t *testing.T) {
+	for _, params := range []string{` + "`" + `{"a":1,"b":2}` + "`" + `, ` + "`" + `[1,2]` + "`" + `} {
+		response := call(t, ` + "`" + `{"jsonrpc":"2.0","id":7,"method":"Add","params":` + "`" + `+params+` + "`" + `}` + "`" + `)
+		if response["jsonrpc"] != "2.0" || response["id"] != 7.0 || response["result"].(map[string]interface{})["result"] != 3.0 {
+			t.Fatalf("%s: got %v", params, response)
+		}
+	}
+
+	cases := map[string][2]interface{}{
+		` + "`" + `{"jsonrpc":"2.0","id":"a","method":"Add","params":[1]}` + "`" + `:           {-32602.0, "Add takes 2 params, got 1"},
+		` + "`" + `{"jsonrpc":"2.0","id":"a","method":"Add","params":{"a":1}}` + "`" + `:       {-32602.0, "missing param b"},
+		` + "`" + `{"jsonrpc":"2.0","id":"a","method":"Add","params":{"a":"x","b":1}}` + "`" + `: {-32602.0, "validation error: parameter a must be a float64"},
+		` + "`" + `{"jsonrpc":"2.0","id":"a","method":"Mul","params":[1,2]}` + "`" + `:         {-32601.0, "Method not found"},
+		` + "`" + `{"jsonrpc":"1.0","id":"a","method":"Add","params":[1,2]}` + "`" + `:         {-32600.0, "jsonrpc must be \"2.0\""},
+		` + "`" + `{"jsonrpc":"2.0","id":"a","method":"Root","params":[-1]}` + "`" + `:         {-32000.0, "Negative"},
+	}
+	for request, want := range cases {
+		response := call(t, request)
+		object, _ := response["error"].(map[string]interface{})
+		if response["id"] != "a" || object["code"] != want[0] || object["message"] != want[1] {
+			t.Errorf("%s: got %v", request, response)
+		}
+	}
+	if response := call(t, ` + "`" + `{"jsonrpc":"2.0","id":"a","method":"Root","params":[-1]}` + "`" + `); response["error"].(map[string]interface{})["data"].(map[string]interface{})["code"] != "Negative" {
+		t.Errorf("the code of the thrown error is not in the data: %v", response)
+	}
+	if response := call(t, ` + "`" + `{"jsonrpc":"2.0","method":"Add","params":[1,2]}` + "`" + `); response["error"].(map[string]interface{})["code"] != -32600.0 {
+		t.Errorf("the notification got %v", response)
+	}
+}
+`
+	testStub(t, source, map[string]string{"root.go": implementation, "stub_test.go": test}, false)
+}
+
+// the method gets the deadline of the request in its context, and a request past its deadline is not served
+func TestRequestDeadline(t *testing.T) {
+	source := "service calculator {" + calculatorMethods + "    remaining(string label) -> (float64 millis);\n}\n"
+	implementation := `package stub
+
+import (
+	"context"
+	"time"
+)
+
+func Remaining(ctx context.Context, label string) (float64, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return -1, nil
+	}
+	return float64(time.Until(deadline).Milliseconds()), nil
+}
+`
+	test := `package stub
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRemaining(t *testing.T) {
+	deadline := time.Now().Add(time.Minute).UnixNano()
+	response := call(t, fmt.Sprintf(` + "`" + `{"method":"Remaining","params":{"label":"budget"},"deadline_unix_nano":%d}` + "`" + `, deadline))
+	if millis, _ := response["millis"].(float64); millis <= 50000 || millis > 60000 {
+		t.Fatalf("got %v", response)
+	}
+
+	response = call(t, ` + "`" + `{"method":"Remaining","params":{"label":"budget"}}` + "`" + `)
+	if response["millis"] != -1.0 {
+		t.Fatalf("got %v without a deadline", response)
+	}
+
+	expired := time.Now().Add(-time.Second).UnixNano()
+	response = call(t, fmt.Sprintf(` + "`" + `{"method":"Remaining","params":{"label":"budget"},"deadline_unix_nano":%d}` + "`" + `, expired))
+	if response["error"] != "Deadline exceeded" {
+		t.Fatalf("got %v past the deadline", response)
+	}
+}
+`
+	testStub(t, source, map[string]string{"remaining.go": implementation, "call_test.go": callTest, "stub_test.go": test}, false)
+}
+
+// the methods are dispatched through the registry, so a method can be registered at runtime
+// and a method of the idl unregistered and registered again
+func TestMethodRegistry(t *testing.T) {
+	test := `package stub
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	RegisterMethod("Mul", func(ctx context.Context, params map[string]interface{}) (map[string]interface{}, error) {
+		a, _ := toFloat64(params["a"])
+		b, _ := toFloat64(params["b"])
+		if b == 0 {
+			return nil, errors.New("b must not be zero")
+		}
+		return map[string]interface{}{"result": a * b}, nil
+	})
+	if response := call(t, "{\"method\":\"Mul\",\"params\":{\"a\":3,\"b\":4}}"); response["result"] != 12.0 {
+		t.Fatalf("got %v", response)
+	}
+	if response := call(t, "{\"method\":\"Mul\",\"params\":{\"a\":3,\"b\":0}}"); response["error"] != "b must not be zero" {
+		t.Fatalf("got %v", response)
+	}
+
+	// the params of a method registered at runtime are not declared, so they are given by name over JSON-RPC
+	response := call(t, "{\"jsonrpc\":\"2.0\",\"id\":1,\"method\":\"Mul\",\"params\":[3,4]}")
+	if object, _ := response["error"].(map[string]interface{}); object["code"] != -32602.0 || object["message"] != "the params of Mul must be given by name" {
+		t.Fatalf("got %v", response)
+	}
+
+	add := UnregisterMethod("Add")
+	if add == nil {
+		t.Fatal("Add is not registered")
+	}
+	if response := call(t, "{\"method\":\"Add\",\"params\":{\"a\":1,\"b\":2}}"); response["error"] != "Invalid RPC Call Method" {
+		t.Fatalf("the unregistered Add got %v", response)
+	}
+	response = call(t, "{\"jsonrpc\":\"2.0\",\"id\":1,\"method\":\"Add\",\"params\":[1,2]}")
+	if object, _ := response["error"].(map[string]interface{}); object["code"] != -32601.0 {
+		t.Fatalf("the unregistered Add got %v over JSON-RPC", response)
+	}
+	if UnregisterMethod("Add") != nil {
+		t.Fatal("Add is unregistered twice")
+	}
+
+	RegisterMethod("Add", add)
+	if response := call(t, "{\"method\":\"Add\",\"params\":{\"a\":1,\"b\":2}}"); response["result"] != 3.0 {
+		t.Fatalf("the registered Add got %v", response)
+	}
+}
+`
+	testStub(t, "service calculator {"+calculatorMethods+"}\n", map[string]string{"call_test.go": callTest, "stub_test.go": test}, false)
+}
+
+// the reserved __methods call lists the registered methods and the streams, for the load balancer to route by method
+func TestServedMethods(t *testing.T) {
+	source := "service calculator {" + calculatorMethods + "    stream feed(stream float64 x) -> (stream float64 y);\n}\n"
+	implementation := `package stub
+
+import "context"
+
+func Feed(ctx context.Context, in <-chan float64, out chan<- float64) error {
+	for x := range in {
+		out <- x
+	}
+	return nil
+}
+`
+	test := `package stub
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestServedMethods(t *testing.T) {
+	if methods := ServedMethods(); !reflect.DeepEqual(methods, []string{"Add", "Divide", "Feed", "Sub"}) {
+		t.Fatalf("got %v", methods)
+	}
+
+	sub := UnregisterMethod("Sub")
+	defer RegisterMethod("Sub", sub)
+	response := call(t, ` + "`" + `{"method":"__methods","params":{}}` + "`" + `)
+	if fmt.Sprint(response["methods"]) != "[Add Divide Feed]" {
+		t.Fatalf("got %v without Sub", response)
+	}
+}
+`
+	testStub(t, source, map[string]string{"feed.go": implementation, "call_test.go": callTest, "stub_test.go": test}, false)
+}
+
+// the params of a request with a checksum are verified against it, and the returns are sent with theirs
+func TestChecksum(t *testing.T) {
+	test := `package stub
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestChecksum(t *testing.T) {
+	params := map[string]interface{}{"a": json.Number("1"), "b": json.Number("2")}
+	response := call(t, fmt.Sprintf("{\"method\":\"Add\",\"params\":{\"a\":1,\"b\":2},\"checksum\":%q}", checksum(params)))
+	sum, _ := response["checksum"].(string)
+	delete(response, "checksum")
+	if response["result"] != 3.0 || sum != checksum(map[string]interface{}{"result": 3.0}) {
+		t.Fatalf("got %v with the checksum %q", response, sum)
+	}
+
+	// the params corrupted on the way do not match
+	response = call(t, fmt.Sprintf("{\"method\":\"Add\",\"params\":{\"a\":1,\"b\":3},\"checksum\":%q}", checksum(params)))
+	if response["error"] != "checksum mismatch" || response["code"] != "ChecksumMismatch" {
+		t.Fatalf("got %v", response)
+	}
+	if !errors.Is(&RPCError{Code: "ChecksumMismatch"}, ErrChecksumMismatch) {
+		t.Fatal("the code does not match ErrChecksumMismatch")
+	}
+
+	// the returns of a request without a checksum are sent without one
+	if response := call(t, "{\"method\":\"Add\",\"params\":{\"a\":1,\"b\":2}}"); response["checksum"] != nil {
+		t.Fatalf("got %v", response)
+	}
+}
+`
+	testStub(t, "service calculator {"+calculatorMethods+"}\n", map[string]string{"call_test.go": callTest, "stub_test.go": test}, false)
+}
+
+// with params structs the params of each method are decoded into its typed struct,
+// and a param of the wrong type is rejected like with the params map
+func TestParamsStructs(t *testing.T) {
+	test := callTest + `
+func TestAddParams(t *testing.T) {
+	params := AddParams{A: 1, B: 2}
+	if params.A+params.B != 3 {
+		t.Fatalf("got %+v", params)
+	}
+	if response := call(t, ` + "`" + `{"method":"Add","params":{"a":1,"b":2}}` + "`" + `); response["result"] != 3.0 {
+		t.Fatalf("got %v", response)
+	}
+	if response := call(t, ` + "`" + `{"method":"Add","params":{"a":"1","b":2}}` + "`" + `); response["error"] != "validation error: parameter a must be a float64" {
+		t.Fatalf("got %v", response)
+	}
+	if response := call(t, ` + "`" + `{"method":"Add","params":{"a":1}}` + "`" + `); response["error"] != "validation error: parameter b must be a float64" {
+		t.Fatalf("got %v", response)
+	}
+}
+`
+	testStub(t, "service calculator {"+calculatorMethods+"}\n", map[string]string{"stub_test.go": test}, false, true)
+}
+
+// a map return is sent as an object, an empty one if the method returns a nil map
+func TestMapReturn(t *testing.T) {
+	source := "service calculator {" + calculatorMethods + "    rates(string base) -> (map<string, float64> rates, string base);\n}\n"
+	implementation := `package stub
+
+import "context"
+
+func Rates(ctx context.Context, base string) (map[string]float64, string, error) {
+	if base != "usd" {
+		return nil, base, nil
+	}
+	return map[string]float64{"eur": 0.5, "gbp": 0.25}, base, nil
+}
+`
+	test := callTest + `
+func TestRates(t *testing.T) {
+	response := call(t, ` + "`" + `{"method":"Rates","params":{"base":"usd"}}` + "`" + `)
+	if rates, ok := response["rates"].(map[string]interface{}); !ok || len(rates) != 2 || rates["eur"] != 0.5 || rates["gbp"] != 0.25 || response["base"] != "usd" {
+		t.Fatalf("got %v", response)
+	}
+	response = call(t, ` + "`" + `{"method":"Rates","params":{"base":"chf"}}` + "`" + `)
+	if rates, ok := response["rates"].(map[string]interface{}); !ok || len(rates) != 0 {
+		t.Fatalf("got %v", response)
+	}
+}
+`
+	testStub(t, source, map[string]string{"rates.go": implementation, "stub_test.go": test}, false)
+}
+
+// the dispatch of a call is traced as a child of the span of the caller, whose trace context comes in the metadata
+func TestDispatchSpan(t *testing.T) {
+	test := `package stub
+
+import (
+	"testing"
+
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestDispatchSpan(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tracer = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+
+	const traceID, parentID = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	if response := call(t, "{\"method\":\"Add\",\"params\":{\"a\":1,\"b\":2},\"metadata\":{\"traceparent\":\"00-"+traceID+"-"+parentID+"-01\"}}"); response["result"] != 3.0 {
+		t.Fatalf("got %v", response)
+	}
+	call(t, "{\"method\":\"Divide\",\"params\":{\"a\":1,\"b\":0}}")
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans", len(spans))
+	}
+	add, divide := spans[0], spans[1]
+	if add.Name() != "Add" || add.SpanContext().TraceID().String() != traceID || add.Parent().SpanID().String() != parentID || add.Status().Code == codes.Error {
+		t.Fatalf("got the span %s of the trace %s with the parent %s and the status %v", add.Name(), add.SpanContext().TraceID(), add.Parent().SpanID(), add.Status())
+	}
+	// a call without a trace context starts a new trace, the error of the response is its status
+	if divide.Name() != "Divide" || divide.Parent().IsValid() || divide.Status().Code != codes.Error {
+		t.Fatalf("got the span %s with the parent %v and the status %v", divide.Name(), divide.Parent(), divide.Status())
+	}
+}
+`
+	testStub(t, "service calculator {"+calculatorMethods+"}\n", map[string]string{"call_test.go": callTest, "stub_test.go": test}, false)
+}
+
+// a heartbeat is encoded as a binary message with its fields at fixed offsets,
+// the addresses and capabilities of the first one as a JSON object at its end
+func TestBinaryHeartbeat(t *testing.T) {
+	test := `package stub
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+func TestAppendHeartbeat(t *testing.T) {
+	message := map[string]interface{}{"heartbeat": true, "ready": true, "load": 0.25, "ts": int64(1700000000000), "mac": "ab", "port": "8081", "capabilities": map[string]string{"gpu": "true"}}
+	buf, err := appendHeartbeat(nil, message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf[0] != heartbeatMagic || buf[1] != heartbeatMessage || int(binary.BigEndian.Uint16(buf[2:4])) != len(buf)-4 {
+		t.Fatalf("got the header % x", buf[:4])
+	}
+	body := buf[4:]
+	if body[0] != 1 || math.Float64frombits(binary.BigEndian.Uint64(body[1:9])) != 0.25 || binary.BigEndian.Uint64(body[9:17]) != 1700000000000 {
+		t.Fatalf("got the fixed fields % x", body[:17])
+	}
+	if rest := string(body[17:]); rest != "\x02ab\x048081"+` + "`" + `{"capabilities":{"gpu":"true"}}` + "`" + ` {
+		t.Fatalf("got %q after the fixed fields", rest)
+	}
+
+	// the buffer is reused, an unregister message has its own type and no extra object
+	buf, err = appendHeartbeat(buf[:0], map[string]interface{}{"unregister": true})
+	if err != nil || buf[1] != unregisterMessage || len(buf) != 4+17+2 {
+		t.Fatalf("got % x, %v", buf, err)
+	}
+
+	long := make([]byte, 256)
+	if _, err := appendHeartbeat(nil, map[string]interface{}{"port": string(long)}); err == nil {
+		t.Fatal("encoded a port longer than 255 bytes")
+	}
+}
+
+// the heartbeats are encoded into the reused buffer, only the map of the extra fields is allocated
+func TestAppendHeartbeatAllocations(t *testing.T) {
+	message := map[string]interface{}{"heartbeat": true, "ready": true, "load": 0.25}
+	buf := make([]byte, 0, 64)
+	allocations := testing.AllocsPerRun(100, func() {
+		buf, _ = appendHeartbeat(buf[:0], message)
+	})
+	if allocations > 1 {
+		t.Fatalf("got %v allocations per heartbeat", allocations)
+	}
+}
+`
+	testStub(t, "service calculator {"+calculatorMethods+"}\n", map[string]string{"stub_test.go": test}, false)
+}
+
+// once SetDraining is called the heartbeats ask the load balancer to stop routing new requests
+func TestDrainingHeartbeats(t *testing.T) {
+	test := `package stub
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSetDraining(t *testing.T) {
+	HeartbeatFormat = "json"
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	heartbeats := make(chan map[string]interface{}, 16)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		decoder := json.NewDecoder(conn)
+		for {
+			var heartbeat map[string]interface{}
+			if decoder.Decode(&heartbeat) != nil {
+				return
+			}
+			heartbeats <- heartbeat
+		}
+	}()
+
+	Ready()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go SendHeartbeats(ctx, make(chan struct{}, 1), ln.Addr().String(), "8081")
+	if heartbeat := <-heartbeats; heartbeat["draining"] != nil || Draining() {
+		t.Fatalf("got %v before SetDraining", heartbeat)
+	}
+
+	SetDraining()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case heartbeat := <-heartbeats:
+			if heartbeat["draining"] == true {
+				return
+			}
+		case <-timeout:
+			t.Fatal("no draining heartbeat after SetDraining")
+		}
+	}
+}
+
+func TestAppendDrainingHeartbeat(t *testing.T) {
+	buf, err := appendHeartbeat(nil, map[string]interface{}{"heartbeat": true, "ready": true, "draining": true})
+	if err != nil || buf[4] != 3 {
+		t.Fatalf("got the flags %#x, %v", buf[4], err)
+	}
+}
+`
+	testStub(t, "service calculator {"+calculatorMethods+"}\n", map[string]string{"stub_test.go": test}, false)
+}
+
+// validate exits with 1 for an idl which does not parse, e.g. with an unknown type
+func TestValidate(t *testing.T) {
+	dir := t.TempDir()
+	invalid := filepath.Join(dir, "paint.idl")
+	valid := filepath.Join(dir, "calculator.idl")
+	os.WriteFile(invalid, []byte("service paint {\n    paint(Colour color) -> (bool ok);\n}\n"), 0644)
+	os.WriteFile(valid, []byte("service calculator {\n    add(int32 a, int32 b) -> (int32 result);\n}\n"), 0644)
+	if code := validate(invalid); code != 1 {
+		t.Errorf("validate exited with %d for an unknown type", code)
+	}
+	if code := validate(valid); code != 0 {
+		t.Errorf("validate exited with %d for a valid idl", code)
+	}
+}
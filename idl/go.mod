@@ -0,0 +1,7 @@
+module github.com/denizydmr07/rpc-project/idl
+
+go 1.18
+
+require go.uber.org/zap v1.27.0
+
+require go.uber.org/multierr v1.10.0 // indirect
@@ -0,0 +1,292 @@
+// Package idl parses the idl file the stub generators generate the client and the server stubs from.
+// both generators use this parser, so an idl valid for one is valid for the other
+package idl
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Service represents a service
+// it contains the name of the service and the methods
+type Service struct {
+	Name    string
+	Doc     []string // lines of the comment block preceding the service, without the leading "//"
+	Methods []Method
+	Enums   []*Enum  // enum types declared in the idl file
+	Errors  []string // errors thrown by the methods, in the order of first declaration
+
+	Metadata []Metadata // metadata of the service, e.g. its version and owner, in the order of declaration
+
+	MapValues []Field // types of the values of the map returns, in the order of first declaration
+}
+
+// Metadata is a key/value declared inside the service block, e.g. version "2.1";
+// it is generated as a string constant named after its key, e.g. ServiceVersion
+type Metadata struct {
+	Key   string
+	Value string
+	Name  string   // name of the generated constant
+	Doc   []string // lines of the comment block preceding the metadata, without the leading "//"
+	Line  int      // line of the metadata in the idl file
+}
+
+// Enum represents an enum type declared in the idl file,
+// it is generated as an int type with a constant per value
+// and sent as the integer value of the constant
+type Enum struct {
+	Name   string
+	Values []string // names of the values in the order of declaration, numbered from zero
+	Line   int      // line of the enum in the idl file
+}
+
+// print the service
+func (s Service) String() string {
+	str := "Service: " + s.Name + ", "
+	for _, method := range s.Methods {
+		str += method.String()
+	}
+	return str
+}
+
+// Method represents a method
+// it contains the name, params and returns
+// params and returns are kept in the order of declaration in the idl file
+type Method struct {
+	Name      string
+	Doc       []string // lines of the comment block preceding the method, without the leading "//"
+	Params    []Field
+	Returns   []Field
+	Aliases   []string // deprecated names of the method, dispatched to the same implementation
+	Stream    bool     // both sides stream, the only param and the only return are sent as frames
+	Subscribe bool     // the server pushes the only return as frames until either side ends the subscription
+	Throws    []string // errors declared by the method, generated as Err<Name> sentinels
+	Line      int      // line of the method in the idl file
+
+	MaxConcurrency int // calls of the method the server runs at the same time, unlimited if zero
+}
+
+// Field represents a parameter or a return value of a method
+type Field struct {
+	Name       string
+	Type       string
+	Enum       *Enum // enum type of the field, nil if the type is not an enum
+	Chunked    bool  // the param is sent in chunks after the request instead of in its params
+	Optional   bool  // the return may be absent, declared as "string? value" and generated as a pointer which is nil if it is absent
+	Constraint       // constraint of a parameter, empty if it is not constrained
+}
+
+// Constraint restricts the values of a parameter
+// it is written after the parameter name in brackets:
+// "int age [0..150]" for a range of numbers, either bound may be omitted,
+// "string name [maxlen=64]" for the maximum length of a string
+type Constraint struct {
+	Min    string // minimum of a number, inclusive, empty if not bounded
+	Max    string // maximum of a number, inclusive, empty if not bounded
+	MaxLen int    // maximum number of characters of a string, zero if not bounded
+}
+
+// paramPattern matches a parameter with an optional constraint, e.g. "int age [0..150]"
+var paramPattern = regexp.MustCompile(`^\s*(\S+)\s+(\w+)\s*(?:\[([^\]]*)\])?\s*$`)
+
+// parseConstraint parses the constraint written in the brackets after a parameter
+func parseConstraint(text string) (Constraint, error) {
+	text = strings.TrimSpace(text)
+
+	// maximum length of a string
+	if strings.HasPrefix(text, "maxlen=") {
+		maxLen, err := strconv.Atoi(strings.TrimPrefix(text, "maxlen="))
+		if err != nil || maxLen <= 0 {
+			return Constraint{}, fmt.Errorf("invalid maxlen in constraint %q", text)
+		}
+		return Constraint{MaxLen: maxLen}, nil
+	}
+
+	// range of a number
+	bounds := strings.Split(text, "..")
+	if len(bounds) != 2 {
+		return Constraint{}, fmt.Errorf("invalid constraint %q, expected [min..max] or [maxlen=n]", text)
+	}
+	constraint := Constraint{Min: strings.TrimSpace(bounds[0]), Max: strings.TrimSpace(bounds[1])}
+	for _, bound := range []string{constraint.Min, constraint.Max} {
+		if _, err := strconv.ParseFloat(bound, 64); bound != "" && err != nil {
+			return Constraint{}, fmt.Errorf("invalid bound %q in constraint %q", bound, text)
+		}
+	}
+	return constraint, nil
+}
+
+// numberTypes maps the numeric types of the idl to the function of the stub converting a number
+// to the Go type of the same name. the numbers are decoded as json.Number so the 64-bit integers
+// keep their precision, the conversion fails if the number does not fit the type
+var numberTypes = map[string]string{
+	"float32": "toFloat32",
+	"float64": "toFloat64",
+	"int32":   "toInt32",
+	"int64":   "toInt64",
+	"uint32":  "toUint32",
+	"uint64":  "toUint64",
+}
+
+// builtinType reports whether the Go type is the one of a type of the idl other than an enum
+func builtinType(t string) bool {
+	_, number := numberTypes[t]
+	return number || t == "string" || t == "bool" || t == "[]byte" || strings.HasPrefix(t, "map[string]")
+}
+
+// goType returns the Go type of a type of the idl, bytes are sent as base64 strings and generated as []byte.
+// the other types have the same name in Go
+func goType(idlType string) string {
+	if idlType == "bytes" {
+		return "[]byte"
+	}
+	return idlType
+}
+
+// mapPattern matches a map type of the idl, e.g. "map<string, float64>"
+var mapPattern = regexp.MustCompile(`map\s*<\s*(\w+)\s*,\s*(\w+)\s*>`)
+
+// mapType returns the Go type of a map type of the idl, e.g. map[string]float64 for "map<string,float64>".
+// the keys must be strings like the keys of a JSON object, the values numbers, strings or bools
+func mapType(idlType string) (string, error) {
+	matches := mapPattern.FindStringSubmatch(idlType)
+	if matches == nil || matches[0] != idlType {
+		return "", fmt.Errorf("invalid map type %q", idlType)
+	}
+	if matches[1] != "string" {
+		return "", fmt.Errorf("the keys of %q must be strings", idlType)
+	}
+	if _, number := numberTypes[matches[2]]; !number && matches[2] != "string" && matches[2] != "bool" {
+		return "", fmt.Errorf("the values of %q must be numbers, strings or bools", idlType)
+	}
+	return "map[string]" + matches[2], nil
+}
+
+// splitList splits a list of params or returns on the commas outside of the angle brackets of the map types
+func splitList(list string) []string {
+	var items []string
+	depth, start := 0, 0
+	for i, r := range list {
+		switch r {
+		case '<':
+			depth++
+		case '>':
+			depth--
+		case ',':
+			if depth == 0 {
+				items = append(items, list[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(items, list[start:])
+}
+
+// MapValue returns the Go type of the values of a map field, empty if the field is not a map
+func (f Field) MapValue() string {
+	if !strings.HasPrefix(f.Type, "map[string]") {
+		return ""
+	}
+	return strings.TrimPrefix(f.Type, "map[string]")
+}
+
+// Converter returns the function of the stub converting a decoded value to the type of the field,
+// enums are converted from an int64, bytes from a base64 string and maps from an object. it is empty if the value is used as decoded,
+// e.g. for a string or a chunked param which is reassembled to a []byte
+func (f Field) Converter() string {
+	switch {
+	case f.Enum != nil:
+		return "toInt64"
+	case f.Type == "[]byte" && !f.Chunked:
+		return "toBytes"
+	case f.MapValue() != "":
+		return "toMap" + strings.Title(f.MapValue())
+	}
+	return numberTypes[f.Type]
+}
+
+// ReturnType returns the Go type the client stub returns the field as, a pointer if it is optional
+func (f Field) ReturnType() string {
+	if f.Optional {
+		return "*" + f.Type
+	}
+	return f.Type
+}
+
+// Zero returns the value of the field returned by a failed call
+func (f Field) Zero() string {
+	switch {
+	case f.Optional, f.Type == "[]byte", f.MapValue() != "":
+		return "nil"
+	case strings.HasPrefix(f.Type, "uint"):
+		return "0"
+	case f.Type == "string":
+		return `""`
+	case f.Type == "bool":
+		return "false"
+	}
+	return "-1"
+}
+
+// checkBounds checks the bounds of the range constraint of a param are constants of its type,
+// since the generated code compares the param to them
+func checkBounds(field Field) error {
+	for _, bound := range []string{field.Min, field.Max} {
+		if bound == "" {
+			continue
+		}
+		var err error
+		switch field.Type {
+		case "float32":
+			_, err = strconv.ParseFloat(bound, 32)
+		case "int32":
+			_, err = strconv.ParseInt(bound, 10, 32)
+		case "int64":
+			_, err = strconv.ParseInt(bound, 10, 64)
+		case "uint32":
+			_, err = strconv.ParseUint(bound, 10, 32)
+		case "uint64":
+			_, err = strconv.ParseUint(bound, 10, 64)
+		}
+		if err != nil {
+			return fmt.Errorf("bound %q is not a valid %s", bound, field.Type)
+		}
+	}
+	return nil
+}
+
+// ChunkedParam returns the param of the method uploaded in chunks, nil if it has none
+func (m Method) ChunkedParam() *Field {
+	for i := range m.Params {
+		if m.Params[i].Chunked {
+			return &m.Params[i]
+		}
+	}
+	return nil
+}
+
+// HasChunkedParam reports whether a param of the method is uploaded in chunks
+func (m Method) HasChunkedParam() bool {
+	for _, param := range m.Params {
+		if param.Chunked {
+			return true
+		}
+	}
+	return false
+}
+
+// print the method
+func (m Method) String() string {
+	str := "Method: " + m.Name + ", "
+	str += "Params: "
+	for _, param := range m.Params {
+		str += param.Name + " " + param.Type + ", "
+	}
+	str += "Returns: "
+	for _, ret := range m.Returns {
+		str += ret.Name + " " + ret.Type + ", "
+	}
+	return str
+}
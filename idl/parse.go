@@ -0,0 +1,487 @@
+package idl
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// aliasPattern matches a deprecated alias of a method, e.g. "deprecated add_numbers = add;"
+var aliasPattern = regexp.MustCompile(`^\s*deprecated\s+(\w+)\s*=\s*(\w+)\s*;`)
+
+// alias is a deprecated alias declared in the idl file
+type alias struct {
+	name   string // name of the alias
+	target string // name of the method the alias routes to
+	line   int    // line of the alias in the idl file
+}
+
+// enumPattern matches the start of an enum block, e.g. "enum Color { RED; GREEN;",
+// the values may continue on the following lines until the closing brace
+var enumPattern = regexp.MustCompile(`^\s*enum\s+(\w+)\s*\{([^}]*)(\})?`)
+
+// enumValuePattern matches the name of an enum value, which is generated as a Go constant
+var enumValuePattern = regexp.MustCompile(`^[A-Za-z_]\w*$`)
+
+// addEnumValues adds the values separated by semicolons to the enum
+// it returns an error if a value is not a valid name
+func addEnumValues(enum *Enum, values string, lineNumber int) error {
+	for _, value := range strings.Split(values, ";") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		if !enumValuePattern.MatchString(value) {
+			return fmt.Errorf("line %d: invalid value %q of enum %q", lineNumber, value, enum.Name)
+		}
+		enum.Values = append(enum.Values, value)
+	}
+	return nil
+}
+
+// streamPattern matches a bidirectional streaming method,
+// e.g. "stream feed(stream float64 x) -> (stream float64 y);"
+var streamPattern = regexp.MustCompile(`^\s*stream\s+(\w+)\(\s*stream\s+(\w+)\s+(\w+)\s*\)\s*->\s*\(\s*stream\s+(\w+)\s+(\w+)\s*\)\s*;`)
+
+// subscribePattern matches the keyword of a subscription preceding a method,
+// e.g. "subscribe watch(string topic) -> (stream string event);"
+var subscribePattern = regexp.MustCompile(`^\s*subscribe\s+`)
+
+// maxConcurrencyPattern matches the concurrency limit preceding a method, e.g. "maxconcurrency(4) heavy(...)"
+var maxConcurrencyPattern = regexp.MustCompile(`^\s*maxconcurrency\(\s*(\w*)\s*\)\s*`)
+
+// metadataPattern matches a metadata of the service, e.g. "version "2.1";" or "owner "math-team";"
+var metadataPattern = regexp.MustCompile(`^\s*(\w+)\s+"([^"\\]*)"\s*;\s*$`)
+
+// metadataName returns the name of the constant generated for a metadata key, e.g. ServiceBuildDate for build_date
+func metadataName(key string) string {
+	name := "Service"
+	for _, part := range strings.Split(key, "_") {
+		if part != "" {
+			name += methodName(part)
+		}
+	}
+	return name
+}
+
+// methodPattern matches a method, e.g. "add(int a, int b) -> (int result);"
+// or with errors, e.g. "divide(int a, int b) -> (int result) throws DivByZero;"
+var methodPattern = regexp.MustCompile(`(\w+)\(([^)]*)\)\s*->\s*\(([^)]*)\)(?:\s*throws\s+([\w\s,]+))?;`)
+
+// reservedNames are the names a parameter can not have since it is declared as a Go variable in the generated
+// methods: the Go keywords, the predeclared types and values, and the names the client methods use themselves
+var reservedNames = map[string]bool{
+	"break": true, "case": true, "chan": true, "const": true, "continue": true, "default": true, "defer": true,
+	"else": true, "fallthrough": true, "for": true, "func": true, "go": true, "goto": true, "if": true, "import": true,
+	"interface": true, "map": true, "package": true, "range": true, "return": true, "select": true, "struct": true,
+	"switch": true, "type": true, "var": true,
+
+	"bool": true, "byte": true, "error": true, "float32": true, "float64": true, "int32": true, "int64": true,
+	"string": true, "uint32": true, "uint64": true, "nil": true, "true": true, "false": true,
+
+	"client_": true, "mock_": true, "err": true, "params": true, "chunked": true, "response": true, "results": true, "ok": true,
+	"conn": true, "events": true, "subscription": true, "errors": true, "json": true,
+}
+
+// methodName returns the name of the generated function of a method or an alias
+func methodName(name string) string {
+	// if method name starts with lowercase, make it uppercase
+	if name[0] >= 'a' && name[0] <= 'z' {
+		return strings.Title(name)
+	}
+	return name
+}
+
+// Parse parses the service from the idl file
+// it returns an error if a line is not a valid declaration, a method or a parameter of a method is declared twice
+// or an alias does not refer to a declared method
+func Parse(r io.Reader, logger *zap.Logger) (*Service, error) {
+	service := &Service{}
+
+	// line of the first declaration of each method name
+	methodLines := make(map[string]int)
+
+	// aliases are attached to their methods once all methods are parsed
+	var aliases []alias
+
+	// enum whose values are being read, nil outside of an enum block
+	var enum *Enum
+
+	// comment block read since the last declaration, it documents the next service or method
+	var doc []string
+
+	// read the idf file line by line, the scanner drops the \r of CRLF line endings
+	scanner := bufio.NewScanner(r)
+	logger.Debug("starting to scan the file")
+
+	// parse the idf file
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+
+		line := scanner.Text()
+
+		// a file saved with a UTF-8 byte order mark, e.g. on Windows, starts with it
+		if lineNumber == 1 {
+			line = strings.TrimPrefix(line, "\uFEFF")
+		}
+
+		// a comment block right before a service or a method documents it,
+		// comments inside an enum block are skipped
+		if trimmed := strings.TrimSpace(line); strings.HasPrefix(trimmed, "//") {
+			if enum == nil {
+				doc = append(doc, strings.TrimPrefix(trimmed, "//"))
+			}
+			continue
+		}
+		lineDoc := doc
+		doc = nil
+
+		// inside an enum block, read the values until the closing brace
+		if enum != nil {
+			values := line
+			closed := strings.Contains(line, "}")
+			if closed {
+				values = line[:strings.Index(line, "}")]
+			}
+			if err := addEnumValues(enum, values, lineNumber); err != nil {
+				return nil, err
+			}
+			if closed {
+				enum = nil
+			}
+			continue
+		}
+
+		// a method may limit the calls the server runs at the same time
+		maxConcurrency := 0
+		if matches := maxConcurrencyPattern.FindStringSubmatch(line); matches != nil {
+			n, err := strconv.Atoi(matches[1])
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("line %d: invalid maxconcurrency %q, must be a positive number", lineNumber, matches[1])
+			}
+			line = line[len(matches[0]):]
+			if !strings.Contains(line, "->") {
+				return nil, fmt.Errorf("line %d: maxconcurrency must precede a method", lineNumber)
+			}
+			maxConcurrency = n
+		}
+
+		// a subscription keeps the connection open while the server pushes its events
+		subscribe := false
+		if matches := subscribePattern.FindStringSubmatch(line); matches != nil {
+			line = line[len(matches[0]):]
+			if !strings.Contains(line, "->") {
+				return nil, fmt.Errorf("line %d: subscribe must precede a method", lineNumber)
+			}
+			subscribe = true
+		}
+
+		// metadata of the service, declared inside its block
+		if matches := metadataPattern.FindStringSubmatch(line); matches != nil {
+			logger.Debug("Metadata found", zap.String("line", line))
+
+			if service.Name == "" {
+				return nil, fmt.Errorf("line %d: metadata %q must be declared inside the service", lineNumber, matches[1])
+			}
+			metadata := Metadata{Key: matches[1], Value: matches[2], Name: metadataName(matches[1]), Doc: lineDoc, Line: lineNumber}
+			// keys are compared by their constants, e.g. build_date and buildDate generate the same one
+			for _, declared := range service.Metadata {
+				if declared.Name == metadata.Name {
+					return nil, fmt.Errorf("line %d: metadata %q is already declared at line %d", lineNumber, matches[1], declared.Line)
+				}
+			}
+			service.Metadata = append(service.Metadata, metadata)
+			continue
+		}
+
+		// if the line declares an enum, read its values
+		if matches := enumPattern.FindStringSubmatch(line); matches != nil {
+			logger.Debug("Enum found", zap.String("line", line))
+
+			for _, declared := range service.Enums {
+				if declared.Name == matches[1] {
+					return nil, fmt.Errorf("line %d: enum %q is already declared at line %d", lineNumber, matches[1], declared.Line)
+				}
+			}
+			enum = &Enum{Name: matches[1], Line: lineNumber}
+			service.Enums = append(service.Enums, enum)
+			if err := addEnumValues(enum, matches[2], lineNumber); err != nil {
+				return nil, err
+			}
+			if matches[3] != "" {
+				enum = nil
+			}
+			continue
+		}
+
+		// if the line contains KEYWORD service, get the service name
+		if strings.Contains(line, "service") {
+			logger.Debug("Service found", zap.String("line", line))
+
+			fields := strings.Fields(line)
+			if len(fields) < 2 || strings.HasPrefix(fields[1], "{") {
+				return nil, fmt.Errorf("line %d: service has no name", lineNumber)
+			}
+			service.Name = fields[1]
+			service.Doc = lineDoc
+		} else if matches := aliasPattern.FindStringSubmatch(line); matches != nil { // if the line declares an alias
+			logger.Debug("Alias found", zap.String("line", line))
+
+			aliases = append(aliases, alias{name: matches[1], target: matches[2], line: lineNumber})
+		} else if matches := streamPattern.FindStringSubmatch(line); matches != nil { // if the line declares a streaming method
+			logger.Debug("Stream method found", zap.String("line", line))
+
+			method := Method{
+				Name:    methodName(matches[1]),
+				Params:  []Field{{Name: matches[3], Type: goType(matches[2])}},
+				Returns: []Field{{Name: matches[5], Type: goType(matches[4])}},
+				Doc:     lineDoc,
+				Stream:  true,
+				Line:    lineNumber,
+
+				MaxConcurrency: maxConcurrency,
+			}
+			if first, ok := methodLines[method.Name]; ok {
+				return nil, fmt.Errorf("line %d: method %q is already declared at line %d", lineNumber, matches[1], first)
+			}
+			methodLines[method.Name] = lineNumber
+
+			service.Methods = append(service.Methods, method)
+		} else if strings.Contains(line, "->") { // if the line contains method, get the method details
+			logger.Debug("Method found", zap.String("line", line))
+
+			method := Method{Doc: lineDoc, Line: lineNumber, Subscribe: subscribe, MaxConcurrency: maxConcurrency}
+
+			matches := methodPattern.FindStringSubmatch(line)
+			if matches == nil {
+				return nil, fmt.Errorf("line %d: invalid method %q, expected e.g. add(int32 a, int32 b) -> (int32 result);", lineNumber, strings.TrimSpace(line))
+			}
+			method.Name = methodName(matches[1])
+
+			// methods are compared after capitalization since they generate the same function
+			if first, ok := methodLines[method.Name]; ok {
+				return nil, fmt.Errorf("line %d: method %q is already declared at line %d", lineNumber, matches[1], first)
+			}
+			methodLines[method.Name] = lineNumber
+
+			// params are in the form of "int a, int b, ...", a method may have none, e.g. "ping() -> (bool ok);"
+			var params []string
+			if strings.TrimSpace(matches[2]) != "" {
+				params = splitList(mapPattern.ReplaceAllString(matches[2], "map<$1,$2>"))
+			}
+			for _, param := range params {
+				// a chunked param is uploaded in chunks after the request, e.g. "chunked bytes data"
+				chunked := false
+				if trimmed := strings.TrimSpace(param); strings.HasPrefix(trimmed, "chunked ") {
+					chunked = true
+					param = strings.TrimPrefix(trimmed, "chunked ")
+				}
+
+				paramParts := paramPattern.FindStringSubmatch(param)
+				if paramParts == nil {
+					return nil, fmt.Errorf("line %d: invalid parameter %q of method %q", lineNumber, strings.TrimSpace(param), matches[1])
+				}
+				for _, declared := range method.Params {
+					if declared.Name == paramParts[2] {
+						return nil, fmt.Errorf("line %d: parameter %q of method %q is declared twice", lineNumber, paramParts[2], matches[1])
+					}
+				}
+				if reservedNames[paramParts[2]] {
+					return nil, fmt.Errorf("line %d: parameter %q of method %q is a reserved name", lineNumber, paramParts[2], matches[1])
+				}
+				if strings.HasSuffix(paramParts[1], "?") {
+					return nil, fmt.Errorf("line %d: parameter %q of method %q can not be optional, only returns can", lineNumber, paramParts[2], matches[1])
+				}
+				if strings.HasPrefix(paramParts[1], "map<") {
+					return nil, fmt.Errorf("line %d: parameter %q of method %q can not be a map, only returns can", lineNumber, paramParts[2], matches[1])
+				}
+				field := Field{Name: paramParts[2], Type: paramParts[1]}
+
+				// constraint of the parameter if any
+				if paramParts[3] != "" {
+					constraint, err := parseConstraint(paramParts[3])
+					if err != nil {
+						return nil, fmt.Errorf("line %d: parameter %q of method %q: %v", lineNumber, paramParts[2], matches[1], err)
+					}
+					field.Constraint = constraint
+					if err := checkBounds(field); err != nil {
+						return nil, fmt.Errorf("line %d: parameter %q of method %q: %v", lineNumber, paramParts[2], matches[1], err)
+					}
+				}
+
+				// only bytes are sent in chunks, reassembled to a []byte
+				if chunked && field.Type != "bytes" {
+					return nil, fmt.Errorf("line %d: chunked parameter %q of method %q must be of type bytes", lineNumber, paramParts[2], matches[1])
+				}
+				if chunked && subscribe {
+					return nil, fmt.Errorf("line %d: subscription %q can not have a chunked parameter", lineNumber, matches[1])
+				}
+				if chunked {
+					for _, declared := range method.Params {
+						if declared.Chunked {
+							return nil, fmt.Errorf("line %d: method %q has more than one chunked parameter", lineNumber, matches[1])
+						}
+					}
+					field.Chunked = true
+				}
+				field.Type = goType(field.Type)
+				method.Params = append(method.Params, field)
+			}
+
+			// returns are in the form of "int result, ...", an optional return has a "?" after its type.
+			// the spaces are removed from the map types so each is one word, e.g. "map<string,float64> rates"
+			returns := splitList(mapPattern.ReplaceAllString(matches[3], "map<$1,$2>"))
+
+			// a subscription returns a single stream of events, e.g. "stream string event"
+			if subscribe {
+				var event []string
+				if len(returns) == 1 {
+					event = strings.Fields(returns[0])
+				}
+				if len(event) != 3 || event[0] != "stream" {
+					return nil, fmt.Errorf("line %d: subscription %q must return a single stream, e.g. (stream string event)", lineNumber, matches[1])
+				}
+				if strings.HasSuffix(event[1], "?") || strings.HasPrefix(event[1], "map<") {
+					return nil, fmt.Errorf("line %d: the events of subscription %q can not be optional or a map", lineNumber, matches[1])
+				}
+				returns[0] = event[1] + " " + event[2]
+			}
+			for _, ret := range returns {
+				retParts := strings.Fields(ret)
+				if len(retParts) != 2 {
+					return nil, fmt.Errorf("line %d: invalid return %q of method %q", lineNumber, strings.TrimSpace(ret), matches[1])
+				}
+				for _, declared := range method.Returns {
+					if declared.Name == retParts[1] {
+						return nil, fmt.Errorf("line %d: return %q of method %q is declared twice", lineNumber, retParts[1], matches[1])
+					}
+				}
+				optional := strings.HasSuffix(retParts[0], "?")
+				field := Field{Name: retParts[1], Type: goType(strings.TrimSuffix(retParts[0], "?")), Optional: optional}
+				if strings.HasPrefix(field.Type, "map<") {
+					// an absent map is sent as an empty one
+					if optional {
+						return nil, fmt.Errorf("line %d: return %q of method %q can not be optional since it is a map", lineNumber, retParts[1], matches[1])
+					}
+					var err error
+					if field.Type, err = mapType(field.Type); err != nil {
+						return nil, fmt.Errorf("line %d: return %q of method %q: %v", lineNumber, retParts[1], matches[1], err)
+					}
+				}
+				method.Returns = append(method.Returns, field)
+			}
+
+			// errors are in the form of "DivByZero, ..."
+			if matches[4] != "" {
+				for _, name := range strings.Split(matches[4], ",") {
+					name = strings.TrimSpace(name)
+					if name == "" {
+						return nil, fmt.Errorf("line %d: invalid error list of method %q", lineNumber, matches[1])
+					}
+					method.Throws = append(method.Throws, methodName(name))
+				}
+			}
+
+			service.Methods = append(service.Methods, method)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if enum != nil {
+		return nil, fmt.Errorf("line %d: enum %q is not closed", enum.Line, enum.Name)
+	}
+
+	// an idl without a service or its methods, e.g. only comments, would generate a stub serving nothing
+	if service.Name == "" {
+		return nil, fmt.Errorf("no service is declared")
+	}
+	if len(service.Methods) == 0 {
+		return nil, fmt.Errorf("service %q declares no methods", service.Name)
+	}
+
+	// errors shared by the methods are generated once
+	thrown := make(map[string]bool)
+	for _, method := range service.Methods {
+		for _, name := range method.Throws {
+			if !thrown[name] {
+				thrown[name] = true
+				service.Errors = append(service.Errors, name)
+			}
+		}
+	}
+
+	// the maps with the same type of values share their converter
+	mapValues := make(map[string]bool)
+	for _, method := range service.Methods {
+		for _, ret := range method.Returns {
+			if value := ret.MapValue(); value != "" && !mapValues[value] {
+				mapValues[value] = true
+				service.MapValues = append(service.MapValues, Field{Type: value})
+			}
+		}
+	}
+
+	// resolve the enum types of the params and the returns,
+	// the values are generated as constants of the package so they must be unique
+	enums := make(map[string]*Enum)
+	valueLines := make(map[string]int)
+	for _, enum := range service.Enums {
+		if len(enum.Values) == 0 {
+			return nil, fmt.Errorf("line %d: enum %q has no values", enum.Line, enum.Name)
+		}
+		for _, value := range enum.Values {
+			if first, ok := valueLines[value]; ok {
+				return nil, fmt.Errorf("line %d: enum value %q is already declared at line %d", enum.Line, value, first)
+			}
+			valueLines[value] = enum.Line
+		}
+		enums[enum.Name] = enum
+	}
+	for i := range service.Methods {
+		method := &service.Methods[i]
+		for j := range method.Params {
+			method.Params[j].Enum = enums[method.Params[j].Type]
+		}
+		for j := range method.Returns {
+			method.Returns[j].Enum = enums[method.Returns[j].Type]
+		}
+
+		// any other type would only fail when the stubs are compiled
+		for _, field := range append(append([]Field(nil), method.Params...), method.Returns...) {
+			if field.Enum == nil && !builtinType(field.Type) {
+				return nil, fmt.Errorf("line %d: unknown type %q of %q in method %q", method.Line, field.Type, field.Name, method.Name)
+			}
+		}
+	}
+
+	// attach the aliases to their methods
+	for _, alias := range aliases {
+		name := methodName(alias.name)
+		if first, ok := methodLines[name]; ok {
+			return nil, fmt.Errorf("line %d: alias %q is already declared at line %d", alias.line, alias.name, first)
+		}
+		methodLines[name] = alias.line
+
+		found := false
+		for i := range service.Methods {
+			if service.Methods[i].Name == methodName(alias.target) {
+				service.Methods[i].Aliases = append(service.Methods[i].Aliases, name)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("line %d: alias %q refers to undeclared method %q", alias.line, alias.name, alias.target)
+		}
+	}
+
+	return service, nil
+}
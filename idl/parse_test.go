@@ -0,0 +1,417 @@
+package idl
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func parse(idl string) (*Service, error) {
+	return Parse(strings.NewReader(idl), zap.NewNop())
+}
+
+// calculatorMethods are the methods of the calculator, for the idls which only need some methods
+const calculatorMethods = `
+    add(float64 a, float64 b) -> (float64 result);
+    sub(float64 a, float64 b) -> (float64 result);
+    divide(float64 a, float64 b) -> (float64 result) throws DivByZero;
+`
+
+func TestParseCalculator(t *testing.T) {
+	file, err := os.Open("calculator.idl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	service, err := Parse(file, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if service.Name != "calculator" || len(service.Methods) != 3 {
+		t.Fatalf("got %s", service)
+	}
+	divide := service.Methods[2]
+	if divide.Name != "Divide" || len(divide.Params) != 2 || len(divide.Throws) != 1 || divide.Throws[0] != "DivByZero" {
+		t.Fatalf("got %s throws %v", divide, divide.Throws)
+	}
+}
+
+func TestParseMethodWithoutParams(t *testing.T) {
+	service, err := parse("service health {\n    ping() -> (bool ok);\n}\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ping := service.Methods[0]
+	if ping.Name != "Ping" || len(ping.Params) != 0 || len(ping.Returns) != 1 || ping.Returns[0].Name != "ok" {
+		t.Fatalf("got %s", ping)
+	}
+}
+
+// lines which do not match the declaration they look like are errors with their line number, not panics
+func TestParseInvalidMethod(t *testing.T) {
+	cases := map[string]string{
+		"add(int32 a, int32 b) -> (int32 result)":  `line 2: invalid method "add(int32 a, int32 b) -> (int32 result)"`,
+		"add(int32 a, int32 b) -> ();":             `line 2: invalid return "" of method "add"`,
+		"add(int32 a, int32 b) -> (int32);":        `line 2: invalid return "int32" of method "add"`,
+		"add(int32 a, int32 b) -> (int32 r s);":    `line 2: invalid return "int32 r s" of method "add"`,
+		"add(int32 a, ) -> (int32 result);":        `line 2: invalid parameter "" of method "add"`,
+		"add(int32 err, int32 b) -> (int32 sum);":  `line 2: parameter "err" of method "add" is a reserved name`,
+		"add(int32 a, int32 a) -> (int32 result);": `line 2: parameter "a" of method "add" is declared twice`,
+	}
+	for method, want := range cases {
+		_, err := parse("service calculator {\n    " + method + "\n}\n")
+		if err == nil || !strings.HasPrefix(err.Error(), want) {
+			t.Errorf("%s: got %v, want %s", method, err, want)
+		}
+	}
+}
+
+func TestReservedParameterName(t *testing.T) {
+	for _, name := range []string{"err", "params", "response", "results", "client_", "mock_", "type", "string"} {
+		_, err := parse("service calculator {\n    add(int32 " + name + ", int32 b) -> (int32 result);\n}\n")
+		if err == nil || !strings.Contains(err.Error(), "line 2: parameter \""+name+"\" of method \"add\" is a reserved name") {
+			t.Errorf("%s: got %v", name, err)
+		}
+	}
+	// the receivers of the generated methods are named so they do not collide with the usual short names
+	if _, err := parse("service calculator {\n    add(int32 c, int32 m) -> (int32 result);\n}\n"); err != nil {
+		t.Error(err)
+	}
+}
+
+// a method, a parameter or a return declared twice fails naming both lines, rather than generating duplicate functions
+func TestParseDuplicates(t *testing.T) {
+	cases := map[string]string{
+		"add(int32 a, int32 b) -> (int32 result);\n    sub(int32 a, int32 b) -> (int32 result);\n    add(int32 x, int32 y) -> (int32 sum);": `line 4: method "add" is already declared at line 2`,
+		"add(int32 a, int32 b) -> (int32 result);\n    Add(int32 a, int32 b) -> (int32 result);":                                            `line 3: method "Add" is already declared at line 2`,
+		"add(int32 a, int32 b, int32 a) -> (int32 result);":                                                                                 `line 2: parameter "a" of method "add" is declared twice`,
+		"divmod(int32 a, int32 b) -> (int32 q, int32 q);":                                                                                   `line 2: return "q" of method "divmod" is declared twice`,
+	}
+	for methods, want := range cases {
+		_, err := parse("service calculator {\n    " + methods + "\n}\n")
+		if err == nil || err.Error() != want {
+			t.Errorf("%q: got %v, want %s", methods, err, want)
+		}
+	}
+}
+
+// params and returns are kept in the order they are declared, not sorted by name
+func TestParseKeepsDeclarationOrder(t *testing.T) {
+	service, err := parse("service calculator {\n    pow(int32 z, int32 a, int32 m) -> (int32 result);\n}\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	method := service.Methods[0]
+	want := []Field{{Name: "z", Type: "int32"}, {Name: "a", Type: "int32"}, {Name: "m", Type: "int32"}}
+	if !reflect.DeepEqual(method.Params, want) {
+		t.Fatalf("got params %v, want %v", method.Params, want)
+	}
+	if len(method.Returns) != 1 || method.Returns[0] != (Field{Name: "result", Type: "int32"}) {
+		t.Fatalf("got returns %v", method.Returns)
+	}
+}
+
+func TestParseConstraints(t *testing.T) {
+	service, err := parse("service people {\n    setAge(int32 age [0..150], float64 score [..1.5], string name [maxlen=64], string note) -> (bool ok);\n}\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := service.Methods[0].Params
+	want := []Constraint{{Min: "0", Max: "150"}, {Max: "1.5"}, {MaxLen: 64}, {}}
+	for i, param := range params {
+		if param.Constraint != want[i] {
+			t.Errorf("%s: got %+v, want %+v", param.Name, param.Constraint, want[i])
+		}
+	}
+
+	cases := map[string]string{
+		"int32 age [0-150]":       `invalid constraint "0-150", expected [min..max] or [maxlen=n]`,
+		"int32 age [0..old]":      `invalid bound "old" in constraint "0..old"`,
+		"string name [maxlen=0]":  `invalid maxlen in constraint "maxlen=0"`,
+		"string name [maxlen=xl]": `invalid maxlen in constraint "maxlen=xl"`,
+	}
+	for param, want := range cases {
+		_, err := parse("service people {\n    setAge(" + param + ") -> (bool ok);\n}\n")
+		if err == nil || !strings.HasPrefix(err.Error(), "line 2: parameter") || !strings.HasSuffix(err.Error(), want) {
+			t.Errorf("%s: got %v, want %s", param, err, want)
+		}
+	}
+}
+
+// aliases are attached to the method they refer to, in declaration order, even when declared before it
+func TestParseAliases(t *testing.T) {
+	service, err := parse("service calculator {\n    deprecated add_numbers = add;\n    add(int32 a, int32 b) -> (int32 result);\n    deprecated plus = add;\n    sub(int32 a, int32 b) -> (int32 result);\n}\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	add, sub := service.Methods[0], service.Methods[1]
+	if len(service.Methods) != 2 || !reflect.DeepEqual(add.Aliases, []string{"Add_numbers", "Plus"}) || len(sub.Aliases) != 0 {
+		t.Fatalf("got aliases %v of add, %v of sub", add.Aliases, sub.Aliases)
+	}
+
+	cases := map[string]string{
+		"deprecated plus = mul;":                             `line 4: alias "plus" refers to undeclared method "mul"`,
+		"deprecated add = add;":                              `line 4: alias "add" is already declared at line 2`,
+		"deprecated plus = add;\n    deprecated plus = sub;": `line 5: alias "plus" is already declared at line 4`,
+	}
+	for alias, want := range cases {
+		_, err := parse("service calculator {\n    add(int32 a, int32 b) -> (int32 result);\n    sub(int32 a, int32 b) -> (int32 result);\n    " + alias + "\n}\n")
+		if err == nil || err.Error() != want {
+			t.Errorf("%q: got %v, want %s", alias, err, want)
+		}
+	}
+}
+
+// enum values may span lines, and params and returns of an enum type are resolved to it
+func TestParseEnums(t *testing.T) {
+	service, err := parse("service palette {\n    enum Color { RED; GREEN;\n        BLUE; }\n    enum Shade { LIGHT; DARK; }\n    mix(Color a, Color b, int32 weight) -> (Color result);\n}\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(service.Enums) != 2 || !reflect.DeepEqual(service.Enums[0].Values, []string{"RED", "GREEN", "BLUE"}) || !reflect.DeepEqual(service.Enums[1].Values, []string{"LIGHT", "DARK"}) {
+		t.Fatalf("got enums %+v", service.Enums)
+	}
+	method := service.Methods[0]
+	if method.Params[0].Enum != service.Enums[0] || method.Params[2].Enum != nil || method.Returns[0].Enum != service.Enums[0] {
+		t.Fatalf("got params %+v, returns %+v", method.Params, method.Returns)
+	}
+
+	cases := map[string]string{
+		"enum Color { RED; GREEN; }\n    enum Color { BLUE; }": `line 4: enum "Color" is already declared at line 3`,
+		"enum Color { RED; GREEN; }\n    enum Shade { RED; }":  `line 4: enum value "RED" is already declared at line 3`,
+		"enum Color { }":                   `line 3: enum "Color" has no values`,
+		"enum Color { RED; LIGHT GREEN; }": `line 3: invalid value "LIGHT GREEN" of enum "Color"`,
+		"enum Color { RED; 2GREEN; }":      `line 3: invalid value "2GREEN" of enum "Color"`,
+		"enum Color { RED; GREEN-ISH; }":   `line 3: invalid value "GREEN-ISH" of enum "Color"`,
+		"enum Color { RED;":                `line 3: enum "Color" is not closed`,
+	}
+	for enums, want := range cases {
+		_, err := parse("service palette {\n    paint(int32 color) -> (bool ok);\n    " + enums + "\n")
+		if err == nil || err.Error() != want {
+			t.Errorf("%q: got %v, want %s", enums, err, want)
+		}
+	}
+}
+
+// a streaming method has its only param and its only return streamed
+func TestParseStream(t *testing.T) {
+	service, err := parse("service sensors {\n    stream feed(stream float64 x) -> (stream float64 y);\n    add(float64 a, float64 b) -> (float64 result);\n}\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	feed, add := service.Methods[0], service.Methods[1]
+	if !feed.Stream || feed.Name != "Feed" || !reflect.DeepEqual(feed.Params, []Field{{Name: "x", Type: "float64"}}) || !reflect.DeepEqual(feed.Returns, []Field{{Name: "y", Type: "float64"}}) {
+		t.Fatalf("got %+v", feed)
+	}
+	if add.Stream {
+		t.Fatalf("got %+v", add)
+	}
+
+	_, err = parse("service sensors {\n    feed(float64 x) -> (float64 y);\n    stream feed(stream float64 x) -> (stream float64 y);\n}\n")
+	if err == nil || err.Error() != `line 3: method "feed" is already declared at line 2` {
+		t.Fatalf("got %v", err)
+	}
+}
+
+// a subscription has its only return streamed, which is a single stream of events which are not optional or a map
+func TestParseSubscribe(t *testing.T) {
+	service, err := parse("service ticker {\n    subscribe ticks(int32 count) -> (stream int32 n);\n    add(float64 a, float64 b) -> (float64 result);\n}\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ticks, add := service.Methods[0], service.Methods[1]
+	if !ticks.Subscribe || ticks.Stream || ticks.Name != "Ticks" || len(ticks.Params) != 1 || ticks.Params[0].Name != "count" || len(ticks.Returns) != 1 || ticks.Returns[0].Name != "n" || ticks.Returns[0].Type != "int32" {
+		t.Fatalf("got %+v", ticks)
+	}
+	if add.Subscribe {
+		t.Fatalf("got %+v", add)
+	}
+
+	cases := map[string]string{
+		"subscribe ticks(int32 count) -> (int32 n);":                        `line 2: subscription "ticks" must return a single stream, e.g. (stream string event)`,
+		"subscribe ticks(int32 count) -> (stream int32 n, stream int32 m);": `line 2: subscription "ticks" must return a single stream, e.g. (stream string event)`,
+		"subscribe ticks(int32 count) -> (stream int32? n);":                `line 2: the events of subscription "ticks" can not be optional or a map`,
+		"subscribe upload(chunked bytes data) -> (stream int32 n);":         `line 2: subscription "upload" can not have a chunked parameter`,
+		"subscribe enum color { red, green }":                               "line 2: subscribe must precede a method",
+	}
+	for line, want := range cases {
+		if _, err := parse("service ticker {\n    " + line + "\n}\n"); err == nil || err.Error() != want {
+			t.Errorf("%s: got %v, want %s", line, err, want)
+		}
+	}
+}
+
+// the metadata of the service is declared inside its block and named after its key
+func TestParseMetadata(t *testing.T) {
+	service, err := parse("service calculator {\n    // release of the service\n    version \"2.1\";\n    build_date \"2024-05-01\";\n" + calculatorMethods + "}\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Metadata{
+		{Key: "version", Value: "2.1", Name: "ServiceVersion", Doc: []string{" release of the service"}, Line: 3},
+		{Key: "build_date", Value: "2024-05-01", Name: "ServiceBuildDate", Line: 4},
+	}
+	if !reflect.DeepEqual(service.Metadata, want) || len(service.Methods) != 3 {
+		t.Fatalf("got %+v with %d methods", service.Metadata, len(service.Methods))
+	}
+
+	cases := map[string]string{
+		"version \"2.1\";\nservice calculator {\n" + calculatorMethods + "}\n":                            `line 1: metadata "version" must be declared inside the service`,
+		"service calculator {\n    build_date \"a\";\n    buildDate \"b\";\n" + calculatorMethods + "}\n": `line 3: metadata "buildDate" is already declared at line 2`,
+	}
+	for source, want := range cases {
+		if _, err := parse(source); err == nil || err.Error() != want {
+			t.Errorf("got %v, want %s", err, want)
+		}
+	}
+}
+
+// the errors thrown by the methods are collected once for the service, in the order of first declaration
+func TestParseThrows(t *testing.T) {
+	service, err := parse("service calculator {\n    divide(float64 a, float64 b) -> (float64 result) throws DivByZero;\n    root(float64 x) -> (float64 result) throws negative, DivByZero;\n    add(float64 a, float64 b) -> (float64 result);\n}\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(service.Methods[1].Throws, []string{"Negative", "DivByZero"}) || service.Methods[2].Throws != nil {
+		t.Fatalf("got throws %v of root, %v of add", service.Methods[1].Throws, service.Methods[2].Throws)
+	}
+	if !reflect.DeepEqual(service.Errors, []string{"DivByZero", "Negative"}) {
+		t.Fatalf("got errors %v", service.Errors)
+	}
+
+	_, err = parse("service calculator {\n    divide(float64 a, float64 b) -> (float64 result) throws DivByZero,;\n}\n")
+	if err == nil || err.Error() != `line 2: invalid error list of method "divide"` {
+		t.Fatalf("got %v", err)
+	}
+}
+
+// a comment block right before the service or a method documents it, a blank line detaches it
+func TestParseDoc(t *testing.T) {
+	service, err := parse(`// calculator does arithmetic
+// on float64 numbers
+service calculator {
+    // Add returns the sum
+    add(float64 a, float64 b) -> (float64 result);
+    // detached by the blank line
+
+    sub(float64 a, float64 b) -> (float64 result);
+    enum Color {
+        // not a doc comment
+        RED;
+    }
+    //Divide fails if b is zero
+    //
+    //   indented
+    divide(float64 a, float64 b) -> (float64 result) throws DivByZero;
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(service.Doc, "|") != " calculator does arithmetic| on float64 numbers" {
+		t.Errorf("doc of the service: %q", service.Doc)
+	}
+	docs := map[string][]string{
+		"Add":    {" Add returns the sum"},
+		"Sub":    nil,
+		"Divide": {"Divide fails if b is zero", "", "   indented"},
+	}
+	for _, method := range service.Methods {
+		if strings.Join(method.Doc, "|") != strings.Join(docs[method.Name], "|") || len(method.Doc) != len(docs[method.Name]) {
+			t.Errorf("doc of %s: %q, want %q", method.Name, method.Doc, docs[method.Name])
+		}
+	}
+}
+
+// maxconcurrency precedes a method with a positive limit
+func TestParseMaxConcurrency(t *testing.T) {
+	service, err := parse("service calculator {\n    maxconcurrency(4) add(float64 a, float64 b) -> (float64 result);\n    maxconcurrency( 1 ) stream feed(stream float64 x) -> (stream float64 y);\n    sub(float64 a, float64 b) -> (float64 result);\n}\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limits := []int{service.Methods[0].MaxConcurrency, service.Methods[1].MaxConcurrency, service.Methods[2].MaxConcurrency}; !reflect.DeepEqual(limits, []int{4, 1, 0}) {
+		t.Fatalf("got limits %v", limits)
+	}
+
+	cases := map[string]string{
+		"maxconcurrency(0) add(float64 a, float64 b) -> (float64 result);": `line 2: invalid maxconcurrency "0", must be a positive number`,
+		"maxconcurrency(x) add(float64 a, float64 b) -> (float64 result);": `line 2: invalid maxconcurrency "x", must be a positive number`,
+		"maxconcurrency(2) enum Color { RED; }":                            `line 2: maxconcurrency must precede a method`,
+	}
+	for line, want := range cases {
+		_, err := parse("service calculator {\n    " + line + "\n}\n")
+		if err == nil || err.Error() != want {
+			t.Errorf("%q: got %v, want %s", line, err, want)
+		}
+	}
+}
+
+// a file saved with a UTF-8 byte order mark and CRLF line endings parses like a plain one
+func TestParseByteOrderMark(t *testing.T) {
+	source := "\uFEFFservice calculator {\r\n    // Add returns a plus b\r\n    add(float64 a, float64 b) -> (float64 result);\r\n}\r\n"
+	service, err := parse(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if service.Name != "calculator" || len(service.Methods) != 1 || service.Methods[0].Name != "Add" {
+		t.Fatalf("got %s", service)
+	}
+	if doc := service.Methods[0].Doc; len(doc) != 1 || doc[0] != " Add returns a plus b" {
+		t.Fatalf("got the doc %q", doc)
+	}
+}
+
+// a type which is neither a builtin nor an enum is rejected
+func TestParseUnknownType(t *testing.T) {
+	source := "service paint {\n    paint(Colour color) -> (bool ok);\n}\n"
+	_, err := parse(source)
+	if err == nil || err.Error() != `line 2: unknown type "Colour" of "color" in method "Paint"` {
+		t.Fatalf("got %v", err)
+	}
+
+}
+
+// an idl without a service, a service name or methods is rejected rather than generating an empty stub
+func TestParseEmpty(t *testing.T) {
+	cases := map[string]string{
+		"":                    "no service is declared",
+		"// only a comment\n": "no service is declared",
+		"service {\n    add(int32 a, int32 b) -> (int32 result);\n}\n": "line 1: service has no name",
+		"service\n":                 "line 1: service has no name",
+		"service calculator {\n}\n": `service "calculator" declares no methods`,
+	}
+	for source, want := range cases {
+		_, err := parse(source)
+		if err == nil || err.Error() != want {
+			t.Errorf("%q: got %v, want %s", source, err, want)
+		}
+	}
+}
+
+// a map is only a return, declared with string keys and values which are numbers, strings or bools
+func TestParseMap(t *testing.T) {
+	cases := map[string]string{
+		"rates(string base) -> (map<int32, float64> rates);":    `line 2: return "rates" of method "rates": the keys of "map<int32,float64>" must be strings`,
+		"rates(string base) -> (map<string, bytes> rates);":     `line 2: return "rates" of method "rates": the values of "map<string,bytes>" must be numbers, strings or bools`,
+		"rates(string base) -> (map<string, float64>? rates);":  `line 2: return "rates" of method "rates" can not be optional since it is a map`,
+		"convert(map<string, float64> rates) -> (float64 sum);": `line 2: parameter "rates" of method "convert" can not be a map, only returns can`,
+	}
+	for method, want := range cases {
+		_, err := parse("service exchange {\n    " + method + "\n}\n")
+		if err == nil || err.Error() != want {
+			t.Errorf("%q: got %v, want %s", method, err, want)
+		}
+	}
+}
+
+// only a return can be optional
+func TestParseOptional(t *testing.T) {
+	_, err := parse("service directory {\n    lookup(string? name) -> (string email);\n}\n")
+	if err == nil || err.Error() != `line 2: parameter "name" of method "lookup" can not be optional, only returns can` {
+		t.Fatalf("got %v", err)
+	}
+}
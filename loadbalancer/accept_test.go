@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// temporaryError is a temporary accept error, e.g. EMFILE on fd exhaustion
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Temporary() bool { return true }
+func (temporaryError) Timeout() bool   { return false }
+
+// failingListener fails the accepts with the errors before accepting on the listener
+type failingListener struct {
+	net.Listener
+	errs chan error
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	select {
+	case err := <-l.errs:
+		return nil, err
+	default:
+		return l.Listener.Accept()
+	}
+}
+
+func TestAcceptBackoff(t *testing.T) {
+	backoff := &acceptBackoff{max: 15 * time.Millisecond}
+	for _, want := range []time.Duration{5 * time.Millisecond, 10 * time.Millisecond, 15 * time.Millisecond, 15 * time.Millisecond} {
+		start := time.Now()
+		if !backoff.retry(temporaryError{}) {
+			t.Fatal("temporary error not retried")
+		}
+		if backoff.delay != want || time.Since(start) < want {
+			t.Fatalf("got delay %v after %v, want %v", backoff.delay, time.Since(start), want)
+		}
+	}
+	backoff.reset()
+	if backoff.delay != 0 {
+		t.Fatal("delay not reset")
+	}
+	if backoff.retry(errors.New("permanent")) {
+		t.Fatal("permanent error retried")
+	}
+}
+
+// the accept loop keeps serving after repeated temporary errors and stops on a permanent one
+func TestServeHeartbeatsRetriesTemporaryErrors(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	failing := &failingListener{Listener: ln, errs: make(chan error, 8)}
+	for i := 0; i < 5; i++ {
+		failing.errs <- temporaryError{}
+	}
+
+	lb := NewLoadBalancer(time.Second)
+	lb.AcceptBackoffMax = 10 * time.Millisecond
+	served := make(chan error)
+	go func() { served <- lb.serveHeartbeats(failing) }()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	json.NewEncoder(conn).Encode(map[string]interface{}{"heartbeat": true, "ready": true, "port": "8081"})
+	waitFor(t, "the registration after the accept errors", func() bool {
+		lb.Mutex.Lock()
+		defer lb.Mutex.Unlock()
+		return len(lb.ServerKeys) == 1
+	})
+
+	// the loop is blocked in Accept, the permanent error is returned by the next one
+	permanent := errors.New("listener broken")
+	failing.errs <- permanent
+	if conn, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+		defer conn.Close()
+	}
+	select {
+	case err := <-served:
+		if err != permanent {
+			t.Fatalf("got %v, want the permanent error", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the accept loop did not stop on a permanent error")
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// the admin listener serves the endpoints meant for the operators only, over plain HTTP,
+// so it should be bound to a private address, e.g. 127.0.0.1:6060. it serves:
+//   - GET /snapshot, the state of the servers as returned by Snapshot
+//   - POST /drain?server=<serving address>, drains the server as SetDraining, "&draining=false" routes requests to it again
+//   - /debug/pprof/, the profiles of net/http/pprof if they are enabled
+//
+// every endpoint needs the admin token as "Authorization: Bearer <token>" if AdminToken is set,
+// /drain changes the routing so it is only served with a token.
+// the profiles are opt-in, they expose the internals of the process and a CPU profile or a trace costs while it runs.
+// importing net/http/pprof also registers them on http.DefaultServeMux, which is never served
+
+// StartAdmin serves the admin endpoints on address until the load balancer is stopped,
+// the profiles of net/http/pprof are served under /debug/pprof/ if profiles is set
+func (lb *LoadBalancer) StartAdmin(address string, profiles bool) error {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	lb.Mutex.Lock()
+	lb.listeners = append(lb.listeners, ln)
+	lb.Mutex.Unlock()
+
+	// no write timeout, a CPU profile or a trace is written once it is recorded, e.g. after 30 seconds
+	server := &http.Server{
+		Handler:           lb.adminHandler(profiles),
+		ReadHeaderTimeout: lb.ReadTimeout,
+		IdleTimeout:       lb.IdleTimeout,
+	}
+	lb.Mutex.Lock()
+	lb.httpServers = append(lb.httpServers, server)
+	lb.Mutex.Unlock()
+
+	go func() {
+		if err := server.Serve(ln); err != nil && !errors.Is(err, net.ErrClosed) && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("Error in Serve, stopped the admin listener", zap.Error(err))
+		}
+	}()
+
+	logger.Info("Admin listener started", zap.String("address", address), zap.Bool("pprof", profiles), zap.Bool("authenticated", len(lb.AdminToken) > 0))
+	return nil
+}
+
+// adminHandler returns the handler of the admin endpoints, checking the admin token before any of them
+func (lb *LoadBalancer) adminHandler(profiles bool) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/snapshot", lb.handleSnapshot)
+	if len(lb.AdminToken) > 0 {
+		mux.HandleFunc("/drain", lb.handleDrain)
+	}
+	if profiles {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !lb.adminAuthorized(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "invalid admin token", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// adminAuthorized returns true if the request has the admin token or no token is set
+func (lb *LoadBalancer) adminAuthorized(r *http.Request) bool {
+	if len(lb.AdminToken) == 0 {
+		return true
+	}
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(header, "Bearer ")), lb.AdminToken) == 1
+}
+
+// handleSnapshot sends the snapshot of the servers as JSON
+func (lb *LoadBalancer) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lb.Snapshot())
+}
+
+// handleDrain drains the server given by its serving address, or routes requests to it again with draining=false
+func (lb *LoadBalancer) handleDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	address := query.Get("server")
+	if address == "" {
+		http.Error(w, "the server to drain must be given as ?server=<serving address>", http.StatusBadRequest)
+		return
+	}
+	draining := true
+	if value := query.Get("draining"); value != "" {
+		var err error
+		if draining, err = strconv.ParseBool(value); err != nil {
+			http.Error(w, "invalid boolean draining "+strconv.Quote(value), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := lb.SetDraining(address, draining); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	logger.Info("Drain set from the admin listener", zap.String("address", address), zap.Bool("draining", draining), zap.String("remote", r.RemoteAddr))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func adminRequest(t *testing.T, handler http.Handler, method string, target string, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, target, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestAdminSnapshot(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	registerTestServer(lb, "10.0.0.1:8081").Capabilities = map[string]string{"gpu": "true"}
+	registerTestServer(lb, "10.0.0.2:8081")
+
+	w := adminRequest(t, lb.adminHandler(false), http.MethodGet, "/snapshot", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	var snapshot []ServerSnapshot
+	if err := json.Unmarshal(w.Body.Bytes(), &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshot) != 2 || snapshot[0].ServingAddress != "10.0.0.1:8081" || snapshot[0].Capabilities["gpu"] != "true" || !snapshot[1].Healthy {
+		t.Fatalf("got %+v", snapshot)
+	}
+
+	// the profiles are opt-in and there is no /drain without a token
+	for _, path := range []string{"/debug/pprof/", "/drain?server=10.0.0.1:8081"} {
+		if w := adminRequest(t, lb.adminHandler(false), http.MethodPost, path, ""); w.Code != http.StatusNotFound {
+			t.Errorf("%s: got status %d", path, w.Code)
+		}
+	}
+	if w := adminRequest(t, lb.adminHandler(true), http.MethodGet, "/debug/pprof/", ""); w.Code != http.StatusOK {
+		t.Errorf("/debug/pprof/ with profiles: got status %d", w.Code)
+	}
+}
+
+func TestAdminToken(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	lb.AdminToken = []byte("t0ken")
+	handler := lb.adminHandler(true)
+
+	for _, path := range []string{"/snapshot", "/debug/pprof/"} {
+		for _, token := range []string{"", "wrong"} {
+			w := adminRequest(t, handler, http.MethodGet, path, token)
+			if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("%s with token %q: got status %d", path, token, w.Code)
+			}
+		}
+		if w := adminRequest(t, handler, http.MethodGet, path, "t0ken"); w.Code != http.StatusOK {
+			t.Errorf("%s: got status %d", path, w.Code)
+		}
+	}
+}
+
+func TestAdminDrain(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	lb.AdminToken = []byte("t0ken")
+	handler := lb.adminHandler(false)
+	drained := registerTestServer(lb, "10.0.0.1:8081")
+	other := registerTestServer(lb, "10.0.0.2:8081")
+
+	if w := adminRequest(t, handler, http.MethodPost, "/drain?server=10.0.0.1:8081", ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("drain without the token: got status %d", w.Code)
+	}
+	if drained.draining() {
+		t.Fatal("drained without the token")
+	}
+
+	cases := []struct {
+		method string
+		target string
+		status int
+	}{
+		{http.MethodGet, "/drain?server=10.0.0.1:8081", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/drain", http.StatusBadRequest},
+		{http.MethodPost, "/drain?server=10.0.0.1:8081&draining=maybe", http.StatusBadRequest},
+		{http.MethodPost, "/drain?server=10.0.0.9:8081", http.StatusNotFound},
+	}
+	for _, c := range cases {
+		if w := adminRequest(t, handler, c.method, c.target, "t0ken"); w.Code != c.status {
+			t.Errorf("%s %s: got status %d, want %d", c.method, c.target, w.Code, c.status)
+		}
+	}
+
+	if w := adminRequest(t, handler, http.MethodPost, "/drain?server=10.0.0.1:8081", "t0ken"); w.Code != http.StatusNoContent {
+		t.Fatalf("drain: got status %d: %s", w.Code, w.Body)
+	}
+	if !drained.draining() || other.draining() {
+		t.Fatal("the server is not drained")
+	}
+	for i := 0; i < 4; i++ {
+		if server := lb.getServer(nil, nil); server != other {
+			t.Fatalf("request routed to %v while draining", server.ServingAddress)
+		}
+	}
+
+	if w := adminRequest(t, handler, http.MethodPost, "/drain?server=10.0.0.1:8081&draining=false", "t0ken"); w.Code != http.StatusNoContent {
+		t.Fatalf("undrain: got status %d", w.Code)
+	}
+	if drained.draining() {
+		t.Fatal("the server is still draining")
+	}
+}
+
+func TestStartAdmin(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	defer lb.Stop()
+	if err := lb.StartAdmin("127.0.0.1:0", false); err != nil {
+		t.Fatal(err)
+	}
+	lb.Mutex.Lock()
+	address := lb.listeners[len(lb.listeners)-1].Addr().String()
+	lb.Mutex.Unlock()
+
+	response, err := http.Get("http://" + address + "/snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d", response.StatusCode)
+	}
+}
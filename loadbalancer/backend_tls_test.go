@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+// startTLSBackend serves a fake server over tls answering each request with {"result":3}
+func startTLSBackend(t *testing.T, certificate tls.Certificate) string {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{certificate}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				var request map[string]interface{}
+				if err := json.NewDecoder(conn).Decode(&request); err != nil {
+					return
+				}
+				conn.Write([]byte(`{"result":3}` + "\n"))
+			}(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestBackendTLS(t *testing.T) {
+	certificate, roots := newTestCertificate(t)
+	backend := startTLSBackend(t, certificate)
+	request := `{"method":"Add","params":{"a":1,"b":2}}`
+
+	lb := NewLoadBalancer(time.Second)
+	lb.BackendTLS = &tls.Config{RootCAs: roots}
+	registerTestServer(lb, backend)
+	if response := relayTestRequest(t, lb, request); response["result"] != 3.0 {
+		t.Fatalf("got %v", response)
+	}
+
+	// a server whose certificate is not signed by the CA is not relayed to
+	untrusted := NewLoadBalancer(time.Second)
+	untrusted.BackendTLS = &tls.Config{RootCAs: x509.NewCertPool()}
+	registerTestServer(untrusted, backend)
+	if response := relayTestRequest(t, untrusted, request); response["error"] == nil {
+		t.Fatalf("relayed to an untrusted server: %v", response)
+	}
+
+	// plain tcp to a tls server fails
+	plain := NewLoadBalancer(time.Second)
+	registerTestServer(plain, backend)
+	if response := relayTestRequest(t, plain, request); response["error"] == nil {
+		t.Fatalf("relayed over plain tcp: %v", response)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// Canary routes a fraction of the requests to the canary servers, the ones advertising the tag
+// as a capability, e.g. canary=true, and the other requests only to the stable servers,
+// so a new version is validated with a limited blast radius
+type Canary struct {
+	Fraction float64 // fraction of the requests routed to the canary servers, from 0 to 1
+	Key      string  // capability tagging the canary servers
+	Value    string  // value of the capability tagging the canary servers
+}
+
+// canaryBuckets is the resolution of the fraction of the requests hashed to the canary servers
+const canaryBuckets = 10000
+
+// isCanary reports whether the server is a canary server.
+// the caller must hold the mutex of the LoadBalancer, which locks the capabilities
+func (c *Canary) isCanary(server *ServerInfo) bool {
+	value, ok := server.Capabilities[c.Key]
+	return ok && value == c.Value
+}
+
+// toCanary reports whether the request is routed to the canary servers. the request id is hashed
+// so the retries of a request are routed alike, a request without an id is routed randomly
+func (c *Canary) toCanary(request map[string]interface{}) bool {
+	id := requestID(request)
+	if id == "" {
+		return rand.Float64() < c.Fraction
+	}
+	return xxhash.Sum64String(id)%canaryBuckets < uint64(c.Fraction*canaryBuckets)
+}
+
+// requestID returns the id of the request: the "request-id" of its metadata,
+// or else its idempotency key or its JSON-RPC 2.0 id. it is empty if the request has none
+func requestID(request map[string]interface{}) string {
+	metadata, _ := request["metadata"].(map[string]interface{})
+	if id, _ := metadata["request-id"].(string); id != "" {
+		return id
+	}
+	if key := idempotencyKey(request); key != "" {
+		return key
+	}
+	if id, ok := request["id"]; ok && id != nil {
+		return fmt.Sprint(id)
+	}
+	return ""
+}
+
+// filter returns the keys of the servers the request may be routed to, the canary servers or
+// the stable ones. a request to the canary servers falls back to the stable ones if there is no
+// canary server, but a request to the stable servers is never routed to a canary server.
+// the caller must hold the mutex of the LoadBalancer
+func (c *Canary) filter(request map[string]interface{}, servers map[string]*ServerInfo, keys []string) []string {
+	var canary, stable []string
+	for _, key := range keys {
+		if c.isCanary(servers[key]) {
+			canary = append(canary, key)
+		} else {
+			stable = append(stable, key)
+		}
+	}
+	if len(canary) > 0 && c.toCanary(request) {
+		return canary
+	}
+	return stable
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+// registerCanary registers a stable and a canary server, tagged canary=true
+func registerCanary(lb *LoadBalancer) (stable, canary *ServerInfo) {
+	stable = registerTestServer(lb, "10.0.0.1:8081")
+	canary = registerTestServer(lb, "10.0.0.2:8081")
+	canary.Capabilities = map[string]string{"canary": "true"}
+	return stable, canary
+}
+
+// the fraction of the requests is routed to the canary server, a request id always to the same server
+func TestCanaryFraction(t *testing.T) {
+	lb := NewLoadBalancer(time.Minute)
+	lb.Canary = &Canary{Fraction: 0.2, Key: "canary", Value: "true"}
+	_, canary := registerCanary(lb)
+
+	const requests = 5000
+	canaries := 0
+	for i := 0; i < requests; i++ {
+		request := map[string]interface{}{"method": "Add", "metadata": map[string]interface{}{"request-id": fmt.Sprint("request-", i)}}
+		server := lb.getServer(request, nil)
+		if server == canary {
+			canaries++
+		}
+		for retry := 0; retry < 3; retry++ {
+			if again := lb.getServer(request, nil); again != server {
+				t.Fatalf("request %d is routed to %s then to %s", i, server.ServingAddress, again.ServingAddress)
+			}
+		}
+	}
+	if fraction := float64(canaries) / requests; math.Abs(fraction-0.2) > 0.03 {
+		t.Fatalf("%.3f of the requests are routed to the canary server, want 0.2", fraction)
+	}
+}
+
+// the requests to the canary servers fall back to the stable ones without a canary server,
+// but the stable requests are never routed to a canary server
+func TestCanaryFallback(t *testing.T) {
+	lb := NewLoadBalancer(time.Minute)
+	lb.Canary = &Canary{Fraction: 1, Key: "version", Value: "2"}
+	stable := registerTestServer(lb, "10.0.0.1:8081")
+	for i := 0; i < 10; i++ {
+		if server := lb.getServer(map[string]interface{}{"method": "Add"}, nil); server != stable {
+			t.Fatalf("got %v without a canary server", server)
+		}
+	}
+
+	lb.Canary.Fraction = 0
+	canary := registerTestServer(lb, "10.0.0.2:8081")
+	canary.Capabilities = map[string]string{"version": "2"}
+	for i := 0; i < 10; i++ {
+		if server := lb.getServer(map[string]interface{}{"method": "Add", "id": i}, nil); server != stable {
+			t.Fatalf("a stable request is routed to %s", server.ServingAddress)
+		}
+	}
+
+	// without a stable server the stable requests are not routed at all
+	lb.Mutex.Lock()
+	lb.removeServer(stable.HeartbeatAddress)
+	lb.Mutex.Unlock()
+	if server := lb.getServer(map[string]interface{}{"method": "Add"}, nil); server != nil {
+		t.Fatalf("a stable request is routed to %s", server.ServingAddress)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	cases := []struct {
+		request map[string]interface{}
+		want    string
+	}{
+		{map[string]interface{}{"method": "Add", "id": 7.0, "metadata": map[string]interface{}{"request-id": "r1", "idempotency-key": "k1"}}, "r1"},
+		{map[string]interface{}{"method": "Add", "id": 7.0, "metadata": map[string]interface{}{"idempotency-key": "k1"}}, "Add\x00k1\x0074234e98afe7498fb5daf1f36ac2d78acc339464f950703b8c019892f982b90b"},
+		{map[string]interface{}{"method": "Add", "id": 7.0}, "7"},
+		{map[string]interface{}{"method": "Add", "id": nil}, ""},
+		{map[string]interface{}{"method": "Add"}, ""},
+	}
+	for _, c := range cases {
+		if got := requestID(c.request); got != c.want {
+			t.Errorf("requestID(%v) = %q, want %q", c.request, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net"
+
+	"go.uber.org/zap"
+)
+
+// a client may negotiate the compression of its connection once, with a first message
+// {"compression": ["gzip"]} listing the compressions it supports instead of a request.
+// the load balancer answers {"compression": "gzip"} if its policy allows one of them, or
+// {"compression": "none"}, then the bytes following the answer are compressed in both directions
+
+// compressionGzip is the only compression supported
+const compressionGzip = "gzip"
+
+// compressionOffer returns the compressions the client supports if the message negotiates the compression
+// of the connection, false if it is a request
+func compressionOffer(rawRequest json.RawMessage) ([]interface{}, bool) {
+	message, err := inspectRequest(rawRequest)
+	if err != nil {
+		return nil, false
+	}
+	if _, ok := message["method"]; ok {
+		return nil, false
+	}
+	offer, ok := message["compression"].([]interface{})
+	return offer, ok
+}
+
+// negotiateCompression answers the offer of the client with the compression picked by the policy,
+// and returns the connection compressed with it. decoder is the decoder of the connection so far,
+// the bytes it read after the offer are the first compressed ones
+func (lb *LoadBalancer) negotiateCompression(conn net.Conn, decoder *json.Decoder, offer []interface{}) (net.Conn, error) {
+	picked := "none"
+	for _, compression := range offer {
+		if compression == compressionGzip && lb.Compression == compressionGzip {
+			picked = compressionGzip
+		}
+	}
+	if err := json.NewEncoder(conn).Encode(map[string]interface{}{"compression": picked}); err != nil {
+		return nil, err
+	}
+	logger.Debug("Compression negotiated", zap.String("address", conn.RemoteAddr().String()), zap.String("compression", picked))
+	if picked != compressionGzip {
+		return conn, nil
+	}
+
+	// the newline after the offer is not part of the compressed bytes
+	buffered, err := io.ReadAll(decoder.Buffered())
+	if err != nil {
+		return nil, err
+	}
+	return newCompressedConn(conn, bytes.NewReader(bytes.TrimLeft(buffered, " \t\r\n"))), nil
+}
+
+// compressedConn is a connection compressed with gzip in both directions,
+// every write is flushed so a message is not held back in the compressor
+type compressedConn struct {
+	net.Conn
+	source io.Reader    // compressed bytes, the ones already read from the connection first
+	reader *gzip.Reader // reads the header of the peer, so it is created on the first read
+	writer *gzip.Writer
+}
+
+// newCompressedConn returns the connection compressed with gzip, buffered holds the compressed bytes
+// already read from it
+func newCompressedConn(conn net.Conn, buffered io.Reader) *compressedConn {
+	return &compressedConn{
+		Conn:   conn,
+		source: io.MultiReader(buffered, conn),
+		writer: gzip.NewWriter(conn),
+	}
+}
+
+func (c *compressedConn) Read(p []byte) (int, error) {
+	if c.reader == nil {
+		reader, err := gzip.NewReader(c.source)
+		if err != nil {
+			return 0, err
+		}
+		c.reader = reader
+	}
+	return c.reader.Read(p)
+}
+
+func (c *compressedConn) Write(p []byte) (int, error) {
+	if _, err := c.writer.Write(p); err != nil {
+		return 0, err
+	}
+	return len(p), c.writer.Flush()
+}
+
+// Close ends the compressed bytes before closing the connection, so the peer reads them to the end
+func (c *compressedConn) Close() error {
+	c.writer.Close()
+	return c.Conn.Close()
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countingConn counts the bytes read from the connection, as they are on the wire
+type countingConn struct {
+	net.Conn
+	read int
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read += n
+	return n, err
+}
+
+// negotiateTestCompression opens a client connection handled by the load balancer and offers the compressions
+// it returns the connection and the compression answered by the load balancer
+func negotiateTestCompression(t *testing.T, lb *LoadBalancer, offer ...string) (*countingConn, *json.Decoder, string) {
+	t.Helper()
+	client, lbSide := net.Pipe()
+	go lb.handleRequest(lbSide)
+	t.Cleanup(func() { client.Close() })
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn := &countingConn{Conn: client}
+	if err := json.NewEncoder(conn).Encode(map[string]interface{}{"compression": offer}); err != nil {
+		t.Fatal(err)
+	}
+	decoder := json.NewDecoder(conn)
+	var answer map[string]interface{}
+	if err := decoder.Decode(&answer); err != nil {
+		t.Fatal(err)
+	}
+	compression, _ := answer["compression"].(string)
+	return conn, decoder, compression
+}
+
+// the request and the response are compressed on the wire after the negotiation, and the response
+// is read to the end of the compressed bytes once the load balancer closes the connection
+func TestCompressionRoundTrip(t *testing.T) {
+	result := strings.Repeat("compressible ", 1000)
+	lb := NewLoadBalancer(time.Second)
+	lb.Compression = compressionGzip
+	backend, requests := startBackend(t, `{"result":"`+result+`"}`)
+	registerTestServer(lb, backend)
+
+	conn, decoder, compression := negotiateTestCompression(t, lb, "br", compressionGzip)
+	if compression != compressionGzip {
+		t.Fatalf("compression %q negotiated, want gzip", compression)
+	}
+
+	// the bytes the load balancer read after the answer are the first compressed ones
+	writer := gzip.NewWriter(conn)
+	param := strings.Repeat("a", 10000)
+	if err := json.NewEncoder(writer).Encode(map[string]interface{}{"method": "Echo", "params": map[string]interface{}{"s": param}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case request := <-requests:
+		if request["params"].(map[string]interface{})["s"] != param {
+			t.Fatal("the server got a different param")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the request is not relayed")
+	}
+
+	// the newline after the answer is not part of the compressed bytes
+	buffered, _ := io.ReadAll(decoder.Buffered())
+	reader, err := gzip.NewReader(io.MultiReader(bytes.NewReader(bytes.TrimLeft(buffered, "\n")), conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := conn.read
+	plain, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("the compressed response does not end: %v", err)
+	}
+	var response map[string]interface{}
+	if err := json.Unmarshal(plain, &response); err != nil || response["result"] != result {
+		t.Fatalf("got %s, %v", plain, err)
+	}
+	if wire := conn.read - before; wire >= len(plain)/10 {
+		t.Fatalf("%d bytes on the wire for a response of %d bytes", wire, len(plain))
+	}
+}
+
+// the first request after the negotiation is read within the read timeout, not the idle timeout,
+// so it is relayed with keep-alive disabled
+func TestCompressionWithoutKeepAlive(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	lb.Compression = compressionGzip
+	lb.IdleTimeout = 0
+	backend, requests := startBackend(t, `{"result":3}`)
+	registerTestServer(lb, backend)
+
+	conn, decoder, compression := negotiateTestCompression(t, lb, compressionGzip)
+	if compression != compressionGzip {
+		t.Fatalf("compression %q negotiated, want gzip", compression)
+	}
+	writer := gzip.NewWriter(conn)
+	if err := json.NewEncoder(writer).Encode(map[string]interface{}{"method": "Add", "params": map[string]interface{}{"a": 1, "b": 2}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-requests:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the request is not relayed")
+	}
+	buffered, _ := io.ReadAll(decoder.Buffered())
+	reader, err := gzip.NewReader(io.MultiReader(bytes.NewReader(bytes.TrimLeft(buffered, "\n")), conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response map[string]interface{}
+	if err := json.NewDecoder(reader).Decode(&response); err != nil || response["result"] != 3.0 {
+		t.Fatalf("got %v, %v", response, err)
+	}
+}
+
+// a load balancer not allowing compression answers none and the connection stays plain
+func TestCompressionNone(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	backend, _ := startBackend(t, `{"result":3}`)
+	registerTestServer(lb, backend)
+
+	conn, decoder, compression := negotiateTestCompression(t, lb, compressionGzip)
+	if compression != "none" {
+		t.Fatalf("compression %q negotiated, want none", compression)
+	}
+	if err := json.NewEncoder(conn).Encode(map[string]interface{}{"method": "Add", "params": map[string]interface{}{"a": 1, "b": 2}}); err != nil {
+		t.Fatal(err)
+	}
+	var response map[string]interface{}
+	if err := decoder.Decode(&response); err != nil || response["result"] != 3.0 {
+		t.Fatalf("got %v, %v", response, err)
+	}
+	if rest, _ := io.ReadAll(io.MultiReader(decoder.Buffered(), conn)); len(bytes.TrimSpace(rest)) != 0 {
+		t.Fatalf("unexpected bytes after the response: %q", rest)
+	}
+}
+
+// a client sending its first request right after the offer, before the answer, gets it relayed
+// when the connection stays plain
+func TestCompressionNonePipelined(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	backend, _ := startBackend(t, `{"result":3}`)
+	registerTestServer(lb, backend)
+
+	client := serveClient(t, lb)
+	var messages bytes.Buffer
+	encoder := json.NewEncoder(&messages)
+	encoder.Encode(map[string]interface{}{"compression": []string{compressionGzip}})
+	encoder.Encode(map[string]interface{}{"method": "Add", "params": map[string]interface{}{"a": 1, "b": 2}})
+	// both messages are written at once, so the load balancer reads the request with the offer
+	go client.Write(messages.Bytes())
+
+	decoder := json.NewDecoder(client)
+	var answer, response map[string]interface{}
+	if err := decoder.Decode(&answer); err != nil || answer["compression"] != "none" {
+		t.Fatalf("got the answer %v, %v", answer, err)
+	}
+	if err := decoder.Decode(&response); err != nil || response["result"] != 3.0 {
+		t.Fatalf("got %v, %v", response, err)
+	}
+}
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// heartbeatInterval is the interval the servers send heartbeats at,
+// the heartbeat timeout must be longer than it
+const heartbeatInterval = 500 * time.Millisecond
+
+// Config is the configuration of the load balancer read from the environment
+type Config struct {
+	HBAddress              string           // address to listen for heartbeats on
+	ClientAddress          string           // address to listen for requests on
+	TLS                    *tls.Config      // tls config to serve the clients
+	Timeout                time.Duration    // time without a heartbeat to consider a server unhealthy
+	ScanInterval           time.Duration    // interval to check the heartbeats of the servers
+	HeartbeatSecret        []byte           // shared secret to verify heartbeats, verification is disabled if empty
+	BackendTLS             *tls.Config      // tls config to connect to the servers, plain tcp is used if nil
+	AcceptBackoffMax       time.Duration    // maximum delay between retries of a failing accept
+	Workers                int              // workers handling the requests, a goroutine per connection is used if zero
+	QueueDepth             int              // connections waiting for a worker before new ones are shed
+	ProxyProtocol          bool             // clients connect through a proxy sending a PROXY protocol header
+	AllowPin               bool             // requests may be pinned to a server by its serving address
+	MethodLimits           *MethodLimits    // rate limits of the methods, nil if not configured
+	MaxRelayAttempts       int              // attempts to connect to a server for a request, unlimited if zero
+	MaxRelayTime           time.Duration    // time a request may spend trying the servers, unlimited if zero
+	MaxServerConns         int              // connections to a server at the same time, unlimited if zero
+	Outliers               *OutlierDetector // ejects the servers failing too often, disabled if nil
+	Canary                 *Canary          // routes a fraction of the requests to the canary servers, disabled if nil
+	Gossip                 *Gossip          // shares the servers with the peer load balancers, disabled if nil
+	Middleware             Middleware       // wraps the exchange of the requests with the servers, disabled if nil
+	Metrics                *Metrics         // metrics recorded by the metrics middleware, nil if it is not enabled
+	WebSocketAddress       string           // address to listen for WebSocket clients on, disabled if empty
+	WebSocketOrigins       []string         // origins allowed to open a WebSocket connection, any origin is allowed if empty
+	GatewayAddress         string           // address to serve the HTTP gateway on, disabled if empty
+	GatewaySchema          GatewaySchema    // types of the params of the methods called over the HTTP gateway, inferred if nil
+	AdminAddress           string           // address to serve the admin endpoints on over plain HTTP, disabled if empty
+	Pprof                  bool             // serves the profiles of net/http/pprof on the admin listener
+	AdminToken             []byte           // bearer token of the admin endpoints, they are not authenticated if empty
+	IdleTimeout            time.Duration    // time to wait for the next request on a kept-alive client connection, keep-alive is disabled if zero
+	ReadTimeout            time.Duration    // time to receive the first request of a client connection, disabled if zero
+	HandshakeTimeout       time.Duration    // time to complete the TLS handshake of a client connection, disabled if zero
+	LargeResponseThreshold int64            // response size in bytes to log a warning, disabled if zero
+	MaxResponseSize        int64            // size in bytes of the largest response relayed from a server, unlimited if zero
+	TruncateOversized      bool             // sends the leading bytes of a response larger than MaxResponseSize flagged as truncated instead of only an error
+	Tracing                bool             // traces the relay of the requests with OpenTelemetry, exported over OTLP
+	Compression            string           // compression of the client connections allowed to the clients offering it, "gzip", or none if empty
+	SlowResponseThreshold  time.Duration    // relay latency to log a warning, disabled if zero
+	SlowHeartbeatFactor    float64          // factor of the heartbeat interval to warn about late heartbeats, disabled if zero
+	Strategy               Strategy         // strategy to select the servers, round-robin is used if nil
+	RetryMalformed         bool             // relays a request once more to another server if the response of a server is malformed
+	LatencyAlpha           float64          // weight of the latest request in the rolling latency of a server
+	HealthSummaryInterval  time.Duration    // interval to log a health summary, disabled if zero
+	MethodCheckInterval    time.Duration    // interval to ask the servers for the methods they serve, disabled if zero
+	SRVName                string           // SRV record to discover servers from, discovery is disabled if empty
+	SRVInterval            time.Duration    // interval to poll the SRV record and probe the servers
+}
+
+// configError lists every problem found in the configuration
+type configError []string
+
+func (e configError) Error() string {
+	return "invalid configuration:\n  " + strings.Join(e, "\n  ")
+}
+
+// add records a problem with the configuration
+func (e *configError) add(format string, args ...interface{}) {
+	*e = append(*e, fmt.Sprintf(format, args...))
+}
+
+// loadConfig reads the configuration of the load balancer from the environment and validates it
+// it returns a configError listing every invalid setting instead of stopping at the first one
+func loadConfig() (*Config, error) {
+	var errs configError
+	config := &Config{
+		HBAddress:        os.Getenv("LB_HB_ADDRESS"),
+		ClientAddress:    os.Getenv("LB_CLIENT_ADDRESS"),
+		Timeout:          1*time.Second + 200*time.Millisecond,
+		ScanInterval:     250 * time.Millisecond,
+		HeartbeatSecret:  []byte(os.Getenv("LB_HB_SECRET")),
+		AcceptBackoffMax: time.Second,
+		IdleTimeout:      30 * time.Second,
+		ReadTimeout:      5 * time.Second,
+		HandshakeTimeout: 5 * time.Second,
+		SRVName:          os.Getenv("LB_SRV_NAME"),
+		SRVInterval:      5 * time.Second,
+		LatencyAlpha:     statsAlpha,
+		MaxRelayAttempts: 3,
+	}
+
+	// addresses to listen on
+	for _, name := range []string{"LB_HB_ADDRESS", "LB_CLIENT_ADDRESS"} {
+		address := os.Getenv(name)
+		if address == "" {
+			errs.add("%s is not set", name)
+		} else if _, _, err := net.SplitHostPort(address); err != nil {
+			errs.add("%s: %v", name, err)
+		}
+	}
+
+	// certificate to serve the clients
+	if cert, err := tls.LoadX509KeyPair("lb.crt", "lb.key"); err != nil {
+		errs.add("certificate lb.crt/lb.key: %v", err)
+	} else {
+		config.TLS = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		}
+	}
+	minVersion, cipherSuites := parseTLSPolicy(&errs)
+	if config.TLS != nil {
+		config.TLS.MinVersion = minVersion
+		config.TLS.CipherSuites = cipherSuites
+	}
+
+	// tls config to connect to the servers
+	if caPath := os.Getenv("LB_BACKEND_CA"); caPath != "" {
+		if ca, err := os.ReadFile(caPath); err != nil {
+			errs.add("LB_BACKEND_CA: %v", err)
+		} else if roots := x509.NewCertPool(); !roots.AppendCertsFromPEM(ca) {
+			errs.add("LB_BACKEND_CA: no certificate found in %s", caPath)
+		} else {
+			config.BackendTLS = &tls.Config{
+				RootCAs:    roots,
+				ServerName: os.Getenv("LB_BACKEND_SERVER_NAME"), // host name of the address is used if empty
+			}
+		}
+	}
+
+	// durations and counts
+	parseDuration(&errs, "LB_HB_TIMEOUT", &config.Timeout)
+	if config.Timeout <= heartbeatInterval {
+		errs.add("LB_HB_TIMEOUT: %s must be longer than the heartbeat interval %s", config.Timeout, heartbeatInterval)
+	}
+	parseDuration(&errs, "LB_HB_SCAN_INTERVAL", &config.ScanInterval)
+	if config.ScanInterval == 0 || config.ScanInterval > config.Timeout {
+		errs.add("LB_HB_SCAN_INTERVAL: %s must be positive and at most LB_HB_TIMEOUT %s", config.ScanInterval, config.Timeout)
+	}
+	parseDuration(&errs, "LB_ACCEPT_BACKOFF_MAX", &config.AcceptBackoffMax)
+	parseInt(&errs, "LB_WORKERS", &config.Workers)
+	parseInt(&errs, "LB_QUEUE_DEPTH", &config.QueueDepth)
+	if value := os.Getenv("LB_PROXY_PROTOCOL"); value != "" {
+		var err error
+		if config.ProxyProtocol, err = strconv.ParseBool(value); err != nil {
+			errs.add("LB_PROXY_PROTOCOL: invalid boolean %q", value)
+		}
+	}
+	if value := os.Getenv("LB_ALLOW_PIN"); value != "" {
+		var err error
+		if config.AllowPin, err = strconv.ParseBool(value); err != nil {
+			errs.add("LB_ALLOW_PIN: invalid boolean %q", value)
+		}
+	}
+	parseInt(&errs, "LB_RELAY_MAX_ATTEMPTS", &config.MaxRelayAttempts)
+	parseDuration(&errs, "LB_RELAY_MAX_TIME", &config.MaxRelayTime)
+	parseInt(&errs, "LB_MAX_SERVER_CONNS", &config.MaxServerConns)
+	if path := os.Getenv("LB_METHOD_LIMITS"); path != "" {
+		limits, err := loadMethodLimits(path)
+		if err != nil {
+			errs.add("LB_METHOD_LIMITS: %v", err)
+		}
+		config.MethodLimits = limits
+	}
+	if value := os.Getenv("LB_LARGE_RESPONSE_BYTES"); value != "" {
+		var err error
+		if config.LargeResponseThreshold, err = strconv.ParseInt(value, 10, 64); err != nil || config.LargeResponseThreshold < 0 {
+			errs.add("LB_LARGE_RESPONSE_BYTES: invalid size %q", value)
+		}
+	}
+	if value := os.Getenv("LB_MAX_RESPONSE_BYTES"); value != "" {
+		var err error
+		if config.MaxResponseSize, err = strconv.ParseInt(value, 10, 64); err != nil || config.MaxResponseSize < 0 {
+			errs.add("LB_MAX_RESPONSE_BYTES: invalid size %q", value)
+		}
+	}
+	// behavior when a response is larger than LB_MAX_RESPONSE_BYTES, an error is sent to the client by default
+	switch value := os.Getenv("LB_OVERSIZED_RESPONSE"); value {
+	case "", "reject":
+	case "truncate":
+		config.TruncateOversized = true
+	default:
+		errs.add("LB_OVERSIZED_RESPONSE: unknown behavior %q, must be reject or truncate", value)
+	}
+	// compression of the client connections, negotiated by the clients offering it
+	switch value := os.Getenv("LB_COMPRESSION"); value {
+	case "", "none":
+	case compressionGzip:
+		config.Compression = compressionGzip
+	default:
+		errs.add("LB_COMPRESSION: unknown compression %q, must be none or gzip", value)
+	}
+	switch value := os.Getenv("LB_TRACING"); value {
+	case "", "none":
+	case "otlp":
+		config.Tracing = true
+	default:
+		errs.add("LB_TRACING: unknown exporter %q, must be none or otlp", value)
+	}
+	parseDuration(&errs, "LB_SLOW_RESPONSE", &config.SlowResponseThreshold)
+	parseDuration(&errs, "LB_CLIENT_IDLE_TIMEOUT", &config.IdleTimeout)
+	parseDuration(&errs, "LB_CLIENT_READ_TIMEOUT", &config.ReadTimeout)
+	parseDuration(&errs, "LB_TLS_HANDSHAKE_TIMEOUT", &config.HandshakeTimeout)
+	if value := os.Getenv("LB_SLOW_HEARTBEAT_FACTOR"); value != "" {
+		var err error
+		if config.SlowHeartbeatFactor, err = strconv.ParseFloat(value, 64); err != nil || config.SlowHeartbeatFactor < 1 {
+			errs.add("LB_SLOW_HEARTBEAT_FACTOR: invalid factor %q, must be at least 1", value)
+		}
+	}
+	parseDuration(&errs, "LB_HEALTH_SUMMARY_INTERVAL", &config.HealthSummaryInterval)
+	parseDuration(&errs, "LB_METHOD_CHECK_INTERVAL", &config.MethodCheckInterval)
+	parseDuration(&errs, "LB_SRV_INTERVAL", &config.SRVInterval)
+	if config.SRVName != "" && config.SRVInterval == 0 {
+		errs.add("LB_SRV_INTERVAL must be positive")
+	}
+
+	// outlier detection, enabled by the error rate to eject the servers at
+	if value := os.Getenv("LB_OUTLIER_ERROR_RATE"); value != "" {
+		detector := &OutlierDetector{Window: 30 * time.Second, Ejection: 30 * time.Second}
+		var err error
+		if detector.ErrorRate, err = strconv.ParseFloat(value, 64); err != nil || detector.ErrorRate <= 0 || detector.ErrorRate >= 1 {
+			errs.add("LB_OUTLIER_ERROR_RATE: invalid rate %q, must be between 0 and 1", value)
+		}
+		parseDuration(&errs, "LB_OUTLIER_WINDOW", &detector.Window)
+		parseDuration(&errs, "LB_OUTLIER_EJECTION", &detector.Ejection)
+		if detector.Window == 0 || detector.Ejection == 0 {
+			errs.add("LB_OUTLIER_WINDOW and LB_OUTLIER_EJECTION must be positive")
+		}
+		config.Outliers = detector
+	}
+
+	// canary routing, enabled by the fraction of the requests to route to the canary servers
+	if value := os.Getenv("LB_CANARY_FRACTION"); value != "" {
+		canary := &Canary{Key: "canary", Value: "true"}
+		var err error
+		if canary.Fraction, err = strconv.ParseFloat(value, 64); err != nil || canary.Fraction < 0 || canary.Fraction > 1 {
+			errs.add("LB_CANARY_FRACTION: invalid fraction %q, must be between 0 and 1", value)
+		}
+		if tag := os.Getenv("LB_CANARY_TAG"); tag != "" {
+			key, value, ok := strings.Cut(tag, "=")
+			if !ok || key == "" {
+				errs.add("LB_CANARY_TAG: invalid tag %q, must be key=value", tag)
+			}
+			canary.Key, canary.Value = key, value
+		}
+		config.Canary = canary
+	}
+
+	// gossip with the peer load balancers, enabled by the address to listen for their gossip on
+	if address := os.Getenv("LB_GOSSIP_ADDRESS"); address != "" {
+		gossip := &Gossip{Address: address, Interval: time.Second, TTL: 5 * time.Second}
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			errs.add("LB_GOSSIP_ADDRESS: %v", err)
+		}
+		for _, peer := range strings.Split(os.Getenv("LB_PEERS"), ",") {
+			if peer = strings.TrimSpace(peer); peer == "" {
+				continue
+			}
+			if _, _, err := net.SplitHostPort(peer); err != nil {
+				errs.add("LB_PEERS: %v", err)
+			}
+			gossip.Peers = append(gossip.Peers, peer)
+		}
+		parseDuration(&errs, "LB_GOSSIP_INTERVAL", &gossip.Interval)
+		parseDuration(&errs, "LB_GOSSIP_TTL", &gossip.TTL)
+		if gossip.Interval == 0 || gossip.TTL <= gossip.Interval {
+			errs.add("LB_GOSSIP_INTERVAL must be positive and LB_GOSSIP_TTL longer than it")
+		}
+		config.Gossip = gossip
+	}
+
+	// WebSocket listener for the browser clients, served with the tls config of the clients
+	if address := os.Getenv("LB_WS_ADDRESS"); address != "" {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			errs.add("LB_WS_ADDRESS: %v", err)
+		}
+		config.WebSocketAddress = address
+	}
+	for _, origin := range strings.Split(os.Getenv("LB_WS_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			config.WebSocketOrigins = append(config.WebSocketOrigins, origin)
+		}
+	}
+
+	// HTTP gateway for the integrations without a client, served with the tls config of the clients
+	if address := os.Getenv("LB_HTTP_ADDRESS"); address != "" {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			errs.add("LB_HTTP_ADDRESS: %v", err)
+		}
+		config.GatewayAddress = address
+	}
+	if path := os.Getenv("LB_HTTP_SCHEMA"); path != "" {
+		schema, err := loadGatewaySchema(path)
+		if err != nil {
+			errs.add("LB_HTTP_SCHEMA: %v", err)
+		}
+		config.GatewaySchema = schema
+	}
+
+	// admin listener for the operators, served over plain HTTP
+	if address := os.Getenv("LB_ADMIN_ADDRESS"); address != "" {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			errs.add("LB_ADMIN_ADDRESS: %v", err)
+		}
+		config.AdminAddress = address
+	}
+	if value := os.Getenv("LB_PPROF"); value != "" {
+		var err error
+		if config.Pprof, err = strconv.ParseBool(value); err != nil {
+			errs.add("LB_PPROF: invalid boolean %q", value)
+		}
+		if config.Pprof && config.AdminAddress == "" {
+			errs.add("LB_PPROF: the profiles are served on the admin listener, LB_ADMIN_ADDRESS must be set")
+		}
+	}
+	if token := os.Getenv("LB_ADMIN_TOKEN"); token != "" {
+		if config.AdminAddress == "" {
+			errs.add("LB_ADMIN_TOKEN: the token authenticates the admin listener, LB_ADMIN_ADDRESS must be set")
+		}
+		config.AdminToken = []byte(token)
+	}
+
+	// middlewares wrapping the requests, in order from the outermost
+	var middlewares []Middleware
+	for _, name := range strings.Split(os.Getenv("LB_MIDDLEWARE"), ",") {
+		switch name = strings.TrimSpace(name); name {
+		case "":
+		case "logging":
+			middlewares = append(middlewares, Logging())
+		case "metrics":
+			if config.Metrics == nil {
+				config.Metrics = NewMetrics()
+			}
+			middlewares = append(middlewares, config.Metrics.Middleware())
+		default:
+			errs.add("LB_MIDDLEWARE: unknown middleware %q", name)
+		}
+	}
+	if len(middlewares) > 0 {
+		config.Middleware = Chain(middlewares...)
+	}
+	if config.Metrics != nil && config.HealthSummaryInterval == 0 {
+		errs.add("LB_MIDDLEWARE: the metrics are logged with the health summary, LB_HEALTH_SUMMARY_INTERVAL must be set")
+	}
+
+	// behavior when a server sends a malformed response, the error is sent to the client by default
+	switch value := os.Getenv("LB_MALFORMED_RESPONSE"); value {
+	case "", "fail":
+	case "retry":
+		config.RetryMalformed = true
+	default:
+		errs.add("LB_MALFORMED_RESPONSE: unknown behavior %q, must be fail or retry", value)
+	}
+
+	// weight of the latest request in the rolling latency the strategies select the servers by
+	if value := os.Getenv("LB_LATENCY_ALPHA"); value != "" {
+		var err error
+		if config.LatencyAlpha, err = strconv.ParseFloat(value, 64); err != nil || config.LatencyAlpha <= 0 || config.LatencyAlpha > 1 {
+			errs.add("LB_LATENCY_ALPHA: invalid weight %q, must be above 0 and at most 1", value)
+		}
+	}
+
+	// strategy to select the servers
+	switch strategy := os.Getenv("LB_STRATEGY"); strategy {
+	case "", "roundrobin":
+	case "weighted":
+		strategy := NewWeightedRandomStrategy()
+		parseDuration(&errs, "LB_WARMUP", &strategy.Warmup)
+		config.Strategy = strategy
+	case "latency":
+		exploration := 0.1
+		if value := os.Getenv("LB_LATENCY_EXPLORATION"); value != "" {
+			var err error
+			if exploration, err = strconv.ParseFloat(value, 64); err != nil || exploration < 0 || exploration > 1 {
+				errs.add("LB_LATENCY_EXPLORATION: invalid rate %q, must be between 0 and 1", value)
+			}
+		}
+		config.Strategy = NewLatencyAwareStrategy(exploration)
+	case "consistent":
+		hasher, ok := hashers[os.Getenv("LB_HASH")]
+		if !ok {
+			errs.add("LB_HASH: unknown hash %q", os.Getenv("LB_HASH"))
+		}
+		virtualNodes := 100
+		parseInt(&errs, "LB_VIRTUAL_NODES", &virtualNodes)
+		if virtualNodes == 0 {
+			errs.add("LB_VIRTUAL_NODES must be positive")
+		}
+		if ok && virtualNodes > 0 {
+			config.Strategy = NewConsistentHashStrategy(hasher, virtualNodes)
+		}
+	default:
+		errs.add("LB_STRATEGY: unknown strategy %q", strategy)
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return config, nil
+}
+
+// tlsVersions are the minimum TLS versions LB_TLS_MIN_VERSION accepts
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTLSPolicy reads the minimum TLS version, 1.2 if LB_TLS_MIN_VERSION is not set, and the
+// cipher suites allowed below TLS 1.3 from LB_TLS_CIPHERS, nil to use the Go defaults if it is not set.
+// only the suites of tls.CipherSuites are accepted, the insecure ones are rejected
+func parseTLSPolicy(errs *configError) (uint16, []uint16) {
+	minVersion := uint16(tls.VersionTLS12)
+	if value := os.Getenv("LB_TLS_MIN_VERSION"); value != "" {
+		version, ok := tlsVersions[value]
+		if !ok {
+			errs.add("LB_TLS_MIN_VERSION: unsupported version %q, must be 1.2 or 1.3", value)
+		}
+		minVersion = version
+	}
+
+	value := os.Getenv("LB_TLS_CIPHERS")
+	if value == "" {
+		return minVersion, nil
+	}
+	if minVersion == tls.VersionTLS13 {
+		errs.add("LB_TLS_CIPHERS: the cipher suites of TLS 1.3 are not configurable")
+		return minVersion, nil
+	}
+	suites := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		suites[suite.Name] = suite.ID
+	}
+	var cipherSuites []uint16
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if id, ok := suites[name]; ok {
+			cipherSuites = append(cipherSuites, id)
+		} else {
+			errs.add("LB_TLS_CIPHERS: unknown or insecure cipher suite %q", name)
+		}
+	}
+	return minVersion, cipherSuites
+}
+
+// logTLSPolicy logs the minimum version and the cipher suites the clients are served with
+func logTLSPolicy(config *tls.Config) {
+	minVersion := ""
+	for name, version := range tlsVersions {
+		if version == config.MinVersion {
+			minVersion = name
+		}
+	}
+	cipherSuites := []string{"Go defaults"}
+	if len(config.CipherSuites) > 0 {
+		cipherSuites = cipherSuites[:0]
+		for _, id := range config.CipherSuites {
+			cipherSuites = append(cipherSuites, tls.CipherSuiteName(id))
+		}
+	}
+	logger.Info("TLS policy", zap.String("minVersion", minVersion), zap.Strings("cipherSuites", cipherSuites))
+}
+
+// parseDuration sets the duration from the environment variable if it is set,
+// it records a problem if the value is not a non-negative duration
+func parseDuration(errs *configError, name string, duration *time.Duration) {
+	value := os.Getenv(name)
+	if value == "" {
+		return
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil || parsed < 0 {
+		errs.add("%s: invalid duration %q", name, value)
+		return
+	}
+	*duration = parsed
+}
+
+// parseInt sets the number from the environment variable if it is set,
+// it records a problem if the value is not a non-negative integer
+func parseInt(errs *configError, name string, number *int) {
+	value := os.Getenv(name)
+	if value == "" {
+		return
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed < 0 {
+		errs.add("%s: invalid number %q", name, value)
+		return
+	}
+	*number = parsed
+}
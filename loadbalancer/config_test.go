@@ -0,0 +1,375 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	t.Setenv("LB_HB_ADDRESS", "127.0.0.1:7070")
+	t.Setenv("LB_CLIENT_ADDRESS", "127.0.0.1:6060")
+	t.Setenv("LB_HB_TIMEOUT", "2s")
+	t.Setenv("LB_WORKERS", "4")
+
+	config, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Timeout != 2*time.Second || config.ScanInterval != 250*time.Millisecond || config.Workers != 4 || config.AcceptBackoffMax != time.Second || config.TLS == nil || config.Strategy != nil {
+		t.Fatalf("got %+v", config)
+	}
+}
+
+// every invalid setting is reported at once, not only the first one
+func TestLoadConfigListsEveryProblem(t *testing.T) {
+	t.Setenv("LB_HB_ADDRESS", "")
+	t.Setenv("LB_CLIENT_ADDRESS", "6060")
+	t.Setenv("LB_HB_TIMEOUT", "100ms")
+	t.Setenv("LB_HB_SCAN_INTERVAL", "0s")
+	t.Setenv("LB_WORKERS", "-1")
+	t.Setenv("LB_SLOW_RESPONSE", "soon")
+	t.Setenv("LB_SLOW_HEARTBEAT_FACTOR", "0.5")
+	t.Setenv("LB_STRATEGY", "fastest")
+
+	_, err := loadConfig()
+	var errs configError
+	if !errors.As(err, &errs) {
+		t.Fatalf("got %v", err)
+	}
+	want := configError{
+		"LB_HB_ADDRESS is not set",
+		"LB_CLIENT_ADDRESS: address 6060: missing port in address",
+		"LB_HB_TIMEOUT: 100ms must be longer than the heartbeat interval 500ms",
+		"LB_HB_SCAN_INTERVAL: 0s must be positive and at most LB_HB_TIMEOUT 100ms",
+		`LB_WORKERS: invalid number "-1"`,
+		`LB_SLOW_RESPONSE: invalid duration "soon"`,
+		`LB_SLOW_HEARTBEAT_FACTOR: invalid factor "0.5", must be at least 1`,
+		`LB_STRATEGY: unknown strategy "fastest"`,
+	}
+	if !reflect.DeepEqual(errs, want) {
+		t.Fatalf("got %q, want %q", errs, want)
+	}
+}
+
+func TestLoadConfigCanary(t *testing.T) {
+	t.Setenv("LB_HB_ADDRESS", "127.0.0.1:7070")
+	t.Setenv("LB_CLIENT_ADDRESS", "127.0.0.1:6060")
+	t.Setenv("LB_CANARY_FRACTION", "0.05")
+	config, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Canary{Fraction: 0.05, Key: "canary", Value: "true"}); config.Canary == nil || *config.Canary != want {
+		t.Fatalf("got %+v, want %+v", config.Canary, want)
+	}
+
+	t.Setenv("LB_CANARY_TAG", "version=2.1")
+	if config, err = loadConfig(); err != nil || config.Canary.Key != "version" || config.Canary.Value != "2.1" {
+		t.Fatalf("got %+v, %v", config.Canary, err)
+	}
+
+	t.Setenv("LB_CANARY_FRACTION", "1.5")
+	t.Setenv("LB_CANARY_TAG", "canary")
+	_, err = loadConfig()
+	want := configError{
+		`LB_CANARY_FRACTION: invalid fraction "1.5", must be between 0 and 1`,
+		`LB_CANARY_TAG: invalid tag "canary", must be key=value`,
+	}
+	var errs configError
+	if !errors.As(err, &errs) || !reflect.DeepEqual(errs, want) {
+		t.Fatalf("got %v, want %q", err, want)
+	}
+}
+
+func TestLoadConfigLatencyStrategy(t *testing.T) {
+	t.Setenv("LB_HB_ADDRESS", "127.0.0.1:7070")
+	t.Setenv("LB_CLIENT_ADDRESS", "127.0.0.1:6060")
+	t.Setenv("LB_STRATEGY", "latency")
+	config, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strategy, ok := config.Strategy.(*LatencyAwareStrategy); !ok || strategy.Exploration != 0.1 || config.LatencyAlpha != statsAlpha {
+		t.Fatalf("got %+v with the latency weight %v", config.Strategy, config.LatencyAlpha)
+	}
+
+	t.Setenv("LB_LATENCY_EXPLORATION", "0.05")
+	t.Setenv("LB_LATENCY_ALPHA", "0.5")
+	if config, err = loadConfig(); err != nil || config.Strategy.(*LatencyAwareStrategy).Exploration != 0.05 || config.LatencyAlpha != 0.5 {
+		t.Fatalf("got %+v with the latency weight %v, %v", config.Strategy, config.LatencyAlpha, err)
+	}
+
+	t.Setenv("LB_LATENCY_EXPLORATION", "2")
+	t.Setenv("LB_LATENCY_ALPHA", "0")
+	_, err = loadConfig()
+	want := configError{
+		`LB_LATENCY_ALPHA: invalid weight "0", must be above 0 and at most 1`,
+		`LB_LATENCY_EXPLORATION: invalid rate "2", must be between 0 and 1`,
+	}
+	var errs configError
+	if !errors.As(err, &errs) || !reflect.DeepEqual(errs, want) {
+		t.Fatalf("got %v, want %q", err, want)
+	}
+}
+
+func TestLoadConfigMalformedResponse(t *testing.T) {
+	t.Setenv("LB_HB_ADDRESS", "127.0.0.1:7070")
+	t.Setenv("LB_CLIENT_ADDRESS", "127.0.0.1:6060")
+	for value, retry := range map[string]bool{"": false, "fail": false, "retry": true} {
+		t.Setenv("LB_MALFORMED_RESPONSE", value)
+		if config, err := loadConfig(); err != nil || config.RetryMalformed != retry {
+			t.Fatalf("%q: got %v, %v", value, config.RetryMalformed, err)
+		}
+	}
+	t.Setenv("LB_MALFORMED_RESPONSE", "ignore")
+	_, err := loadConfig()
+	want := configError{`LB_MALFORMED_RESPONSE: unknown behavior "ignore", must be fail or retry`}
+	var errs configError
+	if !errors.As(err, &errs) || !reflect.DeepEqual(errs, want) {
+		t.Fatalf("got %v, want %q", err, want)
+	}
+}
+
+func TestLoadConfigMaxResponseSize(t *testing.T) {
+	t.Setenv("LB_HB_ADDRESS", "127.0.0.1:7070")
+	t.Setenv("LB_CLIENT_ADDRESS", "127.0.0.1:6060")
+	t.Setenv("LB_MAX_RESPONSE_BYTES", "1048576")
+	t.Setenv("LB_OVERSIZED_RESPONSE", "truncate")
+	config, err := loadConfig()
+	if err != nil || config.MaxResponseSize != 1<<20 || !config.TruncateOversized {
+		t.Fatalf("got %v and %v, %v", config.MaxResponseSize, config.TruncateOversized, err)
+	}
+
+	t.Setenv("LB_MAX_RESPONSE_BYTES", "-1")
+	t.Setenv("LB_OVERSIZED_RESPONSE", "drop")
+	_, err = loadConfig()
+	want := configError{
+		`LB_MAX_RESPONSE_BYTES: invalid size "-1"`,
+		`LB_OVERSIZED_RESPONSE: unknown behavior "drop", must be reject or truncate`,
+	}
+	var errs configError
+	if !errors.As(err, &errs) || !reflect.DeepEqual(errs, want) {
+		t.Fatalf("got %v, want %q", err, want)
+	}
+}
+
+func TestLoadConfigCompression(t *testing.T) {
+	t.Setenv("LB_HB_ADDRESS", "127.0.0.1:7070")
+	t.Setenv("LB_CLIENT_ADDRESS", "127.0.0.1:6060")
+	t.Setenv("LB_COMPRESSION", "gzip")
+	config, err := loadConfig()
+	if err != nil || config.Compression != compressionGzip {
+		t.Fatalf("got %q, %v", config.Compression, err)
+	}
+
+	t.Setenv("LB_COMPRESSION", "brotli")
+	_, err = loadConfig()
+	want := configError{`LB_COMPRESSION: unknown compression "brotli", must be none or gzip`}
+	var errs configError
+	if !errors.As(err, &errs) || !reflect.DeepEqual(errs, want) {
+		t.Fatalf("got %v, want %q", err, want)
+	}
+}
+
+func TestLoadConfigWarmup(t *testing.T) {
+	t.Setenv("LB_HB_ADDRESS", "127.0.0.1:7070")
+	t.Setenv("LB_CLIENT_ADDRESS", "127.0.0.1:6060")
+	t.Setenv("LB_STRATEGY", "weighted")
+	t.Setenv("LB_WARMUP", "30s")
+	config, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strategy, ok := config.Strategy.(*WeightedRandomStrategy); !ok || strategy.Warmup != 30*time.Second {
+		t.Fatalf("got %+v", config.Strategy)
+	}
+}
+
+func TestLoadConfigAllowPin(t *testing.T) {
+	t.Setenv("LB_HB_ADDRESS", "127.0.0.1:7070")
+	t.Setenv("LB_CLIENT_ADDRESS", "127.0.0.1:6060")
+	t.Setenv("LB_ALLOW_PIN", "true")
+	config, err := loadConfig()
+	if err != nil || !config.AllowPin {
+		t.Fatalf("got %v, %v", config.AllowPin, err)
+	}
+
+	t.Setenv("LB_ALLOW_PIN", "sometimes")
+	_, err = loadConfig()
+	want := configError{`LB_ALLOW_PIN: invalid boolean "sometimes"`}
+	var errs configError
+	if !errors.As(err, &errs) || !reflect.DeepEqual(errs, want) {
+		t.Fatalf("got %v, want %q", err, want)
+	}
+}
+
+func TestLoadConfigTracing(t *testing.T) {
+	t.Setenv("LB_HB_ADDRESS", "127.0.0.1:7070")
+	t.Setenv("LB_CLIENT_ADDRESS", "127.0.0.1:6060")
+	t.Setenv("LB_TRACING", "otlp")
+	config, err := loadConfig()
+	if err != nil || !config.Tracing {
+		t.Fatalf("got %v, %v", config.Tracing, err)
+	}
+
+	t.Setenv("LB_TRACING", "jaeger")
+	_, err = loadConfig()
+	want := configError{`LB_TRACING: unknown exporter "jaeger", must be none or otlp`}
+	var errs configError
+	if !errors.As(err, &errs) || !reflect.DeepEqual(errs, want) {
+		t.Fatalf("got %v, want %q", err, want)
+	}
+}
+
+func TestLoadConfigRelayBudget(t *testing.T) {
+	t.Setenv("LB_HB_ADDRESS", "127.0.0.1:7070")
+	t.Setenv("LB_CLIENT_ADDRESS", "127.0.0.1:6060")
+	config, err := loadConfig()
+	if err != nil || config.MaxRelayAttempts != 3 || config.MaxRelayTime != 0 {
+		t.Fatalf("got %v attempts and %v, %v by default", config.MaxRelayAttempts, config.MaxRelayTime, err)
+	}
+
+	t.Setenv("LB_RELAY_MAX_ATTEMPTS", "0")
+	t.Setenv("LB_RELAY_MAX_TIME", "2s")
+	if config, err = loadConfig(); err != nil || config.MaxRelayAttempts != 0 || config.MaxRelayTime != 2*time.Second {
+		t.Fatalf("got %v attempts and %v, %v", config.MaxRelayAttempts, config.MaxRelayTime, err)
+	}
+
+	t.Setenv("LB_RELAY_MAX_ATTEMPTS", "-1")
+	t.Setenv("LB_RELAY_MAX_TIME", "soon")
+	_, err = loadConfig()
+	want := configError{
+		`LB_RELAY_MAX_ATTEMPTS: invalid number "-1"`,
+		`LB_RELAY_MAX_TIME: invalid duration "soon"`,
+	}
+	var errs configError
+	if !errors.As(err, &errs) || !reflect.DeepEqual(errs, want) {
+		t.Fatalf("got %v, want %q", err, want)
+	}
+}
+
+func TestLoadConfigMaxServerConns(t *testing.T) {
+	t.Setenv("LB_HB_ADDRESS", "127.0.0.1:7070")
+	t.Setenv("LB_CLIENT_ADDRESS", "127.0.0.1:6060")
+	config, err := loadConfig()
+	if err != nil || config.MaxServerConns != 0 {
+		t.Fatalf("got %v connections, %v by default", config.MaxServerConns, err)
+	}
+
+	t.Setenv("LB_MAX_SERVER_CONNS", "16")
+	if config, err = loadConfig(); err != nil || config.MaxServerConns != 16 {
+		t.Fatalf("got %v connections, %v", config.MaxServerConns, err)
+	}
+
+	t.Setenv("LB_MAX_SERVER_CONNS", "many")
+	_, err = loadConfig()
+	want := configError{`LB_MAX_SERVER_CONNS: invalid number "many"`}
+	var errs configError
+	if !errors.As(err, &errs) || !reflect.DeepEqual(errs, want) {
+		t.Fatalf("got %v, want %q", err, want)
+	}
+}
+
+func TestLoadConfigHandshakeTimeout(t *testing.T) {
+	t.Setenv("LB_HB_ADDRESS", "127.0.0.1:7070")
+	t.Setenv("LB_CLIENT_ADDRESS", "127.0.0.1:6060")
+	config, err := loadConfig()
+	if err != nil || config.HandshakeTimeout != 5*time.Second {
+		t.Fatalf("got %v, %v by default", config.HandshakeTimeout, err)
+	}
+
+	t.Setenv("LB_TLS_HANDSHAKE_TIMEOUT", "0")
+	if config, err = loadConfig(); err != nil || config.HandshakeTimeout != 0 {
+		t.Fatalf("got %v, %v", config.HandshakeTimeout, err)
+	}
+
+	t.Setenv("LB_TLS_HANDSHAKE_TIMEOUT", "5")
+	_, err = loadConfig()
+	want := configError{`LB_TLS_HANDSHAKE_TIMEOUT: invalid duration "5"`}
+	var errs configError
+	if !errors.As(err, &errs) || !reflect.DeepEqual(errs, want) {
+		t.Fatalf("got %v, want %q", err, want)
+	}
+}
+
+func TestLoadConfigAdmin(t *testing.T) {
+	t.Setenv("LB_HB_ADDRESS", "127.0.0.1:7070")
+	t.Setenv("LB_CLIENT_ADDRESS", "127.0.0.1:6060")
+	t.Setenv("LB_ADMIN_ADDRESS", "127.0.0.1:6061")
+	t.Setenv("LB_PPROF", "true")
+	config, err := loadConfig()
+	if err != nil || config.AdminAddress != "127.0.0.1:6061" || !config.Pprof {
+		t.Fatalf("got %q and %v, %v", config.AdminAddress, config.Pprof, err)
+	}
+
+	t.Setenv("LB_ADMIN_ADDRESS", "")
+	_, err = loadConfig()
+	want := configError{"LB_PPROF: the profiles are served on the admin listener, LB_ADMIN_ADDRESS must be set"}
+	var errs configError
+	if !errors.As(err, &errs) || !reflect.DeepEqual(errs, want) {
+		t.Fatalf("got %v, want %q", err, want)
+	}
+
+	t.Setenv("LB_ADMIN_ADDRESS", "6061")
+	t.Setenv("LB_PPROF", "on")
+	_, err = loadConfig()
+	want = configError{
+		"LB_ADMIN_ADDRESS: address 6061: missing port in address",
+		`LB_PPROF: invalid boolean "on"`,
+	}
+	if !errors.As(err, &errs) || !reflect.DeepEqual(errs, want) {
+		t.Fatalf("got %v, want %q", err, want)
+	}
+
+	t.Setenv("LB_ADMIN_ADDRESS", "127.0.0.1:6061")
+	t.Setenv("LB_PPROF", "")
+	t.Setenv("LB_ADMIN_TOKEN", "t0ken")
+	config, err = loadConfig()
+	if err != nil || string(config.AdminToken) != "t0ken" {
+		t.Fatalf("got %q, %v", config.AdminToken, err)
+	}
+
+	t.Setenv("LB_ADMIN_ADDRESS", "")
+	_, err = loadConfig()
+	want = configError{"LB_ADMIN_TOKEN: the token authenticates the admin listener, LB_ADMIN_ADDRESS must be set"}
+	if !errors.As(err, &errs) || !reflect.DeepEqual(errs, want) {
+		t.Fatalf("got %v, want %q", err, want)
+	}
+}
+
+// the clients are served with the minimum version and the cipher suites of the policy,
+// an unknown version or suite and the suites of TLS 1.3 are rejected
+func TestLoadConfigTLSPolicy(t *testing.T) {
+	t.Setenv("LB_HB_ADDRESS", "127.0.0.1:7070")
+	t.Setenv("LB_CLIENT_ADDRESS", "127.0.0.1:6060")
+	t.Setenv("LB_TLS_CIPHERS", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256")
+
+	config, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256}
+	if config.TLS.MinVersion != tls.VersionTLS12 || !reflect.DeepEqual(config.TLS.CipherSuites, want) {
+		t.Fatalf("got min version %x and cipher suites %x", config.TLS.MinVersion, config.TLS.CipherSuites)
+	}
+
+	cases := []struct {
+		minVersion, ciphers, want string
+	}{
+		{"1.1", "", `LB_TLS_MIN_VERSION: unsupported version "1.1", must be 1.2 or 1.3`},
+		{"1.2", "TLS_RSA_WITH_RC4_128_SHA", `LB_TLS_CIPHERS: unknown or insecure cipher suite "TLS_RSA_WITH_RC4_128_SHA"`},
+		{"1.3", "TLS_AES_128_GCM_SHA256", "LB_TLS_CIPHERS: the cipher suites of TLS 1.3 are not configurable"},
+	}
+	for _, c := range cases {
+		t.Setenv("LB_TLS_MIN_VERSION", c.minVersion)
+		t.Setenv("LB_TLS_CIPHERS", c.ciphers)
+		_, err := loadConfig()
+		var errs configError
+		if !errors.As(err, &errs) || !reflect.DeepEqual(errs, configError{c.want}) {
+			t.Errorf("%s %s: got %v, want %s", c.minVersion, c.ciphers, err, c.want)
+		}
+	}
+}
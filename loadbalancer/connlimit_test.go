@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// a server at MaxServerConns is skipped, the request goes to another server and fails once every server is full
+func TestMaxServerConns(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	lb.MaxServerConns = 1
+	first, firstReceived := startSlowBackend(t, 300*time.Millisecond)
+	second, secondReceived := startSlowBackend(t, 300*time.Millisecond)
+	registerTestServer(lb, first)
+	registerTestServer(lb, second)
+
+	// the slow requests hold the only connection of each server
+	responses := make(chan map[string]interface{}, 2)
+	for i := 0; i < 2; i++ {
+		go func() { responses <- relayTestRequest(t, lb, `{"method":"Add","params":{"a":1,"b":2}}`) }()
+	}
+	for _, received := range []<-chan time.Time{firstReceived, secondReceived} {
+		select {
+		case <-received:
+		case <-time.After(2 * time.Second):
+			t.Fatal("a request was not relayed to each server")
+		}
+	}
+	if response := relayTestRequest(t, lb, `{"method":"Add","params":{"a":1,"b":2}}`); response["error"] != "No server available" {
+		t.Fatalf("got %v with every server full", response)
+	}
+
+	for i := 0; i < 2; i++ {
+		if response := <-responses; response["result"] != 3.0 {
+			t.Fatalf("got %v", response)
+		}
+	}
+	if response := relayTestRequest(t, lb, `{"method":"Add","params":{"a":1,"b":2}}`); response["result"] != 3.0 {
+		t.Fatalf("got %v once the connections ended", response)
+	}
+}
+
+// a pinned request is not relayed to another server when its server is full
+func TestMaxServerConnsPinned(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	lb.MaxServerConns = 1
+	lb.AllowPin = true
+	address, _ := startBackend(t, `{"result":3}`)
+	server := registerTestServer(lb, address)
+
+	if !lb.acquireConn(server) || lb.acquireConn(server) {
+		t.Fatal("the limit of one connection is not kept")
+	}
+	if response := relayTestRequest(t, lb, `{"method":"Add","params":{},"pin":"`+address+`"}`); response["error"] != "Pinned server "+address+" is at its connection limit" {
+		t.Fatalf("got %v", response)
+	}
+
+	lb.releaseConn(server)
+	if response := relayTestRequest(t, lb, `{"method":"Add","params":{},"pin":"`+address+`"}`); response["result"] != 3.0 {
+		t.Fatalf("got %v once the connection was released", response)
+	}
+	if lb.Snapshot()[0].ActiveConns != 0 {
+		t.Fatalf("got %d active connections", lb.Snapshot()[0].ActiveConns)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// a request past its deadline is failed without being relayed
+func TestExpiredDeadline(t *testing.T) {
+	lb := NewLoadBalancer(time.Minute)
+	address, requests := startBackend(t, `{"result":3}`)
+	registerTestServer(lb, address)
+
+	expired := time.Now().Add(-time.Second).UnixNano()
+	response := relayTestRequest(t, lb, fmt.Sprintf(`{"method":"Add","params":{"a":1,"b":2},"deadline_unix_nano":%d}`, expired))
+	if response["error"] != "Deadline exceeded" {
+		t.Fatalf("got %v", response)
+	}
+	select {
+	case request := <-requests:
+		t.Fatalf("the expired request %v is relayed", request)
+	default:
+	}
+}
+
+// the wait for the response of a server is bounded by the deadline of the request,
+// and the server is not blamed for the budget of the client running out
+func TestDeadlineBoundsRelay(t *testing.T) {
+	lb := NewLoadBalancer(time.Minute)
+	address, _ := startSlowBackend(t, 2*time.Second)
+	server := registerTestServer(lb, address)
+
+	start := time.Now()
+	deadline := start.Add(200 * time.Millisecond).UnixNano()
+	response := relayTestRequest(t, lb, fmt.Sprintf(`{"method":"Add","params":{"a":1,"b":2},"deadline_unix_nano":%d}`, deadline))
+	if response["error"] != "Deadline exceeded" {
+		t.Fatalf("got %v", response)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("the relay gave up after %v, want 200ms", elapsed)
+	}
+	server.Mutex.Lock()
+	defer server.Mutex.Unlock()
+	if server.FailureRate != 0 {
+		t.Fatalf("the server is blamed with the failure rate %v", server.FailureRate)
+	}
+}
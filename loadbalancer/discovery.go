@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// SRVResolver resolves DNS SRV records, it is implemented by *net.Resolver
+type SRVResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// SRVDiscovery polls a DNS SRV record and keeps the servers of the
+// load balancer in sync with the resolved targets.
+// discovered servers do not send heartbeats, they are health-checked with active probes instead.
+type SRVDiscovery struct {
+	Name         string          // SRV record name to resolve
+	Interval     time.Duration   // interval between two polls
+	ProbeTimeout time.Duration   // timeout of the probe connection to a target
+	Resolver     SRVResolver     // resolver used to look up the SRV record
+	targets      map[string]bool // serving addresses added by this discovery
+}
+
+// NewSRVDiscovery creates a new SRVDiscovery for the given SRV name using the default resolver
+func NewSRVDiscovery(name string, interval time.Duration) *SRVDiscovery {
+	return &SRVDiscovery{
+		Name:         name,
+		Interval:     interval,
+		ProbeTimeout: interval / 2,
+		Resolver:     net.DefaultResolver,
+		targets:      make(map[string]bool),
+	}
+}
+
+// DiscoverSRV polls the SRV record of the discovery and reconciles the targets
+// works in a separate goroutine until the load balancer is stopped
+func (lb *LoadBalancer) DiscoverSRV(d *SRVDiscovery) {
+	for { // infinite loop
+		lb.pollSRV(d)
+
+		// sleep for the poll interval
+		select {
+		case <-lb.done:
+			return
+		case <-time.After(d.Interval):
+		}
+	}
+}
+
+// pollSRV resolves the SRV record once, probes the targets
+// and reconciles the healthy ones with the servers of the load balancer
+func (lb *LoadBalancer) pollSRV(d *SRVDiscovery) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.Interval)
+	defer cancel()
+
+	_, records, err := d.Resolver.LookupSRV(ctx, "", "", d.Name)
+	if err != nil {
+		// keep the current servers, a failing lookup does not mean the targets are gone
+		logger.Error("Error in SRV lookup", zap.String("name", d.Name), zap.Error(err))
+		return
+	}
+
+	// probe the targets concurrently
+	healthy := make(map[string]bool)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for _, record := range records {
+		address := net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port)))
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+			ok := probe(address, d.ProbeTimeout)
+			mutex.Lock()
+			healthy[address] = ok
+			mutex.Unlock()
+		}(address)
+	}
+	wg.Wait()
+
+	lb.reconcileSRV(d, healthy)
+}
+
+// reconcileSRV adds the healthy targets which are not known yet and removes the targets which vanished
+// from the record. a target failing its probe is kept until its probe timeout expires, so a single
+// failed probe does not drop it, see probeExpired.
+// servers registered by heartbeats are never touched and their serving addresses are not added again,
+// a gossiped server is replaced by the target probed locally
+func (lb *LoadBalancer) reconcileSRV(d *SRVDiscovery, targets map[string]bool) {
+	lb.Mutex.Lock()
+	defer lb.Mutex.Unlock()
+
+	// remove vanished targets
+	for address := range d.targets {
+		if _, ok := targets[address]; !ok {
+			if server, ok := lb.Servers[address]; ok && server.ProbeBacked {
+				lb.removeServer(address)
+			}
+			delete(d.targets, address)
+			logger.Debug("Discovered server removed", zap.String("address", address))
+		}
+	}
+
+	// serving addresses of the servers sending heartbeats
+	heartbeating := make(map[string]bool)
+	for _, server := range lb.Servers {
+		if !server.ProbeBacked && server.GossipPeer == "" {
+			heartbeating[server.ServingAddress] = true
+		}
+	}
+
+	// add or refresh healthy targets
+	for address, ok := range targets {
+		if !ok {
+			continue
+		}
+
+		// the server is already routed to by its heartbeats
+		if heartbeating[address] {
+			delete(d.targets, address)
+			continue
+		}
+
+		if server, ok := lb.Servers[address]; ok {
+			if server.ProbeBacked {
+				server.LastProbe = time.Now()
+				server.IsHealthy = true
+				continue
+			}
+			// the server is known locally now, it is not routed to through its gossiped entry too
+			lb.removeGossiped(address)
+		}
+
+		// discovered servers are keyed by their serving address
+		lb.Servers[address] = &ServerInfo{
+			ServingAddress: address,
+			ProbeBacked:    true,
+			LastProbe:      time.Now(),
+			Registered:     time.Now(),
+			ProbeTimeout:   2*d.Interval + d.ProbeTimeout, // missed two polls
+			IsHealthy:      true,
+			Ready:          true, // the probe succeeded, so it accepts connections
+		}
+		lb.ServerKeys = append(lb.ServerKeys, address)
+		d.targets[address] = true
+		logger.Debug("Discovered server added", zap.String("address", address))
+	}
+}
+
+// removeDiscovered removes the probe-backed server with the serving address once it sends heartbeats,
+// so it is not routed to twice. lb.Mutex must be held
+func (lb *LoadBalancer) removeDiscovered(servingAddress string) {
+	if server, ok := lb.Servers[servingAddress]; ok && server.ProbeBacked {
+		lb.removeServer(servingAddress)
+	}
+}
+
+// probe checks whether a server accepts connections on the given address
+func probe(address string, timeout time.Duration) bool {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		logger.Debug("Probe failed", zap.String("address", address), zap.Error(err))
+		return false
+	}
+	conn.Close()
+	return true
+}
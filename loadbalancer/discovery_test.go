@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeResolver resolves the SRV record to its records, or fails with err
+type fakeResolver struct {
+	mutex   sync.Mutex
+	records []*net.SRV
+	err     error
+}
+
+func (r *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return "", r.records, r.err
+}
+
+func (r *fakeResolver) set(records []*net.SRV, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.records, r.err = records, err
+}
+
+// srvRecord returns the SRV record of a serving address
+func srvRecord(t *testing.T, address string) *net.SRV {
+	t.Helper()
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	number, _ := strconv.Atoi(port)
+	return &net.SRV{Target: host + ".", Port: uint16(number)}
+}
+
+// closedAddress returns an address nothing listens on
+func closedAddress(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := ln.Addr().String()
+	ln.Close()
+	return address
+}
+
+func TestDiscoverSRV(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	backend, requests := startBackend(t, `{"result":3}`)
+	down := closedAddress(t)
+	heartbeating := registerTestServer(lb, closedAddress(t))
+
+	resolver := &fakeResolver{}
+	d := NewSRVDiscovery("_rpc._tcp.example.com", time.Second)
+	d.Resolver = resolver
+
+	// only the target accepting connections is added
+	resolver.set([]*net.SRV{srvRecord(t, backend), srvRecord(t, down)}, nil)
+	lb.pollSRV(d)
+	server, ok := lb.Servers[backend]
+	if !ok || !server.ProbeBacked || !server.IsHealthy {
+		t.Fatalf("discovered server not added: %+v", server)
+	}
+	if _, ok := lb.Servers[down]; ok {
+		t.Fatal("unreachable target added")
+	}
+
+	// the discovered server is routed to, the heartbeat-backed one is down
+	if response := relayTestRequest(t, lb, `{"method":"Add","params":{"a":1,"b":2}}`); response["result"] != 3.0 {
+		t.Fatalf("got %v", response)
+	}
+	if len(requests) != 1 {
+		t.Fatal("the discovered server got no request")
+	}
+
+	// a failing lookup keeps the servers
+	resolver.set(nil, errors.New("SERVFAIL"))
+	lb.pollSRV(d)
+	if _, ok := lb.Servers[backend]; !ok {
+		t.Fatal("discovered server removed after a failing lookup")
+	}
+
+	// a target gone from the record is removed, the servers registered by heartbeats are kept
+	resolver.set(nil, nil)
+	lb.pollSRV(d)
+	if _, ok := lb.Servers[backend]; ok {
+		t.Fatal("vanished target not removed")
+	}
+	if _, ok := lb.Servers[heartbeating.HeartbeatAddress]; !ok || len(lb.ServerKeys) != 1 {
+		t.Fatalf("heartbeat-backed server touched, keys %v", lb.ServerKeys)
+	}
+}
+
+// a target failing its probe stays until its probe timeout expires, then it is evicted like a server missing its heartbeats
+func TestDiscoverSRVProbeExpiry(t *testing.T) {
+	lb := NewLoadBalancer(time.Hour)
+	lb.ScanInterval = 10 * time.Millisecond
+	defer lb.Stop()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := ln.Addr().String()
+
+	resolver := &fakeResolver{}
+	resolver.set([]*net.SRV{srvRecord(t, address)}, nil)
+	d := NewSRVDiscovery("_rpc._tcp.example.com", 50*time.Millisecond)
+	d.Resolver = resolver
+	lb.pollSRV(d)
+	if _, ok := lb.Servers[address]; !ok {
+		t.Fatal("discovered server not added")
+	}
+
+	// the target still in the record fails its probe, it is kept for now
+	ln.Close()
+	lb.pollSRV(d)
+	lb.Mutex.Lock()
+	server, ok := lb.Servers[address]
+	lb.Mutex.Unlock()
+	if !ok {
+		t.Fatal("discovered server removed on its first failed probe")
+	}
+
+	evicted := make(chan string, 1)
+	lb.AddEventListener(func(event Event) {
+		if event.Type == ServerEvicted {
+			evicted <- event.Server
+		}
+	})
+	go lb.MonitorHeartbeats()
+	select {
+	case evictedAddress := <-evicted:
+		if evictedAddress != address {
+			t.Fatalf("%s is evicted, want %s", evictedAddress, address)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the server failing its probes is not evicted")
+	}
+	if time.Since(server.LastProbe) < server.ProbeTimeout {
+		t.Fatal("the server is evicted before its probe timeout")
+	}
+}
+
+// a target already known by its heartbeats or its gossip is routed to once
+func TestDiscoverSRVKnownServer(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	heartbeating, _ := startBackend(t, `{"result":3}`)
+	gossiped, _ := startBackend(t, `{"result":3}`)
+	registerTestServer(lb, heartbeating)
+	lb.mergeGossip("10.0.0.9:7946", []gossipServer{{Address: gossiped, Ready: true}})
+
+	resolver := &fakeResolver{}
+	resolver.set([]*net.SRV{srvRecord(t, heartbeating), srvRecord(t, gossiped)}, nil)
+	d := NewSRVDiscovery("_rpc._tcp.example.com", time.Second)
+	d.Resolver = resolver
+	lb.pollSRV(d)
+
+	// the heartbeat-backed server is not added again, the gossiped one is probed locally from now on
+	if len(lb.ServerKeys) != 2 {
+		t.Fatalf("servers registered twice, keys %v", lb.ServerKeys)
+	}
+	if _, ok := lb.Servers[heartbeating]; ok {
+		t.Fatal("the heartbeat-backed server is discovered too")
+	}
+	if server := lb.Servers[gossiped]; server == nil || !server.ProbeBacked || server.GossipPeer != "" {
+		t.Fatalf("the gossiped server is not replaced by the discovered one: %+v", server)
+	}
+
+	// a discovered server starting to send heartbeats is routed to by its heartbeats only
+	encoder := heartbeatConn(t, lb)
+	_, port, _ := net.SplitHostPort(gossiped)
+	if err := encoder.Encode(map[string]interface{}{"heartbeat": true, "port": port, "addresses": []string{gossiped}}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the heartbeat registration", func() bool {
+		lb.Mutex.Lock()
+		defer lb.Mutex.Unlock()
+		_, discovered := lb.Servers[gossiped]
+		return !discovered && len(lb.ServerKeys) == 2
+	})
+	lb.pollSRV(d)
+	if len(lb.ServerKeys) != 2 {
+		t.Fatalf("the heartbeat-backed server is discovered again, keys %v", lb.ServerKeys)
+	}
+}
+
+// the polls stop with the load balancer
+func TestDiscoverSRVStop(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	resolver := &fakeResolver{}
+	d := NewSRVDiscovery("_rpc._tcp.example.com", 10*time.Millisecond)
+	d.Resolver = resolver
+
+	done := make(chan struct{})
+	go func() {
+		lb.DiscoverSRV(d)
+		close(done)
+	}()
+	lb.Stop()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("DiscoverSRV still polls after Stop")
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+
+	"go.uber.org/zap"
+)
+
+// a server is drained before it is stopped, e.g. for a rolling upgrade: no new request is routed to it
+// while the requests relayed to it finish, then ServerDrained is emitted and it can be stopped.
+// it is drained by SetDraining or by sending "draining": true in its heartbeats
+
+// draining returns true if no new requests are routed to the server
+func (server *ServerInfo) draining() bool {
+	server.Mutex.Lock()
+	defer server.Mutex.Unlock()
+
+	return server.Draining
+}
+
+// SetDraining drains the server serving on the serving address, or routes requests to it again
+// if draining is false. it returns an error if no server serves on the address
+func (lb *LoadBalancer) SetDraining(servingAddress string, draining bool) error {
+	lb.Mutex.Lock()
+	defer lb.unlock()
+
+	for _, server := range lb.Servers {
+		if server.ServingAddress != servingAddress {
+			continue
+		}
+		if draining {
+			lb.drain(server)
+			return nil
+		}
+		server.Mutex.Lock()
+		if server.Draining {
+			logger.Info("Server is not draining anymore", zap.String("address", servingAddress))
+		}
+		server.Draining = false
+		server.Mutex.Unlock()
+		return nil
+	}
+	return fmt.Errorf("no server serves on %s", servingAddress)
+}
+
+// drain stops routing new requests to the server, a server without requests in flight is drained at once.
+// lb.Mutex must be held
+func (lb *LoadBalancer) drain(server *ServerInfo) {
+	server.Mutex.Lock()
+	if server.Draining {
+		server.Mutex.Unlock()
+		return
+	}
+	server.Draining = true
+	inFlight := server.activeConns
+	server.Mutex.Unlock()
+
+	logger.Info("Server is draining", zap.String("address", server.ServingAddress), zap.Int("requests", inFlight))
+	if inFlight == 0 {
+		lb.emitLocked(Event{Type: ServerDrained, Server: server.ServingAddress})
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// drainedEvents returns the servers of the ServerDrained events
+func drainedEvents(events []Event) []string {
+	var servers []string
+	for _, event := range events {
+		if event.Type == ServerDrained {
+			servers = append(servers, event.Server)
+		}
+	}
+	return servers
+}
+
+// a draining server gets no new requests, and is reported drained once the request in flight finished
+func TestSetDraining(t *testing.T) {
+	lb := NewLoadBalancer(time.Minute)
+	slow, received := startSlowBackend(t, 200*time.Millisecond)
+	other, _ := startBackend(t, `{"result":4}`)
+	registerTestServer(lb, slow)
+	registerTestServer(lb, other)
+	events := recordEvents(lb)
+
+	if err := lb.SetDraining("10.0.0.9:8081", true); err == nil || err.Error() != "no server serves on 10.0.0.9:8081" {
+		t.Fatalf("got %v", err)
+	}
+
+	done := make(chan map[string]interface{})
+	go func() { done <- relayTestRequest(t, lb, `{"method":"Add","params":{"a":1,"b":2}}`) }()
+	<-received
+	if err := lb.SetDraining(slow, true); err != nil {
+		t.Fatal(err)
+	}
+	if drained := drainedEvents(events()); len(drained) != 0 {
+		t.Fatalf("drained %v with a request in flight", drained)
+	}
+	for i := 0; i < 4; i++ {
+		if response := relayTestRequest(t, lb, `{"method":"Add","params":{"a":2,"b":2}}`); response["result"] != 4.0 {
+			t.Fatalf("request %d: got %v from the draining server", i, response)
+		}
+	}
+
+	if response := <-done; response["result"] != 3.0 {
+		t.Fatalf("the request in flight got %v", response)
+	}
+	waitFor(t, "the drained event", func() bool { return len(drainedEvents(events())) == 1 })
+	if drained := drainedEvents(events()); drained[0] != slow {
+		t.Fatalf("drained %v", drained)
+	}
+	if snapshot := lb.Snapshot(); !snapshot[0].Draining || snapshot[1].Draining {
+		t.Fatalf("got the snapshot %+v", snapshot)
+	}
+
+	// the server gets requests again once it is not draining
+	if err := lb.SetDraining(slow, false); err != nil {
+		t.Fatal(err)
+	}
+	selected := selections(lb, 4)
+	if selected[slow] != 2 || selected[other] != 2 {
+		t.Fatalf("got %v", selected)
+	}
+}
+
+// a server without a request in flight is drained at once, once
+func TestDrainIdleServer(t *testing.T) {
+	lb := NewLoadBalancer(time.Minute)
+	server := registerTestServer(lb, "10.0.0.1:8081")
+	events := recordEvents(lb)
+	lb.SetDraining(server.ServingAddress, true)
+	lb.SetDraining(server.ServingAddress, true)
+	if drained := drainedEvents(events()); len(drained) != 1 || drained[0] != server.ServingAddress {
+		t.Fatalf("drained %v", drained)
+	}
+	if selected := lb.getServer(nil, nil); selected != nil {
+		t.Fatalf("selected the draining server %s", selected.ServingAddress)
+	}
+}
+
+// a server drains itself with "draining" in its heartbeats, or the draining flag of the binary ones
+func TestDrainingHeartbeat(t *testing.T) {
+	lb := NewLoadBalancer(time.Minute)
+	events := recordEvents(lb)
+	heartbeat := heartbeatConn(t, lb)
+	heartbeat.Encode(map[string]interface{}{"heartbeat": true, "ready": true, "port": "8081"})
+	waitFor(t, "the registration", func() bool { return len(lb.Snapshot()) == 1 })
+	heartbeat.Encode(map[string]interface{}{"heartbeat": true, "ready": true, "draining": true})
+	waitFor(t, "the drain", func() bool { return lb.Snapshot()[0].Draining })
+	if drained := drainedEvents(events()); len(drained) != 1 || drained[0] != ":8081" {
+		t.Fatalf("drained %v", drained)
+	}
+
+	// a server sending its first heartbeat while draining is registered as draining
+	lb = NewLoadBalancer(time.Minute)
+	message := binaryHeartbeat("8081", nil)
+	message[4] |= 2
+	server, lbSide := net.Pipe()
+	defer server.Close()
+	go lb.handleHeartbeat(lbSide)
+	server.Write(message)
+	waitFor(t, "the registration", func() bool { return len(lb.Snapshot()) == 1 })
+	if snapshot := lb.Snapshot(); !snapshot[0].Draining {
+		t.Fatalf("got %+v", snapshot[0])
+	}
+}
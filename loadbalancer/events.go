@@ -0,0 +1,108 @@
+package main
+
+import (
+	"time"
+)
+
+// EventType is the kind of a lifecycle event of the load balancer
+type EventType int
+
+const (
+	ClientConnected    EventType = iota // a client opened a connection
+	ClientDisconnected                  // the connection of a client is closed
+	RequestRelayed                      // a request of a client is sent to a server
+	ResponseReceived                    // the response of a server is received
+	RelayFailed                         // a request could not be sent to a server or its response received
+	ServerRegistered                    // a server sent its first heartbeat
+	ServerUnregistered                  // a server unregistered itself, e.g. to drain
+	ServerEvicted                       // a server missed its heartbeats, probes or gossip and is removed
+	ServerDrained                       // a draining server has no request in flight left, it can be stopped
+)
+
+func (t EventType) String() string {
+	switch t {
+	case ClientConnected:
+		return "ClientConnected"
+	case ClientDisconnected:
+		return "ClientDisconnected"
+	case RequestRelayed:
+		return "RequestRelayed"
+	case ResponseReceived:
+		return "ResponseReceived"
+	case RelayFailed:
+		return "RelayFailed"
+	case ServerRegistered:
+		return "ServerRegistered"
+	case ServerUnregistered:
+		return "ServerUnregistered"
+	case ServerEvicted:
+		return "ServerEvicted"
+	case ServerDrained:
+		return "ServerDrained"
+	}
+	return "Unknown"
+}
+
+// Event is a lifecycle event of the connections of the clients and the servers,
+// the fields not concerning its type are empty
+type Event struct {
+	Type    EventType
+	Time    time.Time
+	Client  string        // address of the client
+	Server  string        // serving address of the server
+	Method  string        // method of the request
+	Latency time.Duration // round trip to the server for ResponseReceived and RelayFailed
+	Err     error         // error of RelayFailed
+}
+
+// EventListener receives the lifecycle events, e.g. to feed a monitoring system.
+// it is called synchronously where the event happens, or right after if the load balancer was locked then,
+// so it may call the methods of the load balancer, e.g. Snapshot, but must not block or add a listener
+type EventListener func(event Event)
+
+// AddEventListener registers a listener for the lifecycle events, no event is emitted without one
+func (lb *LoadBalancer) AddEventListener(listener EventListener) {
+	lb.eventMutex.Lock()
+	defer lb.eventMutex.Unlock()
+	lb.eventListeners = append(lb.eventListeners, listener)
+}
+
+// emit sends the event to the listeners, stamped with the current time.
+// lb.Mutex must not be held, emitLocked queues the event instead
+func (lb *LoadBalancer) emit(event Event) {
+	event.Time = time.Now()
+	lb.send(event)
+}
+
+// emitLocked queues the event, stamped with the current time, until unlock releases lb.Mutex,
+// so the listeners are not called with the load balancer locked. lb.Mutex must be held
+func (lb *LoadBalancer) emitLocked(event Event) {
+	lb.eventMutex.RLock()
+	listening := len(lb.eventListeners) > 0
+	lb.eventMutex.RUnlock()
+	if !listening {
+		return
+	}
+	event.Time = time.Now()
+	lb.lockedEvents = append(lb.lockedEvents, event)
+}
+
+// unlock releases lb.Mutex and sends the events queued by emitLocked in order
+func (lb *LoadBalancer) unlock() {
+	events := lb.lockedEvents
+	lb.lockedEvents = nil
+	lb.Mutex.Unlock()
+
+	for _, event := range events {
+		lb.send(event)
+	}
+}
+
+// send calls the listeners with the event
+func (lb *LoadBalancer) send(event Event) {
+	lb.eventMutex.RLock()
+	defer lb.eventMutex.RUnlock()
+	for _, listener := range lb.eventListeners {
+		listener(event)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordEvents registers a listener recording the events of the load balancer, returns their copy
+func recordEvents(lb *LoadBalancer) func() []Event {
+	var mutex sync.Mutex
+	var events []Event
+	lb.AddEventListener(func(event Event) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		events = append(events, event)
+	})
+	return func() []Event {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]Event(nil), events...)
+	}
+}
+
+func eventTypes(events []Event) []EventType {
+	types := make([]EventType, len(events))
+	for i, event := range events {
+		types[i] = event.Type
+	}
+	return types
+}
+
+// a relayed request emits the events of the client connection and of the exchange with the server
+func TestRelayEvents(t *testing.T) {
+	lb := NewLoadBalancer(time.Minute)
+	address, _ := startBackend(t, `{"result":3}`)
+	registerTestServer(lb, address)
+	events := recordEvents(lb)
+
+	relayTestRequest(t, lb, `{"method":"Add","params":{"a":1,"b":2}}`)
+
+	got := events()
+	want := []EventType{ClientConnected, RequestRelayed, ResponseReceived, ClientDisconnected}
+	if len(got) != len(want) {
+		t.Fatalf("got events %v, want %v", eventTypes(got), want)
+	}
+	for i, event := range got {
+		if event.Type != want[i] || event.Client != "pipe" || event.Time.IsZero() {
+			t.Fatalf("event %d: got %+v, want %v", i, event, want[i])
+		}
+	}
+	for _, event := range got[1:3] {
+		if event.Server != address || event.Method != "Add" {
+			t.Errorf("got %v of the exchange %+v", event.Type, event)
+		}
+	}
+	if got[2].Latency <= 0 {
+		t.Errorf("got the latency %v", got[2].Latency)
+	}
+}
+
+// the registration and the unregistration of a server are emitted
+func TestServerEvents(t *testing.T) {
+	lb := NewLoadBalancer(time.Minute)
+	events := recordEvents(lb)
+
+	encoder := heartbeatConn(t, lb)
+	encoder.Encode(map[string]interface{}{"heartbeat": true, "port": "8081"})
+	waitFor(t, "the registration", func() bool { return len(events()) == 1 })
+	encoder.Encode(map[string]interface{}{"unregister": true})
+	waitFor(t, "the unregistration", func() bool { return len(events()) == 2 })
+
+	if got := eventTypes(events()); got[0] != ServerRegistered || got[1] != ServerUnregistered {
+		t.Fatalf("got events %v", got)
+	}
+	if registered := events()[0]; registered.Server == "" || registered.Server != events()[1].Server {
+		t.Fatalf("got the servers %q and %q", registered.Server, events()[1].Server)
+	}
+}
+
+// the events of the servers happen with the load balancer locked, they are sent once it is released
+// so a listener can call its methods
+func TestEventListenerCallsSnapshot(t *testing.T) {
+	lb := NewLoadBalancer(200 * time.Millisecond)
+	lb.ScanInterval = 20 * time.Millisecond
+	// not Stop, which would wait for the lock if a listener deadlocked with it
+	defer close(lb.done)
+
+	type observed struct {
+		event   Event
+		servers int
+	}
+	events := make(chan observed, 16)
+	lb.AddEventListener(func(event Event) {
+		switch event.Type {
+		case ServerRegistered, ServerDrained, ServerEvicted:
+			events <- observed{event, len(lb.Snapshot())}
+		}
+	})
+	next := func(want EventType) observed {
+		t.Helper()
+		select {
+		case o := <-events:
+			if o.event.Type != want {
+				t.Fatalf("got %s, want %s", o.event.Type, want)
+			}
+			return o
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no %s, the listener is blocked", want)
+		}
+		return observed{}
+	}
+
+	server, lbSide := net.Pipe()
+	defer server.Close()
+	go lb.handleHeartbeat(lbSide)
+	heartbeat := json.NewEncoder(server)
+	heartbeat.Encode(map[string]interface{}{"heartbeat": true, "ready": true, "port": "8081"})
+	if o := next(ServerRegistered); o.servers != 1 || o.event.Server != ":8081" {
+		t.Fatalf("got %+v", o)
+	}
+
+	if err := lb.SetDraining(":8081", true); err != nil {
+		t.Fatal(err)
+	}
+	next(ServerDrained)
+
+	// the server misses its heartbeats
+	go lb.MonitorHeartbeats()
+	if o := next(ServerEvicted); o.servers != 0 {
+		t.Fatalf("got %d servers after the eviction", o.servers)
+	}
+}
+
+func TestEventsWithoutListener(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	server := registerTestServer(lb, "10.0.0.1:8081")
+	if err := lb.SetDraining(server.ServingAddress, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(lb.lockedEvents) != 0 {
+		t.Fatalf("queued %d events without a listener", len(lb.lockedEvents))
+	}
+}
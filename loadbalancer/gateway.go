@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// trivial integrations, e.g. curl or webhooks, can call a method without a client over an HTTP gateway:
+// GET /rpc/Add?a=1&b=2 is relayed as {"method": "Add", "params": {"a": 1, "b": 2}} and the response
+// of the server is sent back as the body. the query values are strings, so they are converted to the
+// types of the params registered in the GatewaySchema, or inferred if the param is not registered
+
+// gatewayPrefix is the path of the gateway, followed by the name of the method
+const gatewayPrefix = "/rpc/"
+
+// GatewaySchema maps the methods to the types of their params, by the names of the idl,
+// e.g. {"Add": {"a": "float64", "b": "float64"}}. enums are given as int64 like on the wire
+type GatewaySchema map[string]map[string]string
+
+// gatewayTypes are the types of the params a GatewaySchema accepts
+var gatewayTypes = map[string]bool{
+	"float32": true,
+	"float64": true,
+	"int32":   true,
+	"int64":   true,
+	"uint32":  true,
+	"uint64":  true,
+	"string":  true,
+	"bool":    true,
+	"bytes":   true,
+}
+
+// loadGatewaySchema reads a GatewaySchema from the JSON file at path
+func loadGatewaySchema(path string) (GatewaySchema, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var schema GatewaySchema
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return nil, err
+	}
+	for method, params := range schema {
+		for name, idlType := range params {
+			if !gatewayTypes[idlType] {
+				return nil, fmt.Errorf("unknown type %q of param %q of %s", idlType, name, method)
+			}
+		}
+	}
+	return schema, nil
+}
+
+// connKey is the key of the client connection in the context of an HTTP request
+type connKey struct{}
+
+// StartGateway serves the HTTP gateway with tls until the load balancer is stopped
+func (lb *LoadBalancer) StartGateway(address string, tlsConfig *tls.Config) error {
+	ln, err := lb.listenClients(address, tlsConfig)
+	if err != nil {
+		return err
+	}
+
+	lb.Mutex.Lock()
+	lb.listeners = append(lb.listeners, ln)
+	lb.Mutex.Unlock()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(gatewayPrefix, lb.handleGateway)
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: lb.ReadTimeout,
+		IdleTimeout:       lb.IdleTimeout,
+		// the connection is kept in the context for the address of the client
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			return context.WithValue(ctx, connKey{}, conn)
+		},
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			switch state {
+			case http.StateNew:
+				lb.emit(Event{Type: ClientConnected, Client: conn.RemoteAddr().String()})
+			case http.StateClosed, http.StateHijacked:
+				lb.emit(Event{Type: ClientDisconnected, Client: conn.RemoteAddr().String()})
+			}
+		},
+	}
+	lb.Mutex.Lock()
+	lb.httpServers = append(lb.httpServers, server)
+	lb.Mutex.Unlock()
+
+	go func() {
+		if err := server.Serve(ln); err != nil && !errors.Is(err, net.ErrClosed) && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("Error in Serve, stopped the HTTP gateway", zap.Error(err))
+		}
+	}()
+
+	logger.Info("HTTP gateway started", zap.String("address", address))
+	return nil
+}
+
+// handleGateway relays the call of a GET request to a server and sends its response back
+func (lb *LoadBalancer) handleGateway(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeGatewayError(w, http.StatusMethodNotAllowed, "only GET is supported")
+		return
+	}
+	method := strings.TrimPrefix(r.URL.Path, gatewayPrefix)
+	if method == "" || strings.Contains(method, "/") {
+		writeGatewayError(w, http.StatusNotFound, "the path must be /rpc/ followed by the method")
+		return
+	}
+
+	params, err := lb.gatewayParams(method, r.URL.Query())
+	if err != nil {
+		writeGatewayError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	request := map[string]interface{}{
+		"method": method,
+		"params": params,
+	}
+	rawRequest, err := json.Marshal(request)
+	if err != nil {
+		writeGatewayError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := lb.limitMethod(request); err != nil {
+		writeGatewayError(w, http.StatusTooManyRequests, err.Error())
+		return
+	}
+
+	conn := r.Context().Value(connKey{}).(net.Conn)
+	logger.Debug("Request received from HTTP client", zap.String("address", conn.RemoteAddr().String()), zap.ByteString("request", rawRequest))
+
+	// the connection belongs to the HTTP server, so it is not watched while waiting for the server
+	response, err := lb.relayMessage(conn, request, rawRequest, true)
+	if err != nil {
+		status := http.StatusBadGateway
+		if errors.Is(err, errNoServer) {
+			status = http.StatusServiceUnavailable
+		}
+		writeGatewayError(w, status, err.Error())
+		return
+	}
+	w.Write(response)
+}
+
+// writeGatewayError sends an error in the native format with the HTTP status
+func writeGatewayError(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	w.Write(errorMessage(nil, message))
+}
+
+// gatewayParams converts the query values to the params of the method,
+// a param must be given at most once
+func (lb *LoadBalancer) gatewayParams(method string, query map[string][]string) (map[string]interface{}, error) {
+	types := lb.GatewaySchema[method]
+	params := make(map[string]interface{}, len(query))
+	for name, values := range query {
+		if len(values) > 1 {
+			return nil, fmt.Errorf("param %q is given more than once", name)
+		}
+		idlType, ok := types[name]
+		if !ok {
+			params[name] = inferParam(values[0])
+			continue
+		}
+		value, err := convertParam(idlType, values[0])
+		if err != nil {
+			return nil, fmt.Errorf("param %q: %v", name, err)
+		}
+		params[name] = value
+	}
+	return params, nil
+}
+
+// convertParam converts a query value to the type of the idl,
+// the numbers are kept as json.Number so the 64-bit integers keep their precision
+func convertParam(idlType string, value string) (interface{}, error) {
+	var err error
+	switch idlType {
+	case "string":
+		return value, nil
+	case "bool":
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b, nil
+		}
+		return nil, fmt.Errorf("invalid bool %q", value)
+	case "bytes":
+		// bytes travel as base64 strings
+		if _, err := base64.StdEncoding.DecodeString(value); err != nil {
+			return nil, fmt.Errorf("invalid base64 %q", value)
+		}
+		return value, nil
+	case "float32":
+		_, err = strconv.ParseFloat(value, 32)
+	case "float64":
+		_, err = strconv.ParseFloat(value, 64)
+	case "int32":
+		_, err = strconv.ParseInt(value, 10, 32)
+	case "int64":
+		_, err = strconv.ParseInt(value, 10, 64)
+	case "uint32":
+		_, err = strconv.ParseUint(value, 10, 32)
+	case "uint64":
+		_, err = strconv.ParseUint(value, 10, 64)
+	}
+	// ParseFloat also accepts e.g. Inf or hex, which are not JSON numbers
+	if err != nil || !json.Valid([]byte(value)) {
+		return nil, fmt.Errorf("invalid %s %q", idlType, value)
+	}
+	return json.Number(value), nil
+}
+
+// inferParam infers the type of a query value of a param not in the schema:
+// true and false are booleans, a JSON number is a number and anything else is a string
+func inferParam(value string) interface{} {
+	if value == "true" || value == "false" {
+		return value == "true"
+	}
+	// a quoted number is unmarshalled to a json.Number too, it is kept as a string
+	var number json.Number
+	if err := json.Unmarshal([]byte(value), &number); err == nil && !strings.HasPrefix(value, `"`) {
+		return number
+	}
+	return value
+}
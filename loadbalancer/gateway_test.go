@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// startGatewayTest starts the gateway of the load balancer and returns a function getting a path from it
+func startGatewayTest(t *testing.T, lb *LoadBalancer) func(path string) (int, map[string]interface{}) {
+	t.Helper()
+	if err := lb.StartGateway("127.0.0.1:0", testTLSConfig(t)); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(lb.Stop)
+	lb.Mutex.Lock()
+	address := lb.listeners[len(lb.listeners)-1].Addr().String()
+	lb.Mutex.Unlock()
+
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+		Timeout:   5 * time.Second,
+	}
+	return func(path string) (int, map[string]interface{}) {
+		t.Helper()
+		response, err := client.Get("https://" + address + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		body, err := io.ReadAll(response.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded map[string]interface{}
+		if err := json.Unmarshal(body, &decoded); err != nil {
+			t.Fatalf("body %q: %v", body, err)
+		}
+		return response.StatusCode, decoded
+	}
+}
+
+// the query values are converted to the types of the schema, or inferred for the params not in it
+func TestGatewayParams(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	lb.GatewaySchema = GatewaySchema{"Add": {"a": "int64", "b": "float64", "name": "string", "ok": "bool"}}
+	backend, requests := startBackend(t, `{"result":3}`)
+	registerTestServer(lb, backend)
+	get := startGatewayTest(t, lb)
+
+	status, response := get("/rpc/Add?a=9007199254740993&b=2.5&name=42&ok=true&n=7&flag=false&s=abc")
+	if status != http.StatusOK || response["result"] != 3.0 {
+		t.Fatalf("got %d %v", status, response)
+	}
+	request := <-requests
+	if request["method"] != "Add" {
+		t.Fatalf("the server got %v", request)
+	}
+	params := request["params"].(map[string]interface{})
+	want := map[string]interface{}{"b": 2.5, "name": "42", "ok": true, "n": 7.0, "flag": false, "s": "abc"}
+	for name, value := range want {
+		if params[name] != value {
+			t.Errorf("param %s is %#v, want %#v", name, params[name], value)
+		}
+	}
+
+	// the int64 is sent as it was given, not rounded through a float64
+	converted, err := lb.gatewayParams("Add", map[string][]string{"a": {"9007199254740993"}})
+	if err != nil || converted["a"] != json.Number("9007199254740993") {
+		t.Fatalf("got %v, %v", converted, err)
+	}
+
+	for _, path := range []string{"/rpc/Add?a=1.5", "/rpc/Add?ok=yes", "/rpc/Add?b=1&b=2"} {
+		if status, response := get(path); status != http.StatusBadRequest || response["error"] == nil {
+			t.Errorf("%s: got %d %v", path, status, response)
+		}
+	}
+}
+
+// a method the server does not know is relayed and its error sent back, a path without a method is not found
+func TestGatewayUnknownMethod(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	backend, requests := startBackend(t, `{"error":"Method not found"}`)
+	registerTestServer(lb, backend)
+	get := startGatewayTest(t, lb)
+
+	status, response := get("/rpc/Nope?x=1")
+	if status != http.StatusOK || response["error"] != "Method not found" {
+		t.Fatalf("got %d %v", status, response)
+	}
+	if request := <-requests; request["method"] != "Nope" {
+		t.Fatalf("the server got %v", request)
+	}
+
+	if status, _ := get("/rpc/"); status != http.StatusNotFound {
+		t.Fatalf("a path without a method got %d", status)
+	}
+}
+
+// a call with no server to route it to is answered with 503, a server failing the relay with 502
+func TestGatewayNoServer(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	get := startGatewayTest(t, lb)
+
+	status, response := get("/rpc/Add?a=1&b=2")
+	if status != http.StatusServiceUnavailable || response["error"] != errNoServer.Error() {
+		t.Fatalf("got %d %v", status, response)
+	}
+
+	// a server closing the connection without answering
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	registerTestServer(lb, ln.Addr().String())
+	if status, response := get("/rpc/Add?a=1&b=2"); status != http.StatusBadGateway {
+		t.Fatalf("got %d %v", status, response)
+	}
+}
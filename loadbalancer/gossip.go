@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Gossip shares the servers of the load balancer with its peers in a cluster,
+// so a server sending heartbeats to one load balancer is routable from all of them.
+// each load balancer periodically pushes its own servers to every peer,
+// servers learned from a peer are not pushed further, so the peers must form a full mesh
+type Gossip struct {
+	Address  string        // address to listen for the gossip of the peers on, also identifies the load balancer
+	Peers    []string      // gossip addresses of the peer load balancers
+	Interval time.Duration // interval to push the servers to the peers
+	TTL      time.Duration // time a gossiped server stays routable without being gossiped again
+}
+
+// gossipTimeout is the time to connect to a peer and exchange a gossip message
+const gossipTimeout = 2 * time.Second
+
+// gossipMessage is the list of servers a load balancer pushes to its peers
+type gossipMessage struct {
+	From      string          `json:"from"`          // gossip address of the sender
+	Timestamp int64           `json:"ts"`            // unix milliseconds, signed with the servers
+	Servers   json.RawMessage `json:"servers"`       // []gossipServer, kept raw to verify the signature
+	MAC       string          `json:"mac,omitempty"` // HMAC of the message with the heartbeat secret
+}
+
+// gossipServer is a server in a gossip message
+type gossipServer struct {
+	Address      string            `json:"address"`                // serving address
+	Addresses    []string          `json:"addresses,omitempty"`    // addresses advertised by a multi-homed server
+	Capabilities map[string]string `json:"capabilities,omitempty"` // capabilities advertised by the server
+	Load         float64           `json:"load"`
+	Ready        bool              `json:"ready"`
+}
+
+// StartGossip listens for the gossip of the peers and starts pushing the servers to them
+// until the load balancer is stopped
+func (lb *LoadBalancer) StartGossip(g *Gossip) error {
+	ln, err := net.Listen("tcp", g.Address)
+	if err != nil {
+		return err
+	}
+
+	lb.Mutex.Lock()
+	lb.Gossip = g
+	lb.listeners = append(lb.listeners, ln)
+	lb.Mutex.Unlock()
+
+	go lb.serveGossip(ln)
+	go lb.pushGossip(g)
+
+	logger.Info("Gossip started", zap.String("address", g.Address), zap.Strings("peers", g.Peers))
+	return nil
+}
+
+// serveGossip accepts the connections of the peers, each one carries a gossip message
+func (lb *LoadBalancer) serveGossip(ln net.Listener) {
+	backoff := &acceptBackoff{max: lb.AcceptBackoffMax}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if backoff.retry(err) {
+				continue
+			}
+			logger.Error("Error in Accept, stopped listening for gossip", zap.Error(err))
+			return
+		}
+		backoff.reset()
+		go lb.handleGossip(conn)
+	}
+}
+
+// handleGossip reads a gossip message from a peer and merges its servers
+func (lb *LoadBalancer) handleGossip(conn net.Conn) {
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(gossipTimeout))
+
+	var message gossipMessage
+	if err := json.NewDecoder(conn).Decode(&message); err != nil {
+		logger.Error("Error in decoding gossip", zap.String("address", conn.RemoteAddr().String()), zap.Error(err))
+		return
+	}
+	if err := lb.verifyGossip(&message); err != nil {
+		logger.Error("Rejected gossip", zap.String("from", message.From), zap.Error(err))
+		return
+	}
+
+	var servers []gossipServer
+	if err := json.Unmarshal(message.Servers, &servers); err != nil {
+		logger.Error("Malformed gossip", zap.String("from", message.From), zap.Error(err))
+		return
+	}
+	lb.mergeGossip(message.From, servers)
+}
+
+// verifyGossip checks the signature and the timestamp of a gossip message like a heartbeat,
+// every message is accepted if no heartbeat secret is configured
+func (lb *LoadBalancer) verifyGossip(message *gossipMessage) error {
+	if len(lb.HeartbeatSecret) == 0 {
+		return nil
+	}
+	expected := signGossip(lb.HeartbeatSecret, message)
+	if !hmac.Equal([]byte(message.MAC), []byte(expected)) {
+		return errors.New("invalid gossip signature")
+	}
+	skew := time.Since(time.UnixMilli(message.Timestamp))
+	if skew > maxHeartbeatSkew || skew < -maxHeartbeatSkew {
+		return fmt.Errorf("stale gossip, timestamp is %s off", skew)
+	}
+	return nil
+}
+
+// signGossip returns the hex encoded HMAC-SHA256 of the sender, the timestamp and the servers of a gossip message
+func signGossip(secret []byte, message *gossipMessage) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s:%d:%s", message.From, message.Timestamp, message.Servers)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// mergeGossip adds or refreshes the servers gossiped by a peer and removes the servers
+// the peer does not gossip anymore, e.g. because they unregistered from it.
+// servers known locally are skipped so a server is not routed to twice
+func (lb *LoadBalancer) mergeGossip(peer string, servers []gossipServer) {
+	lb.Mutex.Lock()
+	defer lb.Mutex.Unlock()
+
+	// serving addresses of the servers known locally
+	local := make(map[string]bool)
+	for _, server := range lb.Servers {
+		if server.GossipPeer == "" {
+			local[server.ServingAddress] = true
+		}
+	}
+
+	gossiped := make(map[string]bool, len(servers))
+	for _, s := range servers {
+		if _, _, err := net.SplitHostPort(s.Address); err != nil || local[s.Address] {
+			continue
+		}
+		gossiped[s.Address] = true
+
+		// gossiped servers are keyed by their serving address
+		if server, ok := lb.Servers[s.Address]; ok {
+			server.LastGossip = time.Now()
+			server.GossipPeer = peer
+			server.ServingAddresses = s.Addresses
+			server.Capabilities = s.Capabilities
+			server.Load = s.Load
+			server.Ready = s.Ready
+			continue
+		}
+
+		lb.Servers[s.Address] = &ServerInfo{
+			ServingAddress:   s.Address,
+			ServingAddresses: s.Addresses,
+			Capabilities:     s.Capabilities,
+			GossipPeer:       peer,
+			LastGossip:       time.Now(),
+			IsHealthy:        true,
+			Ready:            s.Ready,
+			Load:             s.Load,
+		}
+		lb.ServerKeys = append(lb.ServerKeys, s.Address)
+		logger.Debug("Gossiped server added", zap.String("address", s.Address), zap.String("peer", peer))
+	}
+
+	// the peer is the only source of its servers, those it left out are gone
+	for key, server := range lb.Servers {
+		if server.GossipPeer == peer && !gossiped[key] {
+			lb.removeServer(key)
+			logger.Debug("Gossiped server removed", zap.String("address", key), zap.String("peer", peer))
+		}
+	}
+}
+
+// removeGossiped removes the gossiped server with the serving address once it is known locally,
+// e.g. when it starts sending heartbeats to this load balancer too. lb.Mutex must be held
+func (lb *LoadBalancer) removeGossiped(servingAddress string) {
+	if server, ok := lb.Servers[servingAddress]; ok && server.GossipPeer != "" {
+		lb.removeServer(servingAddress)
+	}
+}
+
+// gossipExpired reports whether a gossiped server was not gossiped again for the ttl,
+// e.g. because its peer is down
+func (server *ServerInfo) gossipExpired(ttl time.Duration) bool {
+	return server.GossipPeer != "" && time.Since(server.LastGossip) > ttl
+}
+
+// pushGossip pushes the local servers to every peer each interval until the load balancer is stopped
+func (lb *LoadBalancer) pushGossip(g *Gossip) {
+	for {
+		select {
+		case <-lb.done:
+			return
+		case <-time.After(g.Interval):
+		}
+
+		message, err := lb.gossipMessage(g.Address)
+		if err != nil {
+			logger.Error("Error in encoding gossip", zap.Error(err))
+			continue
+		}
+		for _, peer := range g.Peers {
+			go sendGossip(peer, message)
+		}
+	}
+}
+
+// gossipMessage returns the message listing the local servers, signed if a heartbeat secret is configured
+func (lb *LoadBalancer) gossipMessage(from string) (*gossipMessage, error) {
+	lb.Mutex.Lock()
+	servers := make([]gossipServer, 0, len(lb.ServerKeys))
+	for _, key := range lb.ServerKeys {
+		server := lb.Servers[key]
+		if server.GossipPeer != "" {
+			continue
+		}
+		servers = append(servers, gossipServer{
+			Address:      server.ServingAddress,
+			Addresses:    server.ServingAddresses,
+			Capabilities: server.Capabilities,
+			Load:         server.Load,
+			Ready:        server.Ready,
+		})
+	}
+	lb.Mutex.Unlock()
+
+	raw, err := json.Marshal(servers)
+	if err != nil {
+		return nil, err
+	}
+	message := &gossipMessage{From: from, Timestamp: time.Now().UnixMilli(), Servers: raw}
+	if len(lb.HeartbeatSecret) > 0 {
+		message.MAC = signGossip(lb.HeartbeatSecret, message)
+	}
+	return message, nil
+}
+
+// sendGossip sends a gossip message to a peer, a peer which is down misses the message
+func sendGossip(peer string, message *gossipMessage) {
+	conn, err := net.DialTimeout("tcp", peer, gossipTimeout)
+	if err != nil {
+		logger.Debug("Error in connecting to peer", zap.String("peer", peer), zap.Error(err))
+		return
+	}
+	defer conn.Close()
+
+	conn.SetWriteDeadline(time.Now().Add(gossipTimeout))
+	if err := json.NewEncoder(conn).Encode(message); err != nil {
+		logger.Debug("Error in sending gossip", zap.String("peer", peer), zap.Error(err))
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// startGossip starts the gossip of the load balancer on the address with the peers, pushing every 20ms,
+// and stops the load balancer when the test ends
+func startGossip(t *testing.T, lb *LoadBalancer, address string, peers ...string) {
+	t.Helper()
+	if err := lb.StartGossip(&Gossip{Address: address, Peers: peers, Interval: 20 * time.Millisecond, TTL: 200 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(lb.Stop)
+}
+
+// pushGossip sends a gossip message listing the servers to the load balancer as the peer
+func pushGossip(t *testing.T, lb *LoadBalancer, peer string, secret []byte, servers ...gossipServer) {
+	t.Helper()
+	raw, err := json.Marshal(servers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := &gossipMessage{From: peer, Timestamp: time.Now().UnixMilli(), Servers: raw}
+	if secret != nil {
+		message.MAC = signGossip(secret, message)
+	}
+	sendGossip(lb.Gossip.Address, message)
+}
+
+// a server sending heartbeats to one load balancer of a cluster is routable from the other one,
+// and is removed from it once it is gone from the first one
+func TestGossipSharedBackend(t *testing.T) {
+	backend, requests := startBackend(t, `{"result":3}`)
+	first, second := NewLoadBalancer(time.Second), NewLoadBalancer(time.Second)
+	firstAddress, secondAddress := closedAddress(t), closedAddress(t)
+	startGossip(t, first, firstAddress, secondAddress)
+	startGossip(t, second, secondAddress, firstAddress)
+
+	heartbeat := heartbeatConn(t, first)
+	heartbeat.Encode(map[string]interface{}{"heartbeat": true, "ready": true, "port": "8081", "addresses": []string{backend}})
+	waitFor(t, "the gossiped server", func() bool { return len(second.Snapshot()) == 1 })
+	if server := second.Snapshot()[0]; server.ServingAddress != backend || server.GossipPeer != firstAddress || !server.Ready {
+		t.Fatalf("got %+v", server)
+	}
+
+	if response := relayTestRequest(t, second, `{"method":"Add","params":{"a":1,"b":2}}`); response["result"] != 3.0 {
+		t.Fatalf("got %v", response)
+	}
+	if len(requests) != 1 {
+		t.Fatalf("the server got %d requests, want 1", len(requests))
+	}
+
+	// the gossiped server is not gossiped back to the load balancer it is known by
+	time.Sleep(100 * time.Millisecond)
+	if servers := first.Snapshot(); len(servers) != 1 || servers[0].GossipPeer != "" {
+		t.Fatalf("the first load balancer has %+v", servers)
+	}
+
+	first.Mutex.Lock()
+	first.removeServer("pipe")
+	first.Mutex.Unlock()
+	waitFor(t, "the removal of the gossiped server", func() bool { return len(second.Snapshot()) == 0 })
+}
+
+// a gossiped server is evicted once its peer stops gossiping it for the ttl
+func TestGossipTTL(t *testing.T) {
+	lb := NewLoadBalancer(time.Minute)
+	lb.ScanInterval = 10 * time.Millisecond
+	startGossip(t, lb, closedAddress(t))
+	go lb.MonitorHeartbeats()
+
+	pushGossip(t, lb, "10.0.0.2:7071", nil, gossipServer{Address: "10.0.0.1:8081", Ready: true})
+	waitFor(t, "the gossiped server", func() bool { return len(lb.Snapshot()) == 1 })
+
+	start := time.Now()
+	waitFor(t, "the eviction of the gossiped server", func() bool { return len(lb.Snapshot()) == 0 })
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Fatalf("the gossiped server is evicted after %v, before its ttl", elapsed)
+	}
+}
+
+// a server known locally is not added again from the gossip, and the gossip of a peer
+// is rejected without the signature of the heartbeat secret
+func TestGossipMerge(t *testing.T) {
+	lb := NewLoadBalancer(time.Minute)
+	lb.HeartbeatSecret = []byte("secret")
+	startGossip(t, lb, closedAddress(t))
+	registerTestServer(lb, "10.0.0.1:8081")
+
+	pushGossip(t, lb, "10.0.0.5:7071", nil, gossipServer{Address: "10.0.0.3:8081", Ready: true})
+	pushGossip(t, lb, "10.0.0.5:7071", []byte("other"), gossipServer{Address: "10.0.0.3:8081", Ready: true})
+	pushGossip(t, lb, "10.0.0.2:7071", []byte("secret"), gossipServer{Address: "10.0.0.1:8081", Ready: true}, gossipServer{Address: "10.0.0.4:8081"}, gossipServer{Address: "invalid"})
+	waitFor(t, "the gossiped server", func() bool { return len(lb.Snapshot()) == 2 })
+	time.Sleep(50 * time.Millisecond)
+
+	servers := map[string]ServerSnapshot{}
+	for _, server := range lb.Snapshot() {
+		servers[server.ServingAddress] = server
+	}
+	if local := servers["10.0.0.1:8081"]; local.GossipPeer != "" || local.HeartbeatAddress != "hb-10.0.0.1:8081" {
+		t.Errorf("the local server is replaced by %+v", local)
+	}
+	if gossiped := servers["10.0.0.4:8081"]; gossiped.GossipPeer != "10.0.0.2:7071" || gossiped.Ready {
+		t.Errorf("got the gossiped server %+v", gossiped)
+	}
+	if unsigned, ok := servers["10.0.0.3:8081"]; ok || len(servers) != 2 {
+		t.Errorf("the gossip without a valid signature added %+v", unsigned)
+	}
+
+	// the server the peer leaves out of its gossip is removed at once
+	pushGossip(t, lb, "10.0.0.2:7071", []byte("secret"))
+	waitFor(t, "the removal of the gossiped server", func() bool { return len(lb.Snapshot()) == 1 })
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"hash/crc32"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// Hasher hashes the keys and the virtual nodes of a hash ring
+type Hasher interface {
+	Sum64(data []byte) uint64
+}
+
+// HasherFunc adapts a function to the Hasher interface
+type HasherFunc func(data []byte) uint64
+
+func (f HasherFunc) Sum64(data []byte) uint64 {
+	return f(data)
+}
+
+// hashers are the hash functions selectable with LB_HASH, xxhash is the default
+var hashers = map[string]Hasher{
+	"":       HasherFunc(xxhash.Sum64),
+	"xxhash": HasherFunc(xxhash.Sum64),
+	"fnv": HasherFunc(func(data []byte) uint64 {
+		h := fnv.New64a()
+		h.Write(data)
+		return h.Sum64()
+	}),
+	"crc32": HasherFunc(func(data []byte) uint64 {
+		return uint64(crc32.ChecksumIEEE(data))
+	}),
+}
+
+// HashRing maps keys to servers with consistent hashing.
+// each server is placed on the ring as several virtual nodes to smooth the distribution.
+type HashRing struct {
+	hashes  []uint64               // sorted hashes of the virtual nodes
+	servers map[uint64]*ServerInfo // server of each virtual node
+}
+
+// NewHashRing creates a new HashRing of the servers with the given number of virtual nodes per server
+func NewHashRing(hasher Hasher, virtualNodes int, servers []*ServerInfo) *HashRing {
+	ring := &HashRing{
+		servers: make(map[uint64]*ServerInfo),
+	}
+	for _, server := range servers {
+		for i := 0; i < virtualNodes; i++ {
+			hash := hasher.Sum64([]byte(server.ServingAddress + "#" + strconv.Itoa(i)))
+			ring.hashes = append(ring.hashes, hash)
+			ring.servers[hash] = server
+		}
+	}
+	sort.Slice(ring.hashes, func(i, j int) bool { return ring.hashes[i] < ring.hashes[j] })
+	return ring
+}
+
+// Get returns the server of the first virtual node at or after the hash, nil if the ring is empty
+func (ring *HashRing) Get(hash uint64) *ServerInfo {
+	if len(ring.hashes) == 0 {
+		return nil
+	}
+	i := sort.Search(len(ring.hashes), func(i int) bool { return ring.hashes[i] >= hash })
+	if i == len(ring.hashes) {
+		i = 0 // wrap around the ring
+	}
+	return ring.servers[ring.hashes[i]]
+}
+
+// ConsistentHashStrategy selects servers by the consistent hash of the "key" field of the request,
+// so requests with the same key go to the same server as long as it is healthy.
+// requests without a key are left to round-robin.
+type ConsistentHashStrategy struct {
+	hasher       Hasher
+	virtualNodes int
+	ring         *HashRing  // ring of the last healthy servers
+	members      string     // serving addresses of the servers in the ring
+	mutex        sync.Mutex // mutex to lock the ring
+}
+
+// NewConsistentHashStrategy creates a new ConsistentHashStrategy with the given hasher and virtual nodes per server
+func NewConsistentHashStrategy(hasher Hasher, virtualNodes int) *ConsistentHashStrategy {
+	return &ConsistentHashStrategy{
+		hasher:       hasher,
+		virtualNodes: virtualNodes,
+	}
+}
+
+// Select selects the healthy server owning the key of the request on the ring
+func (s *ConsistentHashStrategy) Select(request map[string]interface{}, servers []*ServerInfo) *ServerInfo {
+	key, ok := request["key"].(string)
+	if !ok {
+		return nil
+	}
+
+	healthy := make([]*ServerInfo, 0, len(servers))
+	addresses := make([]string, 0, len(servers))
+	for _, server := range servers {
+		if server.IsHealthy {
+			healthy = append(healthy, server)
+			addresses = append(addresses, server.ServingAddress)
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// rebuild the ring only when the healthy servers change
+	members := strings.Join(addresses, ",")
+	if s.ring == nil || members != s.members {
+		s.ring = NewHashRing(s.hasher, s.virtualNodes, healthy)
+		s.members = members
+	}
+	return s.ring.Get(s.hasher.Sum64([]byte(key)))
+}
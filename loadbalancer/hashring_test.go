@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+// ringServers returns n servers with distinct serving addresses
+func ringServers(n int) []*ServerInfo {
+	servers := make([]*ServerInfo, n)
+	for i := range servers {
+		servers[i] = &ServerInfo{ServingAddress: fmt.Sprintf("10.0.0.%d:8080", i+1), IsHealthy: true}
+	}
+	return servers
+}
+
+// distribution returns the share of the keys each server owns on the ring
+func distribution(ring *HashRing, hasher Hasher, keys int) map[string]float64 {
+	shares := make(map[string]float64)
+	for i := 0; i < keys; i++ {
+		shares[ring.Get(hasher.Sum64([]byte(fmt.Sprintf("user-%d", i)))).ServingAddress] += 1 / float64(keys)
+	}
+	return shares
+}
+
+// the keys are spread over the servers with every hash function once the servers have enough virtual nodes,
+// fnv spreads keys differing in their last bytes less evenly than xxhash so it is given a wider tolerance
+func TestHashRingDistribution(t *testing.T) {
+	const servers, keys = 5, 20000
+	tolerances := map[string]float64{"xxhash": 0.15, "crc32": 0.2, "fnv": 0.4}
+	for name, tolerance := range tolerances {
+		hasher := hashers[name]
+		tolerance := tolerance
+		t.Run(name, func(t *testing.T) {
+			shares := distribution(NewHashRing(hasher, 200, ringServers(servers)), hasher, keys)
+			if len(shares) != servers {
+				t.Fatalf("keys went to %d of %d servers", len(shares), servers)
+			}
+			for address, share := range shares {
+				t.Logf("%s owns %.1f%% of the keys", address, 100*share)
+				if math.Abs(share-1.0/servers) > tolerance/servers {
+					t.Errorf("%s owns %.1f%% of the keys, want %.1f%% ±%.0f%%", address, 100*share, 100.0/servers, 100*tolerance)
+				}
+			}
+		})
+	}
+}
+
+// more virtual nodes per server smooth the distribution
+func TestHashRingVirtualNodesSmoothDistribution(t *testing.T) {
+	spread := func(virtualNodes int) float64 {
+		hasher := hashers["xxhash"]
+		lowest, highest := 1.0, 0.0
+		for _, share := range distribution(NewHashRing(hasher, virtualNodes, ringServers(5)), hasher, 20000) {
+			lowest, highest = math.Min(lowest, share), math.Max(highest, share)
+		}
+		return highest - lowest
+	}
+	if one, many := spread(1), spread(200); many >= one {
+		t.Fatalf("spread of the shares is %.3f with 200 virtual nodes, %.3f with 1", many, one)
+	}
+}
+
+// removing a server only moves the keys it owned
+func TestHashRingRemovingServerKeepsOtherKeys(t *testing.T) {
+	hasher := hashers["xxhash"]
+	servers := ringServers(4)
+	before, after := NewHashRing(hasher, 100, servers), NewHashRing(hasher, 100, servers[1:])
+	for i := 0; i < 1000; i++ {
+		hash := hasher.Sum64([]byte(fmt.Sprintf("user-%d", i)))
+		if owner := before.Get(hash); owner != servers[0] && after.Get(hash) != owner {
+			t.Fatalf("key %d moved from %s to %s", i, owner.ServingAddress, after.Get(hash).ServingAddress)
+		}
+	}
+	if NewHashRing(hasher, 100, nil).Get(1) != nil {
+		t.Fatal("an empty ring returned a server")
+	}
+}
+
+// the requests with the same key go to the same healthy server, the ones without a key are left to round-robin
+func TestConsistentHashStrategy(t *testing.T) {
+	strategy := NewConsistentHashStrategy(hashers["fnv"], 100)
+	servers := ringServers(3)
+
+	if strategy.Select(map[string]interface{}{"method": "Add"}, servers) != nil {
+		t.Fatal("a request without a key is selected by the ring")
+	}
+	request := map[string]interface{}{"method": "Add", "key": "user-42"}
+	owner := strategy.Select(request, servers)
+	for i := 0; i < 10; i++ {
+		if server := strategy.Select(request, servers); server != owner {
+			t.Fatalf("the key went to %s, then to %s", owner.ServingAddress, server.ServingAddress)
+		}
+	}
+
+	owner.IsHealthy = false
+	if server := strategy.Select(request, servers); server == nil || server == owner {
+		t.Fatalf("the key went to %v after its server became unhealthy", server)
+	}
+	owner.IsHealthy = true
+	if strategy.Select(request, servers) != owner {
+		t.Fatal("the key did not return to its server once healthy")
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// servers send their heartbeats as compact binary messages, or as JSON objects for compatibility,
+// the format of a connection is told apart by its first byte. a binary message is
+//
+//	magic (1 byte) | type (1 byte) | length of the body (uint16) | body
+//
+// and its body, big endian:
+//
+//	flags (1 byte, bit 0 ready, bit 1 draining) | load (float64) | timestamp (int64, 0 if not signed) |
+//	length of the signature (1 byte) | signature | length of the port (1 byte) | port |
+//	JSON object of the nonce, the addresses, the capabilities and the metadata, empty if the message does not carry them
+//
+// it is decoded into the fields of the JSON heartbeats, so both are handled the same way
+
+// heartbeatMagic starts a binary heartbeat, a JSON one starts with '{'
+const heartbeatMagic = 0xB7
+
+// types of the binary heartbeat messages
+const (
+	heartbeatMessage  = 1
+	unregisterMessage = 2
+)
+
+// heartbeatFixedSize is the size of the flags, the load and the timestamp at the start of the body
+const heartbeatFixedSize = 1 + 8 + 8
+
+// readHeartbeat reads the next binary heartbeat message from r and decodes it,
+// the error is io.EOF if r ended before the message
+func readHeartbeat(r io.Reader) (map[string]interface{}, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	if header[0] != heartbeatMagic {
+		return nil, fmt.Errorf("invalid magic byte %#x", header[0])
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[2:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return decodeHeartbeat(header[1], body)
+}
+
+// decodeHeartbeat decodes the body of a binary heartbeat message of the type into the fields of a JSON heartbeat
+func decodeHeartbeat(kind byte, body []byte) (map[string]interface{}, error) {
+	if len(body) < heartbeatFixedSize {
+		return nil, errors.New("heartbeat too short")
+	}
+	request := make(map[string]interface{}, 8)
+	switch kind {
+	case heartbeatMessage:
+		request["heartbeat"] = true
+		request["ready"] = body[0]&1 != 0
+		if body[0]&2 != 0 {
+			request["draining"] = true
+		}
+		request["load"] = math.Float64frombits(binary.BigEndian.Uint64(body[1:9]))
+	case unregisterMessage:
+		request["unregister"] = true
+	default:
+		return nil, fmt.Errorf("unknown heartbeat type %d", kind)
+	}
+	timestamp := int64(binary.BigEndian.Uint64(body[9:17]))
+
+	rest := body[heartbeatFixedSize:]
+	mac, rest, err := readHeartbeatString(rest)
+	if err != nil {
+		return nil, err
+	}
+	port, rest, err := readHeartbeatString(rest)
+	if err != nil {
+		return nil, err
+	}
+	// the timestamp is a number of the JSON heartbeats
+	if mac != "" {
+		request["ts"] = float64(timestamp)
+		request["mac"] = mac
+	}
+	if port != "" {
+		request["port"] = port
+	}
+
+	// the nonce, the addresses, the capabilities and the metadata are only sent with the first heartbeat and when they change
+	if len(rest) > 0 {
+		var extra map[string]interface{}
+		if err := json.Unmarshal(rest, &extra); err != nil {
+			return nil, fmt.Errorf("invalid nonce, addresses, capabilities and metadata: %v", err)
+		}
+		for _, key := range []string{"nonce", "addresses", "capabilities", "metadata"} {
+			if value, ok := extra[key]; ok {
+				request[key] = value
+			}
+		}
+	}
+	return request, nil
+}
+
+// readHeartbeatString reads a string prefixed by its length in one byte and returns the bytes after it
+func readHeartbeatString(data []byte) (string, []byte, error) {
+	if len(data) < 1 || len(data) < 1+int(data[0]) {
+		return "", nil, errors.New("heartbeat too short")
+	}
+	n := 1 + int(data[0])
+	return string(data[1:n]), data[n:], nil
+}
@@ -0,0 +1,652 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"math"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+var testSecret = []byte("s3cret")
+
+// signedHeartbeat signs the fields like a server and returns them as the load balancer decodes them
+func signedHeartbeat(t testing.TB, fields map[string]interface{}, timestamp int64) map[string]interface{} {
+	t.Helper()
+	fields["ts"] = timestamp
+	fields["mac"] = signHeartbeat(testSecret, timestamp, fields)
+	encoded, err := json.Marshal(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var request map[string]interface{}
+	if err := json.Unmarshal(encoded, &request); err != nil {
+		t.Fatal(err)
+	}
+	return request
+}
+
+func firstHeartbeat() map[string]interface{} {
+	return map[string]interface{}{
+		"heartbeat":    true,
+		"ready":        true,
+		"load":         0.25,
+		"port":         "8081",
+		"nonce":        "0123456789abcdef",
+		"addresses":    []string{"10.0.0.1:8081"},
+		"capabilities": map[string]string{"gpu": "true"},
+		"metadata":     map[string]string{"version": "2.1"},
+	}
+}
+
+func TestVerifyHeartbeat(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	lb.HeartbeatSecret = testSecret
+
+	now := time.Now().UnixMilli()
+	timestamp, err := lb.verifyHeartbeat(signedHeartbeat(t, firstHeartbeat(), now), 0)
+	if err != nil || timestamp != now {
+		t.Fatalf("first heartbeat: got %d, %v", timestamp, err)
+	}
+	next := map[string]interface{}{"heartbeat": true, "ready": true, "load": 0.5}
+	if _, err := lb.verifyHeartbeat(signedHeartbeat(t, next, now+1), now); err != nil {
+		t.Fatalf("next heartbeat: %v", err)
+	}
+
+	// every heartbeat is accepted without a secret
+	lb.HeartbeatSecret = nil
+	if _, err := lb.verifyHeartbeat(map[string]interface{}{"heartbeat": true}, now); err != nil {
+		t.Fatalf("unsigned heartbeat without a secret: %v", err)
+	}
+}
+
+// every field the load balancer acts on is signed, so changing or adding any of them fails the signature
+func TestVerifyHeartbeatRejectsForgedFields(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	lb.HeartbeatSecret = testSecret
+
+	forgeries := map[string]func(request map[string]interface{}){
+		"load":         func(r map[string]interface{}) { r["load"] = 0.0 },
+		"ready":        func(r map[string]interface{}) { r["ready"] = false },
+		"draining":     func(r map[string]interface{}) { r["draining"] = true },
+		"unregister":   func(r map[string]interface{}) { r["unregister"] = true },
+		"port":         func(r map[string]interface{}) { r["port"] = "9090" },
+		"nonce":        func(r map[string]interface{}) { r["nonce"] = "fedcba9876543210" },
+		"addresses":    func(r map[string]interface{}) { r["addresses"] = []interface{}{"10.6.6.6:8081"} },
+		"capabilities": func(r map[string]interface{}) { r["capabilities"] = map[string]interface{}{"gpu": "false"} },
+		"metadata":     func(r map[string]interface{}) { delete(r, "metadata") },
+	}
+	for field, forge := range forgeries {
+		t.Run(field, func(t *testing.T) {
+			request := signedHeartbeat(t, firstHeartbeat(), time.Now().UnixMilli())
+			forge(request)
+			if _, err := lb.verifyHeartbeat(request, 0); err == nil || err.Error() != "invalid heartbeat signature" {
+				t.Fatalf("forged %s accepted: %v", field, err)
+			}
+		})
+	}
+}
+
+func TestVerifyHeartbeatRejectsOutOfOrderAndStale(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	lb.HeartbeatSecret = testSecret
+
+	now := time.Now().UnixMilli()
+	heartbeat := map[string]interface{}{"heartbeat": true, "ready": true, "load": 0.0}
+	if _, err := lb.verifyHeartbeat(signedHeartbeat(t, heartbeat, now), now); err == nil {
+		t.Error("heartbeat with the timestamp of the last one accepted")
+	}
+	if _, err := lb.verifyHeartbeat(signedHeartbeat(t, heartbeat, now-1), now); err == nil {
+		t.Error("heartbeat older than the last one accepted")
+	}
+	stale := now - (maxHeartbeatSkew + time.Second).Milliseconds()
+	if _, err := lb.verifyHeartbeat(signedHeartbeat(t, heartbeat, stale), 0); err == nil {
+		t.Error("stale heartbeat accepted")
+	}
+	if _, err := lb.verifyHeartbeat(map[string]interface{}{"heartbeat": true, "ts": float64(now)}, 0); err == nil {
+		t.Error("unsigned heartbeat accepted")
+	}
+}
+
+func TestVerifyHeartbeatRequiresNonce(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	lb.HeartbeatSecret = testSecret
+
+	heartbeat := firstHeartbeat()
+	delete(heartbeat, "nonce")
+	if _, err := lb.verifyHeartbeat(signedHeartbeat(t, heartbeat, time.Now().UnixMilli()), 0); err == nil {
+		t.Fatal("first heartbeat without a nonce accepted")
+	}
+}
+
+// a heartbeat which is not a JSON object is logged with its bytes and its connection closed
+func TestNonObjectHeartbeat(t *testing.T) {
+	for _, heartbeat := range []string{`[{"heartbeat":true,"port":"8081"}]`, `"heartbeat"`, `null`} {
+		logs := observeLogs(t, zapcore.ErrorLevel)
+		lb := NewLoadBalancer(time.Second)
+		server, lbSide := net.Pipe()
+		go lb.handleHeartbeat(lbSide)
+
+		server.SetDeadline(time.Now().Add(2 * time.Second))
+		if _, err := server.Write([]byte(heartbeat + "\n")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := server.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("%s: connection not closed: %v", heartbeat, err)
+		}
+		server.Close()
+
+		entries := logs.FilterMessage("Malformed heartbeat, closing connection").All()
+		if len(entries) != 1 || entries[0].ContextMap()["raw"] != heartbeat || entries[0].ContextMap()["address"] != "pipe" {
+			t.Fatalf("%s: got logs %v", heartbeat, logs.All())
+		}
+		if len(lb.Servers) != 0 {
+			t.Fatalf("%s: registered a server", heartbeat)
+		}
+	}
+}
+
+// an unregister message removes the server and closes its heartbeat connection
+func TestUnregister(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	server, lbSide := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		lb.handleHeartbeat(lbSide)
+		close(done)
+	}()
+	defer server.Close()
+
+	encoder := json.NewEncoder(server)
+	encoder.Encode(map[string]interface{}{"heartbeat": true, "port": "8081"})
+	waitFor(t, "the registration", func() bool {
+		lb.Mutex.Lock()
+		defer lb.Mutex.Unlock()
+		return len(lb.ServerKeys) == 1
+	})
+
+	encoder.Encode(map[string]interface{}{"unregister": true})
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the heartbeat connection is not closed")
+	}
+	if len(lb.Servers) != 0 || len(lb.ServerKeys) != 0 {
+		t.Fatalf("server not removed: %v", lb.ServerKeys)
+	}
+}
+
+// a server missing its heartbeats is evicted at most a scan interval after the timeout, not a timeout later
+func TestScanInterval(t *testing.T) {
+	lb := NewLoadBalancer(200 * time.Millisecond)
+	lb.ScanInterval = 20 * time.Millisecond
+	defer lb.Stop()
+	silent := registerTestServer(lb, "10.0.0.1:8080")
+	go lb.MonitorHeartbeats()
+
+	waitFor(t, "the eviction of the server", func() bool {
+		lb.Mutex.Lock()
+		defer lb.Mutex.Unlock()
+		return len(lb.Servers) == 0
+	})
+	if elapsed := time.Since(silent.LastHeartbeat); elapsed < lb.Timeout || elapsed > lb.Timeout+150*time.Millisecond {
+		t.Fatalf("the server is evicted %v after its last heartbeat, want %v to %v", elapsed, lb.Timeout, lb.Timeout+lb.ScanInterval)
+	}
+}
+
+// a probe-backed server has no heartbeat connection and is evicted by its probes, never by the heartbeat timeout
+func TestMonitorHeartbeatsProbeBackedServer(t *testing.T) {
+	lb := NewLoadBalancer(50 * time.Millisecond)
+	lb.ScanInterval = 10 * time.Millisecond
+	defer lb.Stop()
+
+	probed := &ServerInfo{ServingAddress: "10.0.0.1:8080", ProbeBacked: true, LastProbe: time.Now(), ProbeTimeout: time.Hour, IsHealthy: true}
+	unprobed := &ServerInfo{ServingAddress: "10.0.0.2:8080", ProbeBacked: true, LastProbe: time.Now(), ProbeTimeout: 100 * time.Millisecond, IsHealthy: true}
+	lb.Mutex.Lock()
+	for _, server := range []*ServerInfo{probed, unprobed} {
+		lb.Servers[server.ServingAddress] = server
+		lb.ServerKeys = append(lb.ServerKeys, server.ServingAddress)
+	}
+	lb.Mutex.Unlock()
+	silent := registerTestServer(lb, "10.0.0.3:8080")
+
+	go lb.MonitorHeartbeats()
+
+	registered := func(key string) bool {
+		lb.Mutex.Lock()
+		defer lb.Mutex.Unlock()
+		_, ok := lb.Servers[key]
+		return ok
+	}
+	waitFor(t, "the eviction of the server missing its heartbeats", func() bool { return !registered(silent.HeartbeatAddress) })
+	if !registered(unprobed.ServingAddress) {
+		t.Fatal("the probe-backed server is evicted by the heartbeat timeout")
+	}
+	waitFor(t, "the eviction of the server missing its probes", func() bool { return !registered(unprobed.ServingAddress) })
+
+	time.Sleep(50 * time.Millisecond)
+	if !registered(probed.ServingAddress) {
+		t.Fatal("the probe-backed server passing its probes is evicted")
+	}
+	lb.Mutex.Lock()
+	defer lb.Mutex.Unlock()
+	if unprobed.IsHealthy || silent.IsHealthy {
+		t.Fatal("an evicted server is still healthy")
+	}
+}
+
+// heartbeats arriving progressively later are warned about once, when the mean interval of the window
+// exceeds the heartbeat interval by SlowHeartbeatFactor, and again once they are back on time
+func TestSlowHeartbeats(t *testing.T) {
+	logs := observeLogs(t, zapcore.InfoLevel)
+	lb := NewLoadBalancer(5 * time.Second)
+	lb.SlowHeartbeatFactor = 1.5
+	server := &ServerInfo{HeartbeatAddress: "10.0.0.1:40000"}
+
+	// feed heartbeats at the given intervals and return the messages logged
+	at := time.Now()
+	feed := func(intervals ...time.Duration) []string {
+		logs.TakeAll()
+		for _, interval := range intervals {
+			at = at.Add(interval)
+			server.LastHeartbeat = at
+			lb.trackHeartbeat(server)
+		}
+		var messages []string
+		for _, entry := range logs.TakeAll() {
+			messages = append(messages, entry.Message)
+		}
+		return messages
+	}
+
+	onTime := make([]time.Duration, heartbeatWindow)
+	for i := range onTime {
+		onTime[i] = heartbeatInterval
+	}
+	if messages := feed(onTime...); len(messages) != 0 {
+		t.Fatalf("heartbeats on time logged %v", messages)
+	}
+
+	// each heartbeat is 100ms later than the previous one, the mean of the window reaches 750ms
+	// at the 6th late heartbeat, while every interval is still far from the eviction timeout
+	var late []time.Duration
+	for i := 1; i <= 5; i++ {
+		late = append(late, heartbeatInterval+time.Duration(i)*100*time.Millisecond)
+	}
+	if messages := feed(late...); len(messages) != 0 {
+		t.Fatalf("the first late heartbeats logged %v", messages)
+	}
+	if messages := feed(1100*time.Millisecond, 1200*time.Millisecond, 1300*time.Millisecond); len(messages) != 1 || messages[0] != "Heartbeats are arriving late" {
+		t.Fatalf("got %v, want a single warning", messages)
+	}
+	if !server.heartbeatsSlow || len(server.heartbeatTimes) != heartbeatWindow {
+		t.Fatalf("slow %v with %d times", server.heartbeatsSlow, len(server.heartbeatTimes))
+	}
+
+	// the warning clears once the window is back on time
+	if messages := feed(onTime...); len(messages) != 1 || messages[0] != "Heartbeats are arriving on time again" || server.heartbeatsSlow {
+		t.Fatalf("got %v", messages)
+	}
+
+	// the tracking is disabled without a factor
+	lb.SlowHeartbeatFactor = 0
+	if messages := feed(10*time.Second, 10*time.Second); len(messages) != 0 || len(server.heartbeatTimes) != heartbeatWindow {
+		t.Fatalf("disabled tracking logged %v", messages)
+	}
+}
+
+// the capabilities of the first heartbeat are stored, replaced by the ones sent again,
+// and kept by the heartbeats without them
+func TestHeartbeatCapabilities(t *testing.T) {
+	logs := observeLogs(t, zapcore.ErrorLevel)
+	lb := NewLoadBalancer(time.Second)
+	server, lbSide := net.Pipe()
+	go lb.handleHeartbeat(lbSide)
+	defer server.Close()
+
+	capabilities := func() map[string]string {
+		lb.Mutex.Lock()
+		defer lb.Mutex.Unlock()
+		if len(lb.ServerKeys) != 1 {
+			return nil
+		}
+		return lb.Servers[lb.ServerKeys[0]].Capabilities
+	}
+	encoder := json.NewEncoder(server)
+	encoder.Encode(map[string]interface{}{"heartbeat": true, "port": "8081", "capabilities": map[string]string{"gpu": "true"}})
+	waitFor(t, "the registration", func() bool { return capabilities()["gpu"] == "true" })
+
+	encoder.Encode(map[string]interface{}{"heartbeat": true, "capabilities": map[string]string{"gpu": "false", "version": "2.1"}})
+	waitFor(t, "the new capabilities", func() bool { return capabilities()["version"] == "2.1" })
+	if got := capabilities(); len(got) != 2 || got["gpu"] != "false" {
+		t.Fatalf("got capabilities %v", got)
+	}
+
+	encoder.Encode(map[string]interface{}{"heartbeat": true, "capabilities": map[string]interface{}{"gpu": true}})
+	waitFor(t, "the invalid capabilities", func() bool {
+		return logs.FilterMessage("Invalid capabilities in the heartbeat request").Len() == 1
+	})
+	encoder.Encode(map[string]interface{}{"heartbeat": true})
+	time.Sleep(50 * time.Millisecond)
+	if got := capabilities(); len(got) != 2 || got["gpu"] != "false" {
+		t.Fatalf("capabilities changed to %v", got)
+	}
+}
+
+// the metadata of the service is signed after the capabilities and stored with the registration,
+// as sent in a JSON or a binary first heartbeat
+func TestHeartbeatMetadata(t *testing.T) {
+	metadata := map[string]string{"version": "2.1", "owner": "math-team"}
+	request := signedHeartbeat(t, map[string]interface{}{"heartbeat": true, "port": "8081", "nonce": "0123456789abcdef", "metadata": metadata}, time.Now().UnixMilli())
+	lb := NewLoadBalancer(time.Second)
+	lb.HeartbeatSecret = testSecret
+	if _, err := lb.verifyHeartbeat(request, 0); err != nil {
+		t.Fatalf("signed metadata rejected: %v", err)
+	}
+	request["metadata"] = map[string]interface{}{"version": "2.2", "owner": "math-team"}
+	if _, err := lb.verifyHeartbeat(request, 0); err == nil || err.Error() != "invalid heartbeat signature" {
+		t.Fatalf("forged metadata accepted: %v", err)
+	}
+
+	first := map[string][]byte{
+		"json":   []byte(`{"heartbeat":true,"port":"8081","metadata":{"version":"2.1","owner":"math-team"}}` + "\n"),
+		"binary": binaryHeartbeat("8081", []byte(`{"metadata":{"version":"2.1","owner":"math-team"}}`)),
+	}
+	for format, message := range first {
+		lb := NewLoadBalancer(time.Second)
+		server, lbSide := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			lb.handleHeartbeat(lbSide)
+			close(done)
+		}()
+		go server.Write(message)
+		waitFor(t, "the registration", func() bool { return len(lb.Snapshot()) == 1 })
+		if got := lb.Snapshot()[0].Metadata; !reflect.DeepEqual(got, metadata) {
+			t.Errorf("%s: got the metadata %v", format, got)
+		}
+		server.Close()
+		<-done
+	}
+
+	if _, err := heartbeatStrings(map[string]interface{}{"metadata": map[string]interface{}{"version": 2.1}}, "metadata"); err == nil || err.Error() != `metadata "version" is not a string` {
+		t.Fatalf("got %v", err)
+	}
+	if _, err := heartbeatStrings(map[string]interface{}{"metadata": "2.1"}, "metadata"); err == nil || err.Error() != "metadata must be an object" {
+		t.Fatalf("got %v", err)
+	}
+}
+
+// a first heartbeat captured and replayed on a new connection, e.g. from another host, must not register a server
+func TestReplayedFirstHeartbeatOnNewConnection(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	lb.HeartbeatSecret = testSecret
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go lb.serveHeartbeats(ln)
+
+	heartbeat := firstHeartbeat()
+	delete(heartbeat, "addresses")
+	captured, _ := json.Marshal(signedHeartbeat(t, heartbeat, time.Now().UnixMilli()))
+	var first string
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write(append(captured, '\n'))
+		if i == 0 {
+			first = conn.LocalAddr().String()
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	// the replay would replace the server registered by the first connection
+	time.Sleep(200 * time.Millisecond)
+	lb.Mutex.Lock()
+	defer lb.Mutex.Unlock()
+	if len(lb.ServerKeys) != 1 || lb.ServerKeys[0] != first {
+		t.Fatalf("got servers %v, want only %s", lb.ServerKeys, first)
+	}
+}
+
+// a server registering again from a new heartbeat connection, e.g. after a quick restart,
+// replaces its stale entry at once instead of sharing the traffic with it until it misses its heartbeats
+func TestServerRegistersAgain(t *testing.T) {
+	lb := NewLoadBalancer(time.Minute)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	register := func() net.Conn {
+		t.Helper()
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		lbSide, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go lb.handleHeartbeat(lbSide)
+		json.NewEncoder(conn).Encode(map[string]interface{}{"heartbeat": true, "ready": true, "port": "8081"})
+		return conn
+	}
+
+	stale := register()
+	waitFor(t, "the registration", func() bool { return len(lb.Snapshot()) == 1 })
+	restarted := register()
+	waitFor(t, "the registration again", func() bool {
+		servers := lb.Snapshot()
+		return len(servers) == 1 && servers[0].HeartbeatAddress == restarted.LocalAddr().String()
+	})
+	if servers := lb.Snapshot(); servers[0].ServingAddress != "127.0.0.1:8081" {
+		t.Fatalf("got %+v", servers[0])
+	}
+
+	// the heartbeat connection of the stale entry is closed
+	stale.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := stale.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("the stale heartbeat connection is not closed: %v", err)
+	}
+}
+
+// FuzzHeartbeat sends arbitrary heartbeats to handleHeartbeat, which must not panic nor register a server
+// whose first heartbeat has no valid port
+func FuzzHeartbeat(f *testing.F) {
+	f.Add([]byte(`{"heartbeat":true,"ready":true,"port":"8081"}`))
+	f.Add([]byte(`{"heartbeat":true,"ready":true,"port":8081}`))
+	f.Add([]byte(`{"heartbeat":true,"ready":true}`))
+	f.Add([]byte(`{"heartbeat":true,"ready":true,"port":["8081"]}`))
+	f.Add([]byte(`{"heartbeat":true,"ready":true,"port":"99999"}`))
+	f.Add([]byte(`{"heartbeat":"yes","port":"8081","addresses":"10.0.0.1:8081","load":"high"}`))
+	f.Add([]byte(`[1,2,3]`))
+	f.Add(binaryHeartbeat("8081", nil))
+	f.Add(binaryHeartbeat("", []byte(`{"capabilities":7}`)))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		lb := NewLoadBalancer(time.Second)
+		registered := make(chan string, 16)
+		lb.AddEventListener(func(event Event) {
+			if event.Type == ServerRegistered {
+				registered <- event.Server
+			}
+		})
+
+		server, lbSide := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			lb.handleHeartbeat(lbSide)
+			close(done)
+		}()
+		// the load balancer may close the connection before reading everything
+		go func() {
+			server.Write(append(data, '\n'))
+			server.Close()
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("handleHeartbeat did not return once the connection is closed")
+		}
+
+		// a single JSON heartbeat registers the server only with a valid port
+		var request map[string]interface{}
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		if err := decoder.Decode(&request); err != nil || decoder.More() {
+			return
+		}
+		if _, err := heartbeatPort(request); err != nil && len(registered) > 0 {
+			t.Fatalf("registered %s with an invalid port: %v", <-registered, err)
+		}
+	})
+}
+
+// binaryHeartbeat encodes a binary heartbeat message as the server stub does, without a signature
+func binaryHeartbeat(port string, extra []byte) []byte {
+	body := make([]byte, heartbeatFixedSize, heartbeatFixedSize+2+len(port)+len(extra))
+	body[0] = 1 // ready
+	binary.BigEndian.PutUint64(body[1:9], math.Float64bits(0.25))
+	body = append(body, 0, byte(len(port)))
+	body = append(append(body, port...), extra...)
+
+	message := []byte{heartbeatMagic, heartbeatMessage, 0, 0}
+	binary.BigEndian.PutUint16(message[2:], uint16(len(body)))
+	return append(message, body...)
+}
+
+// a connection whose first byte is the magic byte sends binary heartbeats, handled like the JSON ones
+func TestBinaryHeartbeat(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	server, lbSide := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		lb.handleHeartbeat(lbSide)
+		close(done)
+	}()
+	defer func() {
+		server.Close()
+		<-done
+	}()
+
+	server.Write(binaryHeartbeat("8081", []byte(`{"capabilities":{"gpu":"true"}}`)))
+	waitFor(t, "the registration", func() bool {
+		lb.Mutex.Lock()
+		defer lb.Mutex.Unlock()
+		return len(lb.Servers) == 1
+	})
+	lb.Mutex.Lock()
+	registered := lb.Servers[lb.ServerKeys[0]]
+	if registered.ServingAddress != ":8081" || !registered.Ready || registered.Load != 0.25 || registered.Capabilities["gpu"] != "true" {
+		lb.Mutex.Unlock()
+		t.Fatalf("registered %+v", registered)
+	}
+	lb.Mutex.Unlock()
+
+	// the next heartbeats carry no port
+	server.Write(binaryHeartbeat("", nil))
+	unregister := []byte{heartbeatMagic, unregisterMessage, 0, heartbeatFixedSize + 2}
+	server.Write(append(unregister, make([]byte, heartbeatFixedSize+2)...))
+	waitFor(t, "the unregistration", func() bool {
+		lb.Mutex.Lock()
+		defer lb.Mutex.Unlock()
+		return len(lb.Servers) == 0
+	})
+}
+
+func TestDecodeHeartbeat(t *testing.T) {
+	message := binaryHeartbeat("8081", []byte(`{"addresses":["10.0.0.1:8081"]}`))
+	request, err := readHeartbeat(bytes.NewReader(message))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"heartbeat": true, "ready": true, "load": 0.25, "port": "8081", "addresses": []interface{}{"10.0.0.1:8081"}}
+	if !reflect.DeepEqual(request, want) {
+		t.Fatalf("got %v, want %v", request, want)
+	}
+
+	// the timestamp is only set with a signature, as a number like in a JSON heartbeat
+	body := make([]byte, heartbeatFixedSize)
+	binary.BigEndian.PutUint64(body[9:17], 1700000000000)
+	body = append(append(body, 3), "mac"...)
+	body = append(body, 0)
+	if request, err := decodeHeartbeat(heartbeatMessage, body); err != nil || request["ts"] != 1700000000000.0 || request["mac"] != "mac" || request["ready"] != false {
+		t.Fatalf("got %v, %v", request, err)
+	}
+
+	cases := map[string][]byte{
+		"invalid magic byte 0x7b":  []byte(`{"heartbeat":true}`),
+		"unknown heartbeat type 9": append([]byte{heartbeatMagic, 9, 0, heartbeatFixedSize + 2}, make([]byte, heartbeatFixedSize+2)...),
+		"heartbeat too short":      append([]byte{heartbeatMagic, heartbeatMessage, 0, 3}, 1, 2, 3),
+		"unexpected EOF":           message[:len(message)-1],
+	}
+	for want, message := range cases {
+		if _, err := readHeartbeat(bytes.NewReader(message)); err == nil || err.Error() != want {
+			t.Errorf("got %v, want %s", err, want)
+		}
+	}
+	if _, err := readHeartbeat(bytes.NewReader(nil)); err != io.EOF {
+		t.Fatalf("got %v at the end of the connection", err)
+	}
+}
+
+// BenchmarkHeartbeat handles the heartbeats of a registered server in both formats,
+// the binary ones are decoded without the allocations of the JSON decoder
+func BenchmarkHeartbeat(b *testing.B) {
+	formats := []struct {
+		name      string
+		first     []byte
+		heartbeat []byte
+	}{
+		{
+			name:      "json",
+			first:     []byte(`{"heartbeat":true,"ready":true,"load":0.25,"port":"8081","capabilities":{"gpu":"true"}}` + "\n"),
+			heartbeat: []byte(`{"heartbeat":true,"ready":true,"load":0.25}` + "\n"),
+		},
+		{
+			name:      "binary",
+			first:     binaryHeartbeat("8081", []byte(`{"capabilities":{"gpu":"true"}}`)),
+			heartbeat: binaryHeartbeat("", nil),
+		},
+	}
+	for _, format := range formats {
+		b.Run(format.name, func(b *testing.B) {
+			lb := NewLoadBalancer(time.Minute)
+			server, lbSide := net.Pipe()
+			done := make(chan struct{})
+			go func() {
+				lb.handleHeartbeat(lbSide)
+				close(done)
+			}()
+
+			writer := bufio.NewWriter(server)
+			writer.Write(format.first)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				writer.Write(format.heartbeat)
+			}
+			writer.Flush()
+			server.Close()
+			<-done
+			b.StopTimer()
+
+			if len(lb.Servers) != 1 {
+				b.Fatalf("got %d servers, want 1", len(lb.Servers))
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// registerTestServer registers a healthy server as its first heartbeat would
+func registerTestServer(lb *LoadBalancer, servingAddress string) *ServerInfo {
+	server := &ServerInfo{
+		HeartbeatAddress: "hb-" + servingAddress,
+		ServingAddress:   servingAddress,
+		LastHeartbeat:    time.Now(),
+		IsHealthy:        true,
+		Ready:            true,
+	}
+	lb.Mutex.Lock()
+	lb.Servers[server.HeartbeatAddress] = server
+	lb.ServerKeys = append(lb.ServerKeys, server.HeartbeatAddress)
+	lb.Mutex.Unlock()
+	return server
+}
+
+// startBackend serves a fake server answering each request with the response and closing the connection
+// like the server stub, it returns the address and the channel receiving each decoded request
+func startBackend(t testing.TB, response string) (string, <-chan map[string]interface{}) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	requests := make(chan map[string]interface{}, 64)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var request map[string]interface{}
+				if err := json.NewDecoder(conn).Decode(&request); err != nil {
+					return
+				}
+				select {
+				case requests <- request:
+				default:
+				}
+				conn.Write([]byte(response + "\n"))
+			}()
+		}
+	}()
+	return ln.Addr().String(), requests
+}
+
+// relayTestRequest sends the raw request of a client to the load balancer and returns the response
+// once the load balancer is done with the request
+func relayTestRequest(t testing.TB, lb *LoadBalancer, rawRequest string) map[string]interface{} {
+	t.Helper()
+	client, lbSide := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		lb.handleRequest(lbSide)
+		close(done)
+	}()
+	go client.Write([]byte(rawRequest + "\n"))
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var response map[string]interface{}
+	err := json.NewDecoder(client).Decode(&response)
+	client.Close()
+	<-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+// startSlowBackend serves a fake server answering each request with {"result":3} after the delay,
+// it returns the address and the channel receiving the time the first request is received
+func startSlowBackend(t *testing.T, delay time.Duration) (string, <-chan time.Time) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	received := make(chan time.Time, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var request map[string]interface{}
+				if err := json.NewDecoder(conn).Decode(&request); err != nil {
+					return
+				}
+				select {
+				case received <- time.Now():
+				default:
+				}
+				time.Sleep(delay)
+				conn.Write([]byte(`{"result":3}` + "\n"))
+			}()
+		}
+	}()
+	return ln.Addr().String(), received
+}
+
+// newTestCertificate returns a self-signed certificate valid for 127.0.0.1 and the pool trusting it
+func newTestCertificate(t testing.TB) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(certificate)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// testTLSConfig returns the tls config of the load balancer with its certificate
+func testTLSConfig(t testing.TB) *tls.Config {
+	t.Helper()
+	certificate, err := tls.LoadX509KeyPair("lb.crt", "lb.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{certificate}}
+}
+
+// heartbeatConn serves a heartbeat connection of the load balancer, a server registers by encoding
+// its heartbeats on the returned encoder. the connection is closed when the test ends
+func heartbeatConn(t testing.TB, lb *LoadBalancer) *json.Encoder {
+	t.Helper()
+	server, lbSide := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		lb.handleHeartbeat(lbSide)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		server.Close()
+		<-done
+	})
+	return json.NewEncoder(server)
+}
+
+// waitFor polls the condition until it holds, failing the test after 2 seconds
+func waitFor(t testing.TB, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// observeLogs replaces the logger with one recording the logs at level or above until the test ends
+func observeLogs(t testing.TB, level zapcore.Level) *observer.ObservedLogs {
+	t.Helper()
+	core, logs := observer.New(level)
+	previous := logger
+	logger = zap.New(core)
+	t.Cleanup(func() { logger = previous })
+	return logs
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startEchoingBackend serves a fake server answering each request after the delay with its params
+// and the id of the request, it returns the address and the number of requests it received
+func startEchoingBackend(t *testing.T, delay time.Duration) (string, *int32) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	var calls int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var request map[string]interface{}
+				if err := json.NewDecoder(conn).Decode(&request); err != nil {
+					return
+				}
+				atomic.AddInt32(&calls, 1)
+				time.Sleep(delay)
+				json.NewEncoder(conn).Encode(map[string]interface{}{"jsonrpc": "2.0", "id": request["id"], "result": request["params"]})
+			}()
+		}
+	}()
+	return ln.Addr().String(), &calls
+}
+
+// concurrent requests with the same idempotency key and params are relayed once, each client gets
+// the response with the id of its own request
+func TestIdempotencyKeySharesResponse(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	backend, calls := startEchoingBackend(t, 200*time.Millisecond)
+	registerTestServer(lb, backend)
+
+	const clients = 8
+	responses := make([]map[string]interface{}, clients)
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			responses[i] = relayTestRequest(t, lb, fmt.Sprintf(`{"jsonrpc":"2.0","id":%d,"method":"Add","params":{"a":1,"b":2},"metadata":{"idempotency-key":"k1"}}`, i))
+		}(i)
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(calls); n != 1 {
+		t.Fatalf("the server got %d calls, want 1", n)
+	}
+	for i, response := range responses {
+		if response["id"] != float64(i) {
+			t.Errorf("client %d got the id %v", i, response["id"])
+		}
+		if result, _ := response["result"].(map[string]interface{}); result["a"] != 1.0 || result["b"] != 2.0 {
+			t.Errorf("client %d got %v", i, response)
+		}
+	}
+}
+
+// requests reusing an idempotency key with other params, or for another method, are relayed on their own
+func TestIdempotencyKeyScopedByParams(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	backend, calls := startEchoingBackend(t, 200*time.Millisecond)
+	registerTestServer(lb, backend)
+
+	requests := []string{
+		`{"method":"Add","params":{"a":1,"b":2},"metadata":{"idempotency-key":"k1"}}`,
+		`{"method":"Add","params":{"a":1,"b":3},"metadata":{"idempotency-key":"k1"}}`,
+		`{"method":"Sub","params":{"a":1,"b":2},"metadata":{"idempotency-key":"k1"}}`,
+	}
+	responses := make([]map[string]interface{}, len(requests))
+	var wg sync.WaitGroup
+	for i, request := range requests {
+		wg.Add(1)
+		go func(i int, request string) {
+			defer wg.Done()
+			responses[i] = relayTestRequest(t, lb, request)
+		}(i, request)
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(calls); n != 3 {
+		t.Fatalf("the server got %d calls, want 3", n)
+	}
+	if result, _ := responses[1]["result"].(map[string]interface{}); result["b"] != 3.0 {
+		t.Fatalf("the request with other params got %v", responses[1])
+	}
+}
@@ -0,0 +1,160 @@
+//go:build integration
+
+// the integration tests run the load balancer, the servers and the client in one process,
+// they need the generated stubs: go run . in generator_server_stub and generator_client_stub,
+// then go test -tags integration ./...
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	clientstub "github.com/denizydmr07/rpc-project/client/stub"
+	serverstub "github.com/denizydmr07/rpc-project/server/stub"
+)
+
+// startTestServer serves the server stub on an ephemeral port and sends its heartbeats to hbAddress,
+// it returns the serving port and the number of connections served, and stops the server when the test ends
+func startTestServer(t *testing.T, hbAddress string) (string, *int64) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	var served int64
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt64(&served, 1)
+			go serverstub.HandleConnection(conn)
+		}
+	}()
+	serverstub.Ready()
+	go func() {
+		defer wg.Done()
+		serverstub.SendHeartbeats(ctx, make(chan struct{}, 1), hbAddress, port)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		ln.Close()
+		wg.Wait()
+	})
+	return port, &served
+}
+
+func TestLoadBalancerServersClient(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	if err := lb.Start("127.0.0.1:0", "127.0.0.1:0", testTLSConfig(t)); err != nil {
+		t.Fatal(err)
+	}
+	defer lb.Stop()
+
+	first, firstServed := startTestServer(t, lb.HeartbeatAddr().String())
+	second, secondServed := startTestServer(t, lb.HeartbeatAddr().String())
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		lb.Mutex.Lock()
+		registered := len(lb.ServerKeys)
+		lb.Mutex.Unlock()
+		if registered == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d servers registered, want 2", registered)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Setenv("LB_CLIENT_ADDRESS", lb.ClientAddr().String())
+
+	for i := 0; i < 2; i++ {
+		if result, err := clientstub.Add(1, 2); err != nil || result != 3 {
+			t.Fatalf("Add(1, 2) = %v, %v", result, err)
+		}
+		if result, err := clientstub.Sub(5, 3); err != nil || result != 2 {
+			t.Fatalf("Sub(5, 3) = %v, %v", result, err)
+		}
+	}
+	// the code of a declared error is relayed to the client
+	if _, err := clientstub.Divide(1, 0); !errors.Is(err, clientstub.ErrDivByZero) {
+		t.Fatalf("Divide(1, 0) = %v, want ErrDivByZero", err)
+	}
+
+	for port, served := range map[string]*int64{first: firstServed, second: secondServed} {
+		if atomic.LoadInt64(served) == 0 {
+			t.Errorf("server on port %s got no request", port)
+		}
+	}
+}
+
+// startStandaloneServer serves the server stub on an ephemeral port without a load balancer,
+// with tls if the config is not nil, and returns its address
+func startStandaloneServer(t *testing.T, tlsConfig *tls.Config) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serverstub.HandleConnection(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// the client stub calls a server directly on RPC_DIRECT_ADDRESS, with tls if RPC_DIRECT_TLS is set,
+// the load balancer it would dial otherwise is down
+func TestClientDirectToServer(t *testing.T) {
+	for _, secure := range []bool{false, true} {
+		name, tlsConfig := "plain", (*tls.Config)(nil)
+		if secure {
+			certificate, _ := newTestCertificate(t)
+			name, tlsConfig = "tls", &tls.Config{Certificates: []tls.Certificate{certificate}}
+		}
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("LB_CLIENT_ADDRESS", closedAddress(t))
+			t.Setenv("RPC_DIRECT_ADDRESS", startStandaloneServer(t, tlsConfig))
+			if secure {
+				t.Setenv("RPC_DIRECT_TLS", "1")
+			}
+
+			if result, err := clientstub.Add(1, 2); err != nil || result != 3 {
+				t.Fatalf("Add(1, 2) = %v, %v", result, err)
+			}
+			if _, err := clientstub.Divide(1, 0); !errors.Is(err, clientstub.ErrDivByZero) {
+				t.Fatalf("Divide(1, 0) = %v, want ErrDivByZero", err)
+			}
+		})
+	}
+
+	// the error names the server, not the load balancer
+	t.Setenv("RPC_DIRECT_ADDRESS", closedAddress(t))
+	if _, err := clientstub.Add(1, 2); err == nil || err.Error() != "Server is down" {
+		t.Fatalf("got %v", err)
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+// the clients may speak JSON-RPC 2.0 instead of the native format, a request is told apart
+// by its "jsonrpc" field. it is relayed verbatim like a native one since the server stub
+// converts it, only the errors of the load balancer are converted here
+
+// jsonrpcServerError is the JSON-RPC 2.0 code of the errors of the load balancer,
+// in the range reserved for implementation-defined server errors
+const jsonrpcServerError = -32000
+
+// errorResponse returns the response to a request failing in the load balancer: a JSON-RPC 2.0
+// error object with the id of the request if it has a "jsonrpc" field, the native error otherwise.
+// the request is nil if it could not be decoded
+func errorResponse(request map[string]interface{}, message string) map[string]interface{} {
+	if _, ok := request["jsonrpc"]; !ok {
+		return map[string]interface{}{"error": message}
+	}
+	return map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      request["id"],
+		"error": map[string]interface{}{
+			"code":    jsonrpcServerError,
+			"message": message,
+		},
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// a JSON-RPC 2.0 request failing in the load balancer is answered with an error object and its id,
+// a native request with the native error
+func TestJSONRPCErrorResponse(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+
+	response := relayTestRequest(t, lb, `{"jsonrpc":"2.0","id":3,"method":"Add","params":[1,2]}`)
+	object, _ := response["error"].(map[string]interface{})
+	if response["jsonrpc"] != "2.0" || response["id"] != 3.0 || object["code"] != float64(jsonrpcServerError) || object["message"] != "No server available" {
+		t.Fatalf("got %v", response)
+	}
+
+	if response := relayTestRequest(t, lb, `{"method":"Add","params":{"a":1,"b":2}}`); response["error"] != "No server available" {
+		t.Fatalf("got %v", response)
+	}
+}
+
+// a JSON-RPC 2.0 request is relayed verbatim, the server stub converts it
+func TestJSONRPCRelayed(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	backend, requests := startBackend(t, `{"jsonrpc":"2.0","id":3,"result":{"result":3}}`)
+	registerTestServer(lb, backend)
+
+	response := relayTestRequest(t, lb, `{"jsonrpc":"2.0","id":3,"method":"Add","params":[1,2]}`)
+	if response["id"] != 3.0 || response["result"].(map[string]interface{})["result"] != 3.0 {
+		t.Fatalf("got %v", response)
+	}
+	if request := <-requests; request["jsonrpc"] != "2.0" || request["id"] != 3.0 {
+		t.Fatalf("the server received %v", request)
+	}
+}
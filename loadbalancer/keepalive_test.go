@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// serveClient handles the requests of a client connection as the load balancer does
+// and returns the client side of the connection
+func serveClient(t *testing.T, lb *LoadBalancer) net.Conn {
+	t.Helper()
+	client, lbSide := net.Pipe()
+	go lb.handleRequest(lbSide)
+	t.Cleanup(func() { client.Close() })
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	return client
+}
+
+// a client keeping its connection alive sends its requests one after the other on it,
+// a request without keepalive is the last one of the connection
+func TestKeepAlive(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	backend, requests := startBackend(t, `{"result":3}`)
+	registerTestServer(lb, backend)
+
+	client := serveClient(t, lb)
+	encoder, decoder := json.NewEncoder(client), json.NewDecoder(client)
+	for i := 0; i < 3; i++ {
+		encoder.Encode(map[string]interface{}{"method": "Add", "params": map[string]interface{}{"a": 1, "b": 2}, "keepalive": true})
+		var response map[string]interface{}
+		if err := decoder.Decode(&response); err != nil || response["result"] != 3.0 {
+			t.Fatalf("request %d: got %v, %v", i, response, err)
+		}
+	}
+	encoder.Encode(map[string]interface{}{"method": "Add", "params": map[string]interface{}{"a": 1, "b": 2}})
+	var response map[string]interface{}
+	if err := decoder.Decode(&response); err != nil || response["result"] != 3.0 {
+		t.Fatalf("last request: got %v, %v", response, err)
+	}
+	if err := decoder.Decode(&response); err != io.EOF {
+		t.Fatalf("the connection is open after a request without keepalive: %v", err)
+	}
+	if len(requests) != 4 {
+		t.Fatalf("the server got %d requests, want 4", len(requests))
+	}
+}
+
+// a kept-alive connection is closed once it stays idle for IdleTimeout, keep-alive is disabled without one
+func TestKeepAliveIdleTimeout(t *testing.T) {
+	for _, timeout := range []time.Duration{100 * time.Millisecond, 0} {
+		lb := NewLoadBalancer(time.Second)
+		lb.IdleTimeout = timeout
+		backend, _ := startBackend(t, `{"result":3}`)
+		registerTestServer(lb, backend)
+
+		client := serveClient(t, lb)
+		decoder := json.NewDecoder(client)
+		json.NewEncoder(client).Encode(map[string]interface{}{"method": "Add", "params": map[string]interface{}{"a": 1, "b": 2}, "keepalive": true})
+		var response map[string]interface{}
+		if err := decoder.Decode(&response); err != nil || response["result"] != 3.0 {
+			t.Fatalf("IdleTimeout %v: got %v, %v", timeout, response, err)
+		}
+
+		start := time.Now()
+		if err := decoder.Decode(&response); err != io.EOF {
+			t.Fatalf("IdleTimeout %v: got %v, want the connection closed", timeout, err)
+		}
+		if elapsed := time.Since(start); elapsed < timeout || elapsed > timeout+time.Second {
+			t.Errorf("IdleTimeout %v: the idle connection is closed after %v", timeout, elapsed)
+		}
+	}
+}
+
+// BenchmarkClientConnection sends a request to the load balancer over tls with a full handshake per request,
+// a resumed tls session per request and a kept-alive connection, to measure what the client pool saves.
+// the certificate is generated, the client does not resume a session of an expired certificate
+func BenchmarkClientConnection(b *testing.B) {
+	backend, _ := startBackend(b, `{"result":3}`)
+	lb := NewLoadBalancer(time.Minute)
+	registerTestServer(lb, backend)
+	certificate, _ := newTestCertificate(b)
+	if err := lb.Start("127.0.0.1:0", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{certificate}}); err != nil {
+		b.Fatal(err)
+	}
+	defer lb.Stop()
+	address := lb.ClientAddr().String()
+
+	// call sends a request on the connection and checks its response
+	call := func(conn net.Conn, decoder *json.Decoder, keepAlive bool) {
+		request := map[string]interface{}{"method": "Add", "params": map[string]interface{}{"a": 1, "b": 2}, "keepalive": keepAlive}
+		if err := json.NewEncoder(conn).Encode(request); err != nil {
+			b.Fatal(err)
+		}
+		var response map[string]interface{}
+		if err := decoder.Decode(&response); err != nil || response["result"] != 3.0 {
+			b.Fatalf("got %v, %v", response, err)
+		}
+	}
+	// connectEach dials a connection per request with the tls config
+	connectEach := func(b *testing.B, config *tls.Config) {
+		for i := 0; i < b.N; i++ {
+			conn, err := tls.Dial("tcp", address, config)
+			if err != nil {
+				b.Fatal(err)
+			}
+			call(conn, json.NewDecoder(conn), false)
+			conn.Close()
+			if resumed := conn.ConnectionState().DidResume; i > 0 && resumed != (config.ClientSessionCache != nil) {
+				b.Fatalf("connection %d resumed its tls session: %v", i, resumed)
+			}
+		}
+	}
+
+	b.Run("handshake", func(b *testing.B) {
+		connectEach(b, &tls.Config{InsecureSkipVerify: true})
+	})
+	b.Run("resumed", func(b *testing.B) {
+		connectEach(b, &tls.Config{InsecureSkipVerify: true, ClientSessionCache: tls.NewLRUClientSessionCache(0)})
+	})
+	b.Run("keepalive", func(b *testing.B) {
+		conn, err := tls.Dial("tcp", address, &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer conn.Close()
+		decoder := json.NewDecoder(conn)
+		for i := 0; i < b.N; i++ {
+			call(conn, decoder, true)
+		}
+	})
+}
+
+// a client connection sending no request, or only part of one, is closed after ReadTimeout without a response,
+// a request sent in time is served and the timeout is disabled if zero
+func TestReadTimeout(t *testing.T) {
+	backend, _ := startBackend(t, `{"result":3}`)
+	for _, sent := range []string{"", `{"method":"Add","par`} {
+		lb := NewLoadBalancer(time.Second)
+		lb.ReadTimeout = 100 * time.Millisecond
+		registerTestServer(lb, backend)
+
+		client := serveClient(t, lb)
+		start := time.Now()
+		client.Write([]byte(sent))
+		if data, err := io.ReadAll(client); err != nil || len(data) != 0 {
+			t.Fatalf("sent %q: got %q, %v, want the connection closed", sent, data, err)
+		}
+		if elapsed := time.Since(start); elapsed < lb.ReadTimeout || elapsed > lb.ReadTimeout+time.Second {
+			t.Errorf("sent %q: the connection is closed after %v", sent, elapsed)
+		}
+	}
+
+	lb := NewLoadBalancer(time.Second)
+	lb.ReadTimeout = 100 * time.Millisecond
+	registerTestServer(lb, backend)
+	client := serveClient(t, lb)
+	time.Sleep(50 * time.Millisecond)
+	json.NewEncoder(client).Encode(map[string]interface{}{"method": "Add", "params": map[string]interface{}{"a": 1, "b": 2}})
+	var response map[string]interface{}
+	if err := json.NewDecoder(client).Decode(&response); err != nil || response["result"] != 3.0 {
+		t.Fatalf("request sent in time: got %v, %v", response, err)
+	}
+
+	lb.ReadTimeout = 0
+	client = serveClient(t, lb)
+	client.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	var netErr net.Error
+	if _, err := client.Read(make([]byte, 1)); !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("without a read timeout: got %v, want the connection open", err)
+	}
+}
+
+// serveTLSClient handles the requests of a client connection over tls as the load balancer does
+// and returns the client side of the connection before the handshake. the connection is closed when the test ends
+func serveTLSClient(t *testing.T, lb *LoadBalancer) net.Conn {
+	t.Helper()
+	client, lbSide := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		lb.handleRequest(tls.Server(lbSide, testTLSConfig(t)))
+		close(done)
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		<-done
+	})
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	return client
+}
+
+// a client failing the TLS handshake, e.g. a plaintext one, is closed without its request being decoded,
+// and a client not completing it within HandshakeTimeout is closed then
+func TestHandshake(t *testing.T) {
+	backend, _ := startBackend(t, `{"result":3}`)
+	lb := NewLoadBalancer(time.Second)
+	registerTestServer(lb, backend)
+	events := recordEvents(lb)
+
+	client := serveTLSClient(t, lb)
+	go client.Write([]byte(`{"method":"Add","params":{"a":1,"b":2}}` + "\n"))
+	if data, err := io.ReadAll(client); err != nil || len(data) != 0 {
+		t.Fatalf("got %q, %v, want the plaintext client closed", data, err)
+	}
+	if len(events()) != 0 {
+		t.Fatalf("the plaintext client is handled as a request: %v", eventTypes(events()))
+	}
+
+	lb.HandshakeTimeout = 100 * time.Millisecond
+	client = serveTLSClient(t, lb)
+	start := time.Now()
+	if data, err := io.ReadAll(client); err != nil || len(data) != 0 {
+		t.Fatalf("got %q, %v, want the silent client closed", data, err)
+	}
+	if elapsed := time.Since(start); elapsed < lb.HandshakeTimeout || elapsed > lb.HandshakeTimeout+time.Second {
+		t.Errorf("the silent client is closed after %v", elapsed)
+	}
+
+	conn := tls.Client(serveTLSClient(t, lb), &tls.Config{InsecureSkipVerify: true})
+	json.NewEncoder(conn).Encode(map[string]interface{}{"method": "Add", "params": map[string]interface{}{"a": 1, "b": 2}})
+	var response map[string]interface{}
+	if err := json.NewDecoder(conn).Decode(&response); err != nil || response["result"] != 3.0 {
+		t.Fatalf("over tls: got %v, %v", response, err)
+	}
+}
@@ -1,13 +1,23 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
-	"strings"
+	"sort"
+	"strconv"
 	"sync"
 	"syscall"
 	"time"
@@ -15,6 +25,7 @@ import (
 	"github.com/denizydmr07/zapwrapper/pkg/zapwrapper"
 	"github.com/joho/godotenv"
 	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
 )
 
 var logger *zap.Logger = zapwrapper.NewLogger(
@@ -24,66 +35,317 @@ var logger *zap.Logger = zapwrapper.NewLogger(
 )
 
 type ServerInfo struct {
-	HeartbeatAddress string     // address which server sends heartbeats
-	ServingAddress   string     // address which server serves
-	LastHeartbeat    time.Time  // last  time the server sent a heartbeat
-	IsHealthy        bool       // is the server healthy
-	heartBeatConn    net.Conn   // connection which server sends heartbeats from HeartbeatAddress
-	Mutex            sync.Mutex // mutex to lock the server
+	HeartbeatAddress string            // address which server sends heartbeats
+	ServingAddress   string            // address which server serves
+	ServingAddresses []string          // addresses advertised by a multi-homed server in order of preference, nil if not advertised
+	Capabilities     map[string]string // capability key/values advertised by the server for routing, e.g. "gpu": "true", locked by the LoadBalancer
+	Metadata         map[string]string // metadata of the service advertised by the server with its first heartbeat, e.g. "version": "2.1", nil if none
+	LastHeartbeat    time.Time         // last  time the server sent a heartbeat
+	Registered       time.Time         // time the server registered, its warmup starts then, zero for gossiped servers
+	ProbeBacked      bool              // server is health-checked by active probes instead of heartbeats
+	LastProbe        time.Time         // last time a probe to a probe-backed server succeeded
+	ProbeTimeout     time.Duration     // time without a successful probe to evict a probe-backed server
+	GossipPeer       string            // peer load balancer the server is gossiped by, empty for the servers known locally
+	LastGossip       time.Time         // last time the peer gossiped the server
+	IsHealthy        bool              // is the server healthy
+	Ready            bool              // server reported it is ready to serve, requests are not routed to it until then
+	heartBeatConn    net.Conn          // connection which server sends heartbeats from HeartbeatAddress
+	Load             float64           // load reported by the server in heartbeats, from 0 (idle) to 1 (full)
+	FailureRate      float64           // rolling rate of the failed requests relayed to the server, locked by Mutex
+	Latency          time.Duration     // rolling latency of the requests relayed to the server, locked by Mutex
+	heartbeatTimes   []time.Time       // arrival times of the last heartbeats, at most heartbeatWindow
+	heartbeatsSlow   bool              // heartbeats are arriving later than expected
+	outliers         []outlierBucket   // results of the recent requests for outlier detection, locked by Mutex
+	ejectedUntil     time.Time         // end of the ejection of the server by outlier detection, locked by Mutex
+	ejections        int               // consecutive ejections of the server, locked by Mutex
+	activeConns      int               // connections relaying requests to the server, locked by Mutex
+	Draining         bool              // no new requests are routed to the server, the ones relayed to it finish, locked by Mutex
+	Methods          map[string]bool   // methods served by the server from the deep health check, nil if not known, locked by Mutex
+	Mutex            sync.Mutex        // mutex to lock the server
 }
 
 type LoadBalancer struct {
-	Servers         map[string]*ServerInfo // key is the HeartbeatAddress
-	ServerKeys      []string               // keys of the Servers map to get the server in round-robin fashion
-	RoundRobinIndex int                    // last index of the ServerKeys to get the server in round-robin fashion
-	Timeout         time.Duration          // timeout to consider a server unhealthy
-	Mutex           sync.Mutex             // mutex to lock the LoadBalancer
+	Servers                map[string]*ServerInfo // key is the HeartbeatAddress
+	ServerKeys             []string               // keys of the Servers map to get the server in round-robin fashion
+	RoundRobinIndex        int                    // index of the next server in ServerKeys to get the server in round-robin fashion
+	Timeout                time.Duration          // timeout to consider a server unhealthy
+	ScanInterval           time.Duration          // interval to check the heartbeats of the servers, Timeout is used if zero
+	HeartbeatSecret        []byte                 // shared secret to verify heartbeats, verification is disabled if empty
+	AdminToken             []byte                 // bearer token of the admin endpoints, they are not authenticated and /drain is not served if empty
+	Strategy               Strategy               // strategy to select the servers, round-robin is used if nil
+	RetryMalformed         bool                   // relays a request once more to another server if the response of a server is malformed
+	LatencyAlpha           float64                // weight of the latest request in the rolling latency of a server, statsAlpha if zero
+	SelectFunc             SelectFunc             // custom routing overriding the selection of the servers, disabled if nil
+	BackendTLS             *tls.Config            // tls config to connect to the servers, plain tcp is used if nil
+	LargeResponseThreshold int64                  // response size in bytes to log a warning, disabled if zero
+	MaxResponseSize        int64                  // size in bytes of the largest response relayed from a server, unlimited if zero
+	TruncateOversized      bool                   // sends the leading bytes of a response larger than MaxResponseSize flagged as truncated instead of only an error
+	Compression            string                 // compression of the client connections allowed to the clients offering it, "gzip", or none if empty
+	SlowResponseThreshold  time.Duration          // relay latency to log a warning, disabled if zero
+	SlowHeartbeatFactor    float64                // factor of the heartbeat interval to warn about late heartbeats, disabled if zero
+	AcceptBackoffMax       time.Duration          // maximum delay between retries of a failing accept
+	Workers                int                    // workers handling the requests, a goroutine per connection is used if zero
+	QueueDepth             int                    // connections waiting for a worker before new ones are shed
+	ProxyProtocol          bool                   // clients connect through a proxy sending a PROXY protocol header with their address
+	AllowPin               bool                   // requests may be pinned to a server by its serving address, bypassing the selection
+	MethodLimits           *MethodLimits          // rate limits of the methods regardless of the client, disabled if nil
+	MaxRelayAttempts       int                    // attempts to connect to a server for a request, shared by its retries, unlimited if zero
+	MaxRelayTime           time.Duration          // time a request may spend trying the servers, unlimited if zero
+	MaxServerConns         int                    // connections to a server at the same time, a full server is skipped, unlimited if zero
+	Outliers               *OutlierDetector       // ejects the servers failing too often, disabled if nil
+	Canary                 *Canary                // routes a fraction of the requests to the canary servers, disabled if nil
+	Gossip                 *Gossip                // shares the servers with the peer load balancers, set by StartGossip, disabled if nil
+	Middleware             Middleware             // wraps the exchange of the requests with the servers, the raw messages are relayed if nil
+	Metrics                *Metrics               // metrics of the methods logged with the health summary, disabled if nil
+	WebSocketOrigins       []string               // origins allowed to open a WebSocket connection, any origin is allowed if empty
+	GatewaySchema          GatewaySchema          // types of the params of the methods called over the HTTP gateway, inferred if nil
+	IdleTimeout            time.Duration          // time to wait for the next request on a kept-alive client connection, keep-alive is disabled if zero
+	ReadTimeout            time.Duration          // time to receive the first request of a client connection, disabled if zero
+	HandshakeTimeout       time.Duration          // time to complete the TLS handshake of a client connection, disabled if zero
+	Mutex                  sync.Mutex             // mutex to lock the LoadBalancer
+	listeners              []net.Listener         // listeners opened by Start, heartbeats first
+	httpServers            []*http.Server         // HTTP servers shut down gracefully by ShutdownHTTP, e.g. the gateway
+	requestsServed         int                    // requests served since the last health summary
+	oversizedResponses     int                    // responses larger than MaxResponseSize since the last health summary
+	inflight               singleflight.Group     // requests in flight by idempotency key, to share their responses
+	eventListeners         []EventListener        // listeners of the lifecycle events, locked by eventMutex
+	eventMutex             sync.RWMutex           // mutex to lock the event listeners, apart from Mutex
+	lockedEvents           []Event                // events emitted with Mutex held, sent to the listeners once it is released, locked by Mutex
+	nonces                 map[string]time.Time   // nonces of the first heartbeats accepted, by their timestamp, locked by nonceMutex
+	nonceMutex             sync.Mutex             // mutex to lock the nonces
+	done                   chan struct{}          // closed when the load balancer is stopped
 }
 
+// highLoad is the load above which a server is skipped in round-robin
+// as long as a less loaded server is available
+const highLoad = 0.9
+
+// heartbeatWindow is the number of heartbeat arrival times kept per server
+// to detect heartbeats arriving consistently late
+const heartbeatWindow = 8
+
+// maxHeartbeatSkew is the maximum allowed difference between the timestamp
+// of a signed heartbeat and the time it is received
+const maxHeartbeatSkew = 5 * time.Second
+
 // NewLoadBalancer creates a new LoadBalancer with the given timeout
 func NewLoadBalancer(timeout time.Duration) *LoadBalancer {
 	return &LoadBalancer{
-		Servers:    make(map[string]*ServerInfo),
-		ServerKeys: []string{},
-		Timeout:    timeout,
+		Servers:          make(map[string]*ServerInfo),
+		ServerKeys:       []string{},
+		Timeout:          timeout,
+		ScanInterval:     250 * time.Millisecond,
+		AcceptBackoffMax: time.Second,
+		IdleTimeout:      30 * time.Second,
+		ReadTimeout:      5 * time.Second,
+		HandshakeTimeout: 5 * time.Second,
+		done:             make(chan struct{}),
+	}
+}
+
+// Start listens for heartbeats and requests on the given addresses and starts monitoring the heartbeats.
+// it returns once both listeners are ready, call Stop to shut the load balancer down.
+func (lb *LoadBalancer) Start(hbAddress string, clientAddress string, tlsConfig *tls.Config) error {
+	hbListener, err := net.Listen("tcp", hbAddress)
+	if err != nil {
+		return err
+	}
+	clientListener, err := lb.listenClients(clientAddress, tlsConfig)
+	if err != nil {
+		hbListener.Close()
+		return err
+	}
+
+	lb.Mutex.Lock()
+	lb.listeners = []net.Listener{hbListener, clientListener}
+	lb.Mutex.Unlock()
+
+	go lb.serveHeartbeats(hbListener)
+	go lb.MonitorHeartbeats()
+	go lb.serveRequests(clientListener)
+
+	logger.Info("Load balancer started")
+	return nil
+}
+
+// Stop closes the listeners of the load balancer and stops monitoring the heartbeats.
+// requests being relayed are not interrupted.
+func (lb *LoadBalancer) Stop() {
+	lb.Mutex.Lock()
+	defer lb.Mutex.Unlock()
+
+	for _, ln := range lb.listeners {
+		ln.Close()
+	}
+	lb.listeners = nil
+
+	select {
+	case <-lb.done:
+	default:
+		close(lb.done)
+	}
+}
+
+// ShutdownHTTP shuts down the HTTP servers of the load balancer gracefully, their listeners are closed
+// and the requests in flight are given until ctx is done to complete
+func (lb *LoadBalancer) ShutdownHTTP(ctx context.Context) {
+	lb.Mutex.Lock()
+	servers := lb.httpServers
+	lb.httpServers = nil
+	lb.Mutex.Unlock()
+
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			logger.Warn("HTTP server not shut down gracefully", zap.Error(err))
+		}
+	}
+}
+
+// HeartbeatAddr returns the address the load balancer listens for heartbeats on, nil if not started
+func (lb *LoadBalancer) HeartbeatAddr() net.Addr {
+	return lb.listenerAddr(0)
+}
+
+// ClientAddr returns the address the load balancer listens for requests on, nil if not started
+func (lb *LoadBalancer) ClientAddr() net.Addr {
+	return lb.listenerAddr(1)
+}
+
+// listenerAddr returns the address of the listener at the index, nil if not started
+func (lb *LoadBalancer) listenerAddr(index int) net.Addr {
+	lb.Mutex.Lock()
+	defer lb.Mutex.Unlock()
+
+	if index >= len(lb.listeners) {
+		return nil
 	}
+	return lb.listeners[index].Addr()
 }
 
-// MonitorHeartbeats checks the heartbeats of the servers
-// works in a separate goroutine
+// MonitorHeartbeats checks the heartbeats of the servers every ScanInterval,
+// so a server is evicted at most ScanInterval after its timeout.
+// works in a separate goroutine until the load balancer is stopped
 func (lb *LoadBalancer) MonitorHeartbeats() {
+	interval := lb.ScanInterval
+	if interval == 0 {
+		interval = lb.Timeout
+	}
 	for { // infinite loop
-		time.Sleep(lb.Timeout) // sleep for the timeout duration
+		// sleep for the scan interval
+		select {
+		case <-lb.done:
+			return
+		case <-time.After(interval):
+		}
 		lb.Mutex.Lock()
 
 		// for each server
+		for key, server := range lb.Servers {
+			// each kind of server is evicted by its own liveness signal
+			if server.heartbeatExpired(lb.Timeout) || server.probeExpired() || (lb.Gossip != nil && server.gossipExpired(lb.Gossip.TTL)) {
+				lb.evictServer(key, server)
+			}
+		}
+		lb.unlock()
+	}
+}
+
+// LogHealthSummary logs a summary of the servers and the requests served every interval
+// works in a separate goroutine until the load balancer is stopped
+func (lb *LoadBalancer) LogHealthSummary(interval time.Duration) {
+	for { // infinite loop
+		select {
+		case <-lb.done:
+			return
+		case <-time.After(interval):
+		}
+
+		lb.Mutex.Lock()
+		healthy := 0
 		for _, server := range lb.Servers {
+			if server.IsHealthy {
+				healthy++
+			}
+		}
+		logger.Info("Health summary",
+			zap.Int("healthy", healthy),
+			zap.Int("servers", len(lb.Servers)),
+			zap.Int("requests", lb.requestsServed),
+			zap.Int("oversizedResponses", lb.oversizedResponses),
+			zap.Int("roundRobinIndex", lb.RoundRobinIndex),
+		)
+		lb.requestsServed = 0
+		lb.oversizedResponses = 0
+		lb.Mutex.Unlock()
 
-			// if the server's last heartbeat is older than the timeout
-			if time.Since(server.LastHeartbeat) > lb.Timeout {
-				logger.Debug("Server is unhealthy", zap.String("address", server.HeartbeatAddress))
-				server.IsHealthy = false // mark the server as unhealthy
+		if lb.Metrics != nil {
+			lb.Metrics.log()
+		}
+	}
+}
 
-				// close the connection
-				server.heartBeatConn.Close()
+// heartbeatExpired reports whether a heartbeat-backed server missed its heartbeats for the timeout
+func (server *ServerInfo) heartbeatExpired(timeout time.Duration) bool {
+	return !server.ProbeBacked && server.GossipPeer == "" && time.Since(server.LastHeartbeat) > timeout
+}
 
-				// remove the server from the list
-				delete(lb.Servers, server.HeartbeatAddress)
+// probeExpired reports whether a probe-backed server has not passed a probe for its probe timeout,
+// e.g. because its discoverer can not resolve or probe it anymore
+func (server *ServerInfo) probeExpired() bool {
+	return server.ProbeBacked && time.Since(server.LastProbe) > server.ProbeTimeout
+}
 
-				// remove the server from the keys
-				for i, key := range lb.ServerKeys {
-					if key == server.HeartbeatAddress {
-						lb.ServerKeys = append(lb.ServerKeys[:i], lb.ServerKeys[i+1:]...)
-						break
-					}
-				}
+// evictServer marks the server unhealthy, closes its heartbeat connection if it has one
+// and removes it from the list. the caller must hold the mutex of the LoadBalancer
+func (lb *LoadBalancer) evictServer(key string, server *ServerInfo) {
+	logger.Debug("Server is unhealthy", zap.String("address", key))
+	server.IsHealthy = false // mark the server as unhealthy
 
-				logger.Debug("Server removed", zap.String("address", server.HeartbeatAddress))
+	// close the connection, probe-backed servers have none
+	if server.heartBeatConn != nil {
+		server.heartBeatConn.Close()
+	}
+
+	// remove the server from the list
+	lb.removeServer(key)
+	lb.emitLocked(Event{Type: ServerEvicted, Server: server.ServingAddress})
+
+	logger.Debug("Server removed", zap.String("address", key))
+}
+
+// replaceStale evicts the heartbeat-backed entries serving on servingAddress other than the one with the key,
+// which a server leaves behind when it restarts and registers again from a new heartbeat connection,
+// so the stale entry does not take a second share of the traffic until it misses its heartbeats.
+// the caller must hold the mutex of the LoadBalancer
+func (lb *LoadBalancer) replaceStale(key string, servingAddress string) {
+	for k, server := range lb.Servers {
+		if k == key || server.heartBeatConn == nil || server.ServingAddress != servingAddress {
+			continue
+		}
+		logger.Info("Server registered again, replacing its stale entry",
+			zap.String("address", key),
+			zap.String("stale", k),
+			zap.String("serving", servingAddress),
+		)
+		lb.evictServer(k, server)
+	}
+}
+
+// removeServer removes the server with the given key from the Servers map and the ServerKeys slice
+// the caller must hold the mutex of the LoadBalancer
+func (lb *LoadBalancer) removeServer(key string) {
+	delete(lb.Servers, key)
 
-				//TODO: We may need to approach differently, I wrote isHealthy for any case
+	for i, k := range lb.ServerKeys {
+		if k == key {
+			lb.ServerKeys = append(lb.ServerKeys[:i], lb.ServerKeys[i+1:]...)
+
+			// keep the round robin index on the next server
+			if i < lb.RoundRobinIndex {
+				lb.RoundRobinIndex--
 			}
+			break
 		}
-		lb.Mutex.Unlock()
 	}
 }
 
@@ -96,12 +358,26 @@ func (lb *LoadBalancer) ListenForHeartbeats(LB_HB_ADDRESS string) error {
 	}
 	defer ln.Close()
 	logger.Info("Load balancer started")
+	return lb.serveHeartbeats(ln)
+}
+
+// serveHeartbeats accepts heartbeat connections from the servers on the listener
+// it returns nil once the listener is closed
+func (lb *LoadBalancer) serveHeartbeats(ln net.Listener) error {
+	backoff := &acceptBackoff{max: lb.AcceptBackoffMax}
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			logger.Error("Error in Accept", zap.Error(err))
-			continue
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			if backoff.retry(err) {
+				continue
+			}
+			logger.Error("Error in Accept, stopped listening for heartbeats", zap.Error(err))
+			return err
 		}
+		backoff.reset()
 		go lb.handleHeartbeat(conn)
 	}
 }
@@ -111,14 +387,72 @@ func (lb *LoadBalancer) ListenForHeartbeats(LB_HB_ADDRESS string) error {
 // the first heartbeat contains the port on which the server is serving.
 // persistent connection is used to send heartbeats.
 func (lb *LoadBalancer) handleHeartbeat(conn net.Conn) {
-	decoder := json.NewDecoder(conn)
+	defer conn.Close()
+
+	// the heartbeats of a connection are binary if its first byte is the magic byte, JSON otherwise
+	reader := bufio.NewReader(conn)
+	first, err := reader.Peek(1)
+	if err != nil {
+		return
+	}
+	binaryFormat := first[0] == heartbeatMagic
+
+	decoder := json.NewDecoder(reader)
 	var request map[string]interface{}
 
+	// timestamp of the last accepted heartbeat on this connection
+	var lastTimestamp int64
+
 	for { // infinite loop
 
-		// decode the request
-		err := decoder.Decode(&request)
-		if err != nil {
+		// read the next binary heartbeat into a new map
+		if binaryFormat {
+			var err error
+			if request, err = readHeartbeat(reader); err != nil {
+				if err != io.EOF {
+					logger.Error("Error in decoding heartbeat, closing connection", zap.String("address", conn.RemoteAddr().String()), zap.Error(err))
+				}
+				return
+			}
+		} else {
+			// read the next JSON value as it is, to log it if it is not a heartbeat object
+			var raw json.RawMessage
+			if err := decoder.Decode(&raw); err != nil {
+				if err != io.EOF {
+					logger.Error("Error in decoding heartbeat, closing connection", zap.String("address", conn.RemoteAddr().String()), zap.Error(err))
+				}
+				return
+			}
+
+			// decode the request into a new map, so fields of the previous heartbeat
+			// (e.g. the port of the first one) do not leak into this one
+			request = nil
+			if err := json.Unmarshal(raw, &request); err != nil || request == nil {
+				logger.Error("Malformed heartbeat, closing connection",
+					zap.String("address", conn.RemoteAddr().String()),
+					zap.ByteString("raw", raw),
+					zap.Error(err),
+				)
+				return
+			}
+		}
+
+		// the server is draining, stop routing requests to it and close the connection
+		if _, ok := request["unregister"]; ok {
+			address := conn.RemoteAddr().String()
+			if _, err := lb.verifyHeartbeat(request, lastTimestamp); err != nil {
+				logger.Error("Rejected unregister message", zap.String("address", address), zap.Error(err))
+				continue
+			}
+
+			lb.Mutex.Lock()
+			if server, ok := lb.Servers[address]; ok {
+				lb.removeServer(address)
+				lb.emitLocked(Event{Type: ServerUnregistered, Server: server.ServingAddress})
+			}
+			lb.unlock()
+
+			logger.Info("Server unregistered", zap.String("address", address))
 			return
 		}
 
@@ -126,221 +460,1398 @@ func (lb *LoadBalancer) handleHeartbeat(conn net.Conn) {
 		if _, ok := request["heartbeat"]; ok {
 			logger.Debug("Received heartbeat from server", zap.String("address", conn.RemoteAddr().String()))
 			address := conn.RemoteAddr().String()
+
+			// verify the signature and the timestamp of the heartbeat
+			timestamp, err := lb.verifyHeartbeat(request, lastTimestamp)
+			if err != nil {
+				logger.Error("Rejected heartbeat", zap.String("address", address), zap.Error(err))
+				continue
+			}
+			lastTimestamp = timestamp
+
 			lb.Mutex.Lock()
 
+			// load reported by the server, zero if the server does not report it
+			load, _ := request["load"].(float64)
+
+			// readiness reported by the server, servers not reporting it are ready
+			ready, ok := request["ready"].(bool)
+			if !ok {
+				ready = true
+			}
+
+			// a server draining for an upgrade keeps sending heartbeats until its requests finish
+			draining, _ := request["draining"].(bool)
+
+			// capabilities sent with the first heartbeat and again whenever the server changes them
+			capabilities, err := heartbeatStrings(request, "capabilities")
+			if err != nil {
+				logger.Error("Invalid capabilities in the heartbeat request", zap.Any("request", request), zap.Error(err))
+				lb.Mutex.Unlock()
+				continue
+			}
+
 			// if the server is already in the list
 			if server, ok := lb.Servers[address]; ok {
 				server.LastHeartbeat = time.Now()
+				lb.trackHeartbeat(server)
 				server.IsHealthy = true
+				server.Load = load
+				if ready && !server.Ready {
+					logger.Info("Server is ready", zap.String("address", address))
+				}
+				server.Ready = ready
+				if draining {
+					lb.drain(server)
+				}
+				if capabilities != nil {
+					server.Capabilities = capabilities
+					logger.Info("Server capabilities updated", zap.String("address", address), zap.Any("capabilities", capabilities))
+				}
 			} else { // if the server is not in the list
 
 				logger.Debug("New server connected", zap.String("address", address))
 
-				// remove the port from the address by finding the last colon
-				servingAddress := strings.Split(address, ":")[0]
-
-				// add the port from the request
-				if port, ok := request["port"]; ok { // if the port is found in the request
-					servingAddress += ":" + port.(string)
-				} else {
-					logger.Error("Port not found in the heartbeat request", zap.Any("request", request))
+				// the server serves on the host it connected from, on the port of its first heartbeat
+				port, err := heartbeatPort(request)
+				if err != nil {
+					logger.Error("Invalid port in the heartbeat request", zap.Any("request", request), zap.Error(err))
 					//! TODO: implement a mechanism to report the error to the server
+					lb.Mutex.Unlock()
+					continue
+				}
+				host, _, _ := net.SplitHostPort(address)
+				servingAddress := net.JoinHostPort(host, port)
+
+				// addresses advertised by a multi-homed server, tried in order
+				addresses, err := servingAddresses(request)
+				if err != nil {
+					logger.Error("Invalid addresses in the heartbeat request", zap.Any("request", request), zap.Error(err))
+					lb.Mutex.Unlock()
 					continue
 				}
+				if addresses != nil {
+					servingAddress = addresses[0]
+				}
+
+				// metadata of the service, e.g. its version and owner
+				metadata, err := heartbeatStrings(request, "metadata")
+				if err != nil {
+					logger.Error("Invalid metadata in the heartbeat request", zap.Any("request", request), zap.Error(err))
+					lb.Mutex.Unlock()
+					continue
+				}
+				if metadata != nil {
+					logger.Info("Server metadata", zap.String("address", address), zap.Any("metadata", metadata))
+				}
 
 				// create a new server
 				server := &ServerInfo{
 					HeartbeatAddress: address,
 					ServingAddress:   servingAddress,
+					ServingAddresses: addresses,
+					Capabilities:     capabilities,
+					Metadata:         metadata,
 					LastHeartbeat:    time.Now(),
+					Registered:       time.Now(),
 					IsHealthy:        true,
+					Ready:            ready,
 					heartBeatConn:    conn,
+					Load:             load,
+					Draining:         draining,
 				}
 
+				// the server is known by its heartbeats now, it is not routed to through its gossiped
+				// or discovered entry too
+				lb.removeGossiped(servingAddress)
+				lb.removeDiscovered(servingAddress)
+
+				// a server restarted quickly registers again before its old entry is evicted
+				lb.replaceStale(address, servingAddress)
+
 				// add the server to the map
 				lb.Servers[address] = server
 
 				// add the server to the keys slice
 				lb.ServerKeys = append(lb.ServerKeys, address)
+				lb.emitLocked(Event{Type: ServerRegistered, Server: servingAddress})
 			}
+			lb.unlock()
 		} else {
 			logger.Error("Invalid heartbeat request from server", zap.Any("request", request))
 		}
-		lb.Mutex.Unlock()
 	}
 }
 
-// ListenForRequests listens for requests from the clients on port 8080
-func (lb *LoadBalancer) ListenForRequests(LB_CLIENT_ADDRESS string, tlsConfig *tls.Config) error {
-	//ln, err := net.Listen("tcp", LB_CLIENT_ADDRESS)
-	ln, err := tls.Listen("tcp", LB_CLIENT_ADDRESS, tlsConfig)
-	if err != nil {
-		logger.Error("Error in Listen", zap.Error(err))
-		return err
+// trackHeartbeat records the arrival of a heartbeat and warns once when the mean interval
+// of the recent heartbeats exceeds the heartbeat interval by SlowHeartbeatFactor,
+// which often precedes the server missing the timeout. lb.Mutex must be held.
+func (lb *LoadBalancer) trackHeartbeat(server *ServerInfo) {
+	if lb.SlowHeartbeatFactor <= 0 {
+		return
 	}
-	defer ln.Close()
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			logger.Error("Error in Accept", zap.Error(err))
-			continue
-		}
-		logger.Debug("Client connected", zap.String("address", conn.RemoteAddr().String()))
-		go lb.handleRequest(conn)
+
+	server.heartbeatTimes = append(server.heartbeatTimes, server.LastHeartbeat)
+	if len(server.heartbeatTimes) > heartbeatWindow {
+		server.heartbeatTimes = server.heartbeatTimes[1:]
+	}
+	if len(server.heartbeatTimes) < heartbeatWindow {
+		return
 	}
-}
 
-// TODO: There is a time where server is closed yet not removed, thus can be selected. We need to handle this. Maybe fault tolarence?
+	// mean interval between the heartbeats in the window
+	first, last := server.heartbeatTimes[0], server.heartbeatTimes[len(server.heartbeatTimes)-1]
+	interval := last.Sub(first) / time.Duration(len(server.heartbeatTimes)-1)
+
+	slow := float64(interval) > float64(heartbeatInterval)*lb.SlowHeartbeatFactor
+	if slow && !server.heartbeatsSlow {
+		logger.Warn("Heartbeats are arriving late",
+			zap.String("address", server.HeartbeatAddress),
+			zap.Duration("interval", interval),
+			zap.Duration("expected", heartbeatInterval),
+		)
+	} else if !slow && server.heartbeatsSlow {
+		logger.Info("Heartbeats are arriving on time again",
+			zap.String("address", server.HeartbeatAddress),
+			zap.Duration("interval", interval),
+		)
+	}
+	server.heartbeatsSlow = slow
+}
 
-// handleRequest handles the request from a client.
-// the request is relayed to a server and the response is sent back to the client.
-// the server is selected using the load balancing algorithm.
-func (lb *LoadBalancer) handleRequest(conn net.Conn) {
-	defer conn.Close()
+// verifyHeartbeat checks the HMAC signature of a heartbeat and rejects
+// heartbeats whose timestamp is stale or not newer than the last one
+// accepted on the same connection, and first heartbeats whose nonce was already accepted
+// on any connection. It returns the timestamp of the heartbeat.
+// if no secret is configured, every heartbeat is accepted.
+func (lb *LoadBalancer) verifyHeartbeat(request map[string]interface{}, lastTimestamp int64) (int64, error) {
+	if len(lb.HeartbeatSecret) == 0 {
+		return lastTimestamp, nil
+	}
 
-	// request and response maps
-	request, response := make(map[string]interface{}), make(map[string]interface{})
+	ts, ok := request["ts"].(float64)
+	if !ok {
+		return 0, errors.New("timestamp not found in the heartbeat")
+	}
+	mac, ok := request["mac"].(string)
+	if !ok {
+		return 0, errors.New("signature not found in the heartbeat")
+	}
 
-	// encoder and decoder for the client connection
-	clientEncoder := json.NewEncoder(conn)
-	clientDecoder := json.NewDecoder(conn)
+	// compare the signature with the expected one
+	timestamp := int64(ts)
+	expected := signHeartbeat(lb.HeartbeatSecret, timestamp, request)
+	if !hmac.Equal([]byte(mac), []byte(expected)) {
+		return 0, errors.New("invalid heartbeat signature")
+	}
 
-	// decode the request from the client
-	if err := clientDecoder.Decode(&request); err != nil {
-		logger.Error("Error in decoding request", zap.Error(err))
-		sendError(clientEncoder, "Error in decoding the request")
-		return
+	// reject replayed or reordered heartbeats
+	if timestamp <= lastTimestamp {
+		return 0, fmt.Errorf("out of order heartbeat, timestamp %d is not after %d", timestamp, lastTimestamp)
 	}
 
-	logger.Debug("Request received from client", zap.Any("request", request))
+	// reject heartbeats that are too old or too far in the future
+	skew := time.Since(time.UnixMilli(timestamp))
+	if skew > maxHeartbeatSkew || skew < -maxHeartbeatSkew {
+		return 0, fmt.Errorf("stale heartbeat, timestamp is %s off", skew)
+	}
 
-getServer:
-	// get the server using the load balancing algorithm
-	server := lb.getServer()
-	if server == nil {
-		sendError(clientEncoder, "No server available")
-		return
+	// the first heartbeat registers the server at the host it comes from, so replayed on a new connection,
+	// e.g. from another host, it would register a server there. it is only accepted once by its nonce
+	if _, ok := request["port"]; ok {
+		nonce, _ := request["nonce"].(string)
+		if nonce == "" {
+			return 0, errors.New("nonce not found in the first heartbeat")
+		}
+		if !lb.acceptNonce(nonce, timestamp) {
+			return 0, errors.New("replayed first heartbeat")
+		}
 	}
 
-	// connect to the server server selected
-	serverConn, err := net.Dial("tcp", server.ServingAddress)
-	if err != nil {
-		logger.Error("Error connecting to server", zap.Error(err))
+	return timestamp, nil
+}
 
-		if _, ok := err.(*net.OpError); ok {
-			// this mean tcp dial error, thus server is down yet not removed
-			// we need to get a new server
-			logger.Debug("Server is down, getting a new server")
-			goto getServer
-		} else {
-			sendError(clientEncoder, "Error in connecting to server")
+// acceptNonce returns true if the nonce of a first heartbeat was not accepted before and records it.
+// the nonces are kept as long as their heartbeats are within maxHeartbeatSkew, since older ones are rejected
+// as stale anyway, so the nonces are bounded by the registrations of that window
+func (lb *LoadBalancer) acceptNonce(nonce string, timestamp int64) bool {
+	lb.nonceMutex.Lock()
+	defer lb.nonceMutex.Unlock()
+
+	if lb.nonces == nil {
+		lb.nonces = make(map[string]time.Time)
+	}
+	for seen, at := range lb.nonces {
+		if time.Since(at) > 2*maxHeartbeatSkew {
+			delete(lb.nonces, seen)
 		}
-		return
 	}
-	defer serverConn.Close()
-
-	// relay the request to the server
-	if err := relayJSON(request, serverConn); err != nil {
-		logger.Error("Error sending request to server", zap.Error(err))
-		sendError(clientEncoder, "Error in relaying request to server")
-		return
+	if _, ok := lb.nonces[nonce]; ok {
+		return false
 	}
-	logger.Debug("Request sent to server")
+	lb.nonces[nonce] = time.UnixMilli(timestamp)
+	return true
+}
 
-	// receive the response from the server
-	if err := receiveJSON(&response, serverConn); err != nil {
-		logger.Error("Error receiving response from server", zap.Error(err))
-		sendError(clientEncoder, "Error in receiving response from server")
-		return
+// signedHeartbeatFields are the fields of a heartbeat covered by its signature in the order they are signed,
+// every field the load balancer acts on, so none of them can be changed or added on a signed heartbeat
+var signedHeartbeatFields = []string{"heartbeat", "unregister", "ready", "draining", "load", "port", "nonce", "addresses", "capabilities", "metadata"}
+
+// signHeartbeat returns the hex encoded HMAC-SHA256 of the timestamp and the canonical encoding of the heartbeat:
+// each of the signedHeartbeatFields it carries as its name and its JSON value, whose object keys are sorted.
+// the server signs the same encoding of its Go values, which are encoded alike
+func signHeartbeat(secret []byte, timestamp int64, request map[string]interface{}) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%d", timestamp)
+	for _, field := range signedHeartbeatFields {
+		if value, ok := request[field]; ok {
+			encoded, _ := json.Marshal(value)
+			fmt.Fprintf(mac, "\n%s=%s", field, encoded)
+		}
 	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
 
-	logger.Debug("Response received from server", zap.Any("response", response))
-
-	// send the response to the client
-	if err := clientEncoder.Encode(response); err != nil {
-		logger.Error("Error sending response to client", zap.Error(err))
+// heartbeatPort returns the port a server serves on, sent as a string with its first heartbeat.
+// the heartbeat comes from the server, so a port of another type or out of range is rejected rather than trusted
+func heartbeatPort(request map[string]interface{}) (string, error) {
+	value, ok := request["port"]
+	if !ok {
+		return "", errors.New("port not found")
 	}
-	logger.Debug("Response sent to client")
+	port, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("port %v is not a string", value)
+	}
+	if number, err := strconv.Atoi(port); err != nil || number < 1 || number > 65535 {
+		return "", fmt.Errorf("invalid port %q", port)
+	}
+	return port, nil
 }
 
-// Helper function to relay JSON data over a connection
-func relayJSON(data interface{}, conn net.Conn) error {
-	return json.NewEncoder(conn).Encode(data)
+// servingAddresses returns the serving addresses advertised in the first heartbeat of a server,
+// nil if the heartbeat does not advertise any
+func servingAddresses(request map[string]interface{}) ([]string, error) {
+	value, ok := request["addresses"]
+	if !ok {
+		return nil, nil
+	}
+	list, ok := value.([]interface{})
+	if !ok || len(list) == 0 {
+		return nil, errors.New("addresses must be a non-empty array")
+	}
+	addresses := make([]string, len(list))
+	for i, item := range list {
+		address, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("address %v is not a string", item)
+		}
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return nil, err
+		}
+		addresses[i] = address
+	}
+	return addresses, nil
 }
 
-// Helper function to receive JSON data from a connection
-func receiveJSON(data interface{}, conn net.Conn) error {
-	return json.NewDecoder(conn).Decode(data)
+// heartbeatStrings returns the string key/values advertised as the field in a heartbeat of a server,
+// e.g. the capabilities or the metadata, nil if the heartbeat does not advertise them
+func heartbeatStrings(request map[string]interface{}, field string) (map[string]string, error) {
+	value, ok := request[field]
+	if !ok {
+		return nil, nil
+	}
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s must be an object", field)
+	}
+	values := make(map[string]string, len(object))
+	for key, item := range object {
+		s, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s %q is not a string", field, key)
+		}
+		values[key] = s
+	}
+	return values, nil
 }
 
-// Helper function to send an error response to the client
-func sendError(encoder *json.Encoder, message string) {
-	response := map[string]interface{}{"error": message}
-	encoder.Encode(response)
-}
+// listenClients listens for the clients on the address with tls,
+// the PROXY protocol header of each connection is read first if ProxyProtocol is set
+func (lb *LoadBalancer) listenClients(address string, tlsConfig *tls.Config) (net.Listener, error) {
+	if tlsConfig == nil || (len(tlsConfig.Certificates) == 0 && tlsConfig.GetCertificate == nil && tlsConfig.GetConfigForClient == nil) {
+		return nil, errors.New("tls: neither Certificates, GetCertificate, nor GetConfigForClient set in Config")
+	}
 
-// TODO: Implement the load balancing algorithm
-func (lb *LoadBalancer) getServer() *ServerInfo {
-	lb.Mutex.Lock()
-	defer lb.Mutex.Unlock()
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if lb.ProxyProtocol {
+		ln = &proxyListener{ln}
+	}
+	return tls.NewListener(ln, tlsConfig), nil
+}
 
-	// if there are no servers
-	if len(lb.ServerKeys) == 0 {
-		return nil
+// ListenForRequests listens for requests from the clients on port 8080
+func (lb *LoadBalancer) ListenForRequests(LB_CLIENT_ADDRESS string, tlsConfig *tls.Config) error {
+	//ln, err := net.Listen("tcp", LB_CLIENT_ADDRESS)
+	ln, err := lb.listenClients(LB_CLIENT_ADDRESS, tlsConfig)
+	if err != nil {
+		logger.Error("Error in Listen", zap.Error(err))
+		return err
 	}
+	defer ln.Close()
+	return lb.serveRequests(ln)
+}
 
-	// if the round robin index is greater than the number of servers
-	if lb.RoundRobinIndex >= len(lb.ServerKeys) {
-		lb.RoundRobinIndex = 0
+// serveRequests accepts client connections on the listener
+// it returns nil once the listener is closed
+func (lb *LoadBalancer) serveRequests(ln net.Listener) error {
+	backoff := &acceptBackoff{max: lb.AcceptBackoffMax}
+
+	// queue of the connections waiting for a worker, nil if workers are disabled
+	var queue chan net.Conn
+	if lb.Workers > 0 {
+		queue = lb.startWorkers()
+		defer close(queue)
 	}
-	logger.Debug("Round robin index", zap.Int("index", lb.RoundRobinIndex))
 
-	// get the server using the round robin index
-	server := lb.Servers[lb.ServerKeys[lb.RoundRobinIndex]]
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			if backoff.retry(err) {
+				continue
+			}
+			logger.Error("Error in Accept, stopped listening for requests", zap.Error(err))
+			return err
+		}
+		backoff.reset()
+		logger.Debug("Client connected", zap.String("address", conn.RemoteAddr().String()))
+		if queue == nil {
+			go lb.handleRequest(conn)
+			continue
+		}
 
-	// increment the round robin index
-	lb.RoundRobinIndex++
+		// enqueue the connection, shed it if the queue is full
+		select {
+		case queue <- conn:
+		default:
+			logger.Warn("Request queue is full, shedding the connection", zap.String("address", conn.RemoteAddr().String()))
+			go shedRequest(conn)
+		}
+	}
+}
 
-	logger.Debug("Selected server", zap.String("address", server.ServingAddress))
-	return server
+// startWorkers starts the workers handling the connections in the returned queue,
+// the workers stop when the queue is closed
+func (lb *LoadBalancer) startWorkers() chan net.Conn {
+	queue := make(chan net.Conn, lb.QueueDepth)
+	for i := 0; i < lb.Workers; i++ {
+		go func() {
+			for conn := range queue {
+				lb.handleRequest(conn)
+			}
+		}()
+	}
+	return queue
 }
 
-func main() {
-	err := godotenv.Load()
-	if err != nil {
-		logger.Error("Error loading .env file", zap.Error(err))
+// handshake completes the TLS handshake of a client connection within HandshakeTimeout
+func (lb *LoadBalancer) handshake(conn *tls.Conn) error {
+	if lb.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(lb.HandshakeTimeout))
+		defer conn.SetDeadline(time.Time{})
 	}
+	return conn.Handshake()
+}
+
+// shedRequest rejects a connection which does not fit in the request queue
+func shedRequest(conn net.Conn) {
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	sendError(json.NewEncoder(conn), nil, "server busy")
+}
 
-	LB_HB_ADDRESS := os.Getenv("LB_HB_ADDRESS")
-	LB_CLIENT_ADDRESS := os.Getenv("LB_CLIENT_ADDRESS")
+// acceptBackoff delays the retries of an accept loop on temporary errors
+// like net/http.Server, so a failing listener (e.g. on fd exhaustion) does not spin
+type acceptBackoff struct {
+	delay time.Duration // delay of the last retry, zero after a successful accept
+	max   time.Duration // maximum delay between two retries
+}
 
-	if LB_HB_ADDRESS == "" || LB_CLIENT_ADDRESS == "" {
-		logger.Error("LB_HB_ADDRESS or LB_CLIENT_ADDRESS is not set")
-		return
+// retry sleeps with an exponential backoff and returns true if the error is temporary,
+// it returns false for permanent errors which should stop the accept loop
+func (b *acceptBackoff) retry(err error) bool {
+	if ne, ok := err.(interface{ Temporary() bool }); !ok || !ne.Temporary() {
+		return false
 	}
 
-	cert, err := tls.LoadX509KeyPair("lb.crt", "lb.key")
-	if err != nil {
-		logger.Error("Error loading certificate", zap.Error(err))
-		return
+	if b.delay == 0 {
+		b.delay = 5 * time.Millisecond
+	} else {
+		b.delay *= 2
 	}
-
-	// creare config for tls
-	tlsConfig := &tls.Config{
-		Certificates: []tls.Certificate{cert},
+	if b.max > 0 && b.delay > b.max {
+		b.delay = b.max
 	}
 
-	// Create a new load balancer with a timeout
-	timeout := 1*time.Second + 200*time.Millisecond
-	lb := NewLoadBalancer(timeout)
+	logger.Error("Error in Accept, retrying", zap.Error(err), zap.Duration("delay", b.delay))
+	time.Sleep(b.delay)
+	return true
+}
 
-	// Channel to listen SIGINT and SIGTERM
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+// reset resets the delay after a successful accept
+func (b *acceptBackoff) reset() {
+	b.delay = 0
+}
 
-	// Context to cancel the server
-	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
-	defer cancel()
+// TODO: There is a time where server is closed yet not removed, thus can be selected. We need to handle this. Maybe fault tolarence?
+
+// handleRequest handles the requests from a client.
+// a client keeping the connection alive sends its next request once it has the response,
+// the connection is closed once the client closes it or stays idle for IdleTimeout
+func (lb *LoadBalancer) handleRequest(conn net.Conn) {
+	// conn is replaced by the compressed connection once negotiated, which ends the compressed bytes on close
+	defer func() { conn.Close() }()
+
+	// complete the TLS handshake before decoding, so a client not speaking TLS, e.g. a plaintext client
+	// or a port scanner, is closed at once and not logged as an invalid request
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := lb.handshake(tlsConn); err != nil {
+			logger.Debug("TLS handshake failed, connection closed", zap.String("address", conn.RemoteAddr().String()), zap.Error(err))
+			return
+		}
+	}
+	lb.emit(Event{Type: ClientConnected, Client: conn.RemoteAddr().String()})
+	defer lb.emit(Event{Type: ClientDisconnected, Client: conn.RemoteAddr().String()})
+
+	// encoder and decoder for the client connection
+	clientEncoder := json.NewEncoder(conn)
+	clientDecoder := json.NewDecoder(conn)
+
+	// the compression of the connection is negotiated at most once, before the first request
+	negotiated := false
+	// idle is set once a request was relayed, not by the negotiation which is followed by the first request
+	idle := false
+	for {
+		// wait for the first request until the read timeout, so a client sending nothing
+		// does not hold the connection, and for the next request of a kept-alive connection until the idle timeout
+		if idle {
+			conn.SetReadDeadline(time.Now().Add(lb.IdleTimeout))
+		} else if lb.ReadTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(lb.ReadTimeout))
+		}
+
+		// read the request from the client as it is, it is relayed to the server verbatim
+		var rawRequest json.RawMessage
+		err := clientDecoder.Decode(&rawRequest)
+		conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			var netErr net.Error
+			timeout := errors.As(err, &netErr) && netErr.Timeout()
+			if idle && (err == io.EOF || timeout) {
+				logger.Debug("Kept-alive client connection closed", zap.String("address", conn.RemoteAddr().String()))
+				return
+			}
+			if timeout {
+				logger.Warn("Client sent no request in time, connection closed", zap.String("address", conn.RemoteAddr().String()), zap.Duration("timeout", lb.ReadTimeout))
+				return
+			}
+			logger.Error("Error in decoding request", zap.Error(err))
+			sendError(clientEncoder, nil, "Error in decoding the request")
+			return
+		}
+
+		if !idle && !negotiated {
+			negotiated = true
+			if offer, ok := compressionOffer(rawRequest); ok {
+				negotiatedConn, err := lb.negotiateCompression(conn, clientDecoder, offer)
+				if err != nil {
+					logger.Error("Error in negotiating the compression", zap.Error(err))
+					return
+				}
+				// without compression the decoder is kept, it may have buffered the first request already
+				if negotiatedConn != conn {
+					conn = negotiatedConn
+					clientEncoder = json.NewEncoder(conn)
+					clientDecoder = json.NewDecoder(conn)
+				}
+
+				// the first request follows within the read timeout
+				continue
+			}
+		}
+
+		if !lb.relayRequest(conn, clientEncoder, clientDecoder, rawRequest) || lb.IdleTimeout == 0 {
+			return
+		}
+		idle = true
+	}
+}
+
+// relayRequest relays a request from a client to a server and the response back to the client.
+// the server is selected using the load balancing algorithm, the exchange goes through the middlewares if any.
+// it returns true if the client asked to keep the connection alive and it can carry another request
+func (lb *LoadBalancer) relayRequest(conn net.Conn, clientEncoder *json.Encoder, clientDecoder *json.Decoder, rawRequest json.RawMessage) bool {
+	// decode the request only to inspect the fields needed for routing
+	request, err := parseRequest(rawRequest)
+	if err != nil {
+		logger.Error("Invalid request", zap.String("address", conn.RemoteAddr().String()), zap.Error(err))
+		sendError(clientEncoder, request, err.Error())
+		return false
+	}
+
+	// the methods with a rate limit are throttled regardless of the client
+	if err := lb.limitMethod(request); err != nil {
+		sendError(clientEncoder, request, err.Error())
+		return false
+	}
+
+	logger.Debug("Request received from client", zap.String("address", conn.RemoteAddr().String()), zap.ByteString("request", rawRequest))
+
+	// pipe the frames of a streaming call or a subscription, or the chunks of a chunked upload,
+	// in both directions until the server ends it
+	_, chunked := request["chunked"]
+	subscribe, _ := request["subscribe"].(bool)
+	if stream, _ := request["stream"].(bool); stream || subscribe || chunked {
+		lb.relayStreamRequest(conn, clientEncoder, clientDecoder, request, rawRequest)
+		return false
+	}
+
+	// the client waits for the response before sending its next request on the connection
+	keepAlive, _ := request["keepalive"].(bool)
+
+	response, err := lb.relayMessage(conn, request, rawRequest, keepAlive)
+	if err == errClientGone {
+		logger.Debug("Client disconnected, relay aborted", zap.String("address", conn.RemoteAddr().String()))
+		return false
+	}
+	if err != nil {
+		sendError(clientEncoder, request, err.Error())
+		return keepAlive
+	}
+
+	// send the response to the client
+	if err := relayRaw(response, conn); err != nil {
+		logger.Error("Error sending response to client", zap.Error(err))
+		keepAlive = false
+	}
+	logger.Debug("Response sent to client")
+	return keepAlive
+}
+
+// relayMessage relays a request which is not a stream to a server, through the middlewares if any,
+// and returns the raw response to send to the client.
+// the error is the message to send to the client, or errClientGone if the client disconnected meanwhile
+func (lb *LoadBalancer) relayMessage(conn net.Conn, request map[string]interface{}, rawRequest json.RawMessage, keepAlive bool) (json.RawMessage, error) {
+	start := time.Now()
+
+	// the span covers the selection of the server and the exchange with it
+	span, rawRequest := startRelaySpan(request, rawRequest)
+	exchange := func(watch bool) (json.RawMessage, *ServerInfo, error) {
+		if lb.Middleware == nil {
+			return lb.exchange(conn, request, rawRequest, !watch)
+		}
+		return lb.exchangeThrough(lb.Middleware, conn, request, !watch)
+	}
+
+	var response json.RawMessage
+	var server *ServerInfo
+	var err error
+	if key := idempotencyKey(request); key == "" {
+		response, server, err = exchange(!keepAlive)
+	} else {
+		// a request with the same key in flight is not relayed again, its response is shared.
+		// the client is not watched since the response may be shared with other clients
+		var result interface{}
+		var shared bool
+		result, err, shared = lb.inflight.Do(key, func() (interface{}, error) {
+			response, server, err := exchange(false)
+			return dedupedResponse{response, server}, err
+		})
+		if shared {
+			logger.Debug("Response shared with a request with the same idempotency key", zap.String("key", key))
+		}
+		if d, ok := result.(dedupedResponse); ok {
+			response, server = d.response, d.server
+		}
+
+		// each request gets its own copy of a shared response, answering its own id
+		if shared && err == nil {
+			response = withRequestID(append(json.RawMessage(nil), response...), request)
+		}
+	}
+	endRelaySpan(span, server, err)
+	if err != nil {
+		return nil, err
+	}
+
+	lb.Mutex.Lock()
+	lb.requestsServed++
+	lb.Mutex.Unlock()
+
+	// warn about responses exceeding the thresholds, a middleware may answer without a server
+	if server != nil {
+		lb.checkResponse(request, server, int64(len(response)), time.Since(start))
+	}
+	return response, nil
+}
+
+// dedupedResponse is the response of a request shared with the requests with the same idempotency key
+type dedupedResponse struct {
+	response json.RawMessage
+	server   *ServerInfo
+}
+
+// idempotencyKey returns the key deduplicating the request, scoped by its method and its params,
+// so requests reusing a key with other params are not answered with the same response.
+// it is empty if the metadata of the request has no "idempotency-key"
+func idempotencyKey(request map[string]interface{}) string {
+	metadata, _ := request["metadata"].(map[string]interface{})
+	key, _ := metadata["idempotency-key"].(string)
+	if key == "" {
+		return ""
+	}
+	method, _ := request["method"].(string)
+
+	// the params are encoded with their keys sorted, numbers are kept as they were sent
+	params, err := json.Marshal(request["params"])
+	if err != nil {
+		return ""
+	}
+	hash := sha256.Sum256(params)
+	return method + "\x00" + key + "\x00" + hex.EncodeToString(hash[:])
+}
+
+// withRequestID returns the response with the "id" of the request, the response is returned as it is
+// if the request has no id or the response is not a JSON object
+func withRequestID(response json.RawMessage, request map[string]interface{}) json.RawMessage {
+	id, ok := request["id"]
+	if !ok {
+		return response
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(response, &fields); err != nil || fields == nil {
+		return response
+	}
+	rawID, err := json.Marshal(id)
+	if err != nil {
+		return response
+	}
+	fields["id"] = rawID
+	rewritten, err := json.Marshal(fields)
+	if err != nil {
+		return response
+	}
+	return rewritten
+}
+
+// errClientGone aborts the relay of a request whose client disconnected while waiting for the server
+var errClientGone = errors.New("client disconnected")
+
+// errNoServer fails a request for which getServer finds no server to route it to
+var errNoServer = errors.New("No server available")
+
+// errDeadlineExceeded fails a request whose deadline passed before its response was received
+var errDeadlineExceeded = errors.New("Deadline exceeded")
+
+// requestDeadline returns the deadline the client set in the "deadline_unix_nano" of the request,
+// false if it has none
+func requestDeadline(request map[string]interface{}) (time.Time, bool) {
+	number, ok := request["deadline_unix_nano"].(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	nanos, err := number.Int64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, nanos), true
+}
+
+// deadlineExceeded reports whether the request has a deadline which passed
+func deadlineExceeded(request map[string]interface{}) bool {
+	deadline, ok := requestDeadline(request)
+	return ok && !time.Now().Before(deadline)
+}
+
+// exchange relays the raw request to a server and returns its raw response and the server.
+// the error is the message to send to the client, or errClientGone if the client disconnected meanwhile.
+// a request whose response is malformed is relayed once more to another server if RetryMalformed is set
+func (lb *LoadBalancer) exchange(conn net.Conn, request map[string]interface{}, rawRequest json.RawMessage, keepAlive bool) (json.RawMessage, *ServerInfo, error) {
+	// the retry after a malformed response shares the budget of the first attempt
+	budget := newRelayBudget()
+	response, server, err := lb.exchangeWith(conn, request, rawRequest, keepAlive, nil, budget)
+	if err != errMalformedResponse || !lb.RetryMalformed {
+		return response, server, err
+	}
+
+	// the malformed response is kept if there is no other server to retry on
+	logger.Info("Retrying request on another server", zap.String("failed", server.ServingAddress))
+	retried, retryServer, retryErr := lb.exchangeWith(conn, request, rawRequest, keepAlive, server, budget)
+	if retryServer == nil {
+		return nil, server, err
+	}
+	return retried, retryServer, retryErr
+}
+
+// exchangeWith relays the raw request to a server other than exclude, which may be nil, within the budget,
+// and returns its raw response and the server, which is nil if no server could be connected to
+func (lb *LoadBalancer) exchangeWith(conn net.Conn, request map[string]interface{}, rawRequest json.RawMessage, keepAlive bool, exclude *ServerInfo, budget *relayBudget) (json.RawMessage, *ServerInfo, error) {
+	// start of the round trip to the server
+	start := time.Now()
+
+	server, serverConn, err := lb.connectServer(request, exclude, budget)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer serverConn.Close()
+	defer lb.releaseConn(server)
+
+	// event of the exchange with the server
+	method, _ := request["method"].(string)
+	event := Event{Client: conn.RemoteAddr().String(), Server: server.ServingAddress, Method: method}
+
+	// relay the request to the server
+	if err := relayRaw(rawRequest, serverConn); err != nil {
+		logger.Error("Error sending request to server", zap.Error(err))
+		lb.recordResult(server, false, time.Since(start))
+		event.Type, event.Latency, event.Err = RelayFailed, time.Since(start), err
+		lb.emit(event)
+		return nil, server, errors.New("Error in relaying request to server")
+	}
+	logger.Debug("Request sent to server")
+	event.Type = RequestRelayed
+	lb.emit(event)
+
+	// abort the relay if the client disconnects while waiting for the server,
+	// a kept-alive connection is not watched since reading it would consume the next request
+	clientGone := make(chan struct{})
+	if !keepAlive {
+		go watchClient(conn, serverConn, clientGone)
+	}
+
+	// receive the response from the server
+	response, head, err := lb.receiveResponse(serverConn)
+	if err != nil {
+		select {
+		case <-clientGone:
+			return nil, server, errClientGone
+		default:
+		}
+		event.Type, event.Latency, event.Err = RelayFailed, time.Since(start), err
+		// the server is not blamed for the budget of the client running out
+		if deadlineExceeded(request) {
+			logger.Debug("Deadline exceeded while waiting for server", zap.String("address", server.ServingAddress))
+			lb.emit(event)
+			return nil, server, errDeadlineExceeded
+		}
+		// a malformed response counts against the health of the server like any failed exchange
+		lb.recordResult(server, false, time.Since(start))
+		lb.emit(event)
+		if errors.Is(err, errMalformedResponse) {
+			logger.Warn("Malformed response from server", zap.String("address", server.ServingAddress), zap.Error(err))
+			return nil, server, errMalformedResponse
+		}
+		if err == errResponseTooLarge {
+			logger.Warn("Response from server too large", zap.String("address", server.ServingAddress), zap.Int64("maxSize", lb.MaxResponseSize))
+			lb.Mutex.Lock()
+			lb.oversizedResponses++
+			lb.Mutex.Unlock()
+			if lb.TruncateOversized {
+				return truncatedResponse(request, head), server, nil
+			}
+			return nil, server, errResponseTooLarge
+		}
+		logger.Error("Error receiving response from server", zap.Error(err))
+		return nil, server, errors.New("Error in receiving response from server")
+	}
+	lb.recordResult(server, true, time.Since(start))
+	event.Type, event.Latency = ResponseReceived, time.Since(start)
+	lb.emit(event)
+
+	logger.Debug("Response received from server", zap.ByteString("response", response))
+	return response, server, nil
+}
+
+// relayStreamRequest relays a streaming call, a subscription or a chunked upload to a server,
+// the bytes are piped in both directions until the server closes the connection
+func (lb *LoadBalancer) relayStreamRequest(conn net.Conn, clientEncoder *json.Encoder, clientDecoder *json.Decoder, request map[string]interface{}, rawRequest json.RawMessage) {
+	// start of the round trip to the server
+	start := time.Now()
+
+	server, serverConn, err := lb.connectServer(request, nil, newRelayBudget())
+	if err != nil {
+		sendError(clientEncoder, request, err.Error())
+		return
+	}
+	defer serverConn.Close()
+	defer lb.releaseConn(server)
+
+	// event of the exchange with the server, the response is the whole stream
+	method, _ := request["method"].(string)
+	event := Event{Client: conn.RemoteAddr().String(), Server: server.ServingAddress, Method: method}
+
+	// relay the request to the server
+	if err := relayRaw(rawRequest, serverConn); err != nil {
+		logger.Error("Error sending request to server", zap.Error(err))
+		lb.recordResult(server, false, time.Since(start))
+		event.Type, event.Latency, event.Err = RelayFailed, time.Since(start), err
+		lb.emit(event)
+		sendError(clientEncoder, request, "Error in relaying request to server")
+		return
+	}
+	logger.Debug("Request sent to server")
+	event.Type = RequestRelayed
+	lb.emit(event)
+
+	err = relayStream(conn, clientDecoder.Buffered(), serverConn)
+	lb.recordResult(server, err == nil, time.Since(start))
+	event.Type, event.Latency, event.Err = ResponseReceived, time.Since(start), err
+	if err != nil {
+		logger.Error("Error relaying stream", zap.Error(err))
+		event.Type = RelayFailed
+	}
+	lb.emit(event)
+
+	lb.Mutex.Lock()
+	lb.requestsServed++
+	lb.Mutex.Unlock()
+}
+
+// connectServer selects a server for the request other than exclude, which may be nil,
+// using the load balancing algorithm and connects to it, trying another server while the budget allows.
+// the error is the message to send to the client
+func (lb *LoadBalancer) connectServer(request map[string]interface{}, exclude *ServerInfo, budget *relayBudget) (*ServerInfo, net.Conn, error) {
+	// the request is rejected once its deadline passed, otherwise the remaining budget
+	// bounds the dial and the exchange with the server
+	deadline, _ := requestDeadline(request)
+	for {
+		if deadlineExceeded(request) {
+			return nil, nil, errDeadlineExceeded
+		}
+		if err := lb.budgetExhausted(budget); err != nil {
+			logger.Warn("Relay budget exhausted", zap.Int("attempts", budget.attempts), zap.Strings("servers", budget.servers()))
+			return nil, nil, err
+		}
+
+		// get the server the request is pinned to, or using the load balancing algorithm
+		var server *ServerInfo
+		if _, pinned := request["pin"]; pinned {
+			var err error
+			if server, err = lb.pinnedServer(request, exclude); err != nil {
+				return nil, nil, err
+			}
+		} else if server = lb.getServer(request, exclude); server == nil {
+			return nil, nil, errNoServer
+		}
+
+		// take a connection of the server, another server is selected if it became full since
+		if !lb.acquireConn(server) {
+			if _, pinned := request["pin"]; pinned {
+				return nil, nil, fmt.Errorf("Pinned server %s is at its connection limit", server.ServingAddress)
+			}
+			continue
+		}
+
+		// connect to the server server selected, its connection is released by the caller
+		budget.record(server)
+		start := time.Now()
+		serverConn, err := lb.dialServing(server, deadline)
+		if err == nil {
+			serverConn.SetDeadline(deadline)
+			return server, serverConn, nil
+		}
+		lb.releaseConn(server)
+		if deadlineExceeded(request) {
+			return nil, nil, errDeadlineExceeded
+		}
+		logger.Error("Error connecting to server", zap.Error(err))
+		lb.recordResult(server, false, time.Since(start))
+
+		if _, ok := err.(*net.OpError); !ok {
+			return nil, nil, errors.New("Error in connecting to server")
+		}
+		// a pinned request is not relayed to another server
+		if _, pinned := request["pin"]; pinned {
+			return nil, nil, fmt.Errorf("Pinned server %s is unavailable", server.ServingAddress)
+		}
+		// this mean tcp dial error, thus server is down yet not removed
+		// we need to get a new server
+		logger.Debug("Server is down, getting a new server")
+	}
+}
+
+// relayBudget counts the attempts to connect to a server for a request, shared by its retries
+type relayBudget struct {
+	start    time.Time       // start of the first attempt
+	attempts int             // attempts made so far
+	tried    map[string]bool // serving addresses of the servers tried
+}
+
+// newRelayBudget returns the budget of a request starting now
+func newRelayBudget() *relayBudget {
+	return &relayBudget{start: time.Now(), tried: make(map[string]bool)}
+}
+
+// record counts an attempt to connect to the server
+func (b *relayBudget) record(server *ServerInfo) {
+	b.attempts++
+	b.tried[server.ServingAddress] = true
+}
+
+// servers returns the serving addresses of the servers tried in name order
+func (b *relayBudget) servers() []string {
+	servers := make([]string, 0, len(b.tried))
+	for address := range b.tried {
+		servers = append(servers, address)
+	}
+	sort.Strings(servers)
+	return servers
+}
+
+// budgetExhausted returns the error sent to the client once the request made MaxRelayAttempts attempts
+// or spent MaxRelayTime trying the servers, nil while it may try another one
+func (lb *LoadBalancer) budgetExhausted(budget *relayBudget) error {
+	attempts := lb.MaxRelayAttempts > 0 && budget.attempts >= lb.MaxRelayAttempts
+	timedOut := lb.MaxRelayTime > 0 && budget.attempts > 0 && time.Since(budget.start) >= lb.MaxRelayTime
+	if !attempts && !timedOut {
+		return nil
+	}
+	return fmt.Errorf("Retries exhausted after %d attempts on %d servers", budget.attempts, len(budget.tried))
+}
+
+// pinnedServer returns the server whose serving address the request is pinned to with "pin",
+// if pinning is allowed and the server is healthy and ready. the error is the message to send to the client
+func (lb *LoadBalancer) pinnedServer(request map[string]interface{}, exclude *ServerInfo) (*ServerInfo, error) {
+	if !lb.AllowPin {
+		return nil, errors.New("Pinning requests to a server is not allowed")
+	}
+	pin, ok := request["pin"].(string)
+	if !ok || pin == "" {
+		return nil, errors.New("Invalid pin, must be the serving address of a server")
+	}
+
+	lb.Mutex.Lock()
+	defer lb.Mutex.Unlock()
+	for _, key := range lb.ServerKeys {
+		server := lb.Servers[key]
+		if server.ServingAddress != pin {
+			continue
+		}
+		// the pinned server is used even if it is ejected, but not retried on after a malformed response
+		if !server.IsHealthy || !server.Ready || server == exclude || server.draining() {
+			return nil, fmt.Errorf("Pinned server %s is unavailable", pin)
+		}
+		logger.Debug("Selected pinned server", zap.String("address", server.ServingAddress))
+		return server, nil
+	}
+	return nil, fmt.Errorf("Pinned server %s is unknown", pin)
+}
+
+// acquireConn counts a connection to the server as active until releaseConn is called,
+// it returns false without counting it if the server has MaxServerConns connections already
+func (lb *LoadBalancer) acquireConn(server *ServerInfo) bool {
+	server.Mutex.Lock()
+	defer server.Mutex.Unlock()
+
+	if lb.MaxServerConns > 0 && server.activeConns >= lb.MaxServerConns {
+		return false
+	}
+	server.activeConns++
+	return true
+}
+
+// releaseConn ends a connection counted by acquireConn, the last one of a draining server reports it can be stopped
+func (lb *LoadBalancer) releaseConn(server *ServerInfo) {
+	server.Mutex.Lock()
+	server.activeConns--
+	drained := server.Draining && server.activeConns == 0
+	server.Mutex.Unlock()
+
+	if drained {
+		logger.Info("Draining server has no request in flight left", zap.String("address", server.ServingAddress))
+		lb.emit(Event{Type: ServerDrained, Server: server.ServingAddress})
+	}
+}
+
+// full returns true if the server has MaxServerConns connections, no request is routed to it until one ends
+func (lb *LoadBalancer) full(server *ServerInfo) bool {
+	if lb.MaxServerConns <= 0 {
+		return false
+	}
+	server.Mutex.Lock()
+	defer server.Mutex.Unlock()
+
+	return server.activeConns >= lb.MaxServerConns
+}
+
+// parseRequest decodes the raw request of a client and validates the fields needed to relay it,
+// the error is the message sent back to the client. the request is returned with a validation error
+// so the error can be answered in the protocol of the request
+func parseRequest(rawRequest json.RawMessage) (map[string]interface{}, error) {
+	request, err := inspectRequest(rawRequest)
+	if err != nil {
+		return nil, errors.New("Error in decoding the request")
+	}
+	// the server dispatches on the method, a request without one is never relayed
+	if method, ok := request["method"].(string); !ok || method == "" {
+		return request, errors.New("Invalid request, the method must be a non-empty string")
+	}
+	return request, nil
+}
+
+// inspectRequest decodes the raw request of a client into a map to inspect its fields
+// numbers are decoded as json.Number so they are not altered
+func inspectRequest(rawRequest json.RawMessage) (map[string]interface{}, error) {
+	var request map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(rawRequest))
+	decoder.UseNumber()
+	if err := decoder.Decode(&request); err != nil {
+		return nil, err
+	}
+	if request == nil {
+		return nil, errors.New("request is not a JSON object")
+	}
+	return request, nil
+}
+
+// checkResponse logs a warning if the response relayed from the server is larger
+// or slower than the configured thresholds. a zero threshold disables the check.
+func (lb *LoadBalancer) checkResponse(request map[string]interface{}, server *ServerInfo, size int64, latency time.Duration) {
+	if lb.LargeResponseThreshold > 0 && size > lb.LargeResponseThreshold {
+		logger.Warn("Large response from server",
+			zap.Any("method", request["method"]),
+			zap.String("address", server.ServingAddress),
+			zap.Int64("size", size),
+		)
+	}
+	if lb.SlowResponseThreshold > 0 && latency > lb.SlowResponseThreshold {
+		logger.Warn("Slow response from server",
+			zap.Any("method", request["method"]),
+			zap.String("address", server.ServingAddress),
+			zap.Duration("latency", latency),
+		)
+	}
+}
+
+// dialServer connects to the server on the given address, giving up at the deadline unless it is zero
+// the connection uses tls if BackendTLS is set
+func (lb *LoadBalancer) dialServer(address string, deadline time.Time) (net.Conn, error) {
+	dialer := &net.Dialer{Deadline: deadline}
+	if lb.BackendTLS != nil {
+		return tls.DialWithDialer(dialer, "tcp", address, lb.BackendTLS)
+	}
+	return dialer.Dial("tcp", address)
+}
+
+// recordResult records the result of a request relayed to the server in its rolling stats,
+// and in the outlier detector if it is enabled
+func (lb *LoadBalancer) recordResult(server *ServerInfo, success bool, latency time.Duration) {
+	latencyAlpha := lb.LatencyAlpha
+	if latencyAlpha == 0 {
+		latencyAlpha = statsAlpha
+	}
+	server.recordResult(success, latency, latencyAlpha)
+	if lb.Outliers != nil {
+		lb.Outliers.record(server, success, time.Now())
+	}
+}
+
+// dialServing connects to the first reachable serving address of the server
+// it returns the error of the last address if none of them is reachable
+func (lb *LoadBalancer) dialServing(server *ServerInfo, deadline time.Time) (net.Conn, error) {
+	addresses := server.ServingAddresses
+	if len(addresses) == 0 {
+		addresses = []string{server.ServingAddress}
+	}
+
+	var err error
+	for _, address := range addresses {
+		var conn net.Conn
+		if conn, err = lb.dialServer(address, deadline); err == nil {
+			return conn, nil
+		}
+		logger.Debug("Serving address is unreachable", zap.String("address", address), zap.Error(err))
+	}
+	return nil, err
+}
+
+// watchClient reads from the client connection until it fails, which means the client
+// disconnected or the connection is closed after the response is sent.
+// the server connection is closed then to abort a pending read from the server.
+func watchClient(clientConn net.Conn, serverConn net.Conn, clientGone chan struct{}) {
+	buf := make([]byte, 1)
+	for {
+		if _, err := clientConn.Read(buf); err != nil {
+			close(clientGone)
+			serverConn.Close()
+			return
+		}
+	}
+}
+
+// relayStream pipes the bytes of a streaming call in both directions without decoding the frames.
+// buffered holds the bytes the client sent after the request which are already read from clientConn.
+// the client closing its side is propagated to the server as a half-close,
+// the relay ends once the server closes its side, the caller closes both connections
+func relayStream(clientConn net.Conn, buffered io.Reader, serverConn net.Conn) error {
+	go func() {
+		io.Copy(serverConn, io.MultiReader(buffered, clientConn))
+		closeWrite(serverConn)
+	}()
+
+	_, err := io.Copy(clientConn, serverConn)
+	return err
+}
+
+// closeWrite closes the writing side of the connection if it supports half-close, the whole connection otherwise
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	conn.Close()
+}
+
+// Helper function to relay a raw JSON message over a connection
+// the message is followed by a newline like the messages written by json.Encoder
+func relayRaw(message json.RawMessage, conn net.Conn) error {
+	_, err := conn.Write(append(message, '\n'))
+	return err
+}
+
+// errMalformedResponse is the error of a response of a server which is not a JSON object, e.g. a truncated one
+var errMalformedResponse = errors.New("Malformed response from server")
+
+// Helper function to receive a raw JSON message from a connection
+// the error wraps errMalformedResponse if the message is not a JSON object
+func receiveRaw(conn io.Reader) (json.RawMessage, error) {
+	var message json.RawMessage
+	err := json.NewDecoder(conn).Decode(&message)
+	var syntaxError *json.SyntaxError
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &syntaxError) {
+		return nil, fmt.Errorf("%w: %v", errMalformedResponse, err)
+	}
+	if err == nil && !bytes.HasPrefix(bytes.TrimSpace(message), []byte("{")) {
+		return nil, fmt.Errorf("%w: not a JSON object", errMalformedResponse)
+	}
+	return message, err
+}
+
+// errResponseTooLarge is the error of a response of a server larger than MaxResponseSize
+var errResponseTooLarge = errors.New("Response too large")
+
+// receiveResponse receives the raw response of a server, reading at most MaxResponseSize bytes if it is set.
+// a larger response fails with errResponseTooLarge and the leading MaxResponseSize bytes of it
+func (lb *LoadBalancer) receiveResponse(conn io.Reader) (json.RawMessage, []byte, error) {
+	if lb.MaxResponseSize <= 0 {
+		response, err := receiveRaw(conn)
+		return response, nil, err
+	}
+	var head bytes.Buffer
+	limited := &io.LimitedReader{R: conn, N: lb.MaxResponseSize}
+	response, err := receiveRaw(io.TeeReader(limited, &head))
+	// the limit is only reached by a response which does not fit in it
+	if err != nil && limited.N <= 0 {
+		return nil, head.Bytes(), errResponseTooLarge
+	}
+	return response, nil, err
+}
+
+// truncatedResponse is the error response sent instead of an oversized response with its leading bytes,
+// flagged with "truncated": true. they are in the data of the error of a JSON-RPC 2.0 response
+func truncatedResponse(request map[string]interface{}, head []byte) json.RawMessage {
+	response := errorResponse(request, errResponseTooLarge.Error())
+	truncated := map[string]interface{}{"truncated": true, "partial": string(head)}
+	if e, ok := response["error"].(map[string]interface{}); ok {
+		e["data"] = truncated
+	} else {
+		for key, value := range truncated {
+			response[key] = value
+		}
+	}
+	raw, _ := json.Marshal(response)
+	return raw
+}
+
+// Helper function to send an error response to the client, in the format of the request
+// the request is nil if it could not be decoded
+func sendError(encoder *json.Encoder, request map[string]interface{}, message string) {
+	encoder.Encode(errorResponse(request, message))
+}
+
+// safeSelect selects the server using the strategy, it returns nil if the strategy panics,
+// so a buggy custom strategy falls back to round-robin instead of stopping the load balancer
+func safeSelect(strategy Strategy, request map[string]interface{}, servers []*ServerInfo) (server *ServerInfo) {
+	defer func() {
+		if r := recover(); r != nil {
+			method, _ := request["method"].(string)
+			logger.Error("Strategy panicked, falling back to round-robin",
+				zap.String("method", method),
+				zap.Any("panic", r),
+				zap.Stack("stack"),
+			)
+			server = nil
+		}
+	}()
+	return strategy.Select(request, servers)
+}
+
+// TODO: Implement the load balancing algorithm
+func (lb *LoadBalancer) getServer(request map[string]interface{}, exclude *ServerInfo) *ServerInfo {
+	lb.Mutex.Lock()
+	defer lb.Mutex.Unlock()
+
+	// servers which are ready to serve the method and not ejected, except the excluded one,
+	// ejections are ignored if every ready server is ejected
+	now := time.Now()
+	method, _ := request["method"].(string)
+	var keys, ready []string
+	for _, key := range lb.ServerKeys {
+		if server := lb.Servers[key]; server.Ready && server != exclude && !server.draining() && server.serves(method) && !lb.full(server) {
+			ready = append(ready, key)
+			if !server.ejected(now) {
+				keys = append(keys, key)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		keys = ready
+	}
+	// split the traffic between the canary servers and the stable ones
+	if lb.Canary != nil {
+		keys = lb.Canary.filter(request, lb.Servers, keys)
+	}
+	eligible := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		eligible[key] = true
+	}
+
+	// if there are no servers
+	if len(keys) == 0 {
+		return nil
+	}
+
+	servers := make([]*ServerInfo, 0, len(keys))
+	for _, key := range keys {
+		servers = append(servers, lb.Servers[key])
+	}
+
+	// select the server using the custom routing if it is set
+	if lb.SelectFunc != nil {
+		if server := lb.SelectFunc(request, servers); server != nil {
+			logger.Debug("Selected server by SelectFunc", zap.String("address", server.ServingAddress))
+			return server
+		}
+	}
+
+	// select the server using the strategy if it is set, round-robin is used if it panics
+	if lb.Strategy != nil {
+		if server := safeSelect(lb.Strategy, request, servers); server != nil {
+			logger.Debug("Selected server", zap.String("address", server.ServingAddress))
+			return server
+		}
+	}
+
+	// RoundRobinIndex is the index of the next server in ServerKeys, removeServer keeps it
+	// on the same server when the servers before it are removed so they are served evenly
+	start := lb.RoundRobinIndex % len(lb.ServerKeys)
+
+	// skip the highly loaded servers if a less loaded eligible one is available
+	selected := -1
+	for i := 0; i < len(lb.ServerKeys); i++ {
+		index := (start + i) % len(lb.ServerKeys)
+		if !eligible[lb.ServerKeys[index]] {
+			continue
+		}
+		candidate := lb.Servers[lb.ServerKeys[index]]
+		if selected < 0 {
+			selected = index
+		}
+		if candidate.Load < highLoad {
+			selected = index
+			break
+		}
+	}
+	logger.Debug("Round robin index", zap.Int("index", selected))
+
+	// get the server using the round robin index
+	server := lb.Servers[lb.ServerKeys[selected]]
+
+	// advance the round robin index past the selected server
+	lb.RoundRobinIndex = selected + 1
+
+	logger.Debug("Selected server", zap.String("address", server.ServingAddress))
+	return server
+}
+
+func main() {
+	err := godotenv.Load()
+	if err != nil {
+		logger.Error("Error loading .env file", zap.Error(err))
+	}
+
+	// read and validate the configuration, exit listing every problem if it is invalid
+	config, err := loadConfig()
+	if err != nil {
+		logger.Error("Invalid configuration", zap.Error(err))
+		fmt.Fprintln(os.Stderr, err)
+		logger.Sync()
+		os.Exit(1)
+	}
+
+	// Create a new load balancer with a timeout
+	lb := NewLoadBalancer(config.Timeout)
+	lb.HeartbeatSecret = config.HeartbeatSecret
+	lb.AdminToken = config.AdminToken
+	lb.ScanInterval = config.ScanInterval
+	lb.BackendTLS = config.BackendTLS
+	lb.AcceptBackoffMax = config.AcceptBackoffMax
+	lb.Workers = config.Workers
+	lb.QueueDepth = config.QueueDepth
+	lb.ProxyProtocol = config.ProxyProtocol
+	lb.AllowPin = config.AllowPin
+	lb.MethodLimits = config.MethodLimits
+	lb.MaxRelayAttempts = config.MaxRelayAttempts
+	lb.MaxRelayTime = config.MaxRelayTime
+	lb.MaxServerConns = config.MaxServerConns
+	lb.Outliers = config.Outliers
+	lb.Canary = config.Canary
+	lb.Middleware = config.Middleware
+	lb.Metrics = config.Metrics
+	lb.WebSocketOrigins = config.WebSocketOrigins
+	lb.GatewaySchema = config.GatewaySchema
+	lb.IdleTimeout = config.IdleTimeout
+	lb.ReadTimeout = config.ReadTimeout
+	lb.HandshakeTimeout = config.HandshakeTimeout
+	lb.LargeResponseThreshold = config.LargeResponseThreshold
+	lb.MaxResponseSize = config.MaxResponseSize
+	lb.TruncateOversized = config.TruncateOversized
+	lb.Compression = config.Compression
+	lb.SlowResponseThreshold = config.SlowResponseThreshold
+	lb.SlowHeartbeatFactor = config.SlowHeartbeatFactor
+	lb.Strategy = config.Strategy
+	lb.RetryMalformed = config.RetryMalformed
+	lb.LatencyAlpha = config.LatencyAlpha
+
+	logTLSPolicy(config.TLS)
+
+	if len(lb.HeartbeatSecret) == 0 {
+		logger.Warn("LB_HB_SECRET is not set, heartbeats will not be verified")
+	}
+
+	// Channel to listen SIGINT and SIGTERM
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	// Context to cancel the server
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
 
 	// listen sigint and sigterm signals
 	go func() {
@@ -348,20 +1859,81 @@ func main() {
 		cancel()
 	}()
 
-	// Listen for heartbeats
-	go lb.ListenForHeartbeats(LB_HB_ADDRESS)
+	// Export the spans of the relays if configured, the ones left are flushed on exit
+	if config.Tracing {
+		shutdownTracing, err := startTracing(ctx)
+		if err != nil {
+			logger.Error("Error in starting the tracing", zap.Error(err))
+			return
+		}
+		defer shutdownTracing(context.Background())
+	}
 
-	// Monitor heartbeats
-	go lb.MonitorHeartbeats()
+	// Listen for heartbeats and requests, monitor heartbeats
+	if err := lb.Start(config.HBAddress, config.ClientAddress, config.TLS); err != nil {
+		logger.Error("Error in Listen", zap.Error(err))
+		return
+	}
+	defer lb.Stop()
 
-	// Listen for requests
-	go lb.ListenForRequests(LB_CLIENT_ADDRESS, tlsConfig)
+	// Log a health summary periodically if configured
+	if config.HealthSummaryInterval > 0 {
+		go lb.LogHealthSummary(config.HealthSummaryInterval)
+	}
+
+	// Share the servers with the peer load balancers if configured
+	if config.Gossip != nil {
+		if err := lb.StartGossip(config.Gossip); err != nil {
+			logger.Error("Error in Listen for gossip", zap.Error(err))
+			return
+		}
+	}
+
+	// Serve the browser clients over WebSocket if configured
+	if config.WebSocketAddress != "" {
+		if err := lb.StartWebSocket(config.WebSocketAddress, config.TLS); err != nil {
+			logger.Error("Error in Listen for WebSocket", zap.Error(err))
+			return
+		}
+	}
+
+	// Serve the HTTP gateway if configured
+	if config.GatewayAddress != "" {
+		if err := lb.StartGateway(config.GatewayAddress, config.TLS); err != nil {
+			logger.Error("Error in Listen for the HTTP gateway", zap.Error(err))
+			return
+		}
+	}
+
+	// Serve the admin endpoints if configured
+	if config.AdminAddress != "" {
+		if len(lb.AdminToken) == 0 {
+			logger.Warn("LB_ADMIN_TOKEN is not set, the admin endpoints are not authenticated and /drain is not served")
+		}
+		if err := lb.StartAdmin(config.AdminAddress, config.Pprof); err != nil {
+			logger.Error("Error in Listen for the admin listener", zap.Error(err))
+			return
+		}
+	}
+
+	// Discover servers from DNS SRV records if configured
+	if config.SRVName != "" {
+		go lb.DiscoverSRV(NewSRVDiscovery(config.SRVName, config.SRVInterval))
+	}
+
+	// Check the methods served by the servers if configured
+	if config.MethodCheckInterval > 0 {
+		go lb.CheckMethods(config.MethodCheckInterval)
+	}
 
 	// wait for the signal to stop
 	<-ctx.Done()
 
-	// sleep for 0.5 second
-	<-time.After(500 * time.Millisecond)
+	// give the requests in flight 0.5 second to complete, the HTTP servers stop once theirs are done
+	grace, cancelGrace := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancelGrace()
+	lb.ShutdownHTTP(grace)
+	<-grace.Done()
 
 	logger.Info("Load balancer stopped")
 }
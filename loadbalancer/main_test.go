@@ -0,0 +1,14 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// the tests and the benchmarks do not log, the logger writes to the console and to a file
+func TestMain(m *testing.M) {
+	logger = zap.NewNop()
+	os.Exit(m.Run())
+}
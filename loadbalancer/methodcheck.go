@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// the deep health check asks every server for the methods it serves with the reserved __methods call,
+// and each method is only routed to the servers serving it. it catches the servers missing a method
+// after a partial deploy, which answer heartbeats and probes all the same
+
+// methodsMethod is the reserved method the server stubs answer with the methods they serve
+const methodsMethod = "__methods"
+
+// CheckMethods asks the servers for the methods they serve every interval until the load balancer is stopped
+func (lb *LoadBalancer) CheckMethods(interval time.Duration) {
+	for { // infinite loop
+		lb.Mutex.Lock()
+		servers := make([]*ServerInfo, 0, len(lb.Servers))
+		for _, server := range lb.Servers {
+			servers = append(servers, server)
+		}
+		lb.Mutex.Unlock()
+
+		// check the servers concurrently, a slow server does not delay the others
+		var wg sync.WaitGroup
+		for _, server := range servers {
+			wg.Add(1)
+			go func(server *ServerInfo) {
+				defer wg.Done()
+				lb.checkMethods(server, interval/2)
+			}(server)
+		}
+		wg.Wait()
+
+		select {
+		case <-lb.done:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// checkMethods asks the server for the methods it serves and stores them, giving up after the timeout.
+// the methods are kept as they are if the server cannot be reached, its health is checked apart
+func (lb *LoadBalancer) checkMethods(server *ServerInfo, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	conn, err := lb.dialServing(server, deadline)
+	if err != nil {
+		logger.Debug("Error in checking the methods of the server", zap.String("address", server.ServingAddress), zap.Error(err))
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+
+	request := map[string]interface{}{"method": methodsMethod, "params": map[string]interface{}{}}
+	var response struct {
+		Methods []string `json:"methods"`
+	}
+	if err := json.NewEncoder(conn).Encode(request); err != nil {
+		logger.Debug("Error in checking the methods of the server", zap.String("address", server.ServingAddress), zap.Error(err))
+		return
+	}
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		logger.Debug("Error in checking the methods of the server", zap.String("address", server.ServingAddress), zap.Error(err))
+		return
+	}
+
+	// a server whose stub does not answer __methods, e.g. an older one, is routed every method
+	var methods map[string]bool
+	if response.Methods != nil {
+		methods = make(map[string]bool, len(response.Methods))
+		for _, method := range response.Methods {
+			methods[method] = true
+		}
+	}
+
+	server.Mutex.Lock()
+	changed := !sameMethods(server.Methods, methods)
+	server.Methods = methods
+	server.Mutex.Unlock()
+
+	if changed {
+		sort.Strings(response.Methods)
+		logger.Info("Methods of the server changed", zap.String("address", server.ServingAddress), zap.Strings("methods", response.Methods))
+	}
+}
+
+// serves returns true if the server serves the method, or if its methods are not known
+func (server *ServerInfo) serves(method string) bool {
+	server.Mutex.Lock()
+	defer server.Mutex.Unlock()
+
+	return server.Methods == nil || server.Methods[method]
+}
+
+// sameMethods returns true if both sets hold the same methods, nil only equals nil
+func sameMethods(a, b map[string]bool) bool {
+	if (a == nil) != (b == nil) || len(a) != len(b) {
+		return false
+	}
+	for method := range a {
+		if !b[method] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// each method is only routed to the servers serving it, a server not answering __methods gets every method
+func TestCheckMethods(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	// the fake servers answer __methods and the requests alike, with the methods and their result
+	full, _ := startBackend(t, `{"methods":["add","sub"],"result":1}`)
+	partial, _ := startBackend(t, `{"result":2,"methods":["add"]}`)
+	older, _ := startBackend(t, `{"result":3}`)
+	fullServer := registerTestServer(lb, full)
+	partialServer := registerTestServer(lb, partial)
+	registerTestServer(lb, older)
+
+	go lb.CheckMethods(time.Hour)
+	defer lb.Stop()
+	waitFor(t, "the method check", func() bool {
+		return !partialServer.serves("sub") && fullServer.serves("sub") && !fullServer.serves("mul")
+	})
+
+	if snapshot := lb.Snapshot(); !reflect.DeepEqual(snapshot[0].Methods, []string{"add", "sub"}) || !reflect.DeepEqual(snapshot[1].Methods, []string{"add"}) || snapshot[2].Methods != nil {
+		t.Fatalf("got the methods %v, %v and %v", snapshot[0].Methods, snapshot[1].Methods, snapshot[2].Methods)
+	}
+
+	results := map[string]map[float64]int{"add": {}, "sub": {}, "mul": {}}
+	for method, counts := range results {
+		for i := 0; i < 12; i++ {
+			response := relayTestRequest(t, lb, `{"method":"`+method+`","params":{}}`)
+			result, _ := response["result"].(float64)
+			counts[result]++
+		}
+	}
+	if counts := results["add"]; counts[1] == 0 || counts[2] == 0 || counts[3] == 0 {
+		t.Errorf("add went to %v, want every server", counts)
+	}
+	if counts := results["sub"]; counts[2] != 0 || counts[1] == 0 || counts[3] == 0 {
+		t.Errorf("sub went to %v, want the servers 1 and 3", counts)
+	}
+	if counts := results["mul"]; counts[3] != 12 {
+		t.Errorf("mul went to %v, want the server 3", counts)
+	}
+}
+
+// a server which cannot be reached keeps its methods, and a method no server serves fails
+func TestCheckMethodsUnreachable(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	server := registerTestServer(lb, closedAddress(t))
+	server.Methods = map[string]bool{"add": true}
+
+	lb.checkMethods(server, 100*time.Millisecond)
+	if !server.serves("add") || server.serves("sub") {
+		t.Fatalf("got the methods %v after an unreachable check", server.Methods)
+	}
+	if response := relayTestRequest(t, lb, `{"method":"sub","params":{}}`); response["error"] != "No server available" {
+		t.Fatalf("got %v for a method no server serves", response)
+	}
+}
+
+func TestSameMethods(t *testing.T) {
+	cases := []struct {
+		a, b map[string]bool
+		same bool
+	}{
+		{nil, nil, true},
+		{nil, map[string]bool{}, false},
+		{map[string]bool{"add": true}, map[string]bool{"add": true}, true},
+		{map[string]bool{"add": true}, map[string]bool{"sub": true}, false},
+		{map[string]bool{"add": true}, map[string]bool{"add": true, "sub": true}, false},
+	}
+	for _, c := range cases {
+		if got := sameMethods(c.a, c.b); got != c.same {
+			t.Errorf("sameMethods(%v, %v) = %v", c.a, c.b, got)
+		}
+	}
+}
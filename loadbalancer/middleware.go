@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Handler exchanges a decoded request with a server and returns the decoded response.
+// the error is the message sent to the client instead of a response
+type Handler func(request map[string]interface{}) (map[string]interface{}, error)
+
+// Middleware wraps a handler, e.g. to inspect or transform the requests and the responses.
+// it may answer without calling next, which skips the server
+type Middleware func(next Handler) Handler
+
+// Chain composes the middlewares into one, the first one is the outermost
+func Chain(middlewares ...Middleware) Middleware {
+	return func(next Handler) Handler {
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			next = middlewares[i](next)
+		}
+		return next
+	}
+}
+
+// exchangeThrough exchanges the request with a server through the middleware,
+// the messages are decoded for the middleware and the response is encoded back for the client
+func (lb *LoadBalancer) exchangeThrough(middleware Middleware, conn net.Conn, request map[string]interface{}, keepAlive bool) (json.RawMessage, *ServerInfo, error) {
+	var server *ServerInfo
+	handler := func(request map[string]interface{}) (map[string]interface{}, error) {
+		rawRequest, err := json.Marshal(request)
+		if err != nil {
+			return nil, err
+		}
+		rawResponse, s, err := lb.exchange(conn, request, rawRequest, keepAlive)
+		server = s
+		if err != nil {
+			return nil, err
+		}
+		// the response is a JSON object like the request
+		return inspectRequest(rawResponse)
+	}
+
+	response, err := middleware(handler)(request)
+	if err != nil {
+		return nil, server, err
+	}
+	rawResponse, err := json.Marshal(response)
+	if err != nil {
+		logger.Error("Error in encoding response", zap.Error(err))
+		return nil, server, err
+	}
+	return rawResponse, server, nil
+}
+
+// Logging logs the method, the duration and the error of every request
+func Logging() Middleware {
+	return func(next Handler) Handler {
+		return func(request map[string]interface{}) (map[string]interface{}, error) {
+			start := time.Now()
+			response, err := next(request)
+			method, _ := request["method"].(string)
+			fields := []zap.Field{zap.String("method", method), zap.Duration("duration", time.Since(start))}
+			if err == nil {
+				if e, ok := response["error"]; ok {
+					fields = append(fields, zap.Any("responseError", e))
+				}
+			} else if err != errClientGone {
+				fields = append(fields, zap.Error(err))
+			}
+			logger.Info("Request served", fields...)
+			return response, err
+		}
+	}
+}
+
+// Metrics counts the requests, the errors and the latency of each method
+type Metrics struct {
+	mutex   sync.Mutex
+	methods map[string]*methodMetrics
+}
+
+// methodMetrics are the metrics of a method since they were last logged
+type methodMetrics struct {
+	requests int
+	errors   int
+	latency  time.Duration // total latency of the requests
+}
+
+// NewMetrics returns empty metrics
+func NewMetrics() *Metrics {
+	return &Metrics{methods: make(map[string]*methodMetrics)}
+}
+
+// Middleware returns the middleware recording the requests into the metrics,
+// a request fails if the server could not be reached or responded with an error
+func (m *Metrics) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return func(request map[string]interface{}) (map[string]interface{}, error) {
+			start := time.Now()
+			response, err := next(request)
+			latency := time.Since(start)
+			_, failed := response["error"]
+			method, _ := request["method"].(string)
+
+			m.mutex.Lock()
+			metrics, ok := m.methods[method]
+			if !ok {
+				metrics = &methodMetrics{}
+				m.methods[method] = metrics
+			}
+			metrics.requests++
+			metrics.latency += latency
+			if err != nil || failed {
+				metrics.errors++
+			}
+			m.mutex.Unlock()
+			return response, err
+		}
+	}
+}
+
+// log logs the metrics of each method in name order and resets them
+func (m *Metrics) log() {
+	m.mutex.Lock()
+	methods := m.methods
+	m.methods = make(map[string]*methodMetrics)
+	m.mutex.Unlock()
+
+	names := make([]string, 0, len(methods))
+	for name := range methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		metrics := methods[name]
+		logger.Info("Method metrics",
+			zap.String("method", name),
+			zap.Int("requests", metrics.requests),
+			zap.Int("errors", metrics.errors),
+			zap.Duration("avgLatency", metrics.latency/time.Duration(metrics.requests)),
+		)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the middlewares of a chain run in order from the first one around the request,
+// and in reverse order around the response
+func TestChainOrder(t *testing.T) {
+	var calls []string
+	trace := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(request map[string]interface{}) (map[string]interface{}, error) {
+				calls = append(calls, name+">")
+				response, err := next(request)
+				calls = append(calls, "<"+name)
+				return response, err
+			}
+		}
+	}
+	handler := func(request map[string]interface{}) (map[string]interface{}, error) {
+		calls = append(calls, "server")
+		return map[string]interface{}{"result": 3}, nil
+	}
+
+	response, err := Chain(trace("a"), trace("b"), Chain(trace("c")))(handler)(map[string]interface{}{})
+	if err != nil || response["result"] != 3 {
+		t.Fatalf("got %v, %v", response, err)
+	}
+	if got := strings.Join(calls, " "); got != "a> b> c> server <c <b <a" {
+		t.Fatalf("got %s", got)
+	}
+}
+
+// a middleware answering without calling next skips the server and the middlewares after it,
+// the others see and may transform the decoded request and response
+func TestMiddlewareShortCircuit(t *testing.T) {
+	backend, requests := startBackend(t, `{"result":3,"internal":"x"}`)
+	lb := NewLoadBalancer(time.Second)
+	registerTestServer(lb, backend)
+
+	var reached []string
+	deny := func(next Handler) Handler {
+		return func(request map[string]interface{}) (map[string]interface{}, error) {
+			switch request["method"] {
+			case "Forbidden":
+				return map[string]interface{}{"error": "method denied"}, nil
+			case "Failing":
+				return nil, errors.New("Request rejected by middleware")
+			}
+			return next(request)
+		}
+	}
+	transform := func(next Handler) Handler {
+		return func(request map[string]interface{}) (map[string]interface{}, error) {
+			reached = append(reached, request["method"].(string))
+			delete(request, "token")
+			response, err := next(request)
+			if err == nil {
+				delete(response, "internal")
+				response["server"] = "lb-1"
+			}
+			return response, err
+		}
+	}
+	lb.Middleware = Chain(Logging(), deny, transform)
+
+	response := relayTestRequest(t, lb, `{"method":"Add","params":{"a":1,"b":2},"token":"secret"}`)
+	if response["result"] != 3.0 || response["server"] != "lb-1" || response["internal"] != nil {
+		t.Fatalf("got %v", response)
+	}
+	if request := <-requests; request["token"] != nil || request["method"] != "Add" {
+		t.Fatalf("the server received %v", request)
+	}
+
+	if response := relayTestRequest(t, lb, `{"method":"Forbidden","params":{}}`); response["error"] != "method denied" || len(response) != 1 {
+		t.Fatalf("got %v", response)
+	}
+	if response := relayTestRequest(t, lb, `{"method":"Failing","params":{}}`); response["error"] != "Request rejected by middleware" {
+		t.Fatalf("got %v", response)
+	}
+	if len(requests) != 0 || strings.Join(reached, ",") != "Add" {
+		t.Fatalf("the short-circuited requests reached %v and the server got %d of them", reached, len(requests))
+	}
+}
+
+// the metrics middleware counts the requests and the errors of each method
+func TestMetricsMiddleware(t *testing.T) {
+	backend, _ := startBackend(t, `{"result":3}`)
+	failing, _ := startBackend(t, `{"error":"DivByZero"}`)
+	lb := NewLoadBalancer(time.Second)
+	metrics := NewMetrics()
+	lb.Middleware = metrics.Middleware()
+
+	registerTestServer(lb, backend)
+	for i := 0; i < 3; i++ {
+		relayTestRequest(t, lb, `{"method":"Add","params":{"a":1,"b":2}}`)
+	}
+	lb.Mutex.Lock()
+	lb.removeServer("hb-" + backend)
+	lb.Mutex.Unlock()
+	registerTestServer(lb, failing)
+	relayTestRequest(t, lb, `{"method":"Divide","params":{"a":1,"b":0}}`)
+	lb.Mutex.Lock()
+	lb.removeServer("hb-" + failing)
+	lb.Mutex.Unlock()
+	relayTestRequest(t, lb, `{"method":"Divide","params":{"a":1,"b":2}}`)
+
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	add, divide := metrics.methods["Add"], metrics.methods["Divide"]
+	if add == nil || add.requests != 3 || add.errors != 0 || add.latency <= 0 {
+		t.Errorf("metrics of Add: %+v", add)
+	}
+	if divide == nil || divide.requests != 2 || divide.errors != 2 {
+		t.Errorf("metrics of Divide: %+v", divide)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// OutlierDetector ejects the servers whose recent error rate exceeds a threshold
+// from the rotation for a while, like the outlier detection of Envoy
+type OutlierDetector struct {
+	ErrorRate float64       // rate of the failed requests in the window to eject a server
+	Window    time.Duration // window the error rate is computed over
+	Ejection  time.Duration // duration of an ejection, multiplied by the consecutive ejections of the server
+}
+
+const (
+	outlierBuckets        = 10 // buckets the window is divided into
+	outlierMinRequests    = 5  // requests in the window needed to eject a server
+	maxEjectionMultiplier = 10 // maximum multiplier of the ejection duration
+)
+
+// outlierBucket counts the results of the requests relayed to a server in a part of the window
+type outlierBucket struct {
+	start     time.Time
+	successes int
+	failures  int
+}
+
+// record adds the result of a request to the window of the server and ejects the server
+// if its error rate exceeds the threshold. the window starts empty after an ejection, so the
+// server is reintroduced on probation: it is ejected again for longer if it keeps failing,
+// and the multiplier is reset once it stays a whole window without ejection
+func (d *OutlierDetector) record(server *ServerInfo, success bool, now time.Time) {
+	server.Mutex.Lock()
+	defer server.Mutex.Unlock()
+
+	// requests in flight when the server was ejected are not counted
+	if now.Before(server.ejectedUntil) {
+		return
+	}
+
+	// drop the buckets which left the window and open a new bucket if the last one is full
+	for len(server.outliers) > 0 && now.Sub(server.outliers[0].start) > d.Window {
+		server.outliers = server.outliers[1:]
+	}
+	last := len(server.outliers) - 1
+	if last < 0 || now.Sub(server.outliers[last].start) >= d.Window/outlierBuckets {
+		server.outliers = append(server.outliers, outlierBucket{start: now})
+		last++
+	}
+	if success {
+		server.outliers[last].successes++
+	} else {
+		server.outliers[last].failures++
+	}
+
+	// error rate of the requests in the window
+	total, failures := 0, 0
+	for _, bucket := range server.outliers {
+		total += bucket.successes + bucket.failures
+		failures += bucket.failures
+	}
+	if total < outlierMinRequests || float64(failures)/float64(total) <= d.ErrorRate {
+		if server.ejections > 0 && now.Sub(server.ejectedUntil) >= d.Window {
+			server.ejections = 0
+		}
+		return
+	}
+
+	if server.ejections < maxEjectionMultiplier {
+		server.ejections++
+	}
+	duration := time.Duration(server.ejections) * d.Ejection
+	server.ejectedUntil = now.Add(duration)
+	server.outliers = nil
+
+	logger.Warn("Server ejected for its error rate",
+		zap.String("address", server.ServingAddress),
+		zap.Int("failures", failures),
+		zap.Int("requests", total),
+		zap.Duration("duration", duration),
+	)
+}
+
+// ejected returns true if the server is ejected from the rotation at the given time
+func (server *ServerInfo) ejected(now time.Time) bool {
+	server.Mutex.Lock()
+	defer server.Mutex.Unlock()
+
+	return now.Before(server.ejectedUntil)
+}
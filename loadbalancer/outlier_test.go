@@ -0,0 +1,113 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// a server is ejected once its error rate exceeds the threshold over enough requests,
+// and ejected again for longer if it keeps failing on probation
+func TestOutlierEjection(t *testing.T) {
+	d := &OutlierDetector{ErrorRate: 0.5, Window: 10 * time.Second, Ejection: time.Second}
+	server := &ServerInfo{ServingAddress: "10.0.0.1:8081"}
+	now := time.Now()
+	record := func(success bool, n int) {
+		for i := 0; i < n; i++ {
+			now = now.Add(10 * time.Millisecond)
+			d.record(server, success, now)
+		}
+	}
+
+	// too few requests to judge the server
+	record(false, outlierMinRequests-1)
+	if server.ejected(now) {
+		t.Fatal("ejected before the minimum number of requests")
+	}
+	server.outliers = nil
+
+	// half of the requests failing is not above the threshold
+	record(true, 4)
+	record(false, 4)
+	if server.ejected(now) {
+		t.Fatal("ejected at the threshold")
+	}
+	record(false, 1)
+	if !server.ejected(now) || server.ejections != 1 || !server.ejectedUntil.Equal(now.Add(time.Second)) {
+		t.Fatalf("not ejected for a second, until %v", server.ejectedUntil.Sub(now))
+	}
+
+	// the requests in flight during the ejection are not counted, the server comes back with an empty window
+	record(false, 3)
+	if len(server.outliers) != 0 {
+		t.Fatal("results recorded during the ejection")
+	}
+	now = server.ejectedUntil
+	if server.ejected(now) {
+		t.Fatal("still ejected once the ejection passed")
+	}
+
+	// failing again on probation doubles the ejection
+	record(false, outlierMinRequests)
+	if server.ejections != 2 || !server.ejectedUntil.Equal(now.Add(2*time.Second)) {
+		t.Fatalf("ejection %d for %v", server.ejections, server.ejectedUntil.Sub(now))
+	}
+
+	// a whole window without ejection resets the multiplier
+	now = server.ejectedUntil.Add(d.Window)
+	record(true, 1)
+	if server.ejections != 0 {
+		t.Fatalf("multiplier %d after a healthy window", server.ejections)
+	}
+}
+
+// the failures which left the window are not counted
+func TestOutlierWindowSlides(t *testing.T) {
+	d := &OutlierDetector{ErrorRate: 0.5, Window: time.Second, Ejection: time.Second}
+	server := &ServerInfo{ServingAddress: "10.0.0.1:8081"}
+	now := time.Now()
+	for i := 0; i < 4; i++ {
+		d.record(server, false, now)
+	}
+	now = now.Add(2 * time.Second)
+	for i := 0; i < 4; i++ {
+		d.record(server, true, now)
+	}
+	d.record(server, false, now)
+	if server.ejected(now) {
+		t.Fatal("ejected for failures which left the window")
+	}
+}
+
+// a server answering with malformed responses is ejected and its traffic goes to the healthy one,
+// the ejected servers are still used once every ready server is ejected
+func TestOutlierEjectedServerSkipped(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	lb.Outliers = &OutlierDetector{ErrorRate: 0.5, Window: time.Minute, Ejection: time.Minute}
+	good, goodRequests := startBackend(t, `{"result":3}`)
+	bad, badRequests := startBackend(t, `{"result":`)
+	goodServer := registerTestServer(lb, good)
+	badServer := registerTestServer(lb, bad)
+
+	for i := 0; i < 2*outlierMinRequests; i++ {
+		relayTestRequest(t, lb, `{"method":"Add","params":{"a":1,"b":2}}`)
+	}
+	if len(badRequests) != outlierMinRequests || !badServer.ejected(time.Now()) {
+		t.Fatalf("the failing server got %d requests, ejected %v", len(badRequests), badServer.ejected(time.Now()))
+	}
+
+	for i := 0; i < 4; i++ {
+		if response := relayTestRequest(t, lb, `{"method":"Add","params":{"a":1,"b":2}}`); response["result"] != 3.0 {
+			t.Fatalf("got %v", response)
+		}
+	}
+	if len(badRequests) != outlierMinRequests || len(goodRequests) != outlierMinRequests+4 {
+		t.Fatalf("the ejected server got %d requests, the healthy one %d", len(badRequests), len(goodRequests))
+	}
+
+	lb.Mutex.Lock()
+	goodServer.Ready = false
+	lb.Mutex.Unlock()
+	if server := lb.getServer(map[string]interface{}{"method": "Add"}, nil); server != badServer {
+		t.Fatalf("got %v, want the ejected server as the last one", server)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// a pinned request is relayed to the server with its serving address, and never to another one
+func TestPinnedRequest(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	first, _ := startBackend(t, `{"result":1}`)
+	second, _ := startBackend(t, `{"result":2}`)
+	registerTestServer(lb, first)
+	unready := registerTestServer(lb, second)
+
+	pinned := `{"method":"Add","params":{"a":1,"b":2},"pin":"` + second + `"}`
+	if response := relayTestRequest(t, lb, pinned); response["error"] != "Pinning requests to a server is not allowed" {
+		t.Fatalf("got %v with pinning not allowed", response)
+	}
+
+	lb.AllowPin = true
+	for i := 0; i < 4; i++ {
+		if response := relayTestRequest(t, lb, pinned); response["result"] != 2.0 {
+			t.Fatalf("request %d: got %v", i, response)
+		}
+	}
+
+	lb.Mutex.Lock()
+	unready.Ready = false
+	lb.Mutex.Unlock()
+	if response := relayTestRequest(t, lb, pinned); response["error"] != "Pinned server "+second+" is unavailable" {
+		t.Fatalf("got %v from an unready server", response)
+	}
+
+	cases := map[string]string{
+		`{"method":"Add","params":{},"pin":"10.0.0.9:8081"}`: "Pinned server 10.0.0.9:8081 is unknown",
+		`{"method":"Add","params":{},"pin":""}`:              "Invalid pin, must be the serving address of a server",
+		`{"method":"Add","params":{},"pin":8081}`:            "Invalid pin, must be the serving address of a server",
+	}
+	for request, want := range cases {
+		if response := relayTestRequest(t, lb, request); response["error"] != want {
+			t.Errorf("%s: got %v, want %s", request, response, want)
+		}
+	}
+}
+
+// a pinned server which refuses the connection fails the request rather than it being relayed to another server
+func TestPinnedServerDown(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	lb.AllowPin = true
+	up, _ := startBackend(t, `{"result":1}`)
+	registerTestServer(lb, up)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := ln.Addr().String()
+	ln.Close()
+	registerTestServer(lb, down)
+
+	if response := relayTestRequest(t, lb, `{"method":"Add","params":{},"pin":"`+down+`"}`); response["error"] != "Pinned server "+down+" is unavailable" {
+		t.Fatalf("got %v", response)
+	}
+}
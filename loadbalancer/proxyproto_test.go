@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// proxyV2Header encodes a PROXY protocol v2 header with the command, the family and the address payload
+func proxyV2Header(version byte, command byte, family byte, payload []byte) []byte {
+	header := append([]byte(nil), proxyV2Signature...)
+	header = append(header, version<<4|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:16], uint16(len(payload)))
+	return append(header, payload...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	ipv4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb}
+	ipv6 := make([]byte, 36)
+	copy(ipv6, net.ParseIP("2001:db8::1"))
+	copy(ipv6[16:], net.ParseIP("2001:db8::2"))
+	binary.BigEndian.PutUint16(ipv6[32:], 56324)
+
+	cases := []struct {
+		name   string
+		header string
+		remote string // address in the header, empty if it has none
+		err    string // prefix of the error, empty if the header is valid
+	}{
+		{"v1 tcp4", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", "192.0.2.1:56324", ""},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", "[2001:db8::1]:56324", ""},
+		{"v1 unknown", "PROXY UNKNOWN\r\n", "", ""},
+		{"v1 not terminated", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n", "", "v1 header is not terminated"},
+		{"v1 invalid address", "PROXY TCP4 192.0.2 198.51.100.1 56324 443\r\n", "", "invalid v1 source address"},
+		{"v1 invalid port", "PROXY TCP4 192.0.2.1 198.51.100.1 65536 443\r\n", "", "invalid v1 source address"},
+		{"v1 udp", "PROXY UDP4 192.0.2.1 198.51.100.1 56324 443\r\n", "", "invalid v1 header"},
+		{"v2 tcp4", string(proxyV2Header(2, 1, 0x11, ipv4)), "192.0.2.1:56324", ""},
+		{"v2 tcp6", string(proxyV2Header(2, 1, 0x21, ipv6)), "[2001:db8::1]:56324", ""},
+		{"v2 local", string(proxyV2Header(2, 0, 0x11, ipv4)), "", ""},
+		{"v2 unix", string(proxyV2Header(2, 1, 0x31, make([]byte, 216))), "", ""},
+		{"v2 version", string(proxyV2Header(1, 1, 0x11, ipv4)), "", "unsupported v2 version 1"},
+		{"v2 short", string(proxyV2Header(2, 1, 0x11, ipv4[:8])), "", "short v2 IPv4 addresses"},
+		{"missing", `{"method":"Add","params":{}}` + "\n", "", "missing header"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// the request following the header is left to read
+			r := bufio.NewReader(strings.NewReader(c.header + `{"method":"Add"}`))
+			remote, err := readProxyHeader(r)
+			if c.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), c.err) {
+					t.Fatalf("got %v, want %s", err, c.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (remote == nil && c.remote != "") || (remote != nil && remote.String() != c.remote) {
+				t.Fatalf("got remote %v, want %q", remote, c.remote)
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != `{"method":"Add"}` {
+				t.Fatalf("%q left after the header", rest)
+			}
+		})
+	}
+}
+
+// the client address sent by the proxy before the tls handshake is the one the load balancer sees
+func TestProxyProtocolClientAddress(t *testing.T) {
+	backend, _ := startBackend(t, `{"result":3}`)
+	lb := NewLoadBalancer(time.Second)
+	lb.ProxyProtocol = true
+	registerTestServer(lb, backend)
+	certificate, _ := newTestCertificate(t)
+	logs := observeLogs(t, zapcore.DebugLevel)
+
+	ln, err := lb.listenClients("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{certificate}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go lb.serveRequests(ln)
+
+	raw, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	raw.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := raw.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	conn := tls.Client(raw, &tls.Config{InsecureSkipVerify: true})
+	if err := json.NewEncoder(conn).Encode(map[string]interface{}{"method": "Add", "params": map[string]interface{}{"a": 1, "b": 2}}); err != nil {
+		t.Fatal(err)
+	}
+	var response map[string]interface{}
+	if err := json.NewDecoder(conn).Decode(&response); err != nil || response["result"] != 3.0 {
+		t.Fatalf("got %v, %v", response, err)
+	}
+	received := logs.FilterMessage("Request received from client").All()
+	if len(received) != 1 || received[0].ContextMap()["address"] != "192.0.2.1:56324" {
+		t.Fatalf("the request is seen from %v", received)
+	}
+
+	// a connection without the header is closed
+	plain, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	plain.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := tls.Client(plain, &tls.Config{InsecureSkipVerify: true}).Handshake(); err == nil {
+		t.Fatal("handshake without a PROXY protocol header succeeded")
+	}
+	waitFor(t, "the connection closed", func() bool {
+		return logs.FilterMessage("TLS handshake failed, connection closed").Len() == 1
+	})
+}
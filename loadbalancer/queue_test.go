@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+// the connections beyond the workers and the depth of the queue are shed at once with "server busy"
+func TestRequestQueueShedding(t *testing.T) {
+	const delay = 300 * time.Millisecond
+	backend, _ := startSlowBackend(t, delay)
+
+	lb := NewLoadBalancer(5 * time.Second)
+	lb.Workers = 1
+	lb.QueueDepth = 2
+	registerTestServer(lb, backend)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go lb.serveRequests(ln)
+
+	// the first connection is handled by the worker and waits for the server, the next two wait in the queue
+	const clients = 8
+	type result struct {
+		response map[string]interface{}
+		elapsed  time.Duration
+	}
+	results := make(chan result, clients)
+	start := time.Now()
+	for i := 0; i < clients; i++ {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if err := json.NewEncoder(conn).Encode(map[string]interface{}{"method": "Add", "params": map[string]interface{}{"a": 1, "b": 2}}); err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			var response map[string]interface{}
+			json.NewDecoder(conn).Decode(&response)
+			results <- result{response, time.Since(start)}
+		}()
+		if i == 0 {
+			// the worker takes the first connection before the others are queued
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	served, shed := 0, 0
+	for i := 0; i < clients; i++ {
+		r := <-results
+		switch {
+		case r.response["result"] == 3.0:
+			served++
+		case r.response["error"] == "server busy":
+			shed++
+			if r.elapsed >= delay {
+				t.Errorf("a connection is shed after %v, once a request was served", r.elapsed)
+			}
+		default:
+			t.Errorf("got %v", r.response)
+		}
+	}
+	if served != 3 || shed != clients-3 {
+		t.Fatalf("served %d and shed %d connections, want 3 and %d", served, shed, clients-3)
+	}
+}
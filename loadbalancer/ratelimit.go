@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// errRateLimited is the error of a request of a method above its rate limit
+var errRateLimited = errors.New("Rate limit of the method exceeded")
+
+// MethodLimit is the rate limit of a method, e.g. {"rate": 5, "burst": 10}
+type MethodLimit struct {
+	Rate  float64 `json:"rate"`  // requests per second
+	Burst float64 `json:"burst"` // requests allowed at once, at least 1
+}
+
+// MethodLimits caps the rate of the requests of some methods regardless of the client,
+// each method has a token bucket refilled at its rate up to its burst
+type MethodLimits struct {
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// tokenBucket holds the tokens left for the requests of a method
+type tokenBucket struct {
+	limit  MethodLimit
+	tokens float64
+	last   time.Time // last time the tokens were refilled
+}
+
+// NewMethodLimits returns the limits of the methods with full buckets
+func NewMethodLimits(limits map[string]MethodLimit) *MethodLimits {
+	buckets := make(map[string]*tokenBucket, len(limits))
+	for method, limit := range limits {
+		buckets[method] = &tokenBucket{limit: limit, tokens: limit.Burst, last: time.Now()}
+	}
+	return &MethodLimits{buckets: buckets}
+}
+
+// loadMethodLimits reads the limits of the methods from the JSON file at path,
+// e.g. {"Divide": {"rate": 5, "burst": 10}}
+func loadMethodLimits(path string) (*MethodLimits, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var limits map[string]MethodLimit
+	if err := json.Unmarshal(data, &limits); err != nil {
+		return nil, err
+	}
+	for method, limit := range limits {
+		if limit.Rate <= 0 || limit.Burst < 1 {
+			return nil, fmt.Errorf("invalid limit of %s, the rate must be positive and the burst at least 1", method)
+		}
+	}
+	return NewMethodLimits(limits), nil
+}
+
+// allow takes a token for a request of the method, it returns false if there is none left.
+// the methods without a limit are always allowed
+func (m *MethodLimits) allow(method string, now time.Time) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	bucket, ok := m.buckets[method]
+	if !ok {
+		return true
+	}
+	bucket.tokens += now.Sub(bucket.last).Seconds() * bucket.limit.Rate
+	if bucket.tokens > bucket.limit.Burst {
+		bucket.tokens = bucket.limit.Burst
+	}
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// limitMethod returns errRateLimited if the method of the request is above its rate limit
+func (lb *LoadBalancer) limitMethod(request map[string]interface{}) error {
+	if lb.MethodLimits == nil {
+		return nil
+	}
+	method, _ := request["method"].(string)
+	if !lb.MethodLimits.allow(method, time.Now()) {
+		logger.Warn("Request rate limited", zap.String("method", method))
+		return errRateLimited
+	}
+	return nil
+}
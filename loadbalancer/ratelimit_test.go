@@ -0,0 +1,86 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// a method gets its burst at once, then a request per 1/rate, the methods without a limit are always allowed
+func TestMethodLimits(t *testing.T) {
+	limits := NewMethodLimits(map[string]MethodLimit{"Divide": {Rate: 2, Burst: 3}})
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if !limits.allow("Divide", now) {
+			t.Fatalf("request %d of the burst is limited", i)
+		}
+	}
+	if limits.allow("Divide", now) {
+		t.Fatal("a request beyond the burst is allowed")
+	}
+	if !limits.allow("Divide", now.Add(500*time.Millisecond)) || limits.allow("Divide", now.Add(500*time.Millisecond)) {
+		t.Fatal("want a single request allowed after 1/rate")
+	}
+	// the bucket is refilled up to its burst only
+	later := now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if !limits.allow("Divide", later) {
+			t.Fatalf("request %d is limited after the bucket is refilled", i)
+		}
+	}
+	if limits.allow("Divide", later) {
+		t.Fatal("the bucket is refilled beyond its burst")
+	}
+	for i := 0; i < 10; i++ {
+		if !limits.allow("Add", now) {
+			t.Fatal("a method without a limit is limited")
+		}
+	}
+}
+
+// a request above the limit of its method gets an error without being relayed
+func TestRateLimitedRequest(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	lb.MethodLimits = NewMethodLimits(map[string]MethodLimit{"Divide": {Rate: 0.001, Burst: 1}})
+	address, received := startBackend(t, `{"result":3}`)
+	registerTestServer(lb, address)
+
+	if response := relayTestRequest(t, lb, `{"method":"Divide","params":{"a":6,"b":2}}`); response["result"] != 3.0 {
+		t.Fatalf("got %v", response)
+	}
+	<-received
+	if response := relayTestRequest(t, lb, `{"method":"Divide","params":{"a":6,"b":2}}`); response["error"] != errRateLimited.Error() {
+		t.Fatalf("got %v, want the request rate limited", response)
+	}
+	if response := relayTestRequest(t, lb, `{"method":"Add","params":{"a":1,"b":2}}`); response["result"] != 3.0 {
+		t.Fatalf("got %v", response)
+	}
+	<-received
+	select {
+	case request := <-received:
+		t.Fatalf("relayed %v", request)
+	default:
+	}
+}
+
+func TestLoadMethodLimits(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "limits.json")
+	os.WriteFile(path, []byte(`{"Divide": {"rate": 5, "burst": 10}}`), 0644)
+	limits, err := loadMethodLimits(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bucket := limits.buckets["Divide"]; bucket == nil || bucket.limit != (MethodLimit{Rate: 5, Burst: 10}) || bucket.tokens != 10 {
+		t.Fatalf("got %+v", limits.buckets)
+	}
+
+	os.WriteFile(path, []byte(`{"Divide": {"rate": 5, "burst": 0.5}}`), 0644)
+	if _, err := loadMethodLimits(path); err == nil || err.Error() != "invalid limit of Divide, the rate must be positive and the burst at least 1" {
+		t.Fatalf("got %v", err)
+	}
+	if _, err := loadMethodLimits(filepath.Join(dir, "missing.json")); err == nil {
+		t.Fatal("loaded a missing file")
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// benchLB returns a load balancer with n healthy and ready servers
+func benchLB(n int) *LoadBalancer {
+	lb := NewLoadBalancer(time.Minute)
+	for i := 0; i < n; i++ {
+		registerTestServer(lb, fmt.Sprintf("10.0.%d.%d:8081", i/250, i%250+1))
+	}
+	return lb
+}
+
+func BenchmarkGetServer(b *testing.B) {
+	request := map[string]interface{}{"method": "add", "params": map[string]interface{}{"a": 1.0, "b": 2.0}}
+	for _, n := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("servers=%d", n), func(b *testing.B) {
+			lb := benchLB(n)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if lb.getServer(request, nil) == nil {
+					b.Fatal("no server selected")
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkRelay relays a kept-alive JSON request from a client to a server over TCP and the response back,
+// the server answers one request per connection like the server stub
+func BenchmarkRelay(b *testing.B) {
+	backend, _ := startBackend(b, `{"result":3}`)
+
+	lb := NewLoadBalancer(time.Minute)
+	registerTestServer(lb, backend)
+
+	client, lbSide := net.Pipe()
+	defer client.Close()
+	defer lbSide.Close()
+	responses := make(chan error)
+	go func() {
+		decoder := json.NewDecoder(client)
+		for {
+			var response map[string]interface{}
+			err := decoder.Decode(&response)
+			if err == nil && response["result"] != 3.0 {
+				err = fmt.Errorf("unexpected response %v", response)
+			}
+			responses <- err
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	rawRequest := json.RawMessage(`{"method":"add","params":{"a":1,"b":2},"keepalive":true}`)
+	encoder, decoder := json.NewEncoder(lbSide), json.NewDecoder(lbSide)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !lb.relayRequest(lbSide, encoder, decoder, rawRequest) {
+			b.Fatal("kept-alive connection closed")
+		}
+		if err := <-responses; err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkRelayBody relays a response of a server to a client verbatim as the load balancer does,
+// and decoded then encoded again as it did before, to measure what the raw relay saves
+// BenchmarkRelayBody relays a response of a server to a client verbatim as the load balancer does,
+// and decoded then encoded again as it did before, to measure what the raw relay saves
+func BenchmarkRelayBody(b *testing.B) {
+	items := make([]int, 200)
+	for i := range items {
+		items[i] = i * 7919
+	}
+	body, err := json.Marshal(map[string]interface{}{"result": items, "id": "request-1"})
+	if err != nil {
+		b.Fatal(err)
+	}
+	message := append(body, '\n')
+
+	client, lbSide := net.Pipe()
+	defer client.Close()
+	defer lbSide.Close()
+	go io.Copy(io.Discard, client)
+
+	b.Run("raw", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(message)))
+		for i := 0; i < b.N; i++ {
+			raw, err := receiveRaw(bytes.NewReader(message))
+			if err != nil {
+				b.Fatal(err)
+			}
+			if err := relayRaw(raw, lbSide); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("decoded", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(message)))
+		encoder := json.NewEncoder(lbSide)
+		for i := 0; i < b.N; i++ {
+			var response map[string]interface{}
+			decoder := json.NewDecoder(bytes.NewReader(message))
+			decoder.UseNumber()
+			if err := decoder.Decode(&response); err != nil {
+				b.Fatal(err)
+			}
+			if err := encoder.Encode(response); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startHangingBackend serves a fake server which reads the request and never answers,
+// the channel receives once the load balancer closes the connection of a request
+func startHangingBackend(t *testing.T) (string, <-chan struct{}) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	closed := make(chan struct{}, 16)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(io.Discard, conn)
+				closed <- struct{}{}
+			}()
+		}
+	}()
+	return ln.Addr().String(), closed
+}
+
+// the relay to the server is aborted once the client closes its connection while waiting for the response
+func TestClientGoneAbortsRelay(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	backend, closed := startHangingBackend(t)
+	registerTestServer(lb, backend)
+
+	client, lbSide := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		lb.handleRequest(lbSide)
+		close(done)
+	}()
+	if _, err := client.Write([]byte(`{"method":"Add","params":{"a":1,"b":2}}` + "\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the client gives up once the request reached the server
+	time.Sleep(50 * time.Millisecond)
+	client.Close()
+
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the connection to the server is not closed")
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("handleRequest did not return")
+	}
+}
+
+// the 64-bit integers of the request and the response pass through the load balancer intact,
+// a float64 would round 9223372036854775807 to 9223372036854775808
+func TestRelayKeepsLargeIntegers(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		received <- line
+		conn.Write([]byte(`{"result":9223372036854775807}` + "\n"))
+	}()
+
+	lb := NewLoadBalancer(time.Second)
+	registerTestServer(lb, ln.Addr().String())
+
+	client, lbSide := net.Pipe()
+	defer client.Close()
+	go lb.handleRequest(lbSide)
+	go client.Write([]byte(`{"method":"Lookup","params":{"id":9007199254740993}}` + "\n"))
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	response, err := bufio.NewReader(client).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if request := <-received; !strings.Contains(request, `"id":9007199254740993`) {
+		t.Fatalf("the server received %s", request)
+	}
+	if !strings.Contains(response, `"result":9223372036854775807`) {
+		t.Fatalf("the client received %s", response)
+	}
+}
+
+// the request and the response are relayed byte for byte, keeping the order of the keys and the formatting of the numbers
+func TestRelayVerbatim(t *testing.T) {
+	const request = `{"params":{"b":2,"a":1e0},"method":"Add","trace":"x"}`
+	const response = `{"took":1.50,"result":3}`
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		received <- line
+		conn.Write([]byte(response + "\n"))
+	}()
+
+	lb := NewLoadBalancer(time.Second)
+	registerTestServer(lb, ln.Addr().String())
+
+	client, lbSide := net.Pipe()
+	defer client.Close()
+	go lb.handleRequest(lbSide)
+	go client.Write([]byte(request + "\n"))
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(client).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := <-received; got != request+"\n" {
+		t.Fatalf("the server received %q, want %q", got, request)
+	}
+	if line != response+"\n" {
+		t.Fatalf("the client received %q, want %q", line, response)
+	}
+}
+
+// pipeServer returns the server registered over a heartbeat pipe, nil until it is registered
+func pipeServer(lb *LoadBalancer) *ServerInfo {
+	lb.Mutex.Lock()
+	defer lb.Mutex.Unlock()
+	return lb.Servers["pipe"]
+}
+
+// a multi-homed server advertising an unreachable address first is reached on its second address
+func TestMultiHomedServer(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	backend, requests := startBackend(t, `{"result":3}`)
+	unreachable := closedAddress(t)
+
+	heartbeat := heartbeatConn(t, lb)
+	heartbeat.Encode(map[string]interface{}{"heartbeat": true, "port": "8081", "addresses": []string{unreachable, backend}})
+	waitFor(t, "the registration", func() bool { return pipeServer(lb) != nil })
+	if server := pipeServer(lb); server.ServingAddress != unreachable || len(server.ServingAddresses) != 2 || server.ServingAddresses[1] != backend {
+		t.Fatalf("got %+v", server)
+	}
+
+	for i := 0; i < 3; i++ {
+		if response := relayTestRequest(t, lb, `{"method":"Add","params":{"a":1,"b":2}}`); response["result"] != 3.0 {
+			t.Fatalf("got %v", response)
+		}
+	}
+	if len(requests) != 3 {
+		t.Fatalf("the second address got %d requests", len(requests))
+	}
+}
+
+// a first heartbeat advertising invalid addresses does not register the server
+func TestInvalidServingAddresses(t *testing.T) {
+	for _, addresses := range []interface{}{[]string{}, "10.0.0.1:8081", []interface{}{"10.0.0.1:8081", 8082}, []string{"10.0.0.1"}} {
+		lb := NewLoadBalancer(time.Second)
+		heartbeat := heartbeatConn(t, lb)
+		heartbeat.Encode(map[string]interface{}{"heartbeat": true, "port": "8081", "addresses": addresses})
+		heartbeat.Encode(map[string]interface{}{"heartbeat": true, "port": "8081"})
+		waitFor(t, "the registration", func() bool { return pipeServer(lb) != nil })
+		if server := pipeServer(lb); server.ServingAddresses != nil {
+			t.Fatalf("%v: registered with %v", addresses, server.ServingAddresses)
+		}
+	}
+}
+
+// the frames of a stream are piped in both directions, including the ones the client sent with the request,
+// and the client ending its input reaches the server as a half-close
+func TestRelayStream(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		decoder := json.NewDecoder(conn)
+		encoder := json.NewEncoder(conn)
+		var request map[string]interface{}
+		decoder.Decode(&request)
+		for {
+			var frame map[string]interface{}
+			if decoder.Decode(&frame) != nil {
+				break
+			}
+			encoder.Encode(map[string]interface{}{"y": frame["x"].(float64) * 2})
+		}
+		encoder.Encode(map[string]interface{}{"end": true})
+	}()
+
+	lb := NewLoadBalancer(time.Second)
+	registerTestServer(lb, backend.Addr().String())
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		lb.handleRequest(conn)
+	}()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Write([]byte(`{"method":"Feed","stream":true}` + "\n" + `{"x":1}` + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(client)
+	if line, _ := reader.ReadString('\n'); line != `{"y":2}`+"\n" {
+		t.Fatalf("got %q", line)
+	}
+	client.Write([]byte(`{"x":2}` + "\n"))
+	client.(*net.TCPConn).CloseWrite()
+	rest, err := io.ReadAll(reader)
+	if err != nil || string(rest) != `{"y":4}`+"\n"+`{"end":true}`+"\n" {
+		t.Fatalf("got %q, %v", rest, err)
+	}
+}
+
+// a subscription is piped like a stream, the events the server pushes reach the client until it unsubscribes
+func TestRelaySubscription(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	requests := make(chan map[string]interface{}, 1)
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		decoder := json.NewDecoder(conn)
+		encoder := json.NewEncoder(conn)
+		var request map[string]interface{}
+		decoder.Decode(&request)
+		requests <- request
+		encoder.Encode(map[string]interface{}{"n": 1})
+		encoder.Encode(map[string]interface{}{"n": 2})
+		var frame map[string]interface{}
+		decoder.Decode(&frame)
+		encoder.Encode(map[string]interface{}{"end": true})
+	}()
+
+	lb := NewLoadBalancer(time.Second)
+	registerTestServer(lb, backend.Addr().String())
+	client, lbSide := net.Pipe()
+	defer client.Close()
+	go lb.handleRequest(lbSide)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Write([]byte(`{"method":"Ticks","subscribe":true,"params":{"count":0}}` + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(client)
+	for _, want := range []string{`{"n":1}`, `{"n":2}`} {
+		if line, _ := reader.ReadString('\n'); line != want+"\n" {
+			t.Fatalf("got %q, want %s", line, want)
+		}
+	}
+	client.Write([]byte(`{"end":true}` + "\n"))
+	if line, _ := reader.ReadString('\n'); line != `{"end":true}`+"\n" {
+		t.Fatalf("got %q after unsubscribing", line)
+	}
+	if request := <-requests; request["subscribe"] != true || request["method"] != "Ticks" {
+		t.Fatalf("the server got %v", request)
+	}
+}
+
+// the chunks of a chunked upload follow the request to the same server, including the chunks
+// the load balancer buffered while reading the request, and the response of the server is relayed back
+func TestRelayChunkedUpload(t *testing.T) {
+	payload := make([]byte, 3<<20+17)
+	for i := range payload {
+		payload[i] = byte(i % 251)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	uploads := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		decoder := json.NewDecoder(conn)
+		var request map[string]interface{}
+		decoder.Decode(&request)
+		var data []byte
+		for seq := 0; ; seq++ {
+			var chunk struct {
+				Seq   int
+				Data  []byte
+				Final bool
+			}
+			if err := decoder.Decode(&chunk); err != nil || chunk.Seq != seq {
+				json.NewEncoder(conn).Encode(map[string]interface{}{"error": "chunked upload error"})
+				return
+			}
+			data = append(data, chunk.Data...)
+			if chunk.Final {
+				break
+			}
+		}
+		uploads <- data
+		json.NewEncoder(conn).Encode(map[string]interface{}{"size": len(data)})
+	}()
+
+	lb := NewLoadBalancer(time.Second)
+	registerTestServer(lb, ln.Addr().String())
+
+	client, lbSide := net.Pipe()
+	defer client.Close()
+	go lb.handleRequest(lbSide)
+	go func() {
+		encoder := json.NewEncoder(client)
+		encoder.Encode(map[string]interface{}{"method": "Upload", "params": map[string]interface{}{"name": "blob"}, "chunked": "data"})
+		for seq, size := 0, 256<<10; seq*size < len(payload); seq++ {
+			end := (seq + 1) * size
+			if end > len(payload) {
+				end = len(payload)
+			}
+			encoder.Encode(map[string]interface{}{"seq": seq, "data": payload[seq*size : end], "final": end == len(payload)})
+		}
+	}()
+
+	client.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var response map[string]interface{}
+	if err := json.NewDecoder(client).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response["size"] != float64(len(payload)) {
+		t.Fatalf("got %v", response)
+	}
+	if data := <-uploads; !bytes.Equal(data, payload) {
+		t.Fatalf("the server reassembled %d bytes, want the %d bytes of the payload", len(data), len(payload))
+	}
+}
+
+// a request tries at most MaxRelayAttempts servers refusing the connection, then fails naming the attempts
+func TestRelayAttemptsBudget(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	lb.MaxRelayAttempts = 3
+	for i := 0; i < 4; i++ {
+		registerTestServer(lb, closedAddress(t))
+	}
+	if response := relayTestRequest(t, lb, `{"method":"Add","params":{"a":1,"b":2}}`); response["error"] != "Retries exhausted after 3 attempts on 3 servers" {
+		t.Fatalf("got %v", response)
+	}
+
+	// a server may be tried again within the budget, only distinct ones are counted
+	lb = NewLoadBalancer(time.Second)
+	lb.MaxRelayAttempts = 5
+	registerTestServer(lb, closedAddress(t))
+	registerTestServer(lb, closedAddress(t))
+	if response := relayTestRequest(t, lb, `{"method":"Add","params":{"a":1,"b":2}}`); response["error"] != "Retries exhausted after 5 attempts on 2 servers" {
+		t.Fatalf("got %v", response)
+	}
+
+	// a server accepting the connection within the budget gets the request
+	lb = NewLoadBalancer(time.Second)
+	lb.MaxRelayAttempts = 2
+	registerTestServer(lb, closedAddress(t))
+	up, _ := startBackend(t, `{"result":3}`)
+	registerTestServer(lb, up)
+	if response := relayTestRequest(t, lb, `{"method":"Add","params":{"a":1,"b":2}}`); response["result"] != 3.0 {
+		t.Fatalf("got %v", response)
+	}
+}
+
+// without an attempts budget a request stops trying the servers once MaxRelayTime passed
+func TestRelayTimeBudget(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	lb.MaxRelayAttempts = 0
+	lb.MaxRelayTime = 100 * time.Millisecond
+	registerTestServer(lb, closedAddress(t))
+	registerTestServer(lb, closedAddress(t))
+
+	start := time.Now()
+	response := relayTestRequest(t, lb, `{"method":"Add","params":{"a":1,"b":2}}`)
+	if elapsed := time.Since(start); elapsed < lb.MaxRelayTime || elapsed > time.Second {
+		t.Fatalf("gave up after %v, want about %v", elapsed, lb.MaxRelayTime)
+	}
+	if message, _ := response["error"].(string); !strings.HasPrefix(message, "Retries exhausted after ") || !strings.HasSuffix(message, " attempts on 2 servers") {
+		t.Fatalf("got %v", response)
+	}
+}
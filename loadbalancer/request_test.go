@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+// FuzzParseRequest feeds arbitrary requests to parseRequest and relays the JSON ones through a load balancer
+// without servers, the client must always get an error back and the relay must return
+func FuzzParseRequest(f *testing.F) {
+	f.Add([]byte(`{"method":"Add","params":{"a":1,"b":2}}`))
+	f.Add([]byte(`{"method":"Add","params":{"a":1,`))
+	f.Add([]byte(`{"params":{"a":1,"b":2}}`))
+	f.Add([]byte(`{"method":"","params":{}}`))
+	f.Add([]byte(`{"method":7}`))
+	f.Add([]byte(`{"method":"Add","params":[1,2]}`))
+	f.Add([]byte(`{"method":"Add","params":"a=1&b=2"}`))
+	f.Add([]byte(`{"jsonrpc":"2.0","id":1,"method":"Add","params":[1,2]}`))
+	f.Add([]byte(`{"method":"Add","stream":true,"keepalive":"yes"}`))
+	f.Add([]byte(`null`))
+	f.Add([]byte(`[{"method":"Add"}]`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		request, err := parseRequest(data)
+		if err == nil {
+			if method, ok := request["method"].(string); !ok || method == "" {
+				t.Fatalf("accepted %q without a method", data)
+			}
+		} else if err.Error() == "" {
+			t.Fatalf("empty error for %q", data)
+		}
+
+		// the client connection only delivers valid JSON values to relayRequest
+		if !json.Valid(data) {
+			return
+		}
+		lb := NewLoadBalancer(time.Second)
+		client, lbSide := net.Pipe()
+		defer client.Close()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			defer lbSide.Close()
+			lb.relayRequest(lbSide, json.NewEncoder(lbSide), json.NewDecoder(lbSide), json.RawMessage(data))
+		}()
+
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var response map[string]interface{}
+		if err := json.NewDecoder(client).Decode(&response); err != nil {
+			t.Fatalf("no response to %q: %v", data, err)
+		}
+		if _, ok := response["error"]; !ok {
+			t.Fatalf("got %v for %q, want an error", response, data)
+		}
+		client.Close()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("relayRequest did not return for %q", data)
+		}
+	})
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// responses above the thresholds are logged with their method, server and size or latency
+func TestLargeAndSlowResponsesAreLogged(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	lb.LargeResponseThreshold = 64
+	lb.SlowResponseThreshold = 20 * time.Millisecond
+	large, _ := startBackend(t, `{"result":"`+strings.Repeat("x", 100)+`"}`)
+	registerTestServer(lb, large)
+	logs := observeLogs(t, zapcore.WarnLevel)
+
+	relayTestRequest(t, lb, `{"method":"Echo","params":{}}`)
+	entries := logs.FilterMessage("Large response from server").All()
+	if len(entries) != 1 || entries[0].ContextMap()["method"] != "Echo" || entries[0].ContextMap()["size"].(int64) <= 64 {
+		t.Fatalf("got %v", logs.All())
+	}
+	if logs.FilterMessage("Slow response from server").Len() != 0 {
+		t.Fatal("a fast response is logged as slow")
+	}
+
+	slow, _ := startSlowBackend(t, 40*time.Millisecond)
+	lb.removeServer("hb-" + large)
+	registerTestServer(lb, slow)
+	relayTestRequest(t, lb, `{"method":"Add","params":{"a":1,"b":2}}`)
+	if entries := logs.FilterMessage("Slow response from server").All(); len(entries) != 1 || entries[0].ContextMap()["address"] != slow {
+		t.Fatalf("got %v", logs.All())
+	}
+	if logs.FilterMessage("Large response from server").Len() != 1 {
+		t.Fatal("a small response is logged as large")
+	}
+}
+
+// zero thresholds disable the warnings
+func TestResponseThresholdsDisabled(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	slow, _ := startSlowBackend(t, 20*time.Millisecond)
+	registerTestServer(lb, slow)
+	logs := observeLogs(t, zapcore.WarnLevel)
+
+	relayTestRequest(t, lb, `{"method":"Add","params":{"a":1,"b":2}}`)
+	if logs.Len() != 0 {
+		t.Fatalf("got %v", logs.All())
+	}
+}
+
+// a truncated or non-object response of a server is failed as malformed and counted against the server
+func TestMalformedResponse(t *testing.T) {
+	for _, response := range []string{`{"result":`, `[3]`, `{"result" 3}`} {
+		lb := NewLoadBalancer(time.Second)
+		address, _ := startBackend(t, response)
+		server := registerTestServer(lb, address)
+
+		got := relayTestRequest(t, lb, `{"method":"Add","params":{"a":1,"b":2}}`)
+		if got["error"] != "Malformed response from server" {
+			t.Fatalf("%s: got %v", response, got)
+		}
+		server.Mutex.Lock()
+		failureRate := server.FailureRate
+		server.Mutex.Unlock()
+		if failureRate == 0 {
+			t.Fatalf("%s: the server is not blamed", response)
+		}
+	}
+}
+
+// with RetryMalformed a request whose response is malformed is relayed once more to another server,
+// the malformed response is kept if there is no other server
+func TestRetryMalformed(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	lb.RetryMalformed = true
+	malformed, malformedRequests := startBackend(t, `{"result":`)
+	registerTestServer(lb, malformed)
+
+	if got := relayTestRequest(t, lb, `{"method":"Add","params":{"a":1,"b":2}}`); got["error"] != "Malformed response from server" {
+		t.Fatalf("got %v without another server", got)
+	}
+	<-malformedRequests
+
+	healthy, healthyRequests := startBackend(t, `{"result":3}`)
+	registerTestServer(lb, healthy)
+	for i := 0; i < 4; i++ {
+		if got := relayTestRequest(t, lb, `{"method":"Add","params":{"a":1,"b":2}}`); got["result"] != 3.0 {
+			t.Fatalf("request %d: got %v", i, got)
+		}
+	}
+	if len(healthyRequests) != 4 || len(malformedRequests) == 0 {
+		t.Fatalf("%d requests to the healthy server and %d to the malformed one, want 4 and some", len(healthyRequests), len(malformedRequests))
+	}
+}
+
+// a response larger than MaxResponseSize is rejected, or sent truncated with TruncateOversized,
+// and the responses within the limit are relayed as they are
+func TestMaxResponseSize(t *testing.T) {
+	large := `{"result":"` + strings.Repeat("x", 100) + `"}`
+	lb := NewLoadBalancer(time.Second)
+	lb.MaxResponseSize = 64
+	address, _ := startBackend(t, large)
+	registerTestServer(lb, address)
+
+	if got := relayTestRequest(t, lb, `{"method":"Echo","params":{}}`); got["error"] != "Response too large" || got["truncated"] != nil {
+		t.Fatalf("got %v", got)
+	}
+
+	lb.TruncateOversized = true
+	got := relayTestRequest(t, lb, `{"method":"Echo","params":{}}`)
+	if got["error"] != "Response too large" || got["truncated"] != true || got["partial"] != large[:64] {
+		t.Fatalf("got %v", got)
+	}
+	// the leading bytes are in the data of the error of a JSON-RPC 2.0 response
+	got = relayTestRequest(t, lb, `{"jsonrpc":"2.0","id":1,"method":"Echo","params":{}}`)
+	data, _ := got["error"].(map[string]interface{})["data"].(map[string]interface{})
+	if data["truncated"] != true || data["partial"] != large[:64] {
+		t.Fatalf("got %v", got)
+	}
+
+	lb.Mutex.Lock()
+	oversized := lb.oversizedResponses
+	lb.Mutex.Unlock()
+	if oversized != 3 {
+		t.Fatalf("counted %d oversized responses, want 3", oversized)
+	}
+
+	lb.MaxResponseSize = int64(len(large)) + 1
+	if got := relayTestRequest(t, lb, `{"method":"Echo","params":{}}`); got["result"] != strings.Repeat("x", 100) {
+		t.Fatalf("got %v within the limit", got)
+	}
+}
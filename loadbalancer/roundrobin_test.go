@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// selections counts the servers selected by n calls of getServer by their serving address
+func selections(lb *LoadBalancer, n int) map[string]int {
+	selected := make(map[string]int)
+	for i := 0; i < n; i++ {
+		if server := lb.getServer(nil, nil); server != nil {
+			selected[server.ServingAddress]++
+		}
+	}
+	return selected
+}
+
+// loadOf returns the load of the server registered with the key
+func loadOf(lb *LoadBalancer, key string) float64 {
+	lb.Mutex.Lock()
+	defer lb.Mutex.Unlock()
+	if server, ok := lb.Servers[key]; ok {
+		return server.Load
+	}
+	return -1
+}
+
+// a server reporting a high load in its heartbeats is skipped in round-robin while another one is less loaded
+func TestHighLoadServerGetsLessTraffic(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	idle := registerTestServer(lb, "10.0.0.1:8081")
+	heartbeat := heartbeatConn(t, lb)
+	heartbeat.Encode(map[string]interface{}{"heartbeat": true, "port": "8082", "load": 0.95})
+	// the heartbeat connection is a pipe, the server is keyed by its address which has no host
+	waitFor(t, "the registration", func() bool { return loadOf(lb, "pipe") == 0.95 })
+	loaded := ":8082"
+
+	if selected := selections(lb, 10); selected[idle.ServingAddress] != 10 {
+		t.Fatalf("got %v, want every request on the idle server", selected)
+	}
+
+	// the load reported by the next heartbeats is used
+	heartbeat.Encode(map[string]interface{}{"heartbeat": true, "load": 0.2})
+	waitFor(t, "the load update", func() bool { return loadOf(lb, "pipe") == 0.2 })
+	if selected := selections(lb, 10); selected[idle.ServingAddress] != 5 || selected[loaded] != 5 {
+		t.Fatalf("got %v, want 5 requests each", selected)
+	}
+
+	// servers are still selected when every one of them is loaded
+	lb.Mutex.Lock()
+	idle.Load = 0.95
+	lb.Mutex.Unlock()
+	heartbeat.Encode(map[string]interface{}{"heartbeat": true, "load": 0.95})
+	waitFor(t, "the load update", func() bool { return loadOf(lb, "pipe") == 0.95 })
+	if selected := selections(lb, 10); selected[idle.ServingAddress] != 5 || selected[loaded] != 5 {
+		t.Fatalf("got %v, want 5 requests each", selected)
+	}
+}
+
+// a server registered by a heartbeat reporting it is not ready gets no traffic until a heartbeat reports it ready
+func TestNoTrafficBeforeReady(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	heartbeat := heartbeatConn(t, lb)
+	heartbeat.Encode(map[string]interface{}{"heartbeat": true, "ready": false, "port": "8081"})
+	waitFor(t, "the registration", func() bool { return pipeServer(lb) != nil })
+
+	if server := lb.getServer(map[string]interface{}{"method": "Add"}, nil); server != nil {
+		t.Fatalf("request routed to %s before it is ready", server.ServingAddress)
+	}
+	if response := relayTestRequest(t, lb, `{"method":"Add","params":{"a":1,"b":2}}`); response["error"] != "No server available" {
+		t.Fatalf("got %v", response)
+	}
+
+	heartbeat.Encode(map[string]interface{}{"heartbeat": true, "ready": true})
+	waitFor(t, "the readiness", func() bool { return lb.getServer(map[string]interface{}{"method": "Add"}, nil) != nil })
+}
+
+// removing servers keeps the round robin on the server which was next, it does not restart from the first one
+func TestRoundRobinAfterRemoval(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	var servers []*ServerInfo
+	for i := 1; i <= 4; i++ {
+		servers = append(servers, registerTestServer(lb, fmt.Sprintf("10.0.0.%d:8081", i)))
+	}
+	next := func() string { return lb.getServer(nil, nil).ServingAddress }
+
+	next()
+	next()
+	// a server before the next one is removed
+	lb.Mutex.Lock()
+	lb.removeServer(servers[0].HeartbeatAddress)
+	lb.Mutex.Unlock()
+	if got := next(); got != servers[2].ServingAddress {
+		t.Fatalf("got %s, want %s", got, servers[2].ServingAddress)
+	}
+	// the next server itself is removed
+	lb.Mutex.Lock()
+	lb.removeServer(servers[3].HeartbeatAddress)
+	lb.Mutex.Unlock()
+	for _, want := range []*ServerInfo{servers[1], servers[2], servers[1]} {
+		if got := next(); got != want.ServingAddress {
+			t.Fatalf("got %s, want %s", got, want.ServingAddress)
+		}
+	}
+}
+
+// getServer spreads the requests evenly over the stable servers while servers are added and removed concurrently,
+// and returns nil once every server is removed. run with -race
+func TestRoundRobinConcurrentRemoval(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	const stable, goroutines, cycles = 8, 16, 2000
+	for i := 0; i < stable; i++ {
+		registerTestServer(lb, fmt.Sprintf("10.0.0.%d:8081", i+1))
+	}
+
+	// the servers are selected until the churn is over
+	var churned int64
+	go func() {
+		for i := 0; i < cycles; i++ {
+			// the server is added before the stable ones, so removing it shifts the index of every one of them
+			server := registerTestServer(lb, fmt.Sprintf("10.0.1.%d:8081", i%250+1))
+			lb.Mutex.Lock()
+			lb.ServerKeys = append([]string{server.HeartbeatAddress}, lb.ServerKeys[:len(lb.ServerKeys)-1]...)
+			lb.RoundRobinIndex++
+			lb.Mutex.Unlock()
+			runtime.Gosched()
+			lb.Mutex.Lock()
+			lb.removeServer(server.HeartbeatAddress)
+			lb.Mutex.Unlock()
+			atomic.AddInt64(&churned, 1)
+		}
+	}()
+
+	var mutex sync.Mutex
+	selected := make(map[string]int)
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			counts := make(map[string]int)
+			for atomic.LoadInt64(&churned) < cycles {
+				if server := lb.getServer(nil, nil); server != nil {
+					counts[server.ServingAddress]++
+				}
+				// let the churn take the mutex
+				runtime.Gosched()
+			}
+			mutex.Lock()
+			for address, n := range counts {
+				selected[address] += n
+			}
+			mutex.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	total := 0
+	for i := 0; i < stable; i++ {
+		total += selected[fmt.Sprintf("10.0.0.%d:8081", i+1)]
+	}
+	mean := float64(total) / stable
+	for i := 0; i < stable; i++ {
+		address := fmt.Sprintf("10.0.0.%d:8081", i+1)
+		if n := float64(selected[address]); n < 0.7*mean || n > 1.3*mean {
+			t.Errorf("%s selected %v times, the mean is %.0f", address, n, mean)
+		}
+	}
+
+	lb.Mutex.Lock()
+	for _, key := range append([]string(nil), lb.ServerKeys...) {
+		lb.removeServer(key)
+	}
+	lb.Mutex.Unlock()
+	if server := lb.getServer(nil, nil); server != nil {
+		t.Fatalf("got %s without servers", server.ServingAddress)
+	}
+}
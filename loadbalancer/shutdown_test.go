@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// ShutdownHTTP lets the request in flight on the gateway finish, then the ports of the gateway and the admin listener are released
+func TestShutdownHTTP(t *testing.T) {
+	const delay = 300 * time.Millisecond
+	backend, received := startSlowBackend(t, delay)
+
+	lb := NewLoadBalancer(5 * time.Second)
+	defer lb.Stop()
+	registerTestServer(lb, backend)
+	if err := lb.StartGateway("127.0.0.1:0", testTLSConfig(t)); err != nil {
+		t.Fatal(err)
+	}
+	if err := lb.StartAdmin("127.0.0.1:0", false); err != nil {
+		t.Fatal(err)
+	}
+	lb.Mutex.Lock()
+	gateway := lb.listeners[0].Addr().String()
+	admin := lb.listeners[1].Addr().String()
+	lb.Mutex.Unlock()
+
+	type result struct {
+		status int
+		body   string
+		err    error
+	}
+	results := make(chan result, 1)
+	go func() {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+		response, err := client.Get("https://" + gateway + "/rpc/Add?a=1&b=2")
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer response.Body.Close()
+		body, err := io.ReadAll(response.Body)
+		results <- result{response.StatusCode, string(body), err}
+	}()
+
+	var start time.Time
+	select {
+	case start = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the request is not relayed")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	lb.ShutdownHTTP(ctx)
+	if elapsed := time.Since(start); elapsed < delay {
+		t.Fatalf("shut down after %v, before the request in flight finished", elapsed)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("the deadline passed before the request in flight finished")
+	}
+
+	r := <-results
+	if r.err != nil || r.status != http.StatusOK {
+		t.Fatalf("got status %d, error %v", r.status, r.err)
+	}
+	var response map[string]interface{}
+	if err := json.Unmarshal([]byte(r.body), &response); err != nil || response["result"] != 3.0 {
+		t.Fatalf("got body %q", r.body)
+	}
+
+	for _, address := range []string{gateway, admin} {
+		ln, err := net.Listen("tcp", address)
+		if err != nil {
+			t.Fatalf("%s is not released: %v", address, err)
+		}
+		ln.Close()
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// ServerSnapshot is a copy of the state of a server of the load balancer
+type ServerSnapshot struct {
+	Key              string            // key of the server in the Servers map
+	HeartbeatAddress string            // address which server sends heartbeats, empty for probe-backed servers
+	ServingAddress   string            // address which server serves
+	ServingAddresses []string          // addresses advertised by a multi-homed server, nil if not advertised
+	ProbeBacked      bool              // server is health-checked by active probes instead of heartbeats
+	GossipPeer       string            // peer load balancer the server is gossiped by, empty for the servers known locally
+	Healthy          bool              // server is healthy
+	Ready            bool              // server reported it is ready to serve
+	Ejected          bool              // server is ejected from the rotation by outlier detection
+	Draining         bool              // server is draining, no new requests are routed to it
+	Methods          []string          // methods served by the server in order, nil if not known
+	Metadata         map[string]string // metadata of the service advertised by the server, e.g. "version": "2.1", nil if none
+	Capabilities     map[string]string // capabilities advertised by the server for routing, e.g. "gpu": "true", nil if none
+	LastHeartbeat    time.Time         // last time the server sent a heartbeat
+	LastProbe        time.Time         // last time a probe to the server succeeded
+	Load             float64           // load reported by the server
+	FailureRate      float64           // rolling rate of the failed requests relayed to the server
+	Latency          time.Duration     // rolling latency of the requests relayed to the server
+	Weight           float64           // weight of the server in the weighted strategy
+	ActiveConns      int               // connections relaying requests to the server
+	Next             bool              // server is the next one in round-robin order
+}
+
+// LoadBalancerSnapshot is a copy of the state of the load balancer
+type LoadBalancerSnapshot struct {
+	RoundRobinIndex int              // index in Servers of the next server in round-robin order
+	Servers         []ServerSnapshot // servers in the order of ServerKeys
+}
+
+// Snapshot returns a copy of the state of the servers in the order of ServerKeys, taken under the mutex
+// so it is consistent. the copy shares nothing with the load balancer and can be modified freely
+func (lb *LoadBalancer) Snapshot() []ServerSnapshot {
+	return lb.SnapshotState().Servers
+}
+
+// SnapshotState returns the snapshot of the servers with the round-robin position, taken at once under the mutex
+func (lb *LoadBalancer) SnapshotState() LoadBalancerSnapshot {
+	lb.Mutex.Lock()
+	defer lb.Mutex.Unlock()
+
+	now := time.Now()
+	next := 0
+	if len(lb.ServerKeys) > 0 {
+		next = lb.RoundRobinIndex % len(lb.ServerKeys)
+	}
+
+	snapshot := make([]ServerSnapshot, 0, len(lb.ServerKeys))
+	for i, key := range lb.ServerKeys {
+		server := lb.Servers[key]
+		weight := server.weight()
+		ejected := server.ejected(now)
+
+		server.Mutex.Lock()
+		s := ServerSnapshot{
+			Key:              key,
+			HeartbeatAddress: server.HeartbeatAddress,
+			ServingAddress:   server.ServingAddress,
+			ProbeBacked:      server.ProbeBacked,
+			GossipPeer:       server.GossipPeer,
+			Healthy:          server.IsHealthy,
+			Ready:            server.Ready,
+			Ejected:          ejected,
+			LastHeartbeat:    server.LastHeartbeat,
+			LastProbe:        server.LastProbe,
+			Load:             server.Load,
+			FailureRate:      server.FailureRate,
+			Latency:          server.Latency,
+			Weight:           weight,
+			ActiveConns:      server.activeConns,
+			Draining:         server.Draining,
+			Next:             i == next,
+		}
+		if server.ServingAddresses != nil {
+			s.ServingAddresses = append([]string(nil), server.ServingAddresses...)
+		}
+		if server.Methods != nil {
+			s.Methods = make([]string, 0, len(server.Methods))
+			for method := range server.Methods {
+				s.Methods = append(s.Methods, method)
+			}
+			sort.Strings(s.Methods)
+		}
+		if server.Metadata != nil {
+			s.Metadata = make(map[string]string, len(server.Metadata))
+			for key, value := range server.Metadata {
+				s.Metadata[key] = value
+			}
+		}
+		server.Mutex.Unlock()
+		// the capabilities are locked by the load balancer
+		if server.Capabilities != nil {
+			s.Capabilities = make(map[string]string, len(server.Capabilities))
+			for key, value := range server.Capabilities {
+				s.Capabilities[key] = value
+			}
+		}
+
+		snapshot = append(snapshot, s)
+	}
+	return LoadBalancerSnapshot{RoundRobinIndex: next, Servers: snapshot}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// the snapshot reflects the registered servers and the round-robin position, and shares nothing with them
+func TestSnapshot(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	if snapshot := lb.Snapshot(); len(snapshot) != 0 {
+		t.Fatalf("got %+v without servers", snapshot)
+	}
+
+	static := registerTestServer(lb, "10.0.0.1:8081")
+	heartbeat := heartbeatConn(t, lb)
+	heartbeat.Encode(map[string]interface{}{
+		"heartbeat": true, "ready": true, "port": "8082", "load": 0.25,
+		"addresses": []string{"10.0.0.2:8082", "192.168.0.2:8082"}, "capabilities": map[string]string{"gpu": "true"},
+	})
+	waitFor(t, "the registration", func() bool { return len(lb.Snapshot()) == 2 })
+
+	lb.Mutex.Lock()
+	registered := lb.Servers["pipe"]
+	lb.Mutex.Unlock()
+	registered.Mutex.Lock()
+	registered.activeConns++
+	registered.Mutex.Unlock()
+	lb.getServer(nil, nil)
+
+	snapshot := lb.Snapshot()
+	first, second := snapshot[0], snapshot[1]
+	if first.Key != static.HeartbeatAddress || first.ServingAddress != "10.0.0.1:8081" || !first.Healthy || !first.Ready || first.Next || first.ActiveConns != 0 {
+		t.Fatalf("got %+v", first)
+	}
+	if second.Key != "pipe" || second.HeartbeatAddress != "pipe" || second.ServingAddress != "10.0.0.2:8082" || second.Load != 0.25 || !second.Next || second.ActiveConns != 1 {
+		t.Fatalf("got %+v", second)
+	}
+	if len(second.ServingAddresses) != 2 || second.LastHeartbeat.IsZero() || time.Since(second.LastHeartbeat) > time.Second || second.Weight != registered.weight() {
+		t.Fatalf("got addresses %v, last heartbeat %v, weight %v", second.ServingAddresses, second.LastHeartbeat, second.Weight)
+	}
+	if first.Capabilities != nil || len(second.Capabilities) != 1 || second.Capabilities["gpu"] != "true" {
+		t.Fatalf("got capabilities %v and %v", first.Capabilities, second.Capabilities)
+	}
+
+	// modifying the snapshot does not modify the servers
+	second.ServingAddresses[0] = "10.0.0.9:8082"
+	second.Capabilities["gpu"] = "false"
+	lb.Mutex.Lock()
+	if registered.Capabilities["gpu"] != "true" {
+		t.Fatalf("the snapshot shares the capabilities of the server: %v", registered.Capabilities)
+	}
+	lb.Mutex.Unlock()
+	registered.Mutex.Lock()
+	defer registered.Mutex.Unlock()
+	if registered.ServingAddresses[0] != "10.0.0.2:8082" {
+		t.Fatalf("the snapshot shares the state of the server: %+v", registered.ServingAddresses)
+	}
+}
+
+// the round-robin position of the state follows the selections and wraps around the servers
+func TestSnapshotStateRoundRobinIndex(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	for _, address := range []string{"10.0.0.1:8081", "10.0.0.2:8081", "10.0.0.3:8081"} {
+		registerTestServer(lb, address)
+	}
+	if state := lb.SnapshotState(); state.RoundRobinIndex != 0 || len(state.Servers) != 3 || !state.Servers[0].Next {
+		t.Fatalf("got %+v before a selection", state)
+	}
+
+	for i, want := range []int{1, 2, 0, 1} {
+		lb.getServer(nil, nil)
+		state := lb.SnapshotState()
+		if state.RoundRobinIndex != want || !state.Servers[want].Next {
+			t.Fatalf("after %d selections got the index %d, want %d", i+1, state.RoundRobinIndex, want)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Strategy selects the server to relay a request to.
+// it is given the request of the client and the servers of the load balancer
+// and returns nil if none of them can be selected, in which case the load balancer falls back to round-robin,
+// as it does if Select panics. it is called with the load balancer locked like SelectFunc.
+type Strategy interface {
+	Select(request map[string]interface{}, servers []*ServerInfo) *ServerInfo
+}
+
+// SelectFunc is a custom routing hook selecting the server to relay a request to before the Strategy,
+// e.g. to route a method only to some of the servers. it is given the decoded request and the candidates,
+// the ready servers which are not ejected, and returns nil to fall back to the default selection.
+// it is called with the load balancer locked, so it must not block or call its methods, e.g. Snapshot would deadlock
+type SelectFunc func(request map[string]interface{}, candidates []*ServerInfo) *ServerInfo
+
+const (
+	statsAlpha      = 0.2                   // weight of the latest request in the rolling stats of a server
+	latencyUnit     = 10 * time.Millisecond // latency which halves the weight of a server
+	minServerWeight = 0.01                  // minimum weight, so failing servers still get traffic to recover
+	minWarmupFactor = 0.1                   // fraction of its weight a server gets when it just registered
+)
+
+// recordResult updates the rolling failure rate and latency of the server
+// with the result of a request relayed to it, the latest latency weighs latencyAlpha
+func (server *ServerInfo) recordResult(success bool, latency time.Duration, latencyAlpha float64) {
+	server.Mutex.Lock()
+	defer server.Mutex.Unlock()
+
+	failure := 0.0
+	if !success {
+		failure = 1
+	}
+	server.FailureRate = server.FailureRate*(1-statsAlpha) + failure*statsAlpha
+
+	// latency of failed requests says nothing about the speed of the server
+	if success {
+		if server.Latency == 0 {
+			server.Latency = latency
+		} else {
+			server.Latency = time.Duration(float64(server.Latency)*(1-latencyAlpha) + float64(latency)*latencyAlpha)
+		}
+	}
+}
+
+// weight returns the selection weight of the server computed from its rolling stats
+// and the load it reports. the weight drops with the failure rate, the latency and the load of the server.
+// the caller must hold the mutex of the LoadBalancer.
+func (server *ServerInfo) weight() float64 {
+	server.Mutex.Lock()
+	defer server.Mutex.Unlock()
+
+	weight := (1 - server.FailureRate) / (1 + float64(server.Latency)/float64(latencyUnit))
+	weight *= 1 - server.Load
+	if weight < minServerWeight {
+		weight = minServerWeight
+	}
+	return weight
+}
+
+// warmupFactor returns the fraction of its weight the server gets during the warmup after it registered,
+// ramping linearly from minWarmupFactor to 1 at the end of the warmup
+func (server *ServerInfo) warmupFactor(warmup time.Duration, now time.Time) float64 {
+	elapsed := now.Sub(server.Registered)
+	if warmup <= 0 || server.Registered.IsZero() || elapsed >= warmup {
+		return 1
+	}
+	factor := float64(elapsed) / float64(warmup)
+	if factor < minWarmupFactor {
+		factor = minWarmupFactor
+	}
+	return factor
+}
+
+// WeightedRandomStrategy selects a healthy server randomly,
+// with probability proportional to its weight
+type WeightedRandomStrategy struct {
+	Warmup time.Duration // window after a server registered in which its weight ramps up to full, disabled if zero
+	rand   *rand.Rand
+	mutex  sync.Mutex
+}
+
+// NewWeightedRandomStrategy creates a new WeightedRandomStrategy
+func NewWeightedRandomStrategy() *WeightedRandomStrategy {
+	return &WeightedRandomStrategy{
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Select selects a healthy server with probability proportional to its weight,
+// reduced for the servers still warming up
+func (s *WeightedRandomStrategy) Select(request map[string]interface{}, servers []*ServerInfo) *ServerInfo {
+	now := time.Now()
+	weights := make([]float64, len(servers))
+	total := 0.0
+	for i, server := range servers {
+		if !server.IsHealthy {
+			continue
+		}
+		weights[i] = server.weight() * server.warmupFactor(s.Warmup, now)
+		total += weights[i]
+	}
+
+	if total == 0 {
+		return nil
+	}
+
+	s.mutex.Lock()
+	r := s.rand.Float64() * total
+	s.mutex.Unlock()
+
+	for i, weight := range weights {
+		if r < weight {
+			return servers[i]
+		}
+		r -= weight
+	}
+
+	// floating point rounding may leave r slightly above the last weight
+	for i := len(servers) - 1; i >= 0; i-- {
+		if weights[i] > 0 {
+			return servers[i]
+		}
+	}
+	return nil
+}
+
+// LatencyAwareStrategy selects the healthy server with the lowest rolling latency,
+// except for a fraction of the requests sent to a random healthy server to keep measuring the others
+type LatencyAwareStrategy struct {
+	Exploration float64 // fraction of the requests sent to a random server, from 0 to 1
+	rand        *rand.Rand
+	mutex       sync.Mutex
+}
+
+// NewLatencyAwareStrategy creates a new LatencyAwareStrategy exploring the fraction of the requests
+func NewLatencyAwareStrategy(exploration float64) *LatencyAwareStrategy {
+	return &LatencyAwareStrategy{
+		Exploration: exploration,
+		rand:        rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Select selects the fastest healthy server, or a random one to explore.
+// a server without a latency yet is the fastest, so every server gets measured
+func (s *LatencyAwareStrategy) Select(request map[string]interface{}, servers []*ServerInfo) *ServerInfo {
+	healthy := make([]*ServerInfo, 0, len(servers))
+	for _, server := range servers {
+		if server.IsHealthy {
+			healthy = append(healthy, server)
+		}
+	}
+	if len(healthy) == 0 {
+		return nil
+	}
+
+	s.mutex.Lock()
+	explore := s.rand.Float64() < s.Exploration
+	random := healthy[s.rand.Intn(len(healthy))]
+	s.mutex.Unlock()
+	if explore {
+		return random
+	}
+
+	var fastest *ServerInfo
+	var lowest time.Duration
+	for _, server := range healthy {
+		server.Mutex.Lock()
+		latency := server.Latency
+		server.Mutex.Unlock()
+		if fastest == nil || latency < lowest {
+			fastest, lowest = server, latency
+		}
+	}
+	return fastest
+}
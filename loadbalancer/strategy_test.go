@@ -0,0 +1,228 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// a consistently slow server gets proportionally less traffic once its latency is measured
+func TestWeightedRandomStrategyPrefersFastServer(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	strategy := NewWeightedRandomStrategy()
+	strategy.rand = rand.New(rand.NewSource(1))
+	lb.Strategy = strategy
+	fast, _ := startBackend(t, `{"result":3}`)
+	slow, _ := startSlowBackend(t, 40*time.Millisecond)
+	fastServer := registerTestServer(lb, fast)
+	slowServer := registerTestServer(lb, slow)
+
+	for i := 0; i < 60; i++ {
+		if response := relayTestRequest(t, lb, `{"method":"Add","params":{"a":1,"b":2}}`); response["result"] != 3.0 {
+			t.Fatalf("request %d: got %v", i, response)
+		}
+	}
+	if fastServer.weight() < 3*slowServer.weight() {
+		t.Fatalf("got weight %v for the slow server and %v for the fast one", slowServer.weight(), fastServer.weight())
+	}
+}
+
+// the weight of a server drops with its failure rate, latency and load
+func TestServerWeight(t *testing.T) {
+	healthy := &ServerInfo{}
+	failing := &ServerInfo{FailureRate: 0.5}
+	slow := &ServerInfo{Latency: latencyUnit}
+	loaded := &ServerInfo{Load: 0.75}
+	dead := &ServerInfo{FailureRate: 1}
+	if healthy.weight() != 1 || failing.weight() != 0.5 || slow.weight() != 0.5 || loaded.weight() != 0.25 {
+		t.Fatalf("got weights %v %v %v %v", healthy.weight(), failing.weight(), slow.weight(), loaded.weight())
+	}
+	if dead.weight() != minServerWeight {
+		t.Fatalf("a failing server gets weight %v, want %v to recover", dead.weight(), minServerWeight)
+	}
+
+	server := &ServerInfo{}
+	server.recordResult(false, time.Second, statsAlpha)
+	if server.FailureRate != statsAlpha || server.Latency != 0 {
+		t.Fatalf("got failure rate %v and latency %v after a failure", server.FailureRate, server.Latency)
+	}
+}
+
+// the strategy never selects an unhealthy server and gives up when none is healthy
+func TestWeightedRandomStrategySkipsUnhealthy(t *testing.T) {
+	strategy := NewWeightedRandomStrategy()
+	healthy := &ServerInfo{IsHealthy: true}
+	servers := []*ServerInfo{{}, healthy, {}}
+	for i := 0; i < 20; i++ {
+		if server := strategy.Select(nil, servers); server != healthy {
+			t.Fatalf("selected %+v", server)
+		}
+	}
+	if server := strategy.Select(nil, []*ServerInfo{{}}); server != nil {
+		t.Fatalf("selected %+v", server)
+	}
+}
+
+// a server which just registered gets a fraction of its weight, ramping up to full over the warmup
+func TestWarmup(t *testing.T) {
+	now := time.Now()
+	warmup := 10 * time.Second
+	cases := []struct {
+		registered time.Time
+		want       float64
+	}{
+		{now, minWarmupFactor},
+		{now.Add(-500 * time.Millisecond), minWarmupFactor},
+		{now.Add(-5 * time.Second), 0.5},
+		{now.Add(-warmup), 1},
+		{time.Time{}, 1}, // gossiped
+	}
+	for _, c := range cases {
+		server := &ServerInfo{Registered: c.registered}
+		if factor := server.warmupFactor(warmup, now); factor != c.want {
+			t.Errorf("registered %v before: got %v, want %v", now.Sub(c.registered), factor, c.want)
+		}
+	}
+	if factor := (&ServerInfo{Registered: now}).warmupFactor(0, now); factor != 1 {
+		t.Fatalf("got %v without a warmup", factor)
+	}
+
+	// a cold server gets about a tenth of the traffic of a warm one with the same weight
+	strategy := NewWeightedRandomStrategy()
+	strategy.rand = rand.New(rand.NewSource(1))
+	strategy.Warmup = time.Minute
+	warm := &ServerInfo{IsHealthy: true, Registered: now.Add(-time.Hour)}
+	cold := &ServerInfo{IsHealthy: true, Registered: now}
+	selected := make(map[*ServerInfo]int)
+	for i := 0; i < 1100; i++ {
+		selected[strategy.Select(nil, []*ServerInfo{warm, cold})]++
+	}
+	if selected[cold] < 50 || selected[cold] > 150 {
+		t.Fatalf("selected the cold server %d times out of 1100, want about 100", selected[cold])
+	}
+}
+
+// SelectFunc routes the requests it selects a server for before the strategy, which selects the others,
+// and is only given the ready servers
+func TestSelectFunc(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	first := registerTestServer(lb, "10.0.0.1:8080")
+	second := registerTestServer(lb, "10.0.0.2:8080")
+	unready := registerTestServer(lb, "10.0.0.3:8080")
+	unready.Ready = false
+
+	var candidates []*ServerInfo
+	lb.SelectFunc = func(request map[string]interface{}, servers []*ServerInfo) *ServerInfo {
+		candidates = servers
+		if request["method"] == "Divide" {
+			return second
+		}
+		return nil
+	}
+
+	for i := 0; i < 3; i++ {
+		if server := lb.getServer(map[string]interface{}{"method": "Divide"}, nil); server != second {
+			t.Fatalf("Divide is relayed to %v", server)
+		}
+	}
+	if len(candidates) != 2 {
+		t.Fatalf("SelectFunc is given %d candidates, want the 2 ready servers", len(candidates))
+	}
+	selected := map[*ServerInfo]bool{}
+	for i := 0; i < 2; i++ {
+		selected[lb.getServer(map[string]interface{}{"method": "Add"}, nil)] = true
+	}
+	if !selected[first] || !selected[second] {
+		t.Fatalf("the requests SelectFunc falls back on are not round-robin: %v", selected)
+	}
+}
+
+// panicStrategy is a buggy custom strategy panicking on every selection
+type panicStrategy struct{}
+
+func (panicStrategy) Select(request map[string]interface{}, servers []*ServerInfo) *ServerInfo {
+	panic("index out of range")
+}
+
+// a strategy which panics is logged and the requests fall back to round-robin
+func TestStrategyPanic(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	lb.Strategy = panicStrategy{}
+	first := registerTestServer(lb, "10.0.0.1:8080")
+	second := registerTestServer(lb, "10.0.0.2:8080")
+	logs := observeLogs(t, zapcore.ErrorLevel)
+
+	selected := map[*ServerInfo]int{}
+	for i := 0; i < 4; i++ {
+		selected[lb.getServer(map[string]interface{}{"method": "Add"}, nil)]++
+	}
+	if selected[first] != 2 || selected[second] != 2 {
+		t.Fatalf("the requests are not round-robin after the panics: %v", selected)
+	}
+	entries := logs.FilterMessage("Strategy panicked, falling back to round-robin").All()
+	if len(entries) != 4 || entries[0].ContextMap()["method"] != "Add" {
+		t.Fatalf("got %v", entries)
+	}
+
+	// the lock is released after the panic
+	if snapshot := lb.Snapshot(); len(snapshot) != 2 {
+		t.Fatalf("got %d servers", len(snapshot))
+	}
+}
+
+// the latency-aware strategy selects the fastest healthy server, a server not measured yet first,
+// and explores the others with a fraction of the requests
+func TestLatencyAwareStrategy(t *testing.T) {
+	strategy := NewLatencyAwareStrategy(0)
+	fast := &ServerInfo{IsHealthy: true, Latency: 10 * time.Millisecond}
+	slow := &ServerInfo{IsHealthy: true, Latency: 50 * time.Millisecond}
+	unhealthy := &ServerInfo{Latency: time.Millisecond}
+	servers := []*ServerInfo{slow, unhealthy, fast}
+	for i := 0; i < 20; i++ {
+		if server := strategy.Select(nil, servers); server != fast {
+			t.Fatalf("selected %+v", server)
+		}
+	}
+	unmeasured := &ServerInfo{IsHealthy: true}
+	if server := strategy.Select(nil, append(servers, unmeasured)); server != unmeasured {
+		t.Fatalf("selected %+v before the unmeasured server", server)
+	}
+	if server := strategy.Select(nil, []*ServerInfo{unhealthy}); server != nil {
+		t.Fatalf("selected %+v", server)
+	}
+
+	strategy = NewLatencyAwareStrategy(0.2)
+	strategy.rand = rand.New(rand.NewSource(1))
+	toSlow := 0
+	for i := 0; i < 1000; i++ {
+		switch strategy.Select(nil, servers) {
+		case slow:
+			toSlow++
+		case unhealthy:
+			t.Fatal("explored the unhealthy server")
+		}
+	}
+	// half of the explored requests go to the slow server
+	if toSlow < 60 || toSlow > 140 {
+		t.Fatalf("explored the slow server with %d requests of 1000, want about 100", toSlow)
+	}
+}
+
+// the latest latency weighs LatencyAlpha in the rolling latency, statsAlpha if it is not set
+func TestLatencyAlpha(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	server := &ServerInfo{}
+	lb.recordResult(server, true, 100*time.Millisecond)
+	lb.recordResult(server, true, 200*time.Millisecond)
+	if want := time.Duration(float64(100*time.Millisecond)*(1-statsAlpha) + float64(200*time.Millisecond)*statsAlpha); server.Latency != want {
+		t.Fatalf("got latency %v, want %v", server.Latency, want)
+	}
+
+	lb.LatencyAlpha = 1
+	lb.recordResult(server, true, 30*time.Millisecond)
+	if server.Latency != 30*time.Millisecond {
+		t.Fatalf("got latency %v with the weight 1, want the latest one", server.Latency)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// the summary counts the healthy servers and the requests served since the previous summary
+func TestLogHealthSummary(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	backend, _ := startBackend(t, `{"result":3}`)
+	registerTestServer(lb, backend)
+	registerTestServer(lb, "10.0.0.1:8081").IsHealthy = false
+	logs := observeLogs(t, zapcore.InfoLevel)
+
+	for i := 0; i < 3; i++ {
+		lb.requestsServed++
+	}
+	go lb.LogHealthSummary(20 * time.Millisecond)
+	defer lb.Stop()
+
+	summaries := func() int { return logs.FilterMessage("Health summary").Len() }
+	waitFor(t, "the first summary", func() bool { return summaries() >= 1 })
+	fields := logs.FilterMessage("Health summary").All()[0].ContextMap()
+	if fields["healthy"] != int64(1) || fields["servers"] != int64(2) || fields["requests"] != int64(3) {
+		t.Fatalf("got summary %v", fields)
+	}
+
+	// the requests are counted again from zero
+	waitFor(t, "the second summary", func() bool { return summaries() >= 2 })
+	if fields := logs.FilterMessage("Health summary").All()[1].ContextMap(); fields["requests"] != int64(0) {
+		t.Fatalf("got summary %v", fields)
+	}
+}
+
+// a relayed request is counted as served
+func TestRequestsServedCounted(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	backend, _ := startBackend(t, `{"result":3}`)
+	registerTestServer(lb, backend)
+
+	relayTestRequest(t, lb, `{"method":"Add","params":{"a":1,"b":2}}`)
+	lb.Mutex.Lock()
+	defer lb.Mutex.Unlock()
+	if lb.requestsServed != 1 {
+		t.Fatalf("got %d requests served", lb.requestsServed)
+	}
+}
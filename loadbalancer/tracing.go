@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// the relay of a request is traced with OpenTelemetry if LB_TRACING is otlp. the trace context of the client
+// comes in the "metadata" of the request, e.g. "traceparent", and is replaced by the one of the relay span,
+// so the span of the server is a child of it
+
+// tracer starts the spans of the load balancer, they are not recorded until startTracing is called
+var tracer = otel.Tracer("github.com/denizydmr07/rpc-project/loadbalancer")
+
+// propagator reads and writes the trace context in the metadata of the requests as W3C Trace Context
+var propagator = propagation.TraceContext{}
+
+// startTracing exports the spans to the OTLP/HTTP endpoint set by the standard OTEL_EXPORTER_OTLP_* variables,
+// e.g. OTEL_EXPORTER_OTLP_ENDPOINT, and returns the func flushing the spans left on shutdown
+func startTracing(ctx context.Context) (func(context.Context) error, error) {
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "loadbalancer"))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// metadataCarrier carries the trace context in the decoded metadata of a request
+type metadataCarrier map[string]interface{}
+
+func (c metadataCarrier) Get(key string) string {
+	value, _ := c[key].(string)
+	return value
+}
+
+func (c metadataCarrier) Set(key string, value string) {
+	c[key] = value
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// startRelaySpan starts the span of the relay of the request, a child of the span of the client if the request
+// carries its trace context. the trace context of the span is set in the metadata of the request,
+// so the returned raw request is the one to relay
+func startRelaySpan(request map[string]interface{}, rawRequest json.RawMessage) (trace.Span, json.RawMessage) {
+	metadata, ok := request["metadata"].(map[string]interface{})
+	ctx := propagator.Extract(context.Background(), metadataCarrier(metadata))
+
+	method, _ := request["method"].(string)
+	ctx, span := tracer.Start(ctx, "relay "+method, trace.WithAttributes(attribute.String("rpc.method", method)))
+
+	// metadata which is not an object is relayed as is, the server ignores it too
+	if _, set := request["metadata"]; !span.IsRecording() || (set && !ok) {
+		return span, rawRequest
+	}
+	traced := make(map[string]interface{}, len(metadata)+2)
+	for key, value := range metadata {
+		traced[key] = value
+	}
+	propagator.Inject(ctx, metadataCarrier(traced))
+	request["metadata"] = traced
+
+	// the numbers were decoded as json.Number, so they are encoded back as sent
+	if raw, err := json.Marshal(request); err == nil {
+		rawRequest = raw
+	}
+	return span, rawRequest
+}
+
+// endRelaySpan records the server the request was relayed to, nil if none was, and the error of the relay,
+// then ends the span
+func endRelaySpan(span trace.Span, server *ServerInfo, err error) {
+	if server != nil {
+		span.SetAttributes(attribute.String("server.address", server.ServingAddress))
+	}
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordSpans records the spans of the load balancer until the test ends
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	previous := tracer
+	tracer = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+	t.Cleanup(func() { tracer = previous })
+	return recorder
+}
+
+// the relay span is a child of the span of the client, and its trace context replaces the one relayed to the server
+func TestRelaySpan(t *testing.T) {
+	recorder := recordSpans(t)
+	lb := NewLoadBalancer(time.Second)
+	address, received := startBackend(t, `{"result":3}`)
+	registerTestServer(lb, address)
+
+	const traceID, parentID = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	request := `{"method":"Add","params":{"a":1,"b":2},"metadata":{"user":"ada","traceparent":"00-` + traceID + `-` + parentID + `-01"}}`
+	if response := relayTestRequest(t, lb, request); response["result"] != 3.0 {
+		t.Fatalf("got %v", response)
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans", len(spans))
+	}
+	span := spans[0]
+	if span.Name() != "relay Add" || span.SpanContext().TraceID().String() != traceID || span.Parent().SpanID().String() != parentID {
+		t.Fatalf("got the span %s of the trace %s with the parent %s", span.Name(), span.SpanContext().TraceID(), span.Parent().SpanID())
+	}
+	attributes := map[string]string{}
+	for _, attribute := range span.Attributes() {
+		attributes[string(attribute.Key)] = attribute.Value.Emit()
+	}
+	if attributes["rpc.method"] != "Add" || attributes["server.address"] != address {
+		t.Fatalf("got the attributes %v", attributes)
+	}
+
+	metadata, _ := (<-received)["metadata"].(map[string]interface{})
+	want := "00-" + traceID + "-" + span.SpanContext().SpanID().String() + "-01"
+	if metadata["traceparent"] != want || metadata["user"] != "ada" {
+		t.Fatalf("relayed the metadata %v, want the traceparent %s", metadata, want)
+	}
+}
+
+// a relay failing without a server has the error as the status of its span, which starts a new trace
+func TestRelaySpanError(t *testing.T) {
+	recorder := recordSpans(t)
+	lb := NewLoadBalancer(time.Second)
+	if response := relayTestRequest(t, lb, `{"method":"Add","params":{"a":1,"b":2}}`); response["error"] == nil {
+		t.Fatalf("got %v without a server", response)
+	}
+	spans := recorder.Ended()
+	if len(spans) != 1 || spans[0].Parent().IsValid() || spans[0].Status().Code != codes.Error {
+		t.Fatalf("got the spans %v", spans)
+	}
+}
+
+// without tracing the request is relayed as the client sent it
+func TestRelayWithoutTracing(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	address, received := startBackend(t, `{"result":3}`)
+	registerTestServer(lb, address)
+	relayTestRequest(t, lb, `{"method":"Add","params":{"a":1,"b":2}}`)
+	if request := <-received; request["metadata"] != nil {
+		t.Fatalf("relayed the metadata %v", request["metadata"])
+	}
+}
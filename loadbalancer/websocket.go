@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// browsers can not open raw TLS connections, so the load balancer also serves the clients
+// over WebSocket (RFC 6455). each text or binary message is a request in the format of the
+// raw connections, it is relayed like them and its response is sent back as a text message
+
+// wsGUID is appended to the key of the client to compute the accept header of the handshake
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// wsMaxMessage is the maximum size in bytes of a WebSocket message
+const wsMaxMessage = 1 << 20
+
+// opcodes of the WebSocket frames
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// close status codes sent to the client
+const (
+	wsProtocolError = 1002
+	wsTooBig        = 1009
+)
+
+// StartWebSocket listens for WebSocket clients with tls until the load balancer is stopped
+func (lb *LoadBalancer) StartWebSocket(address string, tlsConfig *tls.Config) error {
+	ln, err := lb.listenClients(address, tlsConfig)
+	if err != nil {
+		return err
+	}
+
+	lb.Mutex.Lock()
+	lb.listeners = append(lb.listeners, ln)
+	lb.Mutex.Unlock()
+
+	go lb.serveWebSocket(ln)
+
+	logger.Info("WebSocket started", zap.String("address", address))
+	return nil
+}
+
+// serveWebSocket accepts the connections of the WebSocket clients
+func (lb *LoadBalancer) serveWebSocket(ln net.Listener) {
+	backoff := &acceptBackoff{max: lb.AcceptBackoffMax}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if backoff.retry(err) {
+				continue
+			}
+			logger.Error("Error in Accept, stopped listening for WebSocket", zap.Error(err))
+			return
+		}
+		backoff.reset()
+		go lb.handleWebSocket(conn)
+	}
+}
+
+// wsConn is the server side of a WebSocket connection
+type wsConn struct {
+	net.Conn
+	reader *bufio.Reader // buffers the frames following the handshake
+}
+
+// handleWebSocket upgrades the connection and relays the requests of its messages
+// until the client closes it or stays idle for IdleTimeout
+func (lb *LoadBalancer) handleWebSocket(conn net.Conn) {
+	defer conn.Close()
+
+	ws, err := lb.upgrade(conn)
+	if err != nil {
+		logger.Debug("WebSocket handshake failed", zap.String("address", conn.RemoteAddr().String()), zap.Error(err))
+		return
+	}
+	logger.Debug("WebSocket client connected", zap.String("address", conn.RemoteAddr().String()))
+	lb.emit(Event{Type: ClientConnected, Client: conn.RemoteAddr().String()})
+	defer lb.emit(Event{Type: ClientDisconnected, Client: conn.RemoteAddr().String()})
+
+	for {
+		if lb.IdleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(lb.IdleTimeout))
+		}
+		message, err := ws.readMessage()
+		conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			if err != io.EOF {
+				logger.Debug("WebSocket connection closed", zap.String("address", conn.RemoteAddr().String()), zap.Error(err))
+			}
+			return
+		}
+
+		if err := ws.writeFrame(wsText, lb.relayWebSocket(conn, message)); err != nil {
+			logger.Error("Error sending response to WebSocket client", zap.Error(err))
+			return
+		}
+	}
+}
+
+// relayWebSocket relays the request of a WebSocket message and returns the response to send back
+func (lb *LoadBalancer) relayWebSocket(conn net.Conn, message []byte) []byte {
+	request, err := parseRequest(message)
+	if err != nil {
+		return errorMessage(request, err.Error())
+	}
+	if err := lb.limitMethod(request); err != nil {
+		return errorMessage(request, err.Error())
+	}
+	logger.Debug("Request received from WebSocket client", zap.String("address", conn.RemoteAddr().String()), zap.ByteString("request", message))
+
+	_, chunked := request["chunked"]
+	subscribe, _ := request["subscribe"].(bool)
+	if stream, _ := request["stream"].(bool); stream || subscribe || chunked {
+		return errorMessage(request, "streams, subscriptions and chunked uploads are not supported over WebSocket")
+	}
+
+	// the connection is not watched while waiting for the server, its frames are read by handleWebSocket
+	response, err := lb.relayMessage(conn, request, message, true)
+	if err != nil {
+		return errorMessage(request, err.Error())
+	}
+	return response
+}
+
+// errorMessage returns an error response like sendError
+func errorMessage(request map[string]interface{}, message string) []byte {
+	response, _ := json.Marshal(errorResponse(request, message))
+	return response
+}
+
+// upgrade reads the opening handshake of the client and accepts it,
+// a request which is not a valid handshake or comes from an origin not allowed is rejected
+func (lb *LoadBalancer) upgrade(conn net.Conn) (*wsConn, error) {
+	if lb.ReadTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(lb.ReadTimeout))
+	}
+	reader := bufio.NewReader(conn)
+	request, err := http.ReadRequest(reader)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+
+	key := request.Header.Get("Sec-WebSocket-Key")
+	switch {
+	case request.Method != http.MethodGet,
+		!headerContains(request.Header, "Connection", "upgrade"),
+		!headerContains(request.Header, "Upgrade", "websocket"),
+		request.Header.Get("Sec-WebSocket-Version") != "13",
+		key == "":
+		rejectHandshake(conn, http.StatusBadRequest)
+		return nil, errors.New("not a WebSocket handshake")
+	case !lb.originAllowed(request.Header.Get("Origin")):
+		rejectHandshake(conn, http.StatusForbidden)
+		return nil, fmt.Errorf("origin %q is not allowed", request.Header.Get("Origin"))
+	}
+
+	accept := sha1.Sum([]byte(key + wsGUID))
+	_, err = fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(accept[:]))
+	if err != nil {
+		return nil, err
+	}
+	return &wsConn{Conn: conn, reader: reader}, nil
+}
+
+// headerContains reports whether a comma-separated header contains the token, ignoring case
+func headerContains(header http.Header, name string, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// rejectHandshake answers a handshake with the error status
+func rejectHandshake(conn net.Conn, status int) {
+	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nConnection: close\r\nContent-Length: 0\r\n\r\n", status, http.StatusText(status))
+}
+
+// originAllowed reports whether a client from the origin may connect,
+// any origin is allowed if WebSocketOrigins is empty
+func (lb *LoadBalancer) originAllowed(origin string) bool {
+	if len(lb.WebSocketOrigins) == 0 {
+		return true
+	}
+	for _, allowed := range lb.WebSocketOrigins {
+		if strings.EqualFold(origin, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// readMessage reads the frames of the next data message and returns its payload,
+// the pings are answered meanwhile. it returns io.EOF once the client closed the connection
+func (c *wsConn) readMessage() ([]byte, error) {
+	var message []byte
+	started := false
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		switch opcode {
+		case wsPing:
+			if err := c.writeFrame(wsPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			// echo the status code of the client
+			if len(payload) > 2 {
+				payload = payload[:2]
+			}
+			c.writeFrame(wsClose, payload)
+			return nil, io.EOF
+		case wsText, wsBinary:
+			if started {
+				return nil, c.fail(wsProtocolError, "new message before the end of the previous one")
+			}
+			started = true
+		case wsContinuation:
+			if !started {
+				return nil, c.fail(wsProtocolError, "continuation frame without a message")
+			}
+		default:
+			return nil, c.fail(wsProtocolError, fmt.Sprintf("unknown opcode %d", opcode))
+		}
+
+		if len(message)+len(payload) > wsMaxMessage {
+			return nil, c.fail(wsTooBig, fmt.Sprintf("message exceeds %d bytes", wsMaxMessage))
+		}
+		message = append(message, payload...)
+		if fin {
+			return message, nil
+		}
+	}
+}
+
+// readFrame reads a frame of the client and unmasks its payload
+func (c *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0F
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, c.fail(wsProtocolError, "reserved bits are set")
+	}
+	if header[1]&0x80 == 0 {
+		return false, 0, nil, c.fail(wsProtocolError, "frames of the client must be masked")
+	}
+
+	// the length is either in the header or in the 2 or 8 bytes following it
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(c.reader, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(c.reader, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	if opcode >= wsClose && (length > 125 || !fin) {
+		return false, 0, nil, c.fail(wsProtocolError, "invalid control frame")
+	}
+	if length > wsMaxMessage {
+		return false, 0, nil, c.fail(wsTooBig, fmt.Sprintf("message exceeds %d bytes", wsMaxMessage))
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// writeFrame writes an unfragmented frame, the frames of the server are not masked
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode}
+	switch length := len(payload); {
+	case length < 126:
+		header = append(header, byte(length))
+	case length <= 0xFFFF:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	}
+	_, err := c.Write(append(header, payload...))
+	return err
+}
+
+// fail closes the connection with the status code and returns the reason as an error
+func (c *wsConn) fail(status uint16, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, status)
+	c.writeFrame(wsClose, append(payload, reason...))
+	return errors.New(reason)
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wsTestClient is the client side of a WebSocket connection, it masks its frames like a browser
+type wsTestClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// dialTestWebSocket sends the opening handshake with the key and the headers on the connection
+// and returns the client with the answer of the load balancer
+func dialTestWebSocket(t *testing.T, conn net.Conn, key string, header map[string]string) (*wsTestClient, *http.Response) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	request := "GET /rpc HTTP/1.1\r\nHost: lb\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\nSec-WebSocket-Version: 13\r\n"
+	if key != "" {
+		request += "Sec-WebSocket-Key: " + key + "\r\n"
+	}
+	for name, value := range header {
+		request += name + ": " + value + "\r\n"
+	}
+	if _, err := io.WriteString(conn, request+"\r\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	client := &wsTestClient{conn: conn, reader: bufio.NewReader(conn)}
+	response, err := http.ReadResponse(client.reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, response
+}
+
+// pipeTestWebSocket opens a connection handled by the load balancer and completes the handshake
+func pipeTestWebSocket(t *testing.T, lb *LoadBalancer) *wsTestClient {
+	t.Helper()
+	conn, lbSide := net.Pipe()
+	go lb.handleWebSocket(lbSide)
+	t.Cleanup(func() { conn.Close() })
+
+	client, response := dialTestWebSocket(t, conn, "dGhlIHNhbXBsZSBub25jZQ==", nil)
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake answered %s", response.Status)
+	}
+	return client
+}
+
+// writeFrame writes a frame masked with a fixed key
+func (c *wsTestClient) writeFrame(t *testing.T, fin bool, opcode byte, payload []byte) {
+	t.Helper()
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	frame := []byte{first}
+	switch length := len(payload); {
+	case length < 126:
+		frame = append(frame, 0x80|byte(length))
+	case length <= 0xFFFF:
+		frame = append(frame, 0x80|126, byte(length>>8), byte(length))
+	default:
+		frame = append(frame, 0x80|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(length))
+	}
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	if _, err := c.conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readFrame reads an unmasked frame of the load balancer
+func (c *wsTestClient) readFrame(t *testing.T) (byte, []byte) {
+	t.Helper()
+	var header [2]byte
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		t.Fatal(err)
+	}
+	if header[0]&0x80 == 0 || header[1]&0x80 != 0 {
+		t.Fatalf("frame of the load balancer is fragmented or masked: %x", header)
+	}
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var extended [2]byte
+		io.ReadFull(c.reader, extended[:])
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		io.ReadFull(c.reader, extended[:])
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		t.Fatal(err)
+	}
+	return header[0] & 0x0F, payload
+}
+
+// expectClose reads the close frame of the load balancer and checks its status code
+func (c *wsTestClient) expectClose(t *testing.T, status uint16) {
+	t.Helper()
+	opcode, payload := c.readFrame(t)
+	if opcode != wsClose || len(payload) < 2 {
+		t.Fatalf("got the frame %d %q, want a close frame", opcode, payload)
+	}
+	if got := binary.BigEndian.Uint16(payload); got != status {
+		t.Fatalf("closed with %d (%s), want %d", got, payload[2:], status)
+	}
+}
+
+// the accept header is computed from the key of the client as in RFC 6455 section 1.3,
+// a request which is not a WebSocket handshake is rejected
+func TestWebSocketHandshake(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+
+	conn, lbSide := net.Pipe()
+	defer conn.Close()
+	go lb.handleWebSocket(lbSide)
+	_, response := dialTestWebSocket(t, conn, "dGhlIHNhbXBsZSBub25jZQ==", nil)
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake answered %s", response.Status)
+	}
+	if accept := response.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("got the accept header %q", accept)
+	}
+
+	conn, lbSide = net.Pipe()
+	defer conn.Close()
+	go lb.handleWebSocket(lbSide)
+	if _, response := dialTestWebSocket(t, conn, "", nil); response.StatusCode != http.StatusBadRequest {
+		t.Fatalf("handshake without a key answered %s", response.Status)
+	}
+}
+
+// only the allowed origins may connect when WebSocketOrigins is set
+func TestWebSocketOrigin(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	lb.WebSocketOrigins = []string{"https://app.example.com"}
+
+	for origin, status := range map[string]int{
+		"https://app.example.com":  http.StatusSwitchingProtocols,
+		"https://APP.example.com":  http.StatusSwitchingProtocols,
+		"https://evil.example.com": http.StatusForbidden,
+	} {
+		conn, lbSide := net.Pipe()
+		go lb.handleWebSocket(lbSide)
+		_, response := dialTestWebSocket(t, conn, "dGhlIHNhbXBsZSBub25jZQ==", map[string]string{"Origin": origin})
+		if response.StatusCode != status {
+			t.Errorf("origin %s answered %s, want %d", origin, response.Status, status)
+		}
+		conn.Close()
+	}
+}
+
+// a masked request is relayed and its response sent back as a text message,
+// a request fragmented in several frames with a ping between them is reassembled and the ping answered
+func TestWebSocketRelay(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	backend, requests := startBackend(t, `{"result":3}`)
+	registerTestServer(lb, backend)
+	client := pipeTestWebSocket(t, lb)
+
+	client.writeFrame(t, true, wsText, []byte(`{"method":"Add","params":{"a":1,"b":2}}`))
+	if opcode, payload := client.readFrame(t); opcode != wsText || string(payload) != `{"result":3}` {
+		t.Fatalf("got the frame %d %s", opcode, payload)
+	}
+
+	client.writeFrame(t, false, wsText, []byte(`{"method":"Add",`))
+	client.writeFrame(t, false, wsContinuation, []byte(`"params":{"a":4,`))
+	client.writeFrame(t, true, wsPing, []byte("are you there"))
+	if opcode, payload := client.readFrame(t); opcode != wsPong || string(payload) != "are you there" {
+		t.Fatalf("got the frame %d %q, want the pong", opcode, payload)
+	}
+	client.writeFrame(t, true, wsContinuation, []byte(`"b":5}}`))
+	if opcode, payload := client.readFrame(t); opcode != wsText || string(payload) != `{"result":3}` {
+		t.Fatalf("got the frame %d %s", opcode, payload)
+	}
+
+	<-requests
+	request := <-requests
+	if params, _ := request["params"].(map[string]interface{}); params["a"] != 4.0 || params["b"] != 5.0 {
+		t.Fatalf("the server got %v", request)
+	}
+
+	// the close frame of the client is echoed
+	client.writeFrame(t, true, wsClose, []byte{0x03, 0xE8})
+	client.expectClose(t, 1000)
+}
+
+// streams, subscriptions and chunked uploads keep the connection to the server open, so they are answered with an error
+func TestWebSocketRejectsStreams(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	backend, _ := startBackend(t, `{"result":3}`)
+	registerTestServer(lb, backend)
+	client := pipeTestWebSocket(t, lb)
+
+	for _, request := range []string{
+		`{"method":"Feed","stream":true}`,
+		`{"method":"Ticks","subscribe":true,"params":{"count":3}}`,
+		`{"method":"Upload","chunked":"data","params":{"name":"a"}}`,
+	} {
+		client.writeFrame(t, true, wsText, []byte(request))
+		if opcode, payload := client.readFrame(t); opcode != wsText || string(payload) != `{"error":"streams, subscriptions and chunked uploads are not supported over WebSocket"}` {
+			t.Fatalf("%s: got the frame %d %s", request, opcode, payload)
+		}
+	}
+}
+
+// a frame or a message larger than wsMaxMessage closes the connection with 1009,
+// an unmasked frame or a continuation without a message with 1002
+func TestWebSocketInvalidFrames(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+
+	client := pipeTestWebSocket(t, lb)
+	header := []byte{0x80 | wsBinary, 0x80 | 127, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint64(header[2:], wsMaxMessage+1)
+	if _, err := client.conn.Write(header); err != nil {
+		t.Fatal(err)
+	}
+	client.expectClose(t, wsTooBig)
+
+	client = pipeTestWebSocket(t, lb)
+	chunk := []byte(strings.Repeat("a", wsMaxMessage/2))
+	client.writeFrame(t, false, wsText, chunk)
+	client.writeFrame(t, false, wsContinuation, chunk)
+	client.writeFrame(t, true, wsContinuation, []byte("a"))
+	client.expectClose(t, wsTooBig)
+
+	client = pipeTestWebSocket(t, lb)
+	if _, err := client.conn.Write([]byte{0x80 | wsText, 2, '{', '}'}); err != nil {
+		t.Fatal(err)
+	}
+	client.expectClose(t, wsProtocolError)
+
+	client = pipeTestWebSocket(t, lb)
+	client.writeFrame(t, true, wsContinuation, []byte("{}"))
+	client.expectClose(t, wsProtocolError)
+}
+
+// a browser-like client connects over tls to the WebSocket listener and calls a server through it
+func TestWebSocketEndToEnd(t *testing.T) {
+	lb := NewLoadBalancer(time.Second)
+	defer lb.Stop()
+	backend, _ := startBackend(t, `{"jsonrpc":"2.0","id":7,"result":3}`)
+	registerTestServer(lb, backend)
+
+	certificate, _ := newTestCertificate(t)
+	if err := lb.StartWebSocket("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{certificate}}); err != nil {
+		t.Fatal(err)
+	}
+	lb.Mutex.Lock()
+	address := lb.listeners[len(lb.listeners)-1].Addr().String()
+	lb.Mutex.Unlock()
+
+	conn, err := tls.Dial("tcp", address, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client, response := dialTestWebSocket(t, conn, "x3JJHMbDL1EzLkh9GBhXDw==", nil)
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake answered %s", response.Status)
+	}
+
+	for i := 0; i < 2; i++ {
+		client.writeFrame(t, true, wsText, []byte(fmt.Sprintf(`{"jsonrpc":"2.0","id":7,"method":"Add","params":{"a":%d,"b":2}}`, i)))
+		if opcode, payload := client.readFrame(t); opcode != wsText || string(payload) != `{"jsonrpc":"2.0","id":7,"result":3}` {
+			t.Fatalf("got the frame %d %s", opcode, payload)
+		}
+	}
+}
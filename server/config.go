@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/denizydmr07/rpc-project/server/stub"
+)
+
+// Config is the configuration of the server read from the command line flags
+type Config struct {
+	Port             string            // port to listen on
+	LBAddress        string            // address of the load balancer to send heartbeats to
+	TLS              *tls.Config       // tls config to serve the load balancer, plain tcp is used if nil
+	AcceptBackoffMax time.Duration     // maximum delay between retries of a failing accept
+	Addresses        []string          // serving addresses advertised to the load balancer, nil if not set
+	MaxInFlight      int64             // number of requests handled at the same time reported as full load
+	LBWait           time.Duration     // how long to retry reaching the load balancer at startup
+	QueueBusy        bool              // queue the calls over the concurrency limit of their method instead of rejecting them
+	ShutdownTimeout  time.Duration     // how long to wait for the connections being handled when stopping before closing them
+	Capabilities     map[string]string // capability key/values advertised to the load balancer, nil if not set
+	Tracing          bool              // traces the dispatch of the calls with OpenTelemetry, exported over OTLP
+	HeartbeatFormat  string            // format of the heartbeats, binary or json
+}
+
+// configError lists every problem found in the configuration
+type configError []string
+
+func (e configError) Error() string {
+	return "invalid configuration:\n  " + strings.Join(e, "\n  ")
+}
+
+// add records a problem with the configuration
+func (e *configError) add(format string, args ...interface{}) {
+	*e = append(*e, fmt.Sprintf(format, args...))
+}
+
+// loadConfig parses the command line flags and validates them
+// it returns a configError listing every invalid flag instead of stopping at the first one
+func loadConfig() (*Config, error) {
+	portPtr := flag.String("p", "8081", "Port to listen")
+	lbAddressPtr := flag.String("lb", "139.179.211.34:7070", "Address of the load balancer to send heartbeats to, empty to serve clients directly without a load balancer")
+	certPtr := flag.String("cert", "", "TLS certificate file, the server listens with TLS if set with -key")
+	keyPtr := flag.String("key", "", "TLS key file, the server listens with TLS if set with -cert")
+	acceptBackoffMaxPtr := flag.Duration("accept-backoff-max", time.Second, "Maximum delay between retries of a failing accept")
+	advertisePtr := flag.String("advertise", "", "Comma-separated serving addresses to advertise to the load balancer in order of preference, the host heartbeats come from is used if empty")
+	lbWaitPtr := flag.Duration("lb-wait", stub.LBWait, "How long to retry reaching the load balancer at startup before stopping")
+	maxInFlightPtr := flag.Int64("max-in-flight", stub.MaxInFlight, "Number of requests handled at the same time reported as full load")
+	queueBusyPtr := flag.Bool("queue-busy", stub.QueueBusyMethods, "Queue the calls over the maxconcurrency of their method instead of rejecting them with \"method busy\"")
+	shutdownTimeoutPtr := flag.Duration("shutdown-timeout", 10*time.Second, "How long to wait for the requests being handled when stopping or draining before closing their connections")
+	tracingPtr := flag.String("tracing", "none", "Exporter of the spans of the calls, none or otlp to export them to the endpoint set by the OTEL_EXPORTER_OTLP_* variables")
+	hbFormatPtr := flag.String("hb-format", stub.HeartbeatFormat, "Format of the heartbeats, binary or json for load balancers which do not read binary heartbeats, json will be removed in the next release")
+	capabilitiesPtr := flag.String("capabilities", "", "Comma-separated key=value capabilities to advertise to the load balancer for routing, e.g. gpu=true,version=2.1")
+
+	flag.Parse()
+
+	var errs configError
+	config := &Config{
+		Port:             *portPtr,
+		LBAddress:        *lbAddressPtr,
+		AcceptBackoffMax: *acceptBackoffMaxPtr,
+		MaxInFlight:      *maxInFlightPtr,
+		LBWait:           *lbWaitPtr,
+		QueueBusy:        *queueBusyPtr,
+		ShutdownTimeout:  *shutdownTimeoutPtr,
+		HeartbeatFormat:  *hbFormatPtr,
+	}
+
+	if port, err := strconv.Atoi(config.Port); err != nil || port < 0 || port > 65535 {
+		errs.add("-p: invalid port %q", config.Port)
+	}
+	if config.LBAddress != "" {
+		if _, _, err := net.SplitHostPort(config.LBAddress); err != nil {
+			errs.add("-lb: %v", err)
+		}
+	}
+
+	// tls config to serve the load balancer
+	if *certPtr != "" || *keyPtr != "" {
+		if *certPtr == "" || *keyPtr == "" {
+			errs.add("-cert and -key must be set together")
+		} else if cert, err := tls.LoadX509KeyPair(*certPtr, *keyPtr); err != nil {
+			errs.add("-cert/-key: %v", err)
+		} else {
+			config.TLS = &tls.Config{
+				Certificates: []tls.Certificate{cert},
+			}
+		}
+	}
+
+	if config.AcceptBackoffMax < 0 {
+		errs.add("-accept-backoff-max must not be negative")
+	}
+	if *advertisePtr != "" {
+		config.Addresses = strings.Split(*advertisePtr, ",")
+		for _, address := range config.Addresses {
+			if _, _, err := net.SplitHostPort(address); err != nil {
+				errs.add("-advertise: %v", err)
+			}
+		}
+	}
+	if config.LBWait < 0 {
+		errs.add("-lb-wait must not be negative")
+	}
+	if *capabilitiesPtr != "" {
+		config.Capabilities = make(map[string]string)
+		for _, pair := range strings.Split(*capabilitiesPtr, ",") {
+			key, value, ok := strings.Cut(pair, "=")
+			if key = strings.TrimSpace(key); !ok || key == "" {
+				errs.add("-capabilities: invalid capability %q, expected key=value", pair)
+				continue
+			}
+			config.Capabilities[key] = strings.TrimSpace(value)
+		}
+	}
+	switch *tracingPtr {
+	case "none":
+	case "otlp":
+		config.Tracing = true
+	default:
+		errs.add("-tracing: unknown exporter %q, must be none or otlp", *tracingPtr)
+	}
+	switch config.HeartbeatFormat {
+	case "binary", "json":
+	default:
+		errs.add("-hb-format: unknown format %q, must be binary or json", config.HeartbeatFormat)
+	}
+	if config.ShutdownTimeout < 0 {
+		errs.add("-shutdown-timeout must not be negative")
+	}
+	if config.MaxInFlight <= 0 {
+		errs.add("-max-in-flight must be positive")
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return config, nil
+}
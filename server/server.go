@@ -2,10 +2,12 @@ package main
 
 import (
 	"context"
-	"flag"
+	"crypto/tls"
+	"fmt"
 	"net"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
@@ -15,76 +17,238 @@ import (
 	"github.com/denizydmr07/rpc-project/server/stub"
 )
 
-func main() {
-	portPtr := flag.String("p", "8081", "Port to listen")
-
-	flag.Parse()
-
-	logger := zapwrapper.NewLogger(
-		zapwrapper.DefaultFilepath,   // Log file path
-		zapwrapper.DefaultMaxBackups, // Max number of log files to retain
-		zapwrapper.DefaultLogLevel,   // Log level
-	)
+var logger *zap.Logger = zapwrapper.NewLogger(
+	zapwrapper.DefaultFilepath,   // Log file path
+	zapwrapper.DefaultMaxBackups, // Max number of log files to retain
+	zapwrapper.DefaultLogLevel,   // Log level
+)
 
-	defer logger.Sync() // Flush any buffered log entries
+// Server serves the methods of the stub and sends heartbeats to the load balancer
+type Server struct {
+	ln               net.Listener       // listener of the server
+	ctx              context.Context    // context cancelled when the server is stopped
+	cancel           context.CancelFunc // cancels the context
+	acceptBackoffMax time.Duration      // maximum delay between retries of a failing accept
+	handlers         sync.WaitGroup     // connections being handled
+	mutex            sync.Mutex         // guards conns
+	conns            map[net.Conn]bool  // connections being handled, closed if they outlast the shutdown timeout
+	LBDown           chan struct{}      // receives a signal when the load balancer is down
+	standalone       bool               // serves the clients directly, no heartbeats are sent to a load balancer
+}
 
-	// channel to detect if the load balancer is down
-	lbDown := make(chan struct{})
+// listen listens on the given address, with tls if the config is not nil
+func listen(address string, tlsConfig *tls.Config) (net.Listener, error) {
+	if tlsConfig != nil {
+		return tls.Listen("tcp", address, tlsConfig)
+	}
+	return net.Listen("tcp", address)
+}
 
-	// Channel to listen SIGINT and SIGTERM
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+// StartServer listens on the given port, serves the methods of the stub and
+// sends heartbeats to the load balancer on lbAddress unless it is empty. Call Stop to shut it down.
+// without a load balancer, e.g. to test the server in isolation, port "0" picks a free port returned by Addr
+func StartServer(port string, lbAddress string, tlsConfig *tls.Config, acceptBackoffMax time.Duration) (*Server, error) {
+	ln, err := listen(":"+port, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
 
 	// Context to cancel the server
 	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
 
-	// Listen on port 8080
-	ln, err := net.Listen("tcp", ":"+*portPtr)
-	if err != nil {
-		logger.Error("Error in Listen", zap.Error(err))
-		return
+	s := &Server{
+		ln:               ln,
+		ctx:              ctx,
+		cancel:           cancel,
+		acceptBackoffMax: acceptBackoffMax,
+		conns:            make(map[net.Conn]bool),
+		LBDown:           make(chan struct{}),
+		standalone:       lbAddress == "",
 	}
-	defer ln.Close()
-	logger.Info("Server started")
 
 	// Start the server
+	go s.serve()
+
+	//? Would it violate the RPC principles if the server sends heartbeats to the load balancer explicitly?
+	// without a load balancer address the server is called directly by the clients
+	// the port advertised is the one the listener is bound to, which the OS picks if port is "0"
+	if lbAddress != "" {
+		_, boundPort, _ := net.SplitHostPort(ln.Addr().String())
+		go stub.SendHeartbeats(s.ctx, s.LBDown, lbAddress, boundPort)
+	}
+
+	return s, nil
+}
+
+// Addr returns the address the server listens on
+func (s *Server) Addr() net.Addr {
+	return s.ln.Addr()
+}
+
+// Stop stops accepting connections and closes the listener
+func (s *Server) Stop() {
+	s.cancel()
+	s.ln.Close()
+}
+
+// Shutdown stops accepting connections and waits up to timeout for the connections being handled to finish,
+// the ones still being handled are closed then. it reports whether every connection finished in time
+func (s *Server) Shutdown(timeout time.Duration) bool {
+	s.Stop()
+
+	done := make(chan struct{})
 	go func() {
-		for {
-			conn, err := ln.Accept()
-			if err != nil {
-				select {
-				case <-ctx.Done():
-					return
-				default:
-					logger.Error("Error in Accept", zap.Error(err))
-					continue
-				}
+		s.handlers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+	}
+
+	s.mutex.Lock()
+	running := len(s.conns)
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mutex.Unlock()
+	logger.Warn("Shutdown timed out, closed the connections still being handled", zap.Int("handlers", running), zap.Duration("timeout", timeout))
+	return false
+}
+
+// Drain unregisters the server from the load balancer, then shuts it down like Shutdown.
+// a server without a load balancer is only shut down
+func (s *Server) Drain(unregisterTimeout time.Duration, shutdownTimeout time.Duration) bool {
+	if !s.standalone && !stub.Unregister(unregisterTimeout) {
+		logger.Error("Could not unregister from the load balancer")
+	}
+	return s.Shutdown(shutdownTimeout)
+}
+
+// serve accepts connections and handles them in separate goroutines
+func (s *Server) serve() {
+	// delay between retries of a failing accept, like net/http.Server
+	var delay time.Duration
+
+	// the listener is open and the accept loop is starting, let the heartbeats report it
+	stub.Ready()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			select {
+			case <-s.ctx.Done():
+				return
+			default:
+			}
+
+			// stop on permanent errors
+			if ne, ok := err.(interface{ Temporary() bool }); !ok || !ne.Temporary() {
+				logger.Error("Error in Accept, stopped accepting", zap.Error(err))
+				return
 			}
 
-			logger.Info("Client connected", zap.String("address", conn.RemoteAddr().String()))
-			go stub.HandleConnection(conn)
+			// retry temporary errors with an exponential backoff
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else {
+				delay *= 2
+			}
+			if delay > s.acceptBackoffMax {
+				delay = s.acceptBackoffMax
+			}
+			logger.Error("Error in Accept, retrying", zap.Error(err), zap.Duration("delay", delay))
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+
+		logger.Info("Client connected", zap.String("address", conn.RemoteAddr().String()))
+		s.handlers.Add(1)
+		s.mutex.Lock()
+		s.conns[conn] = true
+		s.mutex.Unlock()
+		go func() {
+			defer s.handlers.Done()
+			defer func() {
+				s.mutex.Lock()
+				delete(s.conns, conn)
+				s.mutex.Unlock()
+			}()
+			stub.HandleConnection(conn)
+		}()
+	}
+}
+
+func main() {
+	defer logger.Sync() // Flush any buffered log entries
+
+	// parse and validate the flags, exit listing every problem if they are invalid
+	config, err := loadConfig()
+	if err != nil {
+		logger.Error("Invalid configuration", zap.Error(err))
+		fmt.Fprintln(os.Stderr, err)
+		logger.Sync()
+		os.Exit(1)
+	}
+	stub.MaxInFlight = config.MaxInFlight
+	stub.Addresses = config.Addresses
+	stub.LBWait = config.LBWait
+	stub.HeartbeatFormat = config.HeartbeatFormat
+	stub.QueueBusyMethods = config.QueueBusy
+	if config.Capabilities != nil {
+		stub.SetCapabilities(config.Capabilities)
+	}
+
+	// Export the spans of the calls if configured, the ones left are flushed on exit
+	if config.Tracing {
+		shutdownTracing, err := startTracing(context.Background())
+		if err != nil {
+			logger.Error("Error in starting the tracing", zap.Error(err))
+			return
 		}
+		defer shutdownTracing(context.Background())
+	}
+
+	// Channel to listen SIGINT and SIGTERM
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	// Channel to listen SIGUSR1, which drains the server before stopping
+	drain := make(chan os.Signal, 1)
+	signal.Notify(drain, syscall.SIGUSR1)
+
+	// Channel to listen SIGUSR2, which stops the load balancer routing new requests to the server
+	bleed := make(chan os.Signal, 1)
+	signal.Notify(bleed, syscall.SIGUSR2)
+	go func() {
+		<-bleed
+		logger.Info("Received signal to stop receiving new requests")
+		stub.SetDraining()
 	}()
 
-	//? Would it violate the RPC principles if the server sends heartbeats to the load balancer explicitly?
-	go stub.SendHeartbeats(lbDown, *portPtr)
+	// Listen on port 8080
+	server, err := StartServer(config.Port, config.LBAddress, config.TLS, config.AcceptBackoffMax)
+	if err != nil {
+		logger.Error("Error in Listen", zap.Error(err))
+		return
+	}
+	logger.Info("Server started", zap.String("address", server.Addr().String()))
 
 	// waiting for the load balancer to go down or the server to receive a signal
 	select {
-	case <-lbDown:
+	case <-server.LBDown:
 		logger.Error("Load balancer is down")
 	case <-stop:
 		logger.Info("Received signal to stop")
+	case <-drain:
+		logger.Info("Received signal to drain")
+		server.Drain(time.Second, config.ShutdownTimeout)
+		logger.Info("Server drained")
+		return
 	}
 
-	// Stop the server
-	cancel()
-
-	// waiting 1 second
-	<-time.After(1 * time.Second)
-
-	// Close the listener
-	ln.Close()
+	// Stop accepting new connections and wait for the connections being handled
+	server.Shutdown(config.ShutdownTimeout)
 	logger.Info("Server stopped")
 }
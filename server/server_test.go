@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/denizydmr07/rpc-project/server/stub"
+)
+
+// a server without a load balancer address serves the clients directly and never dials a load balancer
+func TestStandaloneServer(t *testing.T) {
+	s, err := StartServer("0", "", nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := json.NewEncoder(conn).Encode(map[string]interface{}{"method": "Add", "params": map[string]interface{}{"a": 1, "b": 2}}); err != nil {
+		t.Fatal(err)
+	}
+	var response map[string]interface{}
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response["result"] != 3.0 {
+		t.Fatalf("got %v, want result 3", response)
+	}
+
+	// without a load balancer there is nothing to unregister from, so the drain does not wait for it
+	start := time.Now()
+	if !s.Drain(10*time.Second, time.Second) {
+		t.Fatal("drain timed out")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("drain took %v, it waited for a load balancer", elapsed)
+	}
+	select {
+	case <-s.LBDown:
+		t.Fatal("the load balancer is reported down")
+	default:
+	}
+	if _, err := net.Dial("tcp", s.Addr().String()); err == nil {
+		t.Fatal("the server still accepts connections after the drain")
+	}
+}
+
+// a request in flight when the drain starts is answered before the server stops, new connections are refused meanwhile
+func TestDrainWaitsForRequestInFlight(t *testing.T) {
+	s, err := StartServer("0", "", nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// the first half of the request is being read when the drain starts
+	request := `{"method":"Add","params":{"a":1,"b":2}}` + "\n"
+	if _, err := conn.Write([]byte(request[:10])); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// there is no load balancer to unregister from
+	drained := make(chan bool)
+	go func() { drained <- s.Drain(100*time.Millisecond, 5*time.Second) }()
+	time.Sleep(200 * time.Millisecond)
+	select {
+	case <-drained:
+		t.Fatal("drain returned while a request is in flight")
+	default:
+	}
+	if c, err := net.Dial("tcp", s.Addr().String()); err == nil {
+		c.Close()
+		t.Fatal("the server accepts connections while draining")
+	}
+
+	if _, err := conn.Write([]byte(request[10:])); err != nil {
+		t.Fatal(err)
+	}
+	var response map[string]interface{}
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response["result"] != 3.0 {
+		t.Fatalf("got %v, want result 3", response)
+	}
+	conn.Close()
+
+	select {
+	case finished := <-drained:
+		if !finished {
+			t.Fatal("drain reported the request in flight as not finished")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("drain did not return after the request in flight finished")
+	}
+}
+
+// a connection still being handled after the shutdown timeout is closed, and the shutdown reports it
+func TestShutdownTimeout(t *testing.T) {
+	s, err := StartServer("0", "", nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// the request is never finished
+	if _, err := conn.Write([]byte(`{"method":"Add",`)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	if s.Shutdown(100 * time.Millisecond) {
+		t.Fatal("the shutdown reported the stuck connection as finished")
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("the shutdown returned after %v", elapsed)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("the stuck connection is open after the shutdown")
+	}
+}
+
+// a server started on port "0" advertises the port the OS picked in its first heartbeat
+func TestHeartbeatAdvertisesBoundPort(t *testing.T) {
+	// the heartbeats are read as JSON here, the load balancer tests the binary ones
+	stub.HeartbeatFormat = "json"
+	defer func() { stub.HeartbeatFormat = "binary" }()
+	lb, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lb.Close()
+
+	s, err := StartServer("0", lb.Addr().String(), nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	hb, err := lb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hb.Close()
+	hb.SetDeadline(time.Now().Add(5 * time.Second))
+	var heartbeat map[string]interface{}
+	if err := json.NewDecoder(hb).Decode(&heartbeat); err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(s.Addr().String())
+	if heartbeat["port"] != port || port == "0" {
+		t.Fatalf("advertised the port %v, want %s", heartbeat["port"], port)
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// startTracing exports the spans of the stub to the OTLP/HTTP endpoint set by the standard OTEL_EXPORTER_OTLP_*
+// variables, e.g. OTEL_EXPORTER_OTLP_ENDPOINT, and returns the func flushing the spans left on shutdown
+func startTracing(ctx context.Context) (func(context.Context) error, error) {
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "server"))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}